@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"receipt-uploader/config"
+	"strings"
+)
+
+// Custom error for API keys that are not configured
+var ErrUnknownAPIKey = errors.New("unknown API key")
+
+// APIKeyStore maps per-user API keys to their owners.
+// Only SHA-256 digests of the keys are held, so the configuration never contains usable secrets.
+type APIKeyStore struct {
+	users map[[sha256.Size]byte]string
+}
+
+// NewAPIKeyStore builds the store from the configured key digests
+func NewAPIKeyStore(keys []config.APIKeyConfig) (*APIKeyStore, error) {
+	store := &APIKeyStore{users: make(map[[sha256.Size]byte]string)}
+	for _, key := range keys {
+		digest, err := hex.DecodeString(strings.ToLower(key.KeySHA256))
+		if err != nil || len(digest) != sha256.Size {
+			return nil, errors.New("api key for user " + key.UserID + ": key_sha256 must be a hex SHA-256 digest")
+		}
+		store.users[[sha256.Size]byte(digest)] = key.UserID
+	}
+	return store, nil
+}
+
+// Verify returns the user that owns the API key
+func (s *APIKeyStore) Verify(apiKey string) (Principal, error) {
+	digest := sha256.Sum256([]byte(apiKey))
+	for known, userID := range s.users {
+		// Compare every digest in constant time so the lookup does not leak how close a guess was
+		if subtle.ConstantTimeCompare(known[:], digest[:]) == 1 {
+			return Principal{UserID: userID, Method: MethodAPIKey}, nil
+		}
+	}
+	return Principal{}, ErrUnknownAPIKey
+}
+
+// Empty reports whether no API keys are configured
+func (s *APIKeyStore) Empty() bool {
+	return len(s.users) == 0
+}
+
+// HashAPIKey returns the hex SHA-256 digest to put in the configuration for an API key
+func HashAPIKey(apiKey string) string {
+	digest := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"errors"
+	"receipt-uploader/config"
+	"testing"
+)
+
+// TestAPIKeyStoreVerify tests resolving API keys to their users
+func TestAPIKeyStoreVerify(t *testing.T) {
+	store, err := NewAPIKeyStore([]config.APIKeyConfig{
+		{UserID: "user1", KeySHA256: HashAPIKey("key-for-user1")},
+		{UserID: "user2", KeySHA256: HashAPIKey("key-for-user2")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create API key store: %v", err)
+	}
+
+	t.Run("KnownKey", func(t *testing.T) {
+		principal, err := store.Verify("key-for-user2")
+		if err != nil || principal.UserID != "user2" || principal.Method != MethodAPIKey {
+			t.Fatalf("Expected user2, got %+v, %v", principal, err)
+		}
+	})
+
+	t.Run("UnknownKey", func(t *testing.T) {
+		if _, err := store.Verify("key-for-user3"); !errors.Is(err, ErrUnknownAPIKey) {
+			t.Fatalf("Expected ErrUnknownAPIKey, got %v", err)
+		}
+	})
+
+	t.Run("InvalidDigest", func(t *testing.T) {
+		if _, err := NewAPIKeyStore([]config.APIKeyConfig{{UserID: "user1", KeySHA256: "zz"}}); err == nil {
+			t.Fatalf("Expected error for invalid digest")
+		}
+	})
+}
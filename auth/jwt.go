@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"receipt-uploader/config"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Clock skew tolerated when checking token expiry and not-before times
+const clockLeeway = 30 * time.Second
+
+// verificationKey is a key from the local key set together with the only algorithm it may be used with
+type verificationKey struct {
+	algorithm string
+	key       any // []byte for HS256, *rsa.PublicKey for RS256
+}
+
+// KeySet verifies JWT bearer tokens against a local set of HS256 and RS256 keys
+type KeySet struct {
+	keys     map[string]verificationKey
+	issuer   string
+	audience string
+}
+
+// NewKeySet loads the configured keys, reading RSA public keys from their PEM files
+func NewKeySet(cfg config.JWTConfig) (*KeySet, error) {
+	keySet := &KeySet{keys: make(map[string]verificationKey), issuer: cfg.Issuer, audience: cfg.Audience}
+	for _, keyConfig := range cfg.Keys {
+		var key any
+		switch keyConfig.Algorithm {
+		case "HS256":
+			key = []byte(keyConfig.Secret)
+		case "RS256":
+			publicKey, err := loadRSAPublicKey(keyConfig.PublicKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("jwt key %q: %v", keyConfig.ID, err)
+			}
+			key = publicKey
+		default:
+			return nil, fmt.Errorf("jwt key %q: unsupported algorithm %q", keyConfig.ID, keyConfig.Algorithm)
+		}
+		keySet.keys[keyConfig.ID] = verificationKey{algorithm: keyConfig.Algorithm, key: key}
+	}
+	return keySet, nil
+}
+
+// Empty reports whether the key set has no keys, in which case every token is rejected
+func (k *KeySet) Empty() bool {
+	return len(k.keys) == 0
+}
+
+// Verify checks the token's signature, expiry, issuer and audience and returns the user from its "sub" claim
+func (k *KeySet) Verify(token string) (Principal, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "RS256"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(clockLeeway),
+	}
+	if k.issuer != "" {
+		options = append(options, jwt.WithIssuer(k.issuer))
+	}
+	if k.audience != "" {
+		options = append(options, jwt.WithAudience(k.audience))
+	}
+
+	parsed, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, k.lookupKey, options...)
+	if err != nil {
+		return Principal{}, err
+	}
+	subject, err := parsed.Claims.GetSubject()
+	if err != nil || subject == "" {
+		return Principal{}, errors.New("token has no subject")
+	}
+	return Principal{UserID: subject, Method: MethodJWT}, nil
+}
+
+// lookupKey selects the verification key named by the token's "kid" header.
+// The token's algorithm must match the key's, so an RSA public key can never be used as an HMAC secret.
+func (k *KeySet) lookupKey(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" && len(k.keys) == 1 {
+		// A single configured key does not need to be named
+		for id := range k.keys {
+			kid = id
+		}
+	}
+
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if token.Method.Alg() != key.algorithm {
+		return nil, fmt.Errorf("key %q does not allow algorithm %s", kid, token.Method.Alg())
+	}
+	return key.key, nil
+}
+
+// loadRSAPublicKey reads a PEM encoded RSA public key
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return jwt.ParseRSAPublicKeyFromPEM(data)
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"receipt-uploader/config"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Helper function to write an RSA public key to a PEM file and return its path
+func writePublicKey(t *testing.T, key *rsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "public.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	return path
+}
+
+// Helper function to sign a token with the given method, key ID and claims
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+// TestKeySetVerify tests verifying HS256 and RS256 bearer tokens
+func TestKeySetVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	publicKeyFile := writePublicKey(t, rsaKey)
+
+	keySet, err := NewKeySet(config.JWTConfig{
+		Issuer:   "https://issuer.example",
+		Audience: "receipts",
+		Keys: []config.JWTKeyConfig{
+			{ID: "hmac", Algorithm: "HS256", Secret: "test-secret"},
+			{ID: "rsa", Algorithm: "RS256", PublicKeyFile: publicKeyFile},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create key set: %v", err)
+	}
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "user123",
+			"iss": "https://issuer.example",
+			"aud": "receipts",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	t.Run("ValidHS256", func(t *testing.T) {
+		principal, err := keySet.Verify(signToken(t, jwt.SigningMethodHS256, "hmac", []byte("test-secret"), validClaims()))
+		if err != nil || principal.UserID != "user123" || principal.Method != MethodJWT {
+			t.Fatalf("Expected user123, got %+v, %v", principal, err)
+		}
+	})
+
+	t.Run("ValidRS256", func(t *testing.T) {
+		principal, err := keySet.Verify(signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, validClaims()))
+		if err != nil || principal.UserID != "user123" {
+			t.Fatalf("Expected user123, got %+v, %v", principal, err)
+		}
+	})
+
+	t.Run("WrongSecret", func(t *testing.T) {
+		if _, err := keySet.Verify(signToken(t, jwt.SigningMethodHS256, "hmac", []byte("guess"), validClaims())); err == nil {
+			t.Fatalf("Expected token with wrong signature to be rejected")
+		}
+	})
+
+	t.Run("AlgorithmConfusion", func(t *testing.T) {
+		// An HS256 token "signed" with the RSA public key must not verify against the RSA key
+		publicPEM, _ := os.ReadFile(publicKeyFile)
+		if _, err := keySet.Verify(signToken(t, jwt.SigningMethodHS256, "rsa", publicPEM, validClaims())); err == nil {
+			t.Fatalf("Expected token using the wrong algorithm for its key to be rejected")
+		}
+	})
+
+	t.Run("UnknownKey", func(t *testing.T) {
+		if _, err := keySet.Verify(signToken(t, jwt.SigningMethodHS256, "other", []byte("test-secret"), validClaims())); err == nil {
+			t.Fatalf("Expected token with unknown kid to be rejected")
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		claims := validClaims()
+		claims["exp"] = time.Now().Add(-time.Hour).Unix()
+		if _, err := keySet.Verify(signToken(t, jwt.SigningMethodHS256, "hmac", []byte("test-secret"), claims)); err == nil {
+			t.Fatalf("Expected expired token to be rejected")
+		}
+	})
+
+	t.Run("MissingExpiry", func(t *testing.T) {
+		claims := validClaims()
+		delete(claims, "exp")
+		if _, err := keySet.Verify(signToken(t, jwt.SigningMethodHS256, "hmac", []byte("test-secret"), claims)); err == nil {
+			t.Fatalf("Expected token without expiry to be rejected")
+		}
+	})
+
+	t.Run("WrongAudience", func(t *testing.T) {
+		claims := validClaims()
+		claims["aud"] = "another-service"
+		if _, err := keySet.Verify(signToken(t, jwt.SigningMethodHS256, "hmac", []byte("test-secret"), claims)); err == nil {
+			t.Fatalf("Expected token for another audience to be rejected")
+		}
+	})
+
+	t.Run("MissingSubject", func(t *testing.T) {
+		claims := validClaims()
+		delete(claims, "sub")
+		if _, err := keySet.Verify(signToken(t, jwt.SigningMethodHS256, "hmac", []byte("test-secret"), claims)); err == nil {
+			t.Fatalf("Expected token without subject to be rejected")
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"receipt-uploader/config"
+	"strings"
+)
+
+// Header carrying a per-user API key
+const APIKeyHeader = "X-API-Key"
+
+// Custom error for requests that carry neither a bearer token nor an API key
+var ErrMissingCredentials = errors.New("no bearer token or API key")
+
+// Authenticator resolves the user making a request from a JWT bearer token or an API key
+type Authenticator struct {
+	Tokens  *KeySet
+	APIKeys *APIKeyStore
+}
+
+// NewAuthenticator builds an Authenticator from the configured key set and API keys
+func NewAuthenticator(cfg config.AuthConfig) (*Authenticator, error) {
+	tokens, err := NewKeySet(cfg.JWT)
+	if err != nil {
+		return nil, err
+	}
+	apiKeys, err := NewAPIKeyStore(cfg.APIKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &Authenticator{Tokens: tokens, APIKeys: apiKeys}, nil
+}
+
+// Empty reports whether neither JWT keys nor API keys are configured, in which case every request is rejected
+func (a *Authenticator) Empty() bool {
+	return a.Tokens.Empty() && a.APIKeys.Empty()
+}
+
+// Middleware authenticates every request before passing it on with the Principal in its context.
+// Requests without valid credentials are rejected with 401 Unauthorized.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := a.Authenticate(r)
+		if err != nil {
+			log.Println("Authentication failed:", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="receipts"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// Authenticate returns the principal for the credentials presented in the request
+func (a *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	if apiKey := r.Header.Get(APIKeyHeader); apiKey != "" {
+		return a.APIKeys.Verify(apiKey)
+	}
+
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return Principal{}, ErrMissingCredentials
+	}
+	return a.Tokens.Verify(strings.TrimSpace(token))
+}
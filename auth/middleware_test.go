@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"receipt-uploader/config"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestMiddleware tests that the middleware puts the authenticated user in the request context
+func TestMiddleware(t *testing.T) {
+	authenticator, err := NewAuthenticator(config.AuthConfig{
+		JWT:     config.JWTConfig{Keys: []config.JWTKeyConfig{{ID: "hmac", Algorithm: "HS256", Secret: "test-secret"}}},
+		APIKeys: []config.APIKeyConfig{{UserID: "api-user", KeySHA256: HashAPIKey("secret-key")}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+
+	// The wrapped handler echoes the user it sees
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := PrincipalFromContext(r.Context())
+		w.Write([]byte(principal.UserID))
+	}))
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("BearerToken", func(t *testing.T) {
+		token := signToken(t, jwt.SigningMethodHS256, "", []byte("test-secret"),
+			jwt.MapClaims{"sub": "jwt-user", "exp": time.Now().Add(time.Hour).Unix()})
+		req := httptest.NewRequest(http.MethodGet, "/receipts", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := serve(req)
+		if rr.Code != http.StatusOK || rr.Body.String() != "jwt-user" {
+			t.Fatalf("Expected jwt-user, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("APIKey", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/receipts", nil)
+		req.Header.Set(APIKeyHeader, "secret-key")
+
+		rr := serve(req)
+		if rr.Code != http.StatusOK || rr.Body.String() != "api-user" {
+			t.Fatalf("Expected api-user, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("TrustedHeaderIgnored", func(t *testing.T) {
+		// The old X-User-ID header no longer identifies anyone
+		req := httptest.NewRequest(http.MethodGet, "/receipts", nil)
+		req.Header.Set("X-User-ID", "api-user")
+
+		rr := serve(req)
+		if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("Expected 401 with WWW-Authenticate, got %d", rr.Code)
+		}
+	})
+
+	t.Run("InvalidAPIKey", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/receipts", nil)
+		req.Header.Set(APIKeyHeader, "wrong-key")
+
+		if rr := serve(req); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status code 401, got %d", rr.Code)
+		}
+	})
+}
+
+// TestAuthenticatorEmpty tests that an authenticator without any keys reports that it cannot accept requests
+func TestAuthenticatorEmpty(t *testing.T) {
+	t.Run("NoKeys", func(t *testing.T) {
+		authenticator, err := NewAuthenticator(config.Default().Auth)
+		if err != nil {
+			t.Fatalf("Failed to create authenticator: %v", err)
+		}
+		if !authenticator.Empty() {
+			t.Fatalf("Expected the default configuration to have no keys")
+		}
+	})
+
+	t.Run("JWTKeys", func(t *testing.T) {
+		authenticator, _ := NewAuthenticator(config.AuthConfig{
+			JWT: config.JWTConfig{Keys: []config.JWTKeyConfig{{ID: "hmac", Algorithm: "HS256", Secret: "test-secret"}}},
+		})
+		if authenticator.Empty() {
+			t.Fatalf("Expected JWT keys to be usable")
+		}
+	})
+
+	t.Run("APIKeys", func(t *testing.T) {
+		authenticator, _ := NewAuthenticator(config.AuthConfig{
+			APIKeys: []config.APIKeyConfig{{UserID: "api-user", KeySHA256: HashAPIKey("secret-key")}},
+		})
+		if authenticator.Empty() {
+			t.Fatalf("Expected API keys to be usable")
+		}
+	})
+}
@@ -0,0 +1,29 @@
+package auth
+
+import "context"
+
+// Authentication methods recorded on a Principal
+const (
+	MethodJWT    = "jwt"
+	MethodAPIKey = "api_key"
+)
+
+// Principal is the authenticated user making a request
+type Principal struct {
+	UserID string // ID of the user, used for receipt ownership
+	Method string // How the user authenticated: MethodJWT or MethodAPIKey
+}
+
+// contextKey is the unexported type for values stored in a request context by this package
+type contextKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the principal
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal stored by the middleware, if any
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(contextKey{}).(Principal)
+	return principal, ok && principal.UserID != ""
+}
@@ -0,0 +1,384 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Supported receipt metadata store drivers
+const (
+	DriverJSON   = "json"
+	DriverSQLite = "sqlite"
+)
+
+// Supported blob store drivers for receipt files
+const (
+	BlobDriverFilesystem = "filesystem"
+	BlobDriverS3         = "s3"
+)
+
+// Config holds the service configuration
+type Config struct {
+	Storage    StorageConfig    `json:"storage"`
+	Blobs      BlobConfig       `json:"blobs"`
+	Renditions RenditionConfig  `json:"renditions"`
+	Processing ProcessingConfig `json:"processing"`
+	Uploads    UploadsConfig    `json:"uploads"`
+	Metadata   MetadataConfig   `json:"metadata"`
+	Quality    QualityConfig    `json:"quality"`
+	Decoding   DecodingConfig   `json:"decoding"`
+	PDF        PDFConfig        `json:"pdf"`
+	Similarity SimilarityConfig `json:"similarity"`
+	Auth       AuthConfig       `json:"auth"`
+}
+
+// StorageConfig selects where receipt metadata is stored
+type StorageConfig struct {
+	Driver     string `json:"driver"`      // "json" or "sqlite"
+	JSONFile   string `json:"json_file"`   // File used by the json driver
+	SQLitePath string `json:"sqlite_path"` // Database file used by the sqlite driver
+}
+
+// BlobConfig selects where receipt originals and thumbnails are stored
+type BlobConfig struct {
+	Driver        string   `json:"driver"`         // "filesystem" or "s3"
+	Root          string   `json:"root"`           // Directory used by the filesystem driver
+	SigningSecret string   `json:"signing_secret"` // HMAC key for the filesystem driver's signed URLs, random per process if empty
+	S3            S3Config `json:"s3"`
+}
+
+// S3Config locates the bucket used by the s3 driver
+type S3Config struct {
+	Endpoint        string `json:"endpoint"` // e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	PathStyle       bool   `json:"path_style"` // Address the bucket as endpoint/bucket, as most self-hosted services require
+}
+
+// RenditionConfig lists the thumbnail presets and sizes the cache of generated thumbnails and resized images
+type RenditionConfig struct {
+	// Total size in bytes of the cached arbitrary width/height variants before the least recently used are evicted.
+	// Thumbnails are not counted and stay cached until their receipt is purged.
+	MaxVariantBytes int64 `json:"max_variant_bytes"`
+	// Thumbnails generated for every receipt; a configured list replaces the defaults
+	Presets []PresetConfig `json:"presets"`
+}
+
+// PresetConfig describes a named thumbnail
+type PresetConfig struct {
+	Name    string `json:"name"`    // Used in /receipts/{id}/thumbnails/{name}
+	Width   int    `json:"width"`   // 0 to derive it from height and the aspect ratio
+	Height  int    `json:"height"`  // 0 to derive it from width and the aspect ratio
+	Fit     string `json:"fit"`     // "fit" to scale inside the box (the default) or "fill" to crop to it
+	Format  string `json:"format"`  // "jpeg" (the default), "png", "gif" or "webp"
+	Quality int    `json:"quality"` // JPEG quality 1-100, 0 for the encoder default
+	Enhance bool   `json:"enhance"` // Crop and straighten the paper and threshold it to black and white
+}
+
+// ProcessingConfig sizes the background thumbnail generation that runs after each upload
+type ProcessingConfig struct {
+	Workers        int `json:"workers"`          // Receipts processed at the same time
+	QueueSize      int `json:"queue_size"`       // Receipts that can wait for a worker
+	MaxAttempts    int `json:"max_attempts"`     // Attempts per receipt before its status becomes "failed"
+	RetryBackoffMS int `json:"retry_backoff_ms"` // Delay before the first retry, doubled for every further retry
+}
+
+// MetadataConfig selects the photo metadata kept in stored originals and renditions
+type MetadataConfig struct {
+	EXIF string `json:"exif"` // "strip_gps" to remove the location (the default), "strip" to remove all EXIF data or "retain"
+}
+
+// QualityConfig sets the quality checks uploaded images must pass. A zero value disables a check.
+type QualityConfig struct {
+	MinWidth      int     `json:"min_width"`      // Pixels
+	MinHeight     int     `json:"min_height"`     // Pixels
+	MinSharpness  float64 `json:"min_sharpness"`  // Variance of the Laplacian; blurry photos score low
+	MinBrightness float64 `json:"min_brightness"` // Mean brightness, 0-255
+	MaxBrightness float64 `json:"max_brightness"` // Mean brightness, 0-255
+}
+
+// UploadsConfig restricts the files that are accepted as receipts
+type UploadsConfig struct {
+	// Formats uploads are accepted in, detected from their contents: jpeg, png, gif, webp, bmp, tiff or pdf
+	AllowedFormats []string `json:"allowed_formats"`
+	// Largest file and multipart request body in bytes; uploads over them get 413. A zero limit disables it.
+	MaxFileBytes    int64 `json:"max_file_bytes"`
+	MaxRequestBytes int64 `json:"max_request_bytes"`
+	// Minutes after which resumable uploads that received no data are deleted
+	ResumableExpiryMinutes int `json:"resumable_expiry_minutes"`
+}
+
+// uploadFormats lists the formats the service can decode uploads in
+var uploadFormats = []string{"jpeg", "png", "gif", "webp", "bmp", "tiff", "pdf"}
+
+// DecodingConfig bounds the memory spent decoding images. A zero limit disables it.
+type DecodingConfig struct {
+	MaxPixels     int64 `json:"max_pixels"`     // Largest width times height of an image
+	MaxDimension  int   `json:"max_dimension"`  // Largest width or height of an image
+	MaxConcurrent int   `json:"max_concurrent"` // Images decoded at the same time, across uploads and thumbnails
+}
+
+// PDFConfig locates the Poppler tools PDF receipts are rasterized with. PDF uploads are rejected if they are missing.
+type PDFConfig struct {
+	PDFInfo  string `json:"pdfinfo"`   // Name or path of the pdfinfo executable, which counts the pages
+	PDFToPPM string `json:"pdftoppm"`  // Name or path of the pdftoppm executable, which renders them
+	PageSize int    `json:"page_size"` // Longest side of rasterized pages in pixels
+	// Longest a tool may run on one document before it is killed, so a crafted PDF cannot hang a request or worker
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+// SimilarityConfig tunes near-duplicate detection of receipt images
+type SimilarityConfig struct {
+	// Largest Hamming distance (0-64) between perceptual hashes for two images to count as similar
+	MaxDistance int `json:"max_distance"`
+}
+
+// AuthConfig lists the credentials accepted by the authentication middleware
+type AuthConfig struct {
+	JWT     JWTConfig      `json:"jwt"`
+	APIKeys []APIKeyConfig `json:"api_keys"`
+}
+
+// JWTConfig configures verification of signed bearer tokens
+type JWTConfig struct {
+	Issuer   string         `json:"issuer"`   // Required "iss" claim, not checked if empty
+	Audience string         `json:"audience"` // Required "aud" claim, not checked if empty
+	Keys     []JWTKeyConfig `json:"keys"`     // Local key set used to verify token signatures
+}
+
+// JWTKeyConfig is a single verification key, selected by the token's "kid" header
+type JWTKeyConfig struct {
+	ID            string `json:"kid"`
+	Algorithm     string `json:"alg"`             // "HS256" or "RS256"
+	Secret        string `json:"secret"`          // Shared secret for HS256
+	PublicKeyFile string `json:"public_key_file"` // PEM encoded RSA public key for RS256
+}
+
+// APIKeyConfig assigns an API key to a user. Only the SHA-256 of the key is stored.
+type APIKeyConfig struct {
+	UserID    string `json:"user_id"`
+	KeySHA256 string `json:"key_sha256"` // Hex encoded SHA-256 of the API key
+}
+
+// Default returns the configuration used when no configuration file is present
+func Default() Config {
+	return Config{
+		Storage: StorageConfig{
+			Driver:     DriverJSON,
+			JSONFile:   "receipts.json",
+			SQLitePath: "receipts.db",
+		},
+		Blobs: BlobConfig{
+			Driver: BlobDriverFilesystem,
+			Root:   "uploads",
+		},
+		Renditions: RenditionConfig{
+			MaxVariantBytes: 256 << 20,
+			Presets: []PresetConfig{
+				{Name: "small", Width: 100, Height: 100},
+				{Name: "medium", Width: 200, Height: 200},
+				{Name: "large", Width: 400, Height: 400},
+			},
+		},
+		Processing: ProcessingConfig{
+			Workers:        2,
+			QueueSize:      100,
+			MaxAttempts:    5,
+			RetryBackoffMS: 1000,
+		},
+		Uploads: UploadsConfig{
+			AllowedFormats:         []string{"jpeg", "png", "gif", "webp", "bmp", "pdf"},
+			MaxFileBytes:           25 << 20,
+			MaxRequestBytes:        100 << 20,
+			ResumableExpiryMinutes: 24 * 60,
+		},
+		Metadata: MetadataConfig{
+			EXIF: "strip_gps",
+		},
+		Quality: QualityConfig{
+			MinWidth:      300,
+			MinHeight:     300,
+			MinSharpness:  20,
+			MinBrightness: 40,
+			MaxBrightness: 253, // Clean scans on white paper average about 250
+		},
+		Decoding: DecodingConfig{
+			MaxPixels:     50_000_000,
+			MaxDimension:  20_000,
+			MaxConcurrent: 4,
+		},
+		PDF: PDFConfig{
+			PDFInfo:        "pdfinfo",
+			PDFToPPM:       "pdftoppm",
+			PageSize:       2000,
+			TimeoutSeconds: 30,
+		},
+		Similarity: SimilarityConfig{
+			MaxDistance: 10,
+		},
+	}
+}
+
+// Load reads the JSON configuration file at path on top of the defaults.
+// A missing file is not an error; the defaults are returned instead.
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	// Decoding into the default presets would merge them with the configured ones
+	cfg.Renditions.Presets = nil
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("invalid configuration file %s: %v", path, err)
+	}
+	if cfg.Renditions.Presets == nil {
+		cfg.Renditions.Presets = Default().Renditions.Presets
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate checks that the configuration values are usable
+func (c Config) Validate() error {
+	switch c.Storage.Driver {
+	case DriverJSON, DriverSQLite:
+	default:
+		return fmt.Errorf("unknown storage driver %q", c.Storage.Driver)
+	}
+
+	switch c.Blobs.Driver {
+	case BlobDriverFilesystem:
+		if c.Blobs.Root == "" {
+			return fmt.Errorf("the filesystem blob driver requires a root directory")
+		}
+	case BlobDriverS3:
+		if c.Blobs.S3.Endpoint == "" || c.Blobs.S3.Region == "" || c.Blobs.S3.Bucket == "" {
+			return fmt.Errorf("the s3 blob driver requires an endpoint, region and bucket")
+		}
+	default:
+		return fmt.Errorf("unknown blob driver %q", c.Blobs.Driver)
+	}
+
+	if c.Renditions.MaxVariantBytes <= 0 {
+		return fmt.Errorf("renditions max_variant_bytes must be positive, got %d", c.Renditions.MaxVariantBytes)
+	}
+
+	names := make(map[string]bool)
+	for _, preset := range c.Renditions.Presets {
+		if err := preset.validate(); err != nil {
+			return fmt.Errorf("rendition preset %q: %v", preset.Name, err)
+		}
+		if names[preset.Name] {
+			return fmt.Errorf("rendition preset %q is defined more than once", preset.Name)
+		}
+		names[preset.Name] = true
+	}
+
+	if c.Processing.Workers < 1 || c.Processing.QueueSize < 1 || c.Processing.MaxAttempts < 1 || c.Processing.RetryBackoffMS < 0 {
+		return fmt.Errorf("processing requires at least one worker, queue slot and attempt, and a non-negative retry_backoff_ms")
+	}
+
+	if len(c.Uploads.AllowedFormats) == 0 {
+		return fmt.Errorf("uploads allowed_formats must list at least one format")
+	}
+	for _, format := range c.Uploads.AllowedFormats {
+		if !slices.Contains(uploadFormats, format) {
+			return fmt.Errorf("unknown upload format %q: must be one of %s", format, strings.Join(uploadFormats, ", "))
+		}
+	}
+
+	uploads := c.Uploads
+	if uploads.MaxFileBytes < 0 || uploads.MaxRequestBytes < 0 {
+		return fmt.Errorf("uploads size limits must not be negative")
+	}
+	if uploads.MaxRequestBytes > 0 && (uploads.MaxFileBytes == 0 || uploads.MaxFileBytes > uploads.MaxRequestBytes) {
+		return fmt.Errorf("uploads max_file_bytes %d exceeds max_request_bytes %d", uploads.MaxFileBytes, uploads.MaxRequestBytes)
+	}
+	if uploads.ResumableExpiryMinutes < 1 {
+		return fmt.Errorf("uploads resumable_expiry_minutes must be positive, got %d", uploads.ResumableExpiryMinutes)
+	}
+
+	switch c.Metadata.EXIF {
+	case "strip_gps", "strip", "retain":
+	default:
+		return fmt.Errorf("unknown metadata exif policy %q: must be strip_gps, strip or retain", c.Metadata.EXIF)
+	}
+
+	quality := c.Quality
+	if quality.MinWidth < 0 || quality.MinHeight < 0 || quality.MinSharpness < 0 || quality.MinBrightness < 0 || quality.MaxBrightness < 0 || quality.MaxBrightness > 255 {
+		return fmt.Errorf("quality limits must not be negative and brightness must be at most 255")
+	}
+	if quality.MaxBrightness > 0 && quality.MinBrightness > quality.MaxBrightness {
+		return fmt.Errorf("quality min_brightness %.1f is above max_brightness %.1f", quality.MinBrightness, quality.MaxBrightness)
+	}
+
+	if c.Decoding.MaxPixels < 0 || c.Decoding.MaxDimension < 0 || c.Decoding.MaxConcurrent < 1 {
+		return fmt.Errorf("decoding limits must not be negative and max_concurrent must be at least 1")
+	}
+
+	if c.PDF.PageSize < 1 {
+		return fmt.Errorf("pdf page_size must be positive, got %d", c.PDF.PageSize)
+	}
+	if c.PDF.TimeoutSeconds < 1 {
+		return fmt.Errorf("pdf timeout_seconds must be positive, got %d", c.PDF.TimeoutSeconds)
+	}
+
+	if c.Similarity.MaxDistance < 0 || c.Similarity.MaxDistance > 64 {
+		return fmt.Errorf("similarity max_distance must be between 0 and 64, got %d", c.Similarity.MaxDistance)
+	}
+
+	for _, key := range c.Auth.JWT.Keys {
+		switch {
+		case key.Algorithm == "HS256" && key.Secret == "":
+			return fmt.Errorf("jwt key %q: HS256 requires a secret", key.ID)
+		case key.Algorithm == "RS256" && key.PublicKeyFile == "":
+			return fmt.Errorf("jwt key %q: RS256 requires a public_key_file", key.ID)
+		case key.Algorithm != "HS256" && key.Algorithm != "RS256":
+			return fmt.Errorf("jwt key %q: unsupported algorithm %q", key.ID, key.Algorithm)
+		}
+	}
+	for _, key := range c.Auth.APIKeys {
+		if key.UserID == "" || len(key.KeySHA256) != 64 {
+			return fmt.Errorf("api key for user %q: user_id and a hex SHA-256 key_sha256 are required", key.UserID)
+		}
+	}
+	return nil
+}
+
+// validate checks that a rendition preset can be generated and addressed by its name
+func (p PresetConfig) validate() error {
+	// Names appear in URLs and blob keys and must not look like a WxH variant
+	if p.Name == "" || p.Name[0] < 'a' || p.Name[0] > 'z' || strings.Trim(p.Name, "abcdefghijklmnopqrstuvwxyz0123456789_-") != "" {
+		return fmt.Errorf("names must start with a lowercase letter and contain only lowercase letters, digits, '_' and '-'")
+	}
+	if p.Width < 0 || p.Height < 0 || (p.Width == 0 && p.Height == 0) {
+		return fmt.Errorf("width and height must not be negative and at least one of them must be set")
+	}
+	switch p.Fit {
+	case "", "fit":
+	case "fill":
+		if p.Width == 0 || p.Height == 0 {
+			return fmt.Errorf("fill requires both width and height")
+		}
+	default:
+		return fmt.Errorf("unknown fit %q", p.Fit)
+	}
+	switch p.Format {
+	case "", "jpeg", "png", "gif", "webp":
+	default:
+		return fmt.Errorf("unknown format %q", p.Format)
+	}
+	if p.Quality < 0 || p.Quality > 100 {
+		return fmt.Errorf("quality must be between 1 and 100")
+	}
+	return nil
+}
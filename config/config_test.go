@@ -0,0 +1,202 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLoad tests loading the configuration file on top of the defaults
+func TestLoad(t *testing.T) {
+	t.Run("MissingFileUsesDefaults", func(t *testing.T) {
+		cfg, err := Load(filepath.Join(t.TempDir(), "missing.json"))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if cfg.Storage.Driver != DriverJSON || cfg.Storage.JSONFile != "receipts.json" {
+			t.Fatalf("Expected default storage config, got %+v", cfg.Storage)
+		}
+	})
+
+	t.Run("OverridesDefaults", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(`{"storage": {"driver": "sqlite"}}`), 0644)
+
+		cfg, err := Load(path)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if cfg.Storage.Driver != DriverSQLite || cfg.Storage.SQLitePath != "receipts.db" {
+			t.Fatalf("Expected sqlite driver with default path, got %+v", cfg.Storage)
+		}
+	})
+
+	t.Run("UnknownDriver", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(`{"storage": {"driver": "postgres"}}`), 0644)
+
+		if _, err := Load(path); err == nil {
+			t.Fatalf("Expected error for unknown driver")
+		}
+	})
+
+	t.Run("InvalidJWTKey", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(`{"auth": {"jwt": {"keys": [{"kid": "k1", "alg": "none"}]}}}`), 0644)
+
+		if _, err := Load(path); err == nil {
+			t.Fatalf("Expected error for unsupported algorithm")
+		}
+	})
+
+	t.Run("InvalidAPIKey", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(`{"auth": {"api_keys": [{"user_id": "user1", "key_sha256": "plaintext"}]}}`), 0644)
+
+		if _, err := Load(path); err == nil {
+			t.Fatalf("Expected error for an API key that is not a SHA-256")
+		}
+	})
+
+	t.Run("BlobDefaults", func(t *testing.T) {
+		cfg, _ := Load(filepath.Join(t.TempDir(), "missing.json"))
+		if cfg.Blobs.Driver != BlobDriverFilesystem || cfg.Blobs.Root != "uploads" {
+			t.Fatalf("Expected filesystem blobs in uploads, got %+v", cfg.Blobs)
+		}
+	})
+
+	t.Run("IncompleteS3Config", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(`{"blobs": {"driver": "s3", "s3": {"endpoint": "http://minio:9000"}}}`), 0644)
+
+		if _, err := Load(path); err == nil {
+			t.Fatalf("Expected error for an s3 driver without region and bucket")
+		}
+	})
+
+	t.Run("InvalidSimilarityDistance", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(`{"similarity": {"max_distance": 65}}`), 0644)
+
+		if _, err := Load(path); err == nil {
+			t.Fatalf("Expected error for a distance above 64")
+		}
+	})
+
+	t.Run("InvalidRenditionBudget", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(`{"renditions": {"max_variant_bytes": 0}}`), 0644)
+
+		if _, err := Load(path); err == nil {
+			t.Fatalf("Expected error for an empty rendition cache budget")
+		}
+	})
+
+	t.Run("CustomPresets", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(`{"renditions": {"presets": [{"name": "square", "width": 150, "height": 150, "fit": "fill", "format": "png"}, {"name": "scan", "height": 1600, "format": "png", "enhance": true}]}}`), 0644)
+
+		cfg, err := Load(path)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(cfg.Renditions.Presets) != 2 || cfg.Renditions.Presets[0].Name != "square" || cfg.Renditions.Presets[0].Fit != "fill" || !cfg.Renditions.Presets[1].Enhance {
+			t.Fatalf("Expected the configured presets to replace the defaults, got %+v", cfg.Renditions.Presets)
+		}
+	})
+
+	t.Run("InvalidPresets", func(t *testing.T) {
+		for _, presets := range []string{
+			`[{"name": "200x200", "width": 200}]`,
+			`[{"name": "Small", "width": 100}]`,
+			`[{"name": "small"}]`,
+			`[{"name": "small", "width": 100, "fit": "fill"}]`,
+			`[{"name": "small", "width": 100, "format": "tiff"}]`,
+			`[{"name": "small", "width": 100, "quality": 101}]`,
+			`[{"name": "small", "width": 100}, {"name": "small", "width": 200}]`,
+		} {
+			path := filepath.Join(t.TempDir(), "config.json")
+			os.WriteFile(path, []byte(`{"renditions": {"presets": `+presets+`}}`), 0644)
+
+			if _, err := Load(path); err == nil {
+				t.Fatalf("Expected error for presets %s", presets)
+			}
+		}
+	})
+
+	t.Run("InvalidMetadataPolicy", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(`{"metadata": {"exif": "keep"}}`), 0644)
+
+		if _, err := Load(path); err == nil {
+			t.Fatalf("Expected error for an unknown metadata policy")
+		}
+	})
+
+	t.Run("InvalidUploadFormats", func(t *testing.T) {
+		for _, formats := range []string{`[]`, `["jpeg", "svg"]`} {
+			path := filepath.Join(t.TempDir(), "config.json")
+			os.WriteFile(path, []byte(`{"uploads": {"allowed_formats": `+formats+`}}`), 0644)
+
+			if _, err := Load(path); err == nil {
+				t.Fatalf("Expected error for upload formats %s", formats)
+			}
+		}
+	})
+
+	t.Run("InvalidUploadLimits", func(t *testing.T) {
+		for _, uploads := range []string{`{"max_file_bytes": -1}`, `{"max_file_bytes": 200, "max_request_bytes": 100}`, `{"max_file_bytes": 0, "max_request_bytes": 100}`, `{"resumable_expiry_minutes": 0}`} {
+			path := filepath.Join(t.TempDir(), "config.json")
+			os.WriteFile(path, []byte(`{"uploads": `+uploads+`}`), 0644)
+
+			if _, err := Load(path); err == nil {
+				t.Fatalf("Expected error for upload limits %s", uploads)
+			}
+		}
+	})
+
+	t.Run("InvalidQualityLimits", func(t *testing.T) {
+		for _, quality := range []string{`{"min_width": -1}`, `{"max_brightness": 300}`, `{"min_brightness": 200, "max_brightness": 100}`} {
+			path := filepath.Join(t.TempDir(), "config.json")
+			os.WriteFile(path, []byte(`{"quality": `+quality+`}`), 0644)
+
+			if _, err := Load(path); err == nil {
+				t.Fatalf("Expected error for quality limits %s", quality)
+			}
+		}
+	})
+
+	t.Run("InvalidDecodingLimits", func(t *testing.T) {
+		for _, decoding := range []string{`{"max_pixels": -1}`, `{"max_dimension": -1}`, `{"max_concurrent": 0}`} {
+			path := filepath.Join(t.TempDir(), "config.json")
+			os.WriteFile(path, []byte(`{"decoding": `+decoding+`}`), 0644)
+
+			if _, err := Load(path); err == nil {
+				t.Fatalf("Expected error for decoding limits %s", decoding)
+			}
+		}
+	})
+
+	t.Run("InvalidPDFPageSize", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(`{"pdf": {"page_size": 0}}`), 0644)
+
+		if _, err := Load(path); err == nil {
+			t.Fatalf("Expected error for a PDF page size of 0")
+		}
+
+		os.WriteFile(path, []byte(`{"pdf": {"timeout_seconds": 0}}`), 0644)
+		if _, err := Load(path); err == nil {
+			t.Fatalf("Expected error for a PDF timeout of 0")
+		}
+	})
+
+	t.Run("InvalidProcessing", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(`{"processing": {"workers": 0}}`), 0644)
+
+		if _, err := Load(path); err == nil {
+			t.Fatalf("Expected error for a processing pool without workers")
+		}
+	})
+}
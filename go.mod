@@ -2,9 +2,26 @@ module receipt-uploader
 
 go 1.23.1
 
-require github.com/google/uuid v1.6.0
+require (
+	github.com/HugoSmits86/nativewebp v0.9.3
+	github.com/golang-jwt/jwt/v5 v5.3.1
+	github.com/google/uuid v1.6.0
+	github.com/shopspring/decimal v1.4.0
+	modernc.org/sqlite v1.34.5
+)
+
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	modernc.org/libc v1.55.3 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.8.0 // indirect
+)
 
 require (
 	github.com/disintegration/imaging v1.6.2
-	golang.org/x/image v0.20.0 // indirect
+	golang.org/x/image v0.20.0
 )
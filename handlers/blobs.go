@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"receipt-uploader/services"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long signed download URLs handed out to clients stay valid
+const signedURLExpiry = 15 * time.Minute
+
+// signatureVerifier is implemented by blob stores whose signed URLs are served by this service
+type signatureVerifier interface {
+	VerifySignature(key, expires, signature string) error
+}
+
+// ServeSignedBlob serves a blob through a signed URL created by the filesystem blob store.
+// The signature takes the place of authentication, so this route is not behind the auth middleware.
+func (h *ReceiptHandler) ServeSignedBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Stores such as S3 sign URLs that point at themselves
+	verifier, ok := h.Blobs.(signatureVerifier)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, services.SignedBlobPath)
+	query := r.URL.Query()
+	if err := verifier.VerifySignature(key, query.Get("expires"), query.Get("signature")); err != nil {
+		http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+		return
+	}
+
+	serveBlob(w, r, h.Blobs, key)
+}
+
+// redirectToBlob redirects to a signed URL of the blob stored under key, so the client downloads it without
+// further authentication, straight from the bucket with the s3 driver
+func (h *ReceiptHandler) redirectToBlob(w http.ResponseWriter, r *http.Request, key string) {
+	signed, err := h.Blobs.SignedURL(key, signedURLExpiry)
+	if errors.Is(err, services.ErrInvalidBlobKey) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error signing blob URL:", err)
+		http.Error(w, "Could not sign download URL", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, signed, http.StatusTemporaryRedirect)
+}
+
+// serveBlob writes the blob stored under key to the response.
+// Seekable blobs go through http.ServeContent so range and conditional requests work.
+func serveBlob(w http.ResponseWriter, r *http.Request, store services.BlobStore, key string) {
+	blob, info, err := store.Get(key)
+	if errors.Is(err, services.ErrBlobNotFound) || errors.Is(err, services.ErrInvalidBlobKey) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error reading blob:", err)
+		http.Error(w, "Could not read file", http.StatusInternalServerError)
+		return
+	}
+	writeBlob(w, r, blob, info)
+}
+
+// writeBlob writes an opened blob to the response and closes it
+func writeBlob(w http.ResponseWriter, r *http.Request, blob io.ReadCloser, info services.BlobInfo) {
+	defer blob.Close()
+
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	if seeker, ok := blob.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(info.Key), info.ModTime, seeker)
+		return
+	}
+
+	// Without seeking only the entity tag is checked, which is all cached renditions need
+	if etag := w.Header().Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if info.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, blob)
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestServeSignedBlob tests downloading blobs through filesystem signed URLs
+func TestServeSignedBlob(t *testing.T) {
+	h, _ := setupTestEnv(t)
+
+	t.Run("ValidSignature", func(t *testing.T) {
+		signed, err := h.Blobs.SignedURL("test.jpg", time.Minute)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		// No user is attached to the request; the signature is the credential
+		rr := httptest.NewRecorder()
+		h.ServeSignedBlob(rr, httptest.NewRequest(http.MethodGet, signed, nil))
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", rr.Code)
+		}
+		if rr.Header().Get("Content-Type") != "image/jpeg" || rr.Body.Len() == 0 {
+			t.Fatalf("Expected the JPEG contents, got %s with %d bytes", rr.Header().Get("Content-Type"), rr.Body.Len())
+		}
+	})
+
+	t.Run("TamperedSignature", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.ServeSignedBlob(rr, httptest.NewRequest(http.MethodGet, "/blobs/test.jpg?expires=9999999999&signature=00", nil))
+
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("Expected status code 403, got %d", rr.Code)
+		}
+	})
+
+	t.Run("ExpiredSignature", func(t *testing.T) {
+		signed, _ := h.Blobs.SignedURL("test.jpg", -time.Minute)
+
+		rr := httptest.NewRecorder()
+		h.ServeSignedBlob(rr, httptest.NewRequest(http.MethodGet, signed, nil))
+
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("Expected status code 403, got %d", rr.Code)
+		}
+	})
+
+	t.Run("MissingBlob", func(t *testing.T) {
+		signed, _ := h.Blobs.SignedURL("missing.jpg", time.Minute)
+
+		rr := httptest.NewRecorder()
+		h.ServeSignedBlob(rr, httptest.NewRequest(http.MethodGet, signed, nil))
+
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("Expected status code 404, got %d", rr.Code)
+		}
+	})
+}
+
+// TestSignedDownloads tests handing out signed URLs of originals and thumbnails
+func TestSignedDownloads(t *testing.T) {
+	h, repo := setupTestEnv(t)
+	storeReceipt(repo, "1", "test.jpg", "test-user")
+
+	// Follows a signed URL without credentials
+	download := func(t *testing.T, signed string) *httptest.ResponseRecorder {
+		if !strings.HasPrefix(signed, "/blobs/") || !strings.Contains(signed, "signature=") {
+			t.Fatalf("Expected a signed URL, got %q", signed)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeSignedBlob(rr, httptest.NewRequest(http.MethodGet, signed, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", rr.Code)
+		}
+		return rr
+	}
+
+	t.Run("OriginalRedirect", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.GetReceipt(rr, withUser(httptest.NewRequest(http.MethodGet, "/receipts/1?redirect=true", nil), "test-user"))
+		if rr.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("Expected status code 307, got %d", rr.Code)
+		}
+		original, _ := os.ReadFile("../testdata/test.jpg")
+		if body := download(t, rr.Header().Get("Location")).Body.Bytes(); !bytes.Equal(body, original) {
+			t.Fatalf("Expected the original, got %d bytes", len(body))
+		}
+	})
+
+	t.Run("Thumbnails", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.GetThumbnails(rr, withUser(httptest.NewRequest(http.MethodGet, "/receipts/1/thumbnails", nil), "test-user"))
+		var response ThumbnailResponse
+		json.NewDecoder(rr.Body).Decode(&response)
+		small := response["small"]
+		if body := download(t, small.DownloadURL).Body; int64(body.Len()) != small.Size {
+			t.Fatalf("Expected the %d byte thumbnail, got %d bytes", small.Size, body.Len())
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"receipt-uploader/models"
+	"receipt-uploader/services"
+	"slices"
+	"sync"
+)
+
+// keyedMutex hands out one lock per key. The zero value is ready to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// keyedLock is the lock for a single key and the number of goroutines holding or waiting for it
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks key and returns the function that unlocks it
+func (k *keyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	lock := k.locks[key]
+	if lock == nil {
+		lock = &keyedLock{}
+		k.locks[key] = lock
+	}
+	lock.refs++
+	k.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		k.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(k.locks, key) // Nobody else is waiting, so the entry can go
+		}
+		k.mu.Unlock()
+	}
+}
+
+// LockAll locks several keys and returns the function that unlocks them.
+// The keys are locked in sorted order so that two callers locking overlapping sets cannot deadlock.
+func (k *keyedMutex) LockAll(keys []string) func() {
+	keys = slices.Compact(slices.Sorted(slices.Values(keys)))
+	unlocks := make([]func(), len(keys))
+	for i, key := range keys {
+		unlocks[i] = k.Lock(key)
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+// contentHashes returns the content hashes of files, the keys of their content locks
+func contentHashes(files []models.PageFile) []string {
+	hashes := make([]string, len(files))
+	for i, file := range files {
+		hashes[i] = file.ContentHash
+	}
+	return hashes
+}
+
+// originalShared reports whether a receipt other than the given one references the same original as file.
+// Originals are stored once per content hash, so the blob may only be deleted when this is false.
+// The caller must hold the content lock of file.ContentHash.
+func (h *ReceiptHandler) originalShared(receipt models.Receipt, file models.PageFile) (bool, error) {
+	if file.ContentHash == "" {
+		return false, nil // Uploaded before originals were content-addressed
+	}
+
+	// At most two references are needed to tell whether another one exists
+	page, err := h.Receipts.Query(models.ReceiptQuery{ContentHash: file.ContentHash, State: models.StateAny, Limit: 2})
+	if err != nil {
+		return false, err
+	}
+	for _, other := range page.Receipts {
+		if other.ID != receipt.ID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// releaseOriginal deletes the original of one of a receipt's files unless another receipt still references it.
+// The caller must hold the content lock of file.ContentHash.
+func (h *ReceiptHandler) releaseOriginal(receipt models.Receipt, file models.PageFile) error {
+	shared, err := h.originalShared(receipt, file)
+	if err != nil || shared {
+		return err
+	}
+	return h.Blobs.Delete(services.OriginalKey(file.FilePath))
+}
+
+// releaseOriginals deletes the originals of all of a receipt's files that no other receipt references.
+// The caller must hold the content locks of the receipt's files.
+func (h *ReceiptHandler) releaseOriginals(receipt models.Receipt) error {
+	released := make(map[string]bool)
+	for _, file := range receipt.Files() {
+		if released[file.FilePath] {
+			continue // The same photo can be a page more than once
+		}
+		released[file.FilePath] = true
+		if err := h.releaseOriginal(receipt, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"receipt-uploader/services"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Errors returned by negotiatePreset
+var (
+	errInvalidFormat = errors.New("invalid format parameter: must be jpeg, png, gif or webp")
+	errNotAcceptable = errors.New("none of the accepted image types can be produced")
+)
+
+// negotiationOrder breaks ties between equally acceptable formats after the preset's own format
+var negotiationOrder = []string{services.FormatJPEG, services.FormatWebP, services.FormatPNG, services.FormatGIF}
+
+// negotiatePreset applies the format and quality query parameters, or failing a format parameter
+// the Accept header, to a preset. It reports whether the result differs from the preset.
+func negotiatePreset(r *http.Request, preset services.RenditionPreset) (services.RenditionPreset, bool, error) {
+	negotiated := preset
+	query := r.URL.Query()
+
+	// An explicit format wins over the Accept header
+	if name := query.Get("format"); name != "" {
+		format, ok := services.ParseFormat(name)
+		if !ok {
+			return preset, false, errInvalidFormat
+		}
+		negotiated.Format = format
+	} else if accept := r.Header.Get("Accept"); accept != "" {
+		format, ok := acceptedFormat(accept, preset.Format)
+		if !ok {
+			return preset, false, errNotAcceptable
+		}
+		negotiated.Format = format
+	}
+
+	if value := query.Get("quality"); value != "" {
+		quality, err := strconv.Atoi(value)
+		if err != nil || quality < 1 || quality > 100 {
+			return preset, false, fmt.Errorf("invalid quality parameter: must be between 1 and 100")
+		}
+		negotiated.Quality = quality
+	}
+	if negotiated.Format != services.FormatJPEG {
+		negotiated.Quality = 0 // Only JPEG has a quality setting
+	}
+
+	return negotiated, negotiated != preset, nil
+}
+
+// acceptedFormat picks the output format the Accept header prefers, favouring fallback among equals
+func acceptedFormat(accept, fallback string) (string, bool) {
+	candidates := append([]string{fallback}, negotiationOrder...)
+	weights := make(map[string]float64)
+	for _, format := range candidates {
+		weights[format] = -1 // Not mentioned
+	}
+
+	// Exact types outrank image/* which outranks */*, whatever their order in the header
+	specificity := make(map[string]int)
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		weight := 1.0
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			weight = q
+		}
+
+		for _, format := range candidates {
+			level := 0
+			switch {
+			case mediaType == "*/*":
+				level = 1
+			case mediaType == "image/*":
+				level = 2
+			case mediaType == services.RenditionPreset{Format: format}.ContentType():
+				level = 3
+			default:
+				continue
+			}
+			if level > specificity[format] {
+				specificity[format] = level
+				weights[format] = weight
+			}
+		}
+	}
+
+	// Stable sort keeps the fallback first among formats of the same weight
+	sort.SliceStable(candidates, func(i, j int) bool { return weights[candidates[i]] > weights[candidates[j]] })
+	if weights[candidates[0]] <= 0 {
+		return "", false
+	}
+	return candidates[0], true
+}
+
+// originalFormat returns the output format matching a receipt's original, or JPEG if it has no such format
+func originalFormat(filePath string) string {
+	if format, ok := services.ParseFormat(path.Ext(filePath)); ok {
+		return format
+	}
+	return services.FormatJPEG
+}
+
+// writeNegotiationError writes the response for an error returned by negotiatePreset
+func writeNegotiationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errNotAcceptable) {
+		http.Error(w, "Not acceptable: "+err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
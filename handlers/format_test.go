@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"receipt-uploader/services"
+	"testing"
+)
+
+// TestAcceptedFormat tests choosing an output format from the Accept header
+func TestAcceptedFormat(t *testing.T) {
+	tests := []struct {
+		accept   string
+		fallback string
+		expected string
+	}{
+		{"*/*", services.FormatPNG, services.FormatPNG},
+		{"image/*", services.FormatJPEG, services.FormatJPEG},
+		{"image/webp", services.FormatJPEG, services.FormatWebP},
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", services.FormatJPEG, services.FormatJPEG},
+		{"image/avif,image/webp;q=1,image/*;q=0.5", services.FormatJPEG, services.FormatWebP},
+		{"image/png;q=0.5, image/gif", services.FormatJPEG, services.FormatGIF},
+		{"image/*, image/jpeg;q=0", services.FormatJPEG, services.FormatWebP},
+	}
+	for _, test := range tests {
+		if format, ok := acceptedFormat(test.accept, test.fallback); !ok || format != test.expected {
+			t.Fatalf("Expected %s for %q, got %s", test.expected, test.accept, format)
+		}
+	}
+
+	for _, accept := range []string{"text/html", "image/avif", "image/*;q=0"} {
+		if format, ok := acceptedFormat(accept, services.FormatJPEG); ok {
+			t.Fatalf("Expected nothing acceptable for %q, got %s", accept, format)
+		}
+	}
+}
+
+// TestNegotiatePreset tests applying the format and quality parameters to a preset
+func TestNegotiatePreset(t *testing.T) {
+	preset := services.RenditionPreset{Name: "small", Width: 100, Height: 100, Fit: services.FitContain, Format: services.FormatJPEG}
+	negotiate := func(target, accept string) (services.RenditionPreset, bool, error) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		return negotiatePreset(req, preset)
+	}
+
+	if negotiated, changed, err := negotiate("/", ""); err != nil || changed || negotiated != preset {
+		t.Fatalf("Expected the preset unchanged, got %+v, %v, %v", negotiated, changed, err)
+	}
+	if negotiated, changed, _ := negotiate("/?format=png", "image/webp"); !changed || negotiated.Format != services.FormatPNG {
+		t.Fatalf("Expected the format parameter to win over the Accept header, got %+v", negotiated)
+	}
+	if negotiated, changed, _ := negotiate("/?quality=40", ""); !changed || negotiated.Quality != 40 {
+		t.Fatalf("Expected quality 40, got %+v", negotiated)
+	}
+	if negotiated, _, _ := negotiate("/?format=webp&quality=40", ""); negotiated.Quality != 0 {
+		t.Fatalf("Expected the quality to be ignored for lossless WebP, got %+v", negotiated)
+	}
+	for _, target := range []string{"/?format=tiff", "/?quality=0", "/?quality=high"} {
+		if _, _, err := negotiate(target, ""); err == nil || err == errNotAcceptable {
+			t.Fatalf("Expected an invalid parameter error for %s, got %v", target, err)
+		}
+	}
+	if _, _, err := negotiate("/", "application/json"); err != errNotAcceptable {
+		t.Fatalf("Expected errNotAcceptable, got %v", err)
+	}
+}
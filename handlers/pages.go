@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"receipt-uploader/models"
+	"receipt-uploader/services"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PageOrder is the request body of ReorderPages
+type PageOrder struct {
+	Order []int `json:"order"` // Current page numbers in their new order, e.g. [3, 1, 2] moves the last page to the front
+}
+
+// AppendPages adds the uploaded images as pages after the last page of a receipt owned by the user.
+// Like UploadReceipt it reports the result of every file; files that fail are left out.
+func (h *ReceiptHandler) AppendPages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check if the request's content type is multipart/form-data
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		http.Error(w, "Content-Type must be multipart/form-data", http.StatusBadRequest)
+		return
+	}
+
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Extract the receipt ID from the URL path
+	receiptID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/receipts/"), "/pages")
+	unlock := h.receiptLocks.Lock(receiptID)
+	defer unlock()
+	receipt, ok := h.ownedReceipt(w, receiptID, userID, models.StateActive)
+	if !ok {
+		return
+	}
+	if isPDFReceipt(receipt) {
+		http.Error(w, "PDF receipts cannot have image pages", http.StatusConflict)
+		return
+	}
+
+	// Hold the content locks until the receipt references the new originals
+	inspected, results, ok := h.inspectPages(w, r)
+	defer closeInspected(inspected)
+	if !ok {
+		return
+	}
+	var hashes []string
+	for _, file := range inspected {
+		if file != nil {
+			hashes = append(hashes, file.saved.SHA256)
+		}
+	}
+	unlockContents := h.contentLocks.LockAll(hashes)
+	defer unlockContents()
+
+	pages, stored := h.storePages(inspected, results)
+	if len(pages) > 0 {
+		existing := receipt.Files()
+		if err := h.updatePages(&receipt, slices.Concat(existing, pages)); err != nil {
+			log.Println("Error storing receipt pages:", err)
+			for _, i := range stored {
+				results[i].Status = http.StatusInternalServerError
+				results[i].Error = "could not store receipt"
+			}
+
+			// Do not leave orphaned originals behind
+			for _, page := range pages {
+				if !receipt.References(page.ContentHash) {
+					h.releaseOriginal(receipt, page)
+				}
+			}
+		} else {
+			for n, i := range stored {
+				results[i].ReceiptID = receipt.ID
+				results[i].Page = len(existing) + n + 1
+				results[i].Status = http.StatusCreated
+			}
+		}
+	}
+
+	// Return the per-file results
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(uploadStatus(results))
+	json.NewEncoder(w).Encode(UploadResponse{Results: results})
+}
+
+// ReorderPages moves the pages of a receipt owned by the user into a new order
+func (h *ReceiptHandler) ReorderPages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Extract the receipt ID from the URL path
+	receiptID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/receipts/"), "/pages")
+	unlock := h.receiptLocks.Lock(receiptID)
+	defer unlock()
+	receipt, ok := h.ownedReceipt(w, receiptID, userID, models.StateActive)
+	if !ok {
+		return
+	}
+	if isPDFReceipt(receipt) {
+		http.Error(w, "Pages of PDF receipts cannot be reordered", http.StatusConflict)
+		return
+	}
+
+	// Decode the new order; unknown fields are rejected so typos are not silently ignored
+	var order PageOrder
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&order); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Every current page must appear exactly once
+	files := receipt.Files()
+	if len(order.Order) != len(files) {
+		http.Error(w, fmt.Sprintf("order must list all %d pages", len(files)), http.StatusBadRequest)
+		return
+	}
+	pages := make([]models.PageFile, len(files))
+	seen := make(map[int]bool, len(files))
+	for i, page := range order.Order {
+		if page < 1 || page > len(files) || seen[page] {
+			http.Error(w, fmt.Sprintf("order must list each page from 1 to %d once", len(files)), http.StatusBadRequest)
+			return
+		}
+		seen[page] = true
+		pages[i] = files[page-1]
+	}
+
+	if err := h.updatePages(&receipt, pages); err != nil {
+		log.Println("Error storing receipt pages:", err)
+		http.Error(w, "Could not update receipt", http.StatusInternalServerError)
+		return
+	}
+
+	// Return the updated receipt
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// DeletePage removes a page from a receipt owned by the user.
+// Its original is deleted unless another page or receipt still references it.
+func (h *ReceiptHandler) DeletePage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Extract the receipt ID and the page number from the URL path
+	receiptID, pageParam, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/receipts/"), "/pages/")
+	unlock := h.receiptLocks.Lock(receiptID)
+	defer unlock()
+	receipt, ok := h.ownedReceipt(w, receiptID, userID, models.StateActive)
+	if !ok {
+		return
+	}
+	if isPDFReceipt(receipt) {
+		http.Error(w, "Pages of PDF receipts cannot be removed", http.StatusConflict)
+		return
+	}
+	files := receipt.Files()
+	page, err := strconv.Atoi(pageParam)
+	if err != nil || page < 1 || page > len(files) {
+		http.Error(w, "Page not found", http.StatusNotFound)
+		return
+	}
+	if len(files) == 1 {
+		http.Error(w, "A receipt needs at least one page; delete the receipt instead", http.StatusConflict)
+		return
+	}
+
+	// Hold the content lock so a concurrent upload cannot start sharing the original while it is released
+	removed := files[page-1]
+	unlockContent := h.contentLocks.Lock(removed.ContentHash)
+	defer unlockContent()
+
+	pages := append(append([]models.PageFile(nil), files[:page-1]...), files[page:]...)
+	if err := h.updatePages(&receipt, pages); err != nil {
+		log.Println("Error storing receipt pages:", err)
+		http.Error(w, "Could not update receipt", http.StatusInternalServerError)
+		return
+	}
+	if !receipt.References(removed.ContentHash) {
+		if err := h.releaseOriginal(receipt, removed); err != nil {
+			// The page is gone either way; the original is only left behind
+			log.Println("Error deleting page original:", err)
+		}
+	}
+
+	// Return the updated receipt
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// inspectPages reads the page images of a multipart request and inspects them concurrently as they arrive.
+// It returns the files that can be stored, nil for those that cannot, with the result of every file.
+// PDF documents have pages of their own and are rejected. Each page is spooled to a temporary file until the request
+// is read, so they can be stored together; the caller removes the files with closeInspected.
+// If the request cannot be read the error is written to w and ok is false.
+func (h *ReceiptHandler) inspectPages(w http.ResponseWriter, r *http.Request) (inspected []*inspectedFile, results []UploadResult, ok bool) {
+	var mu sync.Mutex
+	files := make(map[int]*inspectedFile) // By index, since the number of files is not known in advance
+	results, ok = h.processUploads(w, r, func(i int, part uploadPart) UploadResult {
+		file, result := h.inspectUpload(part)
+		if file != nil && file.saved.Format == services.FormatPDF {
+			file = nil
+			result.Status = http.StatusUnsupportedMediaType
+			result.Reason = services.ReasonFormatNotAllowed
+			result.Error = "PDF documents cannot be pages of a receipt; upload them separately"
+		}
+		if file == nil {
+			part.close()
+		}
+		mu.Lock()
+		files[i] = file
+		mu.Unlock()
+		return result
+	})
+
+	inspected = make([]*inspectedFile, len(results))
+	for i := range inspected {
+		inspected[i] = files[i]
+	}
+	return inspected, results, ok
+}
+
+// storePages stores the originals of the inspected files in request order and returns them as pages,
+// with the index of each page's file. Files that cannot be stored are marked as failed in results.
+// The caller must hold the content locks of the files.
+func (h *ReceiptHandler) storePages(inspected []*inspectedFile, results []UploadResult) ([]models.PageFile, []int) {
+	var pages []models.PageFile
+	var stored []int
+	for i, file := range inspected {
+		if file == nil {
+			continue
+		}
+		if err := services.StoreFile(h.Blobs, file.saved); err != nil {
+			log.Println("Error saving uploaded file:", err)
+			results[i].Status = http.StatusInternalServerError
+			results[i].Error = "could not save file"
+			continue
+		}
+		pages = append(pages, pageFile(file))
+		stored = append(stored, i)
+	}
+	return pages, stored
+}
+
+// updatePages replaces the pages of a receipt and stores it. The receipt's renditions are generated
+// from the new pages, so its thumbnails are generated again in the background.
+func (h *ReceiptHandler) updatePages(receipt *models.Receipt, pages []models.PageFile) error {
+	updated := *receipt
+	updated.SetPages(pages)
+	if h.processing != nil {
+		updated.ProcessingStatus, updated.ProcessingError = models.ProcessingPending, ""
+	}
+	if err := h.Receipts.Update(updated); err != nil {
+		return err
+	}
+	*receipt = updated
+	if h.processing != nil {
+		h.enqueueProcessing(receipt.ID)
+	}
+	return nil
+}
+
+// isPDFReceipt reports whether a receipt's original is a PDF document, whose pages are fixed
+func isPDFReceipt(receipt models.Receipt) bool {
+	return len(receipt.Pages) == 0 && strings.EqualFold(path.Ext(receipt.FilePath), ".pdf")
+}
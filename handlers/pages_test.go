@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"errors"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"receipt-uploader/models"
+	"receipt-uploader/services"
+	"strings"
+	"testing"
+)
+
+// Helper function to upload files from testdata as the pages of one receipt and return the receipt
+func uploadPageReceipt(t *testing.T, h *ReceiptHandler, fileNames ...string) models.Receipt {
+	rr := httptest.NewRecorder()
+	h.UploadReceipt(rr, newUploadRequestTo(t, "/receipts?mode=pages", fileNames...))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	receipt, err := h.Receipts.Get(decodeUploadResponse(t, rr).Results[0].ReceiptID)
+	if err != nil {
+		t.Fatalf("Expected the receipt to be stored, got %v", err)
+	}
+	return receipt
+}
+
+// TestUploadPages tests uploading several files as the pages of one receipt
+func TestUploadPages(t *testing.T) {
+	h, _ := setupTestEnv(t)
+
+	t.Run("Grouped", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequestTo(t, "/receipts?mode=pages", "test.jpg", "test.txt", "exif.jpg"))
+		if rr.Code != http.StatusMultiStatus {
+			t.Fatalf("Expected status code 207, got %d", rr.Code)
+		}
+
+		// The text file is left out and the images become pages 1 and 2 of the same receipt
+		results := decodeUploadResponse(t, rr).Results
+		if results[1].Status != http.StatusUnsupportedMediaType || results[1].ReceiptID != "" {
+			t.Fatalf("Expected the text file to be rejected, got %+v", results[1])
+		}
+		if results[0].Page != 1 || results[2].Page != 2 || results[0].ReceiptID == "" || results[0].ReceiptID != results[2].ReceiptID {
+			t.Fatalf("Expected both images in one receipt, got %+v and %+v", results[0], results[2])
+		}
+		receipt, _ := h.Receipts.Get(results[0].ReceiptID)
+		if len(receipt.Pages) != 2 || receipt.PageCount != 2 || receipt.FilePath != receipt.Pages[0].FilePath || receipt.CameraMake != "" {
+			t.Fatalf("Expected a receipt described by its first page, got %+v", receipt)
+		}
+		for _, page := range receipt.Pages {
+			if _, err := h.Blobs.Stat(page.FilePath); err != nil {
+				t.Fatalf("Expected the original of every page to be stored, got %v", err)
+			}
+		}
+	})
+
+	t.Run("PDFRejected", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequestTo(t, "/receipts?mode=pages", "receipt.pdf", "test.jpg"))
+		results := decodeUploadResponse(t, rr).Results
+		if results[0].Status != http.StatusUnsupportedMediaType || results[1].Page != 1 {
+			t.Fatalf("Expected the PDF document to be rejected, got %+v", results)
+		}
+	})
+
+	t.Run("InvalidParameters", func(t *testing.T) {
+		for _, target := range []string{"/receipts?mode=stack", "/receipts?mode=pages&duplicates=reject"} {
+			rr := httptest.NewRecorder()
+			h.UploadReceipt(rr, newUploadRequestTo(t, target, "test.jpg"))
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("Expected status code 400 for %s, got %d", target, rr.Code)
+			}
+		}
+	})
+}
+
+// TestReceiptPages tests serving, appending, reordering and removing the pages of a receipt
+func TestReceiptPages(t *testing.T) {
+	h, repo := setupTestEnv(t)
+	receipt := uploadPageReceipt(t, h, "test.jpg", "exif.jpg")
+	photo, scan := receipt.Pages[0], receipt.Pages[1]
+	if receipt.ImageWidth != 2560 || scan.ImageWidth != 80 || scan.CameraMake != "Receiptcam" {
+		t.Fatalf("Expected each page to record its own image, got %+v", receipt)
+	}
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := withUser(httptest.NewRequest(method, target, strings.NewReader(body)), "test-user")
+		rr := httptest.NewRecorder()
+		switch {
+		case method == http.MethodDelete:
+			h.DeletePage(rr, req)
+		case method == http.MethodPut:
+			h.ReorderPages(rr, req)
+		case strings.Contains(target, "/thumbnails/"):
+			h.GetThumbnail(rr, req)
+		case strings.HasSuffix(strings.Split(target, "?")[0], "/thumbnails"):
+			h.GetThumbnails(rr, req)
+		default:
+			h.GetReceipt(rr, req)
+		}
+		return rr
+	}
+
+	t.Run("Original", func(t *testing.T) {
+		// A page is served as its own upright original
+		rr := do(http.MethodGet, "/receipts/"+receipt.ID+"?page=2", "")
+		config, _, err := image.DecodeConfig(rr.Body)
+		if rr.Code != http.StatusOK || err != nil || config.Width != 80 || config.Height != 120 {
+			t.Fatalf("Expected the 80x120 original of page 2, got %d %+v %v", rr.Code, config, err)
+		}
+		if rr := do(http.MethodGet, "/receipts/"+receipt.ID+"?page=3", ""); rr.Code != http.StatusNotFound {
+			t.Fatalf("Expected status code 404, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Stitched", func(t *testing.T) {
+		// The 2560x1440 photo is scaled to the 80 pixel width of the scan, giving an 80x165 composite
+		rr := do(http.MethodGet, "/receipts/"+receipt.ID+"?page=all&format=png", "")
+		config, _, err := image.DecodeConfig(rr.Body)
+		if rr.Code != http.StatusOK || err != nil || config.Width != 80 || config.Height != 165 {
+			t.Fatalf("Expected an 80x165 composite, got %d %+v %v", rr.Code, config, err)
+		}
+
+		rr = do(http.MethodGet, "/receipts/"+receipt.ID+"/thumbnails/small?page=all", "")
+		config, _, err = image.DecodeConfig(rr.Body)
+		if rr.Code != http.StatusOK || err != nil || config.Height != 100 || config.Width >= 50 {
+			t.Fatalf("Expected a tall composite thumbnail, got %d %+v %v", rr.Code, config, err)
+		}
+
+		rr = do(http.MethodGet, "/receipts/"+receipt.ID+"/thumbnails?page=all", "")
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "/thumbnails/small?page=all") {
+			t.Fatalf("Expected thumbnail URLs of the composite, got %d %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("Append", func(t *testing.T) {
+		req := newUploadRequestTo(t, "/receipts/"+receipt.ID+"/pages", "test.txt", "test.jpg")
+		rr := httptest.NewRecorder()
+		h.AppendPages(rr, req)
+		if rr.Code != http.StatusMultiStatus {
+			t.Fatalf("Expected status code 207, got %d", rr.Code)
+		}
+		results := decodeUploadResponse(t, rr).Results
+		if results[1].Page != 3 || results[1].ReceiptID != receipt.ID {
+			t.Fatalf("Expected the image to become page 3, got %+v", results[1])
+		}
+		if updated, _ := repo.Get(receipt.ID); updated.PageCount != 3 || updated.Pages[2].ContentHash != photo.ContentHash {
+			t.Fatalf("Expected a third page, got %+v", updated.Pages)
+		}
+	})
+
+	t.Run("Reorder", func(t *testing.T) {
+		for _, body := range []string{`{"order": [1, 1, 2]}`, `{"order": [1, 2]}`, `{"order": [0, 1, 2]}`, `{"pages": [1, 2, 3]}`} {
+			if rr := do(http.MethodPut, "/receipts/"+receipt.ID+"/pages", body); rr.Code != http.StatusBadRequest {
+				t.Fatalf("Expected status code 400 for %s, got %d", body, rr.Code)
+			}
+		}
+
+		// Moving the scan to the front makes it describe the receipt
+		if rr := do(http.MethodPut, "/receipts/"+receipt.ID+"/pages", `{"order": [2, 1, 3]}`); rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", rr.Code)
+		}
+		updated, _ := repo.Get(receipt.ID)
+		if updated.FilePath != scan.FilePath || updated.Pages[1].ContentHash != photo.ContentHash || updated.PerceptualHash != scan.PerceptualHash {
+			t.Fatalf("Expected the scan to be the first page, got %+v", updated)
+		}
+		if updated.ImageWidth != 80 || updated.ImageHeight != 120 || updated.CameraMake != "Receiptcam" || updated.Sharpness != scan.Sharpness {
+			t.Fatalf("Expected the receipt to describe the scan's image, got %+v", updated)
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		if rr := do(http.MethodDelete, "/receipts/"+receipt.ID+"/pages/4", ""); rr.Code != http.StatusNotFound {
+			t.Fatalf("Expected status code 404, got %d", rr.Code)
+		}
+
+		// The scan's original is not referenced anywhere else
+		if rr := do(http.MethodDelete, "/receipts/"+receipt.ID+"/pages/1", ""); rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", rr.Code)
+		}
+		if _, err := h.Blobs.Stat(scan.FilePath); !errors.Is(err, services.ErrBlobNotFound) {
+			t.Fatalf("Expected the removed page's original to be deleted, got %v", err)
+		}
+		if updated, _ := repo.Get(receipt.ID); updated.ImageWidth != 2560 || updated.CameraMake != photo.CameraMake || updated.Brightness != photo.Brightness {
+			t.Fatalf("Expected the receipt to describe the photo again, got %+v", updated)
+		}
+
+		// The photo is still the remaining page
+		if rr := do(http.MethodDelete, "/receipts/"+receipt.ID+"/pages/1", ""); rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", rr.Code)
+		}
+		if _, err := h.Blobs.Stat(photo.FilePath); err != nil {
+			t.Fatalf("Expected an original still used by another page to be kept, got %v", err)
+		}
+
+		// The last page cannot be removed
+		if rr := do(http.MethodDelete, "/receipts/"+receipt.ID+"/pages/1", ""); rr.Code != http.StatusConflict {
+			t.Fatalf("Expected status code 409, got %d", rr.Code)
+		}
+	})
+
+	t.Run("PDF", func(t *testing.T) {
+		repo.Create(models.Receipt{ID: "pdf", FilePath: "originals/receipt.pdf", UserID: "test-user", PageCount: 2})
+		if rr := do(http.MethodPut, "/receipts/pdf/pages", `{"order": [1]}`); rr.Code != http.StatusConflict {
+			t.Fatalf("Expected status code 409, got %d", rr.Code)
+		}
+		rr := httptest.NewRecorder()
+		h.AppendPages(rr, newUploadRequestTo(t, "/receipts/pdf/pages", "test.jpg"))
+		if rr.Code != http.StatusConflict {
+			t.Fatalf("Expected status code 409, got %d", rr.Code)
+		}
+	})
+
+	t.Run("OtherUser", func(t *testing.T) {
+		req := withUser(httptest.NewRequest(http.MethodDelete, "/receipts/"+receipt.ID+"/pages/1", nil), "other-user")
+		rr := httptest.NewRecorder()
+		h.DeletePage(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("Expected status code 403, got %d", rr.Code)
+		}
+	})
+}
+
+// TestPurgeReceiptPages tests that purging a receipt deletes the originals of all of its pages
+func TestPurgeReceiptPages(t *testing.T) {
+	h, _ := setupTestEnv(t)
+	receipt := uploadPageReceipt(t, h, "test.jpg", "exif.jpg")
+
+	req := withUser(httptest.NewRequest(http.MethodDelete, "/receipts/"+receipt.ID+"?purge=true", nil), "test-user")
+	rr := httptest.NewRecorder()
+	h.DeleteReceipt(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code 204, got %d", rr.Code)
+	}
+	for _, page := range receipt.Pages {
+		if _, err := h.Blobs.Stat(page.FilePath); !errors.Is(err, services.ErrBlobNotFound) {
+			t.Fatalf("Expected %s to be deleted, got %v", page.FilePath, err)
+		}
+	}
+}
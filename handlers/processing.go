@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"receipt-uploader/models"
+	"receipt-uploader/services"
+)
+
+// StartProcessing starts the background workers that generate thumbnails right after upload,
+// and queues the receipts whose processing was interrupted by a restart.
+// Without it thumbnails are only generated when they are first requested.
+func (h *ReceiptHandler) StartProcessing(opts services.JobQueueOptions) error {
+	h.processing = services.NewJobQueue(opts, h.processThumbnails, h.processingFailed)
+
+	// Receipts that were queued or being processed when the service stopped
+	var unfinished []models.Receipt
+	for _, status := range []models.ProcessingStatus{models.ProcessingPending, models.ProcessingRunning} {
+		page, err := h.Receipts.Query(models.ReceiptQuery{State: models.StateAny, Processing: status})
+		if err != nil {
+			return err
+		}
+		unfinished = append(unfinished, page.Receipts...)
+	}
+
+	// There may be more of them than fit in the queue, so they are fed in as workers free up
+	queue := h.processing
+	go func() {
+		for _, receipt := range unfinished {
+			if err := queue.EnqueueWait(receipt.ID); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// StopProcessing stops the background workers. Unfinished receipts stay pending and resume on the next start.
+func (h *ReceiptHandler) StopProcessing() {
+	if h.processing != nil {
+		h.processing.Stop()
+	}
+}
+
+// enqueueProcessing queues thumbnail generation for a receipt whose status is pending
+func (h *ReceiptHandler) enqueueProcessing(receiptID string) {
+	if err := h.processing.Enqueue(receiptID); err != nil {
+		// The receipt stays pending and is queued again on the next start; until then thumbnails are generated on request
+		log.Printf("Could not queue thumbnails of receipt %s: %v", receiptID, err)
+	}
+}
+
+// processThumbnails generates the thumbnails of every configured preset for a receipt
+func (h *ReceiptHandler) processThumbnails(receiptID string, attempt int) error {
+	receipt, err := h.setProcessingStatus(receiptID, models.ProcessingRunning, "")
+	if errors.Is(err, models.ErrReceiptNotFound) {
+		return nil // Purged while it was queued
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, preset := range h.Presets {
+		if _, err := h.ensureRendition(receipt, preset, false); err != nil {
+			log.Printf("Attempt %d at generating thumbnails of receipt %s failed: %v", attempt, receiptID, err)
+			h.setProcessingStatus(receiptID, models.ProcessingPending, err.Error())
+			return err
+		}
+	}
+
+	_, err = h.setProcessingStatus(receiptID, models.ProcessingDone, "")
+	if errors.Is(err, models.ErrReceiptNotFound) {
+		// Purged while the thumbnails were generated, so nothing else will remove them
+		return h.Renditions.Invalidate(receiptID)
+	}
+	return err
+}
+
+// processingFailed records that a receipt's thumbnails could not be generated
+func (h *ReceiptHandler) processingFailed(receiptID string, err error) {
+	log.Printf("Giving up on thumbnails of receipt %s: %v", receiptID, err)
+	if _, err := h.setProcessingStatus(receiptID, models.ProcessingFailed, err.Error()); err != nil && !errors.Is(err, models.ErrReceiptNotFound) {
+		log.Println("Error updating processing status:", err)
+	}
+}
+
+// setProcessingStatus updates the processing status of a receipt and returns the updated receipt
+func (h *ReceiptHandler) setProcessingStatus(receiptID string, status models.ProcessingStatus, reason string) (models.Receipt, error) {
+	unlock := h.receiptLocks.Lock(receiptID)
+	defer unlock()
+
+	receipt, err := h.Receipts.Get(receiptID)
+	if err != nil {
+		return receipt, err
+	}
+	receipt.ProcessingStatus = status
+	receipt.ProcessingError = reason
+	return receipt, h.Receipts.Update(receipt)
+}
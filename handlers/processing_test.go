@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"receipt-uploader/models"
+	"receipt-uploader/services"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestProcessing starts background processing with fast retries for the duration of the test
+func startTestProcessing(t *testing.T, h *ReceiptHandler) {
+	err := h.StartProcessing(services.JobQueueOptions{Workers: 2, Capacity: 10, MaxAttempts: 2, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to start processing: %v", err)
+	}
+	t.Cleanup(h.StopProcessing)
+}
+
+// waitForProcessing polls a receipt until its processing status is final
+func waitForProcessing(t *testing.T, repo models.ReceiptRepository, receiptID string) models.Receipt {
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		receipt, err := repo.Get(receiptID)
+		if err == nil && (receipt.ProcessingStatus == models.ProcessingDone || receipt.ProcessingStatus == models.ProcessingFailed) {
+			return receipt
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected processing of receipt %s to finish", receiptID)
+	return models.Receipt{}
+}
+
+// TestBackgroundProcessing tests generating thumbnails in the background
+func TestBackgroundProcessing(t *testing.T) {
+	t.Run("AfterUpload", func(t *testing.T) {
+		h, repo := setupTestEnv(t)
+		startTestProcessing(t, h)
+
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequest(t, "test.jpg"))
+		receiptID := decodeUploadResponse(t, rr).Results[0].ReceiptID
+
+		receipt := waitForProcessing(t, repo, receiptID)
+		if receipt.ProcessingStatus != models.ProcessingDone || receipt.ProcessingError != "" {
+			t.Fatalf("Expected processing to succeed, got %q: %s", receipt.ProcessingStatus, receipt.ProcessingError)
+		}
+		for _, preset := range h.Presets {
+			key, _ := h.renditionKey(receipt, preset, false)
+			if _, err := h.Renditions.Stat(key); err != nil {
+				t.Fatalf("Expected the %s thumbnail to be cached, got %v", preset.Name, err)
+			}
+		}
+	})
+
+	t.Run("ResumeAfterRestart", func(t *testing.T) {
+		h, repo := setupTestEnv(t)
+		repo.Create(models.Receipt{ID: "queued", FilePath: "test.jpg", UserID: "test-user", ProcessingStatus: models.ProcessingPending})
+		repo.Create(models.Receipt{ID: "interrupted", FilePath: "test.jpg", UserID: "test-user", ProcessingStatus: models.ProcessingRunning})
+		startTestProcessing(t, h)
+
+		for _, id := range []string{"queued", "interrupted"} {
+			if receipt := waitForProcessing(t, repo, id); receipt.ProcessingStatus != models.ProcessingDone {
+				t.Fatalf("Expected receipt %s to be processed, got %q", id, receipt.ProcessingStatus)
+			}
+		}
+	})
+
+	t.Run("GiveUpAfterRetries", func(t *testing.T) {
+		h, repo := setupTestEnv(t)
+		repo.Create(models.Receipt{ID: "broken", FilePath: "missing.jpg", ContentHash: strings.Repeat("ef", 32), UserID: "test-user", ProcessingStatus: models.ProcessingPending})
+		startTestProcessing(t, h)
+
+		receipt := waitForProcessing(t, repo, "broken")
+		if receipt.ProcessingStatus != models.ProcessingFailed || receipt.ProcessingError == "" {
+			t.Fatalf("Expected processing to fail with a reason, got %q: %s", receipt.ProcessingStatus, receipt.ProcessingError)
+		}
+	})
+}
@@ -2,188 +2,361 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"mime/multipart"
+	"image"
 	"net/http"
-	"path/filepath"
+	"net/url"
+	"receipt-uploader/auth"
 	"receipt-uploader/models"
 	"receipt-uploader/services"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/disintegration/imaging"
+	"github.com/shopspring/decimal"
 )
 
-// ThumbnailResponse holds the paths for the generated thumbnails
-type ThumbnailResponse struct {
-	Small  string `json:"small"`
-	Medium string `json:"medium"`
-	Large  string `json:"large"`
+// Page sizes for ListReceipts
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+// Thumbnail describes a thumbnail and where to fetch it
+type Thumbnail struct {
+	URL         string `json:"url"`                    // Served by GetThumbnail
+	DownloadURL string `json:"download_url,omitempty"` // Signed URL that downloads the image without authentication until it expires
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Size        int64  `json:"size"` // Size of the encoded image in bytes
+	ContentType string `json:"content_type"`
+}
+
+// ThumbnailResponse describes the thumbnails of a receipt by preset name
+type ThumbnailResponse map[string]Thumbnail
+
+// ReceiptHandler serves the receipt endpoints using the injected receipt repository and blob store
+type ReceiptHandler struct {
+	Receipts models.ReceiptRepository
+	Blobs    services.BlobStore // Where receipt originals are stored
+
+	// Generated thumbnails and resized images, stored in the blob store
+	Renditions *services.RenditionCache
+	// Thumbnail sizes generated for every receipt
+	Presets []services.RenditionPreset
+	// Formats uploads are accepted in, detected from their contents
+	Formats []string
+	// Largest uploaded file and multipart request body in bytes; 0 disables a limit
+	MaxFileBytes    int64
+	MaxRequestBytes int64
+	// Files uploaded in chunks with the tus protocol until they are complete
+	Resumable *services.ResumableStore
+	// EXIF metadata kept in uploaded originals and JPEG renditions
+	Metadata services.MetadataPolicy
+	// Limits uploaded images must meet. The handler checks none unless they are set; the configuration sets them by default.
+	Quality services.QualityLimits
+	// Decodes uploads and originals within pixel limits, a few at a time
+	Decoder *services.ImageDecoder
+
+	// Largest perceptual hash distance for two receipt images to count as similar
+	SimilarDistance int
+
+	processing *services.JobQueue // Generates thumbnails in the background, nil until StartProcessing
+
+	contentLocks   keyedMutex // Serializes uploads and purges of the same original, within this process only
+	renditionLocks keyedMutex // Serializes generation of the same rendition
+	receiptLocks   keyedMutex // Serializes read-modify-write updates of the same receipt
+	uploadLocks    keyedMutex // Serializes chunks of the same resumable upload
+}
+
+// NewReceiptHandler creates a ReceiptHandler backed by the given repository and blob store
+func NewReceiptHandler(receipts models.ReceiptRepository, blobs services.BlobStore) *ReceiptHandler {
+	return &ReceiptHandler{
+		Receipts:        receipts,
+		Blobs:           blobs,
+		Renditions:      services.NewRenditionCache(blobs, defaultRenditionCacheBytes),
+		Presets:         services.DefaultRenditionPresets(),
+		Formats:         services.DefaultUploadFormats(),
+		MaxFileBytes:    defaultMaxFileBytes,
+		MaxRequestBytes: defaultMaxRequestBytes,
+		Resumable:       services.NewResumableStore(blobs, defaultResumableExpiry),
+		Metadata:        services.MetadataStripGPS,
+		Decoder:         services.NewImageDecoder(services.DefaultDecodeLimits(), defaultDecodeConcurrency),
+		SimilarDistance: defaultSimilarDistance,
+	}
+}
+
+// ReceiptListResponse holds one page of receipts and the cursor for the next page
+type ReceiptListResponse struct {
+	Receipts   []models.Receipt `json:"receipts"`
+	NextCursor string           `json:"next_cursor,omitempty"`
 }
 
-// UploadReceipt handles the uploading of receipt images
-func UploadReceipt(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+// GetReceipt retrieves a receipt by ID and serves the file if the user is authorized
+func (h *ReceiptHandler) GetReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Check if the request's content type is multipart/form-data
-	if r.Header.Get("Content-Type") == "" || !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
-		http.Error(w, "Content-Type must be multipart/form-data", http.StatusBadRequest)
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
 		return
 	}
 
-	// Extract user ID from headers
-	userID := r.Header.Get("X-User-ID")
-	if userID == "" {
-		http.Error(w, "X-User-ID header is required", http.StatusBadRequest)
+	// Extract the receipt ID from the URL path
+	receiptID := strings.TrimPrefix(r.URL.Path, "/receipts/")
+	receipt, ok := h.ownedReceipt(w, receiptID, userID, models.StateActive)
+	if !ok {
 		return
 	}
 
-	// Parse the multipart form
-	err := r.ParseMultipartForm(10 << 20) // Max 10MB
+	// Parse optional width and height query parameters
+	width, err := parseQueryParameter(r.URL.Query().Get("width"), "width")
 	if err != nil {
-		http.Error(w, "Error parsing multipart form", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Retrieve all files from the form
-	files := r.MultipartForm.File["file"]
-	if len(files) == 0 {
-		http.Error(w, "No files uploaded", http.StatusBadRequest)
+	height, err := parseQueryParameter(r.URL.Query().Get("height"), "height")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var wg sync.WaitGroup // WaitGroup to wait for all goroutines to finish
-	receiptIDs := make([]string, len(files))
-	errs := make([]error, len(files))
-
-	// Process each file concurrently
-	for i, fileHeader := range files {
-		wg.Add(1)
-		go func(i int, fileHeader *multipart.FileHeader) {
-			defer wg.Done()
-
-			// Save the file using the service layer
-			filePath, err := services.SaveFile(fileHeader)
-			if err != nil {
-				errs[i] = err
-				return
-			}
-
-			// Generate a unique receipt ID and store the receipt metadata
-			receiptID := services.GenerateReceiptID()
-			models.StoreReceipt(receiptID, filePath, userID)
-			receiptIDs[i] = receiptID
-		}(i, fileHeader)
+	// A box beyond the decoding limits could never be rendered
+	if err := h.Decoder.Limits.Check(image.Config{Width: width, Height: height}); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid size: %v", err), http.StatusBadRequest)
+		return
 	}
 
-	// Wait for all the goroutines to finish
-	wg.Wait()
+	page, stitch, ok := requestedPage(w, r, receipt)
+	if !ok {
+		return
+	}
 
-	// Check if any errors occurred
-	for _, err := range errs {
-		if err != nil {
-			http.Error(w, "Error uploading one or more files", http.StatusInternalServerError)
+	// If no resizing or conversion is requested, serve the original file. Pages of PDF documents are rendered,
+	// while a page of a receipt photographed in parts is its own original.
+	query := r.URL.Query()
+	file, _ := receipt.FileOfPage(page)
+	if width == 0 && height == 0 && query.Get("format") == "" && query.Get("quality") == "" && !stitch &&
+		(query.Get("page") == "" || len(receipt.Pages) > 0) {
+		// Clients can download large originals through a signed URL instead, e.g. straight from the bucket
+		if query.Get("redirect") == "true" {
+			h.redirectToBlob(w, r, services.OriginalKey(file.FilePath))
 			return
 		}
+		serveBlob(w, r, h.Blobs, services.OriginalKey(file.FilePath))
+		return
+	}
+
+	// Resized images keep the original's format unless another one is requested or accepted
+	preset := services.VariantPreset(width, height)
+	preset.Format = originalFormat(file.FilePath)
+	preset.Page, preset.Stitch = page, stitch
+	preset, _, err = negotiatePreset(r, preset)
+	if err != nil {
+		writeNegotiationError(w, err)
+		return
 	}
 
-	// Return the list of receipt IDs
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("Receipts uploaded successfully with IDs: %v", strings.Join(receiptIDs, ", "))))
+	// Serve the resized image from the rendition cache, resizing the original on a miss
+	w.Header().Set("Vary", "Accept")
+	blob, info, err := h.openRendition(receipt, preset, true)
+	if err != nil {
+		writeRenditionError(w, err)
+		return
+	}
+	writeBlob(w, r, blob, info)
 }
 
-// GetReceipt retrieves a receipt by ID and serves the file if the user is authorized
-func GetReceipt(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+// PatchReceipt updates the editable metadata of a receipt owned by the user
+func (h *ReceiptHandler) PatchReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Extract user ID from headers
-	userID := r.Header.Get("X-User-ID")
-	if userID == "" {
-		http.Error(w, "X-User-ID header is required", http.StatusBadRequest)
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
 		return
 	}
 
 	// Extract the receipt ID from the URL path
 	receiptID := strings.TrimPrefix(r.URL.Path, "/receipts/")
-	receipt, exists := models.GetReceipt(receiptID)
-	if !exists {
-		http.Error(w, "Receipt not found", http.StatusNotFound)
+	unlock := h.receiptLocks.Lock(receiptID)
+	defer unlock()
+	receipt, ok := h.ownedReceipt(w, receiptID, userID, models.StateActive)
+	if !ok {
 		return
 	}
 
-	// Check if the user owns the receipt
-	if receipt.UserID != userID {
-		http.Error(w, "Unauthorized", http.StatusForbidden)
+	// Decode the fields to change; unknown fields are rejected so typos are not silently ignored
+	var update models.ReceiptUpdate
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&update); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	// Parse optional width and height query parameters
-	width, err := parseQueryParameter(r.URL.Query().Get("width"), "width")
-	if err != nil {
+	// Validate and apply the update
+	if err := update.Apply(&receipt); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := h.Receipts.Update(receipt); err != nil {
+		http.Error(w, "Could not update receipt", http.StatusInternalServerError)
+		return
+	}
 
-	height, err := parseQueryParameter(r.URL.Query().Get("height"), "height")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// Return the updated receipt
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// ListReceipts lists one page of the authenticated user's receipts, filtered and sorted by the query parameters
+func (h *ReceiptHandler) ListReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// If neither width nor height is provided, serve the original image
-	if width == 0 && height == 0 {
-		http.ServeFile(w, r, receipt.FilePath)
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
 		return
 	}
 
-	// Process the image (resize based on provided width and height)
-	img, err := services.ProcessImage(receipt.FilePath, width, height)
+	// Build the query from the pagination, sorting and filter parameters
+	query, err := parseListQuery(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Could not process image", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	query.UserID = userID
 
-	// Serve the resized image back to the client
-	w.Header().Set("Content-Type", "image/jpeg")
-	err = imaging.Encode(w, img, imaging.JPEG)
+	// Get the page of receipts for the user
+	page, err := h.Receipts.Query(query)
+	if errors.Is(err, models.ErrInvalidCursor) {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Could not encode resized image", http.StatusInternalServerError)
+		http.Error(w, "Could not list receipts", http.StatusInternalServerError)
 		return
 	}
+
+	// Return the page as JSON; a user without receipts gets an empty list
+	response := ReceiptListResponse{Receipts: page.Receipts, NextCursor: page.NextCursor}
+	if response.Receipts == nil {
+		response.Receipts = []models.Receipt{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-// ListReceipts lists all receipts for the authenticated user
-func ListReceipts(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// authenticatedUser returns the ID of the user authenticated by the auth middleware.
+// It writes a 401 response and returns false if the request is not authenticated.
+func authenticatedUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return "", false
+	}
+	return principal.UserID, true
+}
+
+// ownedReceipt loads a receipt in the given trash state and checks that it belongs to the user.
+// It writes the error response and returns false if the receipt cannot be served.
+func (h *ReceiptHandler) ownedReceipt(w http.ResponseWriter, receiptID, userID string, state models.ReceiptState) (models.Receipt, bool) {
+	receipt, err := h.Receipts.Get(receiptID)
+	if errors.Is(err, models.ErrReceiptNotFound) || (err == nil && !state.Matches(receipt)) {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return models.Receipt{}, false
+	}
+	if err != nil {
+		http.Error(w, "Could not load receipt", http.StatusInternalServerError)
+		return models.Receipt{}, false
 	}
 
-	// Extract user ID from the X-User-ID header
-	userID := r.Header.Get("X-User-ID")
-	if userID == "" {
-		http.Error(w, "X-User-ID header is required", http.StatusBadRequest)
-		return
+	// Check if the user owns the receipt
+	if receipt.UserID != userID {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return models.Receipt{}, false
 	}
+	return receipt, true
+}
 
-	// Get the list of receipts for the user
-	receipts := models.ListUserReceipts(userID)
-	if len(receipts) == 0 {
-		http.Error(w, "No receipts found for this user", http.StatusNotFound)
-		return
+// parseListQuery builds a receipt query from the ListReceipts query parameters
+func parseListQuery(params url.Values) (models.ReceiptQuery, error) {
+	query := models.ReceiptQuery{
+		Category: params.Get("category"),
+		Merchant: params.Get("merchant"),
+		Cursor:   params.Get("cursor"),
+		Limit:    defaultPageSize,
 	}
 
-	// Return the full list of receipts as JSON
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(receipts)
+	// Page size
+	limit, err := parseQueryParameter(params.Get("limit"), "limit")
+	if err != nil {
+		return query, err
+	}
+	if limit > maxPageSize {
+		return query, fmt.Errorf("limit must be at most %d", maxPageSize)
+	}
+	if limit > 0 {
+		query.Limit = limit
+	}
+
+	// Sort order, newest first by default
+	switch sortBy := params.Get("sort"); sortBy {
+	case "", string(models.SortByUploadedAt):
+		query.SortBy = models.SortByUploadedAt
+	case string(models.SortByTotal):
+		query.SortBy = models.SortByTotal
+	default:
+		return query, fmt.Errorf("sort must be %q or %q", models.SortByUploadedAt, models.SortByTotal)
+	}
+	switch order := params.Get("order"); order {
+	case "", "desc":
+		query.Descending = true
+	case "asc":
+		query.Descending = false
+	default:
+		return query, fmt.Errorf("order must be \"asc\" or \"desc\"")
+	}
+
+	// Transaction date range
+	for name, target := range map[string]*string{"from": &query.FromDate, "to": &query.ToDate} {
+		value := params.Get(name)
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse(time.DateOnly, value); err != nil {
+			return query, fmt.Errorf("%s must be a date in YYYY-MM-DD format", name)
+		}
+		*target = value
+	}
+
+	// Amount range
+	for name, target := range map[string]*decimal.NullDecimal{"min_total": &query.MinTotal, "max_total": &query.MaxTotal} {
+		value := params.Get(name)
+		if value == "" {
+			continue
+		}
+		amount, err := decimal.NewFromString(value)
+		if err != nil || amount.IsNegative() {
+			return query, fmt.Errorf("%s must be a non-negative amount", name)
+		}
+		*target = decimal.NewNullDecimal(amount)
+	}
+
+	return query, nil
 }
 
 // parseQueryParameter parses a query parameter and returns its integer value
@@ -204,94 +377,113 @@ func parseQueryParameter(paramStr, paramName string) (int, error) {
 	return value, nil
 }
 
-// GetThumbnails generates thumbnails in small, medium, and large sizes using ProcessImageConcurrently
-func GetThumbnails(w http.ResponseWriter, r *http.Request) {
-	// Extract user ID from headers
-	userID := r.Header.Get("X-User-ID")
-	if userID == "" {
-		http.Error(w, "X-User-ID header is required", http.StatusBadRequest)
+// GetThumbnails describes the thumbnails of a receipt, one for each configured preset.
+// Thumbnails that are not cached yet are generated concurrently.
+func (h *ReceiptHandler) GetThumbnails(w http.ResponseWriter, r *http.Request) {
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
 		return
 	}
 
 	// Extract the receipt ID from the URL path
 	receiptID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/receipts/"), "/thumbnails")
-	receipt, exists := models.GetReceipt(receiptID)
-	if !exists {
-		http.Error(w, "Receipt not found", http.StatusNotFound)
+	receipt, ok := h.ownedReceipt(w, receiptID, userID, models.StateActive)
+	if !ok {
 		return
 	}
-
-	// Check if the user owns the receipt
-	if receipt.UserID != userID {
-		http.Error(w, "Unauthorized", http.StatusForbidden)
+	page, stitch, ok := requestedPage(w, r, receipt)
+	if !ok {
 		return
 	}
 
-	// Use a WaitGroup to wait for concurrent processing
+	// Generate the missing thumbnails concurrently
+	thumbnails := make([]Thumbnail, len(h.Presets))
+	errs := make([]error, len(h.Presets))
 	var wg sync.WaitGroup
-	wg.Add(3)
-
-	// Channel to collect results
-	resultCh := make(chan services.Result, 3)
-
-	// Process the image concurrently for small, medium, and large sizes
-	go func() {
-		defer wg.Done()
-		img, err := services.ProcessImage(receipt.FilePath, 100, 100) // Small
-		resultCh <- services.Result{Img: img, Err: err}
-	}()
-	go func() {
-		defer wg.Done()
-		img, err := services.ProcessImage(receipt.FilePath, 200, 200) // Medium
-		resultCh <- services.Result{Img: img, Err: err}
-	}()
-	go func() {
-		defer wg.Done()
-		img, err := services.ProcessImage(receipt.FilePath, 400, 400) // Large
-		resultCh <- services.Result{Img: img, Err: err}
-	}()
-
-	// Wait for all processing to complete, then close resultCh
-	go func() {
-		wg.Wait()
-		close(resultCh) // Only close the channel after all the Goroutines are done
-	}()
-
-	// Prepare the response
-	thumbnailResponse := ThumbnailResponse{}
-
-	// Collect results
-	for res := range resultCh {
-		if res.Err != nil {
-			http.Error(w, fmt.Sprintf("Error processing image: %v", res.Err), http.StatusInternalServerError)
+	for i, preset := range h.Presets {
+		preset.Page, preset.Stitch = page, stitch
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := h.ensureRendition(receipt, preset, false)
+			if err == nil {
+				thumbnails[i], err = h.describeRendition(key)
+			}
+			if err == nil {
+				// Thumbnails are never evicted from the cache, so the signed URL stays valid
+				thumbnails[i].DownloadURL, err = h.Blobs.SignedURL(key.BlobKey(), signedURLExpiry)
+			}
+			thumbnails[i].URL = "/receipts/" + url.PathEscape(receipt.ID) + "/thumbnails/" + preset.Name
+			switch {
+			case stitch:
+				thumbnails[i].URL += "?page=all"
+			case page > 1:
+				thumbnails[i].URL += fmt.Sprintf("?page=%d", page)
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+
+	response := make(ThumbnailResponse, len(h.Presets))
+	for i, preset := range h.Presets {
+		if errs[i] != nil {
+			writeRenditionError(w, errs[i])
 			return
 		}
+		response[preset.Name] = thumbnails[i]
+	}
 
-		width := res.Img.Bounds().Dx() // Get the width of the processed image
-		// Save the resized image and determine which size it is based on its dimensions
-		thumbnailPath := filepath.Join("uploads", fmt.Sprintf("%s_%dx%d.jpg", receiptID, res.Img.Bounds().Dx(), res.Img.Bounds().Dy()))
+	// Return the response with thumbnail URLs
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
 
-		// Save the image to the appropriate thumbnail size file
-		if err := services.SaveImage(res.Img, thumbnailPath); err != nil {
-			http.Error(w, fmt.Sprintf("Error saving thumbnail: %v", err), http.StatusInternalServerError)
-			return
-		}
+// GetThumbnail serves the image of one thumbnail preset of a receipt, generating it if it is not cached yet
+func (h *ReceiptHandler) GetThumbnail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-		// Assign the path to the correct field in the response
-		switch {
-		case width <= 100:
-			thumbnailResponse.Small = thumbnailPath
-		case width <= 200:
-			thumbnailResponse.Medium = thumbnailPath
-		case width <= 400:
-			thumbnailResponse.Large = thumbnailPath
-		default:
-			log.Printf("Unexpected image dimensions: %dx%d", res.Img.Bounds().Dx(), res.Img.Bounds().Dy())
-		}
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
 
+	// Extract the receipt ID and the thumbnail size from the URL path
+	receiptID, size, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/receipts/"), "/thumbnails/")
+	preset, ok := h.findPreset(size)
+	if !ok {
+		http.Error(w, "Unknown thumbnail size", http.StatusNotFound)
+		return
+	}
+	receipt, ok := h.ownedReceipt(w, receiptID, userID, models.StateActive)
+	if !ok {
+		return
+	}
+	if preset.Page, preset.Stitch, ok = requestedPage(w, r, receipt); !ok {
+		return
 	}
 
-	// Return the response with thumbnail paths
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(thumbnailResponse)
+	// The preset's format and quality can be overridden per request
+	preset, variant, err := negotiatePreset(r, preset)
+	if err != nil {
+		writeNegotiationError(w, err)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+	blob, info, err := h.openRendition(receipt, preset, variant)
+	if err != nil {
+		writeRenditionError(w, err)
+		return
+	}
+
+	// The rendition key changes with the original, so it identifies this version of the thumbnail
+	w.Header().Set("ETag", renditionETag(info.Key))
+	w.Header().Set("Cache-Control", thumbnailCacheControl)
+	writeBlob(w, r, blob, info)
 }
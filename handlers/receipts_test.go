@@ -1,58 +1,71 @@
 package handlers
 
 import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
 	"net/http"
 	"net/http/httptest"
-	"path/filepath"
+	"os"
+	"receipt-uploader/auth"
 	"receipt-uploader/models"
+	"receipt-uploader/services"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/shopspring/decimal"
 )
 
-// Setup function to create a temporary environment for the test
-func setupTestEnv(t *testing.T) string {
-	tmpDir := t.TempDir()
-	models.ReceiptFile = filepath.Join(tmpDir, "test_receipts.json")
-	models.ReceiptStore = make(map[string]models.Receipt)
-	return tmpDir
+// Setup function to create a handler backed by an in-memory repository and a temporary blob store
+// holding the test image under the key "test.jpg"
+func setupTestEnv(t *testing.T) (*ReceiptHandler, *models.MemoryReceiptRepository) {
+	blobs, err := services.NewFileSystemBlobStore(t.TempDir(), []byte("test-signing-key"))
+	if err != nil {
+		t.Fatalf("Failed to create blob store: %v", err)
+	}
+	image, err := os.Open("../testdata/test.jpg")
+	if err != nil {
+		t.Fatalf("Failed to open test image: %v", err)
+	}
+	defer image.Close()
+	if err := blobs.Put("test.jpg", image, -1, "image/jpeg"); err != nil {
+		t.Fatalf("Failed to store test image: %v", err)
+	}
+
+	repo := models.NewMemoryReceiptRepository()
+	return NewReceiptHandler(repo, blobs), repo
 }
 
-// TestUploadReceipt tests the UploadReceipt handler
-func TestUploadReceipt(t *testing.T) {
-	// Setup the in-memory store for the test and use temporary receipts.json
-	setupTestEnv(t)
-	models.StoreReceipt("1", "/path/to/receipt1.jpg", "test-user")
-
-	t.Run("MissingUserIDHeader", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodPost, "/receipts", strings.NewReader(""))
-		req.Header.Set("Content-Type", "multipart/form-data")
-
-		rr := httptest.NewRecorder()
-
-		UploadReceipt(rr, req)
+// withUser returns the request as it looks after the auth middleware authenticated the user
+func withUser(req *http.Request, userID string) *http.Request {
+	return req.WithContext(auth.WithPrincipal(req.Context(), auth.Principal{UserID: userID, Method: auth.MethodAPIKey}))
+}
 
-		if rr.Code != http.StatusBadRequest {
-			t.Fatalf("Expected status code 400, got %d", rr.Code)
-		}
-	})
+// storeReceipt adds a receipt to the repository for test setup
+func storeReceipt(repo models.ReceiptRepository, id, filePath, userID string) {
+	repo.Create(models.Receipt{ID: id, FilePath: filePath, UserID: userID})
 }
 
 // TestGetReceipt tests the GetReceipt handler
 func TestGetReceipt(t *testing.T) {
-	// Setup in-memory store with some sample receipts and use temporary receipts.json
-	setupTestEnv(t)
-	models.StoreReceipt("1", "../testdata/test.jpg", "test-user")
+	// Setup in-memory store with some sample receipts
+	h, repo := setupTestEnv(t)
+	storeReceipt(repo, "1", "test.jpg", "test-user")
 
 	t.Run("ValidGetReceipt", func(t *testing.T) {
 		// Create a valid GET request
 		req := httptest.NewRequest(http.MethodGet, "/receipts/1", nil)
-		req.Header.Set("X-User-ID", "test-user")
+		req = withUser(req, "test-user")
 
 		// Create a response recorder
 		rr := httptest.NewRecorder()
 
 		// Call the handler
-		GetReceipt(rr, req)
+		h.GetReceipt(rr, req)
 
 		// Check the status code
 		if rr.Code != http.StatusOK {
@@ -60,16 +73,30 @@ func TestGetReceipt(t *testing.T) {
 		}
 	})
 
+	t.Run("LegacyFilePath", func(t *testing.T) {
+		// Receipts uploaded before blob storage recorded their path below the uploads directory
+		storeReceipt(repo, "legacy", "uploads/test.jpg", "test-user")
+		req := httptest.NewRequest(http.MethodGet, "/receipts/legacy", nil)
+		req = withUser(req, "test-user")
+
+		rr := httptest.NewRecorder()
+		h.GetReceipt(rr, req)
+
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("Expected the original to be served, got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+		}
+	})
+
 	t.Run("ReceiptNotFound", func(t *testing.T) {
 		// Create a GET request for a non-existent receipt
 		req := httptest.NewRequest(http.MethodGet, "/receipts/999", nil)
-		req.Header.Set("X-User-ID", "test-user")
+		req = withUser(req, "test-user")
 
 		// Create a response recorder
 		rr := httptest.NewRecorder()
 
 		// Call the handler
-		GetReceipt(rr, req)
+		h.GetReceipt(rr, req)
 
 		// Check the status code
 		if rr.Code != http.StatusNotFound {
@@ -80,13 +107,13 @@ func TestGetReceipt(t *testing.T) {
 	t.Run("UnauthorizedAccess", func(t *testing.T) {
 		// Create a GET request for an existing receipt with a different user
 		req := httptest.NewRequest(http.MethodGet, "/receipts/1", nil)
-		req.Header.Set("X-User-ID", "another-user")
+		req = withUser(req, "another-user")
 
 		// Create a response recorder
 		rr := httptest.NewRecorder()
 
 		// Call the handler
-		GetReceipt(rr, req)
+		h.GetReceipt(rr, req)
 
 		// Check the status code
 		if rr.Code != http.StatusForbidden {
@@ -94,32 +121,32 @@ func TestGetReceipt(t *testing.T) {
 		}
 	})
 
-	t.Run("MissingUserIDHeader", func(t *testing.T) {
-		// Create a GET request with no X-User-ID header
+	t.Run("Unauthenticated", func(t *testing.T) {
+		// Create a GET request without an authenticated user
 		req := httptest.NewRequest(http.MethodGet, "/receipts/1", nil)
 
 		// Create a response recorder
 		rr := httptest.NewRecorder()
 
 		// Call the handler
-		GetReceipt(rr, req)
+		h.GetReceipt(rr, req)
 
 		// Check the status code
-		if rr.Code != http.StatusBadRequest {
-			t.Fatalf("Expected status code 400, got %d", rr.Code)
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status code 401, got %d", rr.Code)
 		}
 	})
 
 	t.Run("ValidImageResize", func(t *testing.T) {
 		// Create a GET request with width and height query parameters
 		req := httptest.NewRequest(http.MethodGet, "/receipts/1?width=100&height=100", nil)
-		req.Header.Set("X-User-ID", "test-user")
+		req = withUser(req, "test-user")
 
 		// Create a response recorder
 		rr := httptest.NewRecorder()
 
 		// Call the handler
-		GetReceipt(rr, req)
+		h.GetReceipt(rr, req)
 
 		// Check the status code
 		if rr.Code != http.StatusOK {
@@ -131,69 +158,608 @@ func TestGetReceipt(t *testing.T) {
 			t.Fatalf("Expected Content-Type image/jpeg, got %s", contentType)
 		}
 	})
+
+	t.Run("ImageResizeEvicted", func(t *testing.T) {
+		// Each variant is evicted by another request right after it is cached
+		store := &evictingBlobStore{BlobStore: h.Blobs}
+		renditions := h.Renditions
+		h.Renditions = services.NewRenditionCache(store, defaultRenditionCacheBytes)
+		defer func() { h.Renditions = renditions }()
+
+		for _, width := range []int{80, 80} {
+			rr := httptest.NewRecorder()
+			h.GetReceipt(rr, withUser(httptest.NewRequest(http.MethodGet, fmt.Sprintf("/receipts/1?width=%d", width), nil), "test-user"))
+			if img, err := imaging.Decode(rr.Body); rr.Code != http.StatusOK || err != nil || img.Bounds().Dx() != width {
+				t.Fatalf("Expected the resized image, got %d, %v", rr.Code, err)
+			}
+		}
+	})
+
+	t.Run("ImageResizeTooLarge", func(t *testing.T) {
+		// A box beyond the decoding limits is refused outright
+		rr := httptest.NewRecorder()
+		h.GetReceipt(rr, withUser(httptest.NewRequest(http.MethodGet, "/receipts/1?width=100000", nil), "test-user"))
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("Expected status code 400, got %d", rr.Code)
+		}
+
+		// A width within them is refused when the aspect ratio makes the image too large
+		rr = httptest.NewRecorder()
+		h.GetReceipt(rr, withUser(httptest.NewRequest(http.MethodGet, "/receipts/1?width=19000", nil), "test-user"))
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("Expected status code 422, got %d", rr.Code)
+		}
+	})
+
+	t.Run("FormatNegotiation", func(t *testing.T) {
+		get := func(target, accept string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req = withUser(req, "test-user")
+			if accept != "" {
+				req.Header.Set("Accept", accept)
+			}
+			rr := httptest.NewRecorder()
+			h.GetReceipt(rr, req)
+			return rr
+		}
+
+		for _, test := range []struct {
+			target, accept, contentType string
+		}{
+			{"/receipts/1?width=100&format=png", "", "image/png"},
+			{"/receipts/1?width=100&format=gif", "", "image/gif"},
+			{"/receipts/1?width=100&quality=30", "", "image/jpeg"},
+			{"/receipts/1?width=100", "image/webp,image/*;q=0.8", "image/webp"},
+			{"/receipts/1?format=webp", "", "image/webp"},
+		} {
+			rr := get(test.target, test.accept)
+			if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != test.contentType {
+				t.Fatalf("Expected %s for %s, got %d %s", test.contentType, test.target, rr.Code, rr.Header().Get("Content-Type"))
+			}
+			if rr.Header().Get("Vary") != "Accept" {
+				t.Fatalf("Expected Vary: Accept for %s, got %q", test.target, rr.Header().Get("Vary"))
+			}
+		}
+
+		if rr := get("/receipts/1?width=100&format=bmp", ""); rr.Code != http.StatusBadRequest {
+			t.Fatalf("Expected status code 400, got %d", rr.Code)
+		}
+		if rr := get("/receipts/1?width=100", "application/pdf"); rr.Code != http.StatusNotAcceptable {
+			t.Fatalf("Expected status code 406, got %d", rr.Code)
+		}
+	})
+
+	t.Run("CachedImageResize", func(t *testing.T) {
+		// A receipt with its own copy of the original, which is removed after the first request
+		original, _, _ := h.Blobs.Get("test.jpg")
+		h.Blobs.Put("cached.jpg", original, -1, "image/jpeg")
+		original.Close()
+		repo.Create(models.Receipt{ID: "cached", FilePath: "cached.jpg", ContentHash: strings.Repeat("cd", 32), UserID: "test-user"})
+
+		get := func() *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/receipts/cached?width=120", nil)
+			req = withUser(req, "test-user")
+			rr := httptest.NewRecorder()
+			h.GetReceipt(rr, req)
+			return rr
+		}
+
+		first := get()
+		if first.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", first.Code)
+		}
+		if renditions, _ := h.Blobs.List("renditions/cached/"); len(renditions) != 1 {
+			t.Fatalf("Expected the resized image to be cached, got %v", renditions)
+		}
+
+		// The second request is served from the cache without reading the original
+		h.Blobs.Delete("cached.jpg")
+		second := get()
+		if second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+			t.Fatalf("Expected the cached image, got status code %d", second.Code)
+		}
+	})
+}
+
+// evictingBlobStore deletes each rendition right after it is stored, as a concurrent request evicting it would
+type evictingBlobStore struct {
+	services.BlobStore
+}
+
+func (s *evictingBlobStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	if err := s.BlobStore.Put(key, r, size, contentType); err != nil {
+		return err
+	}
+	if strings.HasPrefix(key, "renditions/") {
+		return s.BlobStore.Delete(key)
+	}
+	return nil
+}
+
+// TestGetThumbnails tests generating, caching and describing a receipt's thumbnails
+func TestGetThumbnails(t *testing.T) {
+	h, repo := setupTestEnv(t)
+	storeReceipt(repo, "1", "test.jpg", "test-user")
+
+	get := func(t *testing.T) ThumbnailResponse {
+		req := httptest.NewRequest(http.MethodGet, "/receipts/1/thumbnails", nil)
+		req = withUser(req, "test-user")
+		rr := httptest.NewRecorder()
+		h.GetThumbnails(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", rr.Code)
+		}
+		var response ThumbnailResponse
+		json.NewDecoder(rr.Body).Decode(&response)
+		return response
+	}
+
+	first := get(t)
+	if len(first) != 3 {
+		t.Fatalf("Expected a thumbnail for each default preset, got %+v", first)
+	}
+	for size, thumbnail := range first {
+		if thumbnail.URL != "/receipts/1/thumbnails/"+size {
+			t.Fatalf("Expected the %s thumbnail URL, got %s", size, thumbnail.URL)
+		}
+		if thumbnail.Width == 0 || thumbnail.Height == 0 || thumbnail.Size == 0 || thumbnail.ContentType != "image/jpeg" {
+			t.Fatalf("Expected dimensions, size and content type of the %s thumbnail, got %+v", size, thumbnail)
+		}
+	}
+	if first["small"].Width > 100 || first["small"].Height > 100 || first["large"].Width <= first["medium"].Width {
+		t.Fatalf("Expected thumbnails fitted into their sizes, got %+v", first)
+	}
+
+	// Cached thumbnails are not generated again
+	renditions, _ := h.Blobs.List("renditions/1/")
+	// Signed download URLs expire relative to the request, so they are compared separately
+	second := get(t)
+	for _, thumbnails := range []ThumbnailResponse{first, second} {
+		for size, thumbnail := range thumbnails {
+			if !strings.HasPrefix(thumbnail.DownloadURL, "/blobs/renditions/1/") {
+				t.Fatalf("Expected a signed download URL of the %s thumbnail, got %q", size, thumbnail.DownloadURL)
+			}
+			thumbnail.DownloadURL = ""
+			thumbnails[size] = thumbnail
+		}
+	}
+	if !reflect.DeepEqual(second, first) {
+		t.Fatalf("Expected the same thumbnails, got %+v and %+v", first, second)
+	}
+	for _, rendition := range renditions {
+		if again, _ := h.Blobs.Stat(rendition.Key); !again.ModTime.Equal(rendition.ModTime) {
+			t.Fatalf("Expected %s not to be rewritten", rendition.Key)
+		}
+	}
+}
+
+// TestConfiguredPresets tests that the thumbnail endpoints follow the configured presets
+func TestConfiguredPresets(t *testing.T) {
+	h, repo := setupTestEnv(t)
+	storeReceipt(repo, "1", "test.jpg", "test-user")
+	h.Presets = []services.RenditionPreset{
+		{Name: "square", Width: 64, Height: 64, Fit: services.FitCover, Format: services.FormatPNG},
+		{Name: "scan", Height: 120, Fit: services.FitContain, Format: services.FormatPNG, Enhance: true},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/receipts/1/thumbnails", nil)
+	req = withUser(req, "test-user")
+	rr := httptest.NewRecorder()
+	h.GetThumbnails(rr, req)
+
+	var response ThumbnailResponse
+	json.NewDecoder(rr.Body).Decode(&response)
+	square, ok := response["square"]
+	if len(response) != 2 || !ok || square.Width != 64 || square.Height != 64 || square.ContentType != "image/png" {
+		t.Fatalf("Expected the 64x64 PNG square thumbnail, got %+v", response)
+	}
+
+	// The enhanced scan is an additional rendition; the original is left untouched
+	if scan, ok := response["scan"]; !ok || scan.Height > 120 || scan.ContentType != "image/png" {
+		t.Fatalf("Expected the enhanced scan, got %+v", response)
+	}
+	if _, err := h.Blobs.Stat("test.jpg"); err != nil {
+		t.Fatalf("Expected the original to be kept, got %v", err)
+	}
+
+	// Presets that are not configured are not served
+	for target, expected := range map[string]int{"/receipts/1/thumbnails/square": http.StatusOK, "/receipts/1/thumbnails/scan": http.StatusOK, "/receipts/1/thumbnails/small": http.StatusNotFound} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req = withUser(req, "test-user")
+		rr := httptest.NewRecorder()
+		h.GetThumbnail(rr, req)
+		if rr.Code != expected {
+			t.Fatalf("Expected status code %d for %s, got %d", expected, target, rr.Code)
+		}
+	}
+}
+
+// TestGetThumbnail tests serving the image of a single thumbnail size
+func TestGetThumbnail(t *testing.T) {
+	h, repo := setupTestEnv(t)
+	storeReceipt(repo, "1", "test.jpg", "test-user")
+
+	get := func(target, userID string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req = withUser(req, userID)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		h.GetThumbnail(rr, req)
+		return rr
+	}
+
+	t.Run("ValidThumbnail", func(t *testing.T) {
+		rr := get("/receipts/1/thumbnails/medium", "test-user", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", rr.Code)
+		}
+		if contentType := rr.Header().Get("Content-Type"); contentType != "image/jpeg" {
+			t.Fatalf("Expected Content-Type image/jpeg, got %s", contentType)
+		}
+		if rr.Header().Get("ETag") == "" || !strings.HasPrefix(rr.Header().Get("Cache-Control"), "private") {
+			t.Fatalf("Expected caching headers, got %v", rr.Header())
+		}
+
+		// A client holding the current thumbnail does not download it again
+		etag := rr.Header().Get("ETag")
+		if rr := get("/receipts/1/thumbnails/medium", "test-user", http.Header{"If-None-Match": {etag}}); rr.Code != http.StatusNotModified {
+			t.Fatalf("Expected status code 304, got %d", rr.Code)
+		}
+	})
+
+	t.Run("FormatOverride", func(t *testing.T) {
+		rr := get("/receipts/1/thumbnails/medium?format=webp", "test-user", nil)
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/webp" {
+			t.Fatalf("Expected a WebP thumbnail, got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+		}
+
+		// Overrides are cached as variants, apart from the preset itself
+		if variants, _ := h.Blobs.List("renditions/1/"); len(variants) != 2 {
+			t.Fatalf("Expected the preset and its WebP variant to be cached, got %v", variants)
+		}
+	})
+
+	t.Run("ImageTooLarge", func(t *testing.T) {
+		// Originals stored before the limits were lowered are not decoded
+		decoder := h.Decoder
+		h.Decoder = services.NewImageDecoder(services.DecodeLimits{MaxDimension: 2000}, 1)
+		defer func() { h.Decoder = decoder }()
+
+		if rr := get("/receipts/1/thumbnails/large", "test-user", nil); rr.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("Expected status code 422, got %d", rr.Code)
+		}
+	})
+
+	t.Run("UnknownSize", func(t *testing.T) {
+		if rr := get("/receipts/1/thumbnails/huge", "test-user", nil); rr.Code != http.StatusNotFound {
+			t.Fatalf("Expected status code 404, got %d", rr.Code)
+		}
+	})
+
+	t.Run("UnauthorizedAccess", func(t *testing.T) {
+		if rr := get("/receipts/1/thumbnails/small", "another-user", nil); rr.Code != http.StatusForbidden {
+			t.Fatalf("Expected status code 403, got %d", rr.Code)
+		}
+	})
+}
+
+// stubRasterizer renders page n of any PDF document as a white page 100*n pixels wide with a line of text
+type stubRasterizer struct {
+	pages int
+}
+
+func (s stubRasterizer) PageCount(path string) (int, error) {
+	if data, err := os.ReadFile(path); err != nil || !services.IsPDF(data) {
+		return 0, fmt.Errorf("not a PDF document")
+	}
+	return s.pages, nil
+}
+
+func (s stubRasterizer) RasterizePage(path string, page int) (image.Image, error) {
+	img := imaging.New(100*page, 300, color.White)
+	return imaging.Paste(img, imaging.New(50*page, 8, color.Black), image.Pt(10, 20)), nil
+}
+
+// TestPDFReceipts tests uploading a PDF receipt and fetching its pages
+func TestPDFReceipts(t *testing.T) {
+	h, _ := setupTestEnv(t)
+	h.Decoder.Rasterizer = stubRasterizer{pages: 2}
+
+	rr := httptest.NewRecorder()
+	h.UploadReceipt(rr, newUploadRequest(t, "receipt.pdf"))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	result := decodeUploadResponse(t, rr).Results[0]
+	receipt, _ := h.Receipts.Get(result.ReceiptID)
+	if result.ContentType != "application/pdf" || receipt.PageCount != 2 || receipt.PerceptualHash == "" || result.Quality != nil {
+		t.Fatalf("Expected a two page PDF receipt with a hash of its first page, got %+v and %+v", result, receipt)
+	}
+
+	get := func(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler(rr, withUser(httptest.NewRequest(http.MethodGet, target, nil), "test-user"))
+		return rr
+	}
+	size := func(t *testing.T, rr *httptest.ResponseRecorder) image.Point {
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		config, _, err := image.DecodeConfig(rr.Body)
+		if err != nil {
+			t.Fatalf("Expected an image, got %v", err)
+		}
+		return image.Pt(config.Width, config.Height)
+	}
+
+	t.Run("Original", func(t *testing.T) {
+		rr := get(h.GetReceipt, "/receipts/"+receipt.ID)
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/pdf" {
+			t.Fatalf("Expected the PDF document, got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+		}
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		// Page one unless another is selected
+		if got := size(t, get(h.GetReceipt, "/receipts/"+receipt.ID+"?width=50")); got != image.Pt(50, 150) {
+			t.Fatalf("Expected page 1 resized to 50x150, got %v", got)
+		}
+		if got := size(t, get(h.GetReceipt, "/receipts/"+receipt.ID+"?page=2")); got != image.Pt(200, 300) {
+			t.Fatalf("Expected page 2 at its rasterized size, got %v", got)
+		}
+		if rr := get(h.GetReceipt, "/receipts/"+receipt.ID+"?width=50&page=2"); rr.Header().Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("Expected a JPEG page, got %s", rr.Header().Get("Content-Type"))
+		}
+	})
+
+	t.Run("Thumbnails", func(t *testing.T) {
+		if got := size(t, get(h.GetThumbnail, "/receipts/"+receipt.ID+"/thumbnails/small")); got != image.Pt(33, 100) {
+			t.Fatalf("Expected a thumbnail of page 1, got %v", got)
+		}
+		if got := size(t, get(h.GetThumbnail, "/receipts/"+receipt.ID+"/thumbnails/small?page=2")); got != image.Pt(66, 100) {
+			t.Fatalf("Expected a thumbnail of page 2, got %v", got)
+		}
+
+		rr := get(h.GetThumbnails, "/receipts/"+receipt.ID+"/thumbnails?page=2")
+		var thumbnails ThumbnailResponse
+		json.NewDecoder(rr.Body).Decode(&thumbnails)
+		if rr.Code != http.StatusOK || thumbnails["medium"].Width != 133 || !strings.HasSuffix(thumbnails["medium"].URL, "/thumbnails/medium?page=2") {
+			t.Fatalf("Expected the thumbnails of page 2, got %d %+v", rr.Code, thumbnails)
+		}
+	})
+
+	t.Run("PageNotFound", func(t *testing.T) {
+		// Images have a single page, whether or not their page count was recorded
+		h.Receipts.Create(models.Receipt{ID: "photo", FilePath: "test.jpg", UserID: "test-user", PageCount: 1})
+		h.Receipts.Create(models.Receipt{ID: "legacy", FilePath: "test.jpg", UserID: "test-user"})
+		for _, target := range []string{"/receipts/" + receipt.ID + "?page=3", "/receipts/photo?page=2", "/receipts/legacy?width=50&page=2"} {
+			if rr := get(h.GetReceipt, target); rr.Code != http.StatusNotFound {
+				t.Fatalf("Expected status code 404 for %s, got %d", target, rr.Code)
+			}
+		}
+		if rr := get(h.GetThumbnail, "/receipts/"+receipt.ID+"/thumbnails/small?page=3"); rr.Code != http.StatusNotFound {
+			t.Fatalf("Expected status code 404, got %d", rr.Code)
+		}
+		if rr := get(h.GetReceipt, "/receipts/"+receipt.ID+"?page=two"); rr.Code != http.StatusBadRequest {
+			t.Fatalf("Expected status code 400, got %d", rr.Code)
+		}
+	})
 }
 
 // TestListReceipts tests the ListReceipts handler
 func TestListReceipts(t *testing.T) {
-	// Setup some sample receipts in the in-memory store and use temporary receipts.json
-	setupTestEnv(t)
-	models.StoreReceipt("1", "/path/to/receipt1.jpg", "test-user")
-	models.StoreReceipt("2", "/path/to/receipt2.jpg", "test-user")
-	models.StoreReceipt("3", "/path/to/receipt3.jpg", "another-user")
+	// Setup some sample receipts in the in-memory store
+	h, repo := setupTestEnv(t)
+	storeReceipt(repo, "1", "/path/to/receipt1.jpg", "test-user")
+	storeReceipt(repo, "2", "/path/to/receipt2.jpg", "test-user")
+	storeReceipt(repo, "3", "/path/to/receipt3.jpg", "another-user")
+
+	// Give one receipt some metadata
+	receipt, _ := repo.Get("2")
+	receipt.Merchant = "Corner Shop"
+	receipt.Total = decimal.NewNullDecimal(decimal.RequireFromString("9.99"))
+	repo.Update(receipt)
 
 	t.Run("ValidListReceipts", func(t *testing.T) {
-		// Create a GET request for listing receipts for the test-user
-		req := httptest.NewRequest(http.MethodGet, "/receipts", nil)
-		req.Header.Set("X-User-ID", "test-user")
+		// Create a GET request for listing receipts for the test-user, oldest first
+		req := httptest.NewRequest(http.MethodGet, "/receipts?order=asc", nil)
+		req = withUser(req, "test-user")
 
 		// Create a response recorder
 		rr := httptest.NewRecorder()
 
 		// Call the handler
-		ListReceipts(rr, req)
+		h.ListReceipts(rr, req)
 
 		// Check the status code
 		if rr.Code != http.StatusOK {
 			t.Fatalf("Expected status code 200, got %d", rr.Code)
 		}
 
-		// Optionally, check the response body for expected JSON structure
-		expected := `[{"ID":"1","FilePath":"/path/to/receipt1.jpg","UserID":"test-user"},{"ID":"2","FilePath":"/path/to/receipt2.jpg","UserID":"test-user"}]`
-		if strings.TrimSpace(rr.Body.String()) != expected {
-			t.Fatalf("Expected JSON: %s, got: %s", expected, rr.Body.String())
+		// Check the response body contains the user's receipts with their metadata
+		var response ReceiptListResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatalf("Expected JSON list of receipts, got error: %v", err)
+		}
+		receipts := response.Receipts
+		if len(receipts) != 2 || receipts[0].ID != "1" || receipts[1].ID != "2" {
+			t.Fatalf("Expected receipts 1 and 2, got: %+v", receipts)
+		}
+		if receipts[1].Merchant != "Corner Shop" || receipts[1].Total.Decimal.String() != "9.99" {
+			t.Fatalf("Expected receipt metadata in the list, got: %+v", receipts[1])
 		}
 	})
 
 	t.Run("NoReceiptsForUser", func(t *testing.T) {
 		// Create a GET request for a user with no receipts
 		req := httptest.NewRequest(http.MethodGet, "/receipts", nil)
-		req.Header.Set("X-User-ID", "empty-user")
+		req = withUser(req, "empty-user")
 
 		// Create a response recorder
 		rr := httptest.NewRecorder()
 
 		// Call the handler
-		ListReceipts(rr, req)
+		h.ListReceipts(rr, req)
 
-		// Check the status code
-		if rr.Code != http.StatusNotFound {
-			t.Fatalf("Expected status code 404, got %d", rr.Code)
+		// Check the status code and that an empty list is returned
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", rr.Code)
+		}
+		if strings.TrimSpace(rr.Body.String()) != `{"receipts":[]}` {
+			t.Fatalf("Expected empty list, got %s", rr.Body.String())
+		}
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		// Request one receipt per page, oldest first
+		req := httptest.NewRequest(http.MethodGet, "/receipts?limit=1&order=asc", nil)
+		req = withUser(req, "test-user")
+		rr := httptest.NewRecorder()
+		h.ListReceipts(rr, req)
+
+		var first ReceiptListResponse
+		json.NewDecoder(rr.Body).Decode(&first)
+		if len(first.Receipts) != 1 || first.Receipts[0].ID != "1" || first.NextCursor == "" {
+			t.Fatalf("Expected first page with receipt 1 and a cursor, got %+v", first)
+		}
+
+		// Follow the cursor to the second and last page
+		req = httptest.NewRequest(http.MethodGet, "/receipts?limit=1&order=asc&cursor="+first.NextCursor, nil)
+		req = withUser(req, "test-user")
+		rr = httptest.NewRecorder()
+		h.ListReceipts(rr, req)
+
+		var second ReceiptListResponse
+		json.NewDecoder(rr.Body).Decode(&second)
+		if len(second.Receipts) != 1 || second.Receipts[0].ID != "2" || second.NextCursor != "" {
+			t.Fatalf("Expected last page with receipt 2, got %+v", second)
+		}
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/receipts?merchant=corner&min_total=5&sort=total", nil)
+		req = withUser(req, "test-user")
+		rr := httptest.NewRecorder()
+		h.ListReceipts(rr, req)
+
+		var response ReceiptListResponse
+		json.NewDecoder(rr.Body).Decode(&response)
+		if rr.Code != http.StatusOK || len(response.Receipts) != 1 || response.Receipts[0].ID != "2" {
+			t.Fatalf("Expected only receipt 2, got %d: %+v", rr.Code, response)
 		}
 	})
 
-	t.Run("MissingUserIDHeader", func(t *testing.T) {
-		// Create a GET request with no X-User-ID header
+	t.Run("InvalidParameters", func(t *testing.T) {
+		for _, query := range []string{"limit=1000", "sort=merchant", "order=up", "from=yesterday", "min_total=-1", "cursor=bogus"} {
+			req := httptest.NewRequest(http.MethodGet, "/receipts?"+query, nil)
+			req = withUser(req, "test-user")
+			rr := httptest.NewRecorder()
+			h.ListReceipts(rr, req)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("Expected status code 400 for %s, got %d", query, rr.Code)
+			}
+		}
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		// Create a GET request without an authenticated user
 		req := httptest.NewRequest(http.MethodGet, "/receipts", nil)
 
 		// Create a response recorder
 		rr := httptest.NewRecorder()
 
 		// Call the handler
-		ListReceipts(rr, req)
+		h.ListReceipts(rr, req)
 
 		// Check the status code
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status code 401, got %d", rr.Code)
+		}
+	})
+}
+
+// TestPatchReceipt tests the PatchReceipt handler
+func TestPatchReceipt(t *testing.T) {
+	// Setup in-memory store with a sample receipt
+	h, repo := setupTestEnv(t)
+	storeReceipt(repo, "1", "test.jpg", "test-user")
+
+	t.Run("ValidPatch", func(t *testing.T) {
+		body := `{"Merchant": "Corner Shop", "TransactionDate": "2024-04-30", "Total": "12.40", "Currency": "eur",
+			"TaxLines": [{"Name": "VAT", "Rate": "24", "Amount": "2.40"}], "Category": "groceries"}`
+		req := httptest.NewRequest(http.MethodPatch, "/receipts/1", strings.NewReader(body))
+		req = withUser(req, "test-user")
+
+		rr := httptest.NewRecorder()
+		h.PatchReceipt(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+
+		// The change must be persisted in the repository
+		receipt, _ := repo.Get("1")
+		if receipt.Merchant != "Corner Shop" || receipt.Currency != "EUR" || len(receipt.TaxLines) != 1 {
+			t.Fatalf("Receipt was not updated correctly: %+v", receipt)
+		}
+		if receipt.FilePath != "test.jpg" {
+			t.Fatalf("Expected file path to be unchanged, got %s", receipt.FilePath)
+		}
+	})
+
+	t.Run("ClearTotal", func(t *testing.T) {
+		// Null clears the total while leaving out a field keeps it
+		req := withUser(httptest.NewRequest(http.MethodPatch, "/receipts/1", strings.NewReader(`{"Total": null}`)), "test-user")
+		rr := httptest.NewRecorder()
+		h.PatchReceipt(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if receipt, _ := repo.Get("1"); receipt.Total.Valid || receipt.Merchant != "Corner Shop" {
+			t.Fatalf("Expected only the total to be cleared, got %+v", receipt)
+		}
+	})
+
+	t.Run("InvalidField", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPatch, "/receipts/1", strings.NewReader(`{"Total": "-5"}`))
+		req = withUser(req, "test-user")
+
+		rr := httptest.NewRecorder()
+		h.PatchReceipt(rr, req)
+
 		if rr.Code != http.StatusBadRequest {
 			t.Fatalf("Expected status code 400, got %d", rr.Code)
 		}
+		if !strings.Contains(rr.Body.String(), "Total") {
+			t.Fatalf("Expected error to name the invalid field, got %s", rr.Body.String())
+		}
+	})
+
+	t.Run("UnknownField", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPatch, "/receipts/1", strings.NewReader(`{"FilePath": "/etc/passwd"}`))
+		req = withUser(req, "test-user")
+
+		rr := httptest.NewRecorder()
+		h.PatchReceipt(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("Expected status code 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("UnauthorizedAccess", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPatch, "/receipts/1", strings.NewReader(`{"Notes": "mine now"}`))
+		req = withUser(req, "another-user")
+
+		rr := httptest.NewRecorder()
+		h.PatchReceipt(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("Expected status code 403, got %d", rr.Code)
+		}
 	})
 }
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"receipt-uploader/models"
+	"receipt-uploader/services"
+	"strings"
+	"time"
+)
+
+// Thumbnails are fetched with credentials, so only the client may cache them.
+// Clients revalidate with the ETag after a day in case the original was replaced.
+const thumbnailCacheControl = "private, max-age=86400"
+
+// Default size budget of the cached arbitrary width/height variants
+const defaultRenditionCacheBytes = 256 << 20
+
+// Default number of images decoded at the same time
+const defaultDecodeConcurrency = 4
+
+// findPreset looks up a configured rendition preset by name
+func (h *ReceiptHandler) findPreset(name string) (services.RenditionPreset, bool) {
+	for _, preset := range h.Presets {
+		if preset.Name == name {
+			return preset, true
+		}
+	}
+	return services.RenditionPreset{}, false
+}
+
+// renditionETag returns the entity tag of a cached rendition. Renditions are never rewritten in place,
+// since a changed original gets a new blob key, so the key identifies the bytes.
+func renditionETag(blobKey string) string {
+	sum := sha256.Sum256([]byte(blobKey))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// renditionVersion identifies the originals a receipt's renditions are generated from, the preset settings
+// and the metadata policy. Changing any of them, or adding, moving or removing a page, makes every cached
+// rendition of the receipt stale.
+func (h *ReceiptHandler) renditionVersion(receipt models.Receipt) (string, error) {
+	presets := services.PresetsFingerprint(h.Presets, h.Metadata)
+	files := receipt.Files()
+	originals := make([]string, len(files))
+	for i, file := range files {
+		if file.ContentHash != "" {
+			originals[i] = file.ContentHash
+			continue
+		}
+
+		// Originals stored before content addressing are identified by their size and modification time
+		info, err := h.Blobs.Stat(services.OriginalKey(file.FilePath))
+		if err != nil {
+			return "", err
+		}
+		originals[i] = fmt.Sprintf("%x-%x", info.Size, info.ModTime.UnixNano())
+	}
+	if len(originals) == 1 {
+		return originals[0] + "-" + presets, nil
+	}
+
+	// The pages are identified together and in order
+	sum := sha256.Sum256([]byte(strings.Join(originals, ",")))
+	return hex.EncodeToString(sum[:8]) + "-" + presets, nil
+}
+
+// renditionKey returns the cache key of a receipt's rendition.
+// Variants are requested with arbitrary settings, so their key also records the quality.
+// Renditions of later pages record the page, and stitched renditions of all pages are marked as such.
+func (h *ReceiptHandler) renditionKey(receipt models.Receipt, preset services.RenditionPreset, variant bool) (services.RenditionKey, error) {
+	version, err := h.renditionVersion(receipt)
+	if err != nil {
+		return services.RenditionKey{}, err
+	}
+	key := services.RenditionKey{ReceiptID: receipt.ID, Version: version, Size: preset.Name, Format: preset.Extension(), Variant: variant}
+	if variant && preset.Quality > 0 {
+		key.Size += fmt.Sprintf("-q%d", preset.Quality)
+	}
+	switch {
+	case preset.Stitch:
+		key.Size += "-all"
+	case preset.Page > 1:
+		key.Size += fmt.Sprintf("-p%d", preset.Page)
+	}
+	return key, nil
+}
+
+// ensureRendition returns the key of a receipt's rendition, generating and caching it first if it is not cached yet
+func (h *ReceiptHandler) ensureRendition(receipt models.Receipt, preset services.RenditionPreset, variant bool) (services.RenditionKey, error) {
+	key, _, err := h.generateRendition(receipt, preset, variant)
+	return key, err
+}
+
+// generateRendition returns the key of a receipt's rendition and, if it was not cached yet, the bytes it generated and cached
+func (h *ReceiptHandler) generateRendition(receipt models.Receipt, preset services.RenditionPreset, variant bool) (services.RenditionKey, []byte, error) {
+	key, err := h.renditionKey(receipt, preset, variant)
+	if err != nil {
+		return key, nil, err
+	}
+
+	// Concurrent requests for the same rendition generate it only once
+	unlock := h.renditionLocks.Lock(key.BlobKey())
+	defer unlock()
+
+	if _, err := h.Renditions.Stat(key); err == nil || !errors.Is(err, services.ErrBlobNotFound) {
+		return key, nil, err
+	}
+
+	var data []byte
+	if preset.Stitch {
+		data, err = services.RenderStitched(h.Blobs, pageSources(receipt), preset, h.Decoder)
+	} else {
+		// A page of a receipt photographed in parts is the first page of its own original
+		var file models.PageFile
+		file, preset.Page = receipt.FileOfPage(max(preset.Page, 1))
+		data, err = services.Render(h.Blobs, services.OriginalKey(file.FilePath), preset, h.Metadata, h.Decoder)
+	}
+	if err != nil {
+		return key, nil, err
+	}
+	return key, data, h.Renditions.Put(key, data, preset.ContentType())
+}
+
+// pageSources lists every page of a receipt in order: the first page of each of its originals,
+// or the pages of its only original
+func pageSources(receipt models.Receipt) []services.PageSource {
+	if len(receipt.Pages) > 0 {
+		sources := make([]services.PageSource, len(receipt.Pages))
+		for i, file := range receipt.Pages {
+			sources[i] = services.PageSource{Key: services.OriginalKey(file.FilePath), Page: 1}
+		}
+		return sources
+	}
+
+	// Receipts uploaded before page counts were recorded have at least one page
+	sources := make([]services.PageSource, max(receipt.PageCount, 1))
+	for i := range sources {
+		sources[i] = services.PageSource{Key: services.OriginalKey(receipt.FilePath), Page: i + 1}
+	}
+	return sources
+}
+
+// openRendition opens a receipt's rendition, generating it on a cache miss
+func (h *ReceiptHandler) openRendition(receipt models.Receipt, preset services.RenditionPreset, variant bool) (io.ReadCloser, services.BlobInfo, error) {
+	key, err := h.renditionKey(receipt, preset, variant)
+	if err != nil {
+		return nil, services.BlobInfo{}, err
+	}
+
+	// Cache hits skip the lock
+	blob, info, err := h.Renditions.Get(key)
+	if !errors.Is(err, services.ErrBlobNotFound) {
+		return blob, info, err
+	}
+
+	// A variant can be evicted by a concurrent Put between generating or finding it and opening it,
+	// so the freshly generated bytes are served directly and a rendition found cached is looked up once more
+	for attempt := 0; ; attempt++ {
+		key, data, err := h.generateRendition(receipt, preset, variant)
+		if err != nil {
+			return nil, services.BlobInfo{}, err
+		}
+		if data != nil {
+			info := services.BlobInfo{Key: key.BlobKey(), Size: int64(len(data)), ContentType: preset.ContentType(), ModTime: time.Now()}
+			return readSeekNopCloser{bytes.NewReader(data)}, info, nil
+		}
+		blob, info, err = h.Renditions.Get(key)
+		if !errors.Is(err, services.ErrBlobNotFound) || attempt > 0 {
+			return blob, info, err
+		}
+	}
+}
+
+// readSeekNopCloser serves bytes in memory like an opened blob, so range requests still work
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+// Close does nothing
+func (readSeekNopCloser) Close() error {
+	return nil
+}
+
+// requestedPage reads the page query parameter, numbered from 1 or "all" for a stitched rendition of every page,
+// and writes an error response if it is invalid or beyond the receipt's last page
+func requestedPage(w http.ResponseWriter, r *http.Request, receipt models.Receipt) (page int, stitch bool, ok bool) {
+	if r.URL.Query().Get("page") == "all" {
+		return 0, true, true
+	}
+	page, err := parseQueryParameter(r.URL.Query().Get("page"), "page")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, false, false
+	}
+	page = max(page, 1)
+
+	// Receipts uploaded before page counts were recorded are checked when the page is rendered
+	if receipt.PageCount > 0 && page > receipt.PageCount {
+		http.Error(w, "Page not found", http.StatusNotFound)
+		return 0, false, false
+	}
+	return page, false, true
+}
+
+// writeRenditionError writes the response for an error returned while generating a rendition
+func writeRenditionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrImageTooLarge):
+		http.Error(w, "Image is too large to process", http.StatusUnprocessableEntity)
+	case errors.Is(err, services.ErrPageNotFound):
+		http.Error(w, "Page not found", http.StatusNotFound)
+	case errors.Is(err, services.ErrPDFUnsupported):
+		http.Error(w, "PDF receipts cannot be rendered on this server", http.StatusUnprocessableEntity)
+	default:
+		log.Println("Error generating rendition:", err)
+		http.Error(w, "Could not process image", http.StatusInternalServerError)
+	}
+}
+
+// describeRendition reads the dimensions and size of a cached rendition
+func (h *ReceiptHandler) describeRendition(key services.RenditionKey) (Thumbnail, error) {
+	blob, info, err := h.Renditions.Get(key)
+	if err != nil {
+		return Thumbnail{}, err
+	}
+	defer blob.Close()
+
+	// Only the image header is decoded
+	config, _, err := image.DecodeConfig(blob)
+	if err != nil {
+		return Thumbnail{}, err
+	}
+	return Thumbnail{Width: config.Width, Height: config.Height, Size: info.Size, ContentType: info.ContentType}, nil
+}
@@ -0,0 +1,414 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"receipt-uploader/services"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version and extensions of the tus resumable upload protocol (https://tus.io) the upload endpoints implement
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+)
+
+// Default time after which abandoned resumable uploads are deleted
+const defaultResumableExpiry = 24 * time.Hour
+
+// UploadProgress describes a resumable upload
+type UploadProgress struct {
+	ID        string    `json:"id"`
+	FileName  string    `json:"file_name,omitempty"`  // From the filename metadata of the upload
+	Offset    int64     `json:"offset"`               // Bytes received so far
+	Length    int64     `json:"length"`               // Size of the complete file in bytes
+	Expires   time.Time `json:"expires"`              // When the upload is deleted unless it changes before
+	ReceiptID string    `json:"receipt_id,omitempty"` // Receipt created from the complete file, empty until then
+}
+
+// UploadOptions describes the tus protocol support of the server
+func (h *ReceiptHandler) UploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if h.MaxFileBytes > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.MaxFileBytes, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload starts a resumable upload of a receipt file of the length given in the Upload-Length header.
+// The filename and duplicates entries of the Upload-Metadata header are used when the receipt is created.
+func (h *ReceiptHandler) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tusRequest(w, r) {
+		return
+	}
+
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+
+	// The length must be known up front so it can be checked against the size limit
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		http.Error(w, "Upload-Length must be a positive number of bytes", http.StatusBadRequest)
+		return
+	}
+	if h.MaxFileBytes > 0 && length > h.MaxFileBytes {
+		http.Error(w, fmt.Sprintf("Upload too large: %d bytes, at most %d bytes allowed", length, h.MaxFileBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid Upload-Metadata: %v", err), http.StatusBadRequest)
+		return
+	}
+	switch metadata["duplicates"] {
+	case "", duplicatesExisting, duplicatesReject, duplicatesAllow:
+	default:
+		http.Error(w, "Invalid duplicates metadata: must be existing, reject or allow", http.StatusBadRequest)
+		return
+	}
+
+	upload, err := h.Resumable.Create(userID, length, metadata)
+	if err != nil {
+		log.Println("Error creating upload:", err)
+		http.Error(w, "Could not create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/uploads/"+upload.ID)
+	w.Header().Set("Upload-Expires", h.Resumable.Expires(upload).Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HeadUpload reports how many bytes of a resumable upload of the user have been received in the Upload-Offset header
+func (h *ReceiptHandler) HeadUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tusRequest(w, r) {
+		return
+	}
+
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	upload, ok := h.ownedUpload(w, strings.TrimPrefix(r.URL.Path, "/uploads/"), userID)
+	if !ok {
+		return
+	}
+
+	// The offset changes with every chunk
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", h.Resumable.Expires(upload).Format(http.TimeFormat))
+	if len(upload.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatUploadMetadata(upload.Metadata))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetUpload describes a resumable upload of the user, including the receipt created once it is complete
+func (h *ReceiptHandler) GetUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	upload, ok := h.ownedUpload(w, strings.TrimPrefix(r.URL.Path, "/uploads/"), userID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UploadProgress{
+		ID:        upload.ID,
+		FileName:  upload.Metadata["filename"],
+		Offset:    upload.Offset,
+		Length:    upload.Length,
+		Expires:   h.Resumable.Expires(upload),
+		ReceiptID: upload.ReceiptID,
+	})
+}
+
+// PatchUpload appends the request body to a resumable upload of the user at the offset in the Upload-Offset header.
+// Bytes received before the connection drops are kept, so the client can resume from the offset HeadUpload reports.
+// The request that completes the upload validates the file and creates its receipt like UploadReceipt, and responds
+// with the file's UploadResult and its status instead of 204 No Content.
+func (h *ReceiptHandler) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tusRequest(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset must be a non-negative number of bytes", http.StatusBadRequest)
+		return
+	}
+
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Serialize requests for the same upload so chunks cannot overlap
+	uploadID := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	unlock := h.uploadLocks.Lock(uploadID)
+	defer unlock()
+	upload, ok := h.ownedUpload(w, uploadID, userID)
+	if !ok {
+		return
+	}
+	if upload.Complete() {
+		http.Error(w, "Upload already complete as receipt "+upload.ReceiptID, http.StatusConflict)
+		return
+	}
+	if offset != upload.Offset {
+		http.Error(w, fmt.Sprintf("Upload-Offset %d does not match the received %d bytes", offset, upload.Offset), http.StatusConflict)
+		return
+	}
+
+	// Keep what arrived even if the connection dropped, but nothing past the upload's length.
+	// The chunk is spooled to a temporary file, so it is stored with its size without being held in memory.
+	chunk, err := services.SpoolChunk(http.MaxBytesReader(w, r.Body, upload.Length-upload.Offset))
+	if chunk == nil {
+		log.Println("Error spooling upload chunk:", err)
+		http.Error(w, "Could not store chunk", http.StatusInternalServerError)
+		return
+	}
+	defer chunk.Close()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Chunk too large: the upload ends after %d more bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if appendErr := h.Resumable.Append(&upload, offset, chunk.Reader(), chunk.Size()); appendErr != nil {
+		log.Println("Error storing upload chunk:", appendErr)
+		http.Error(w, "Could not store chunk", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Printf("Upload %s interrupted at %d bytes: %v", upload.ID, upload.Offset, err)
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.Offset < upload.Length {
+		w.Header().Set("Upload-Expires", h.Resumable.Expires(upload).Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// The file is complete: create its receipt
+	result := h.completeUpload(&upload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(result.Status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// DeleteUpload abandons a resumable upload of the user and deletes the chunks received so far
+func (h *ReceiptHandler) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tusRequest(w, r) {
+		return
+	}
+
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	uploadID := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	unlock := h.uploadLocks.Lock(uploadID)
+	defer unlock()
+	if _, ok := h.ownedUpload(w, uploadID, userID); !ok {
+		return
+	}
+
+	if err := h.Resumable.Delete(uploadID); err != nil {
+		log.Println("Error deleting upload:", err)
+		http.Error(w, "Could not delete upload", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StartUploadExpiry deletes abandoned resumable uploads every interval until the returned function is called
+func (h *ReceiptHandler) StartUploadExpiry(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				deleted, err := h.Resumable.DeleteExpired(now)
+				if err != nil {
+					log.Println("Error deleting expired uploads:", err)
+				}
+				if deleted > 0 {
+					log.Printf("Deleted %d expired uploads", deleted)
+				}
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// completeUpload validates a fully received upload and creates its receipt like UploadReceipt.
+// A successful upload keeps the receipt ID until it expires, and a rejected file cannot be resumed and is deleted.
+// After a server error the upload is left as it is, so the client can retry the last request.
+func (h *ReceiptHandler) completeUpload(upload *services.ResumableUpload) UploadResult {
+	fileName := upload.Metadata["filename"]
+	contents, err := h.Resumable.Open(*upload)
+	var file *services.SpooledFile
+	if err == nil {
+		file, err = services.SpoolUpload(contents, 0)
+		contents.Close()
+	}
+	if err != nil {
+		log.Println("Error reading upload chunks:", err)
+		return UploadResult{FileName: fileName, Size: upload.Length, Status: http.StatusInternalServerError, Error: "could not read upload"}
+	}
+	defer file.Close()
+
+	duplicates := upload.Metadata["duplicates"]
+	if duplicates == "" {
+		duplicates = duplicatesExisting
+	}
+	result := h.uploadFile(uploadPart{fileName: fileName, file: file}, upload.UserID, duplicates)
+
+	switch {
+	case result.Status >= http.StatusInternalServerError:
+	case result.Error != "":
+		if err := h.Resumable.Delete(upload.ID); err != nil {
+			log.Println("Error deleting rejected upload:", err)
+		}
+	default:
+		if err := h.Resumable.Complete(upload, result.ReceiptID); err != nil {
+			// The receipt exists either way; only looking it up through the upload fails
+			log.Println("Error completing upload:", err)
+		}
+	}
+	return result
+}
+
+// ownedUpload loads a resumable upload and checks that it belongs to the user.
+// It writes the error response and returns false if the upload is missing, expired or owned by someone else.
+func (h *ReceiptHandler) ownedUpload(w http.ResponseWriter, uploadID, userID string) (services.ResumableUpload, bool) {
+	upload, err := h.Resumable.Get(uploadID)
+	if errors.Is(err, services.ErrUploadNotFound) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return upload, false
+	}
+	if err != nil {
+		log.Println("Error loading upload:", err)
+		http.Error(w, "Could not load upload", http.StatusInternalServerError)
+		return upload, false
+	}
+
+	// Check if the user owns the upload
+	if upload.UserID != userID {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return services.ResumableUpload{}, false
+	}
+	return upload, true
+}
+
+// tusRequest sets the protocol version every tus response carries and checks that the client speaks it.
+// It writes 412 Precondition Failed and returns false for other versions.
+func tusRequest(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Tus-Resumable must be "+tusVersion, http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header: comma separated keys, each followed by a space
+// and its base64 encoded value unless the value is empty
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty key")
+		}
+		if _, ok := metadata[key]; ok {
+			return nil, fmt.Errorf("key %q appears more than once", key)
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("value of %q is not base64: %v", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// formatUploadMetadata encodes metadata for the Upload-Metadata header, sorted by key
+func formatUploadMetadata(metadata map[string]string) string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key
+		if value := metadata[key]; value != "" {
+			pairs[i] += " " + base64.StdEncoding.EncodeToString([]byte(value))
+		}
+	}
+	return strings.Join(pairs, ", ")
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"receipt-uploader/services"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// Helper function to send a tus request as the given user to the handler for its method
+func tusRequestAs(h *ReceiptHandler, userID, method, target string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := withUser(httptest.NewRequest(method, target, bytes.NewReader(body)), userID)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rr := httptest.NewRecorder()
+	switch method {
+	case http.MethodOptions:
+		h.UploadOptions(rr, req)
+	case http.MethodPost:
+		h.CreateUpload(rr, req)
+	case http.MethodHead:
+		h.HeadUpload(rr, req)
+	case http.MethodGet:
+		h.GetUpload(rr, req)
+	case http.MethodPatch:
+		h.PatchUpload(rr, req)
+	case http.MethodDelete:
+		h.DeleteUpload(rr, req)
+	}
+	return rr
+}
+
+// Helper function to create a resumable upload of a file from testdata and return its URL and contents
+func createResumableUpload(t *testing.T, h *ReceiptHandler, fileName string) (string, []byte) {
+	data, err := os.ReadFile("../testdata/" + fileName)
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+	rr := tusRequestAs(h, "test-user", http.MethodPost, "/uploads", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(data)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(fileName)) + ",is_confidential",
+	})
+	if rr.Code != http.StatusCreated || !strings.HasPrefix(rr.Header().Get("Location"), "/uploads/") {
+		t.Fatalf("Expected status code 201 with a Location, got %d %v", rr.Code, rr.Header())
+	}
+	return rr.Header().Get("Location"), data
+}
+
+// Helper function to append a chunk to a resumable upload
+func patchUpload(h *ReceiptHandler, location string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	return tusRequestAs(h, "test-user", http.MethodPatch, location, chunk, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	})
+}
+
+// TestResumableUpload tests uploading a receipt in chunks with the tus protocol
+func TestResumableUpload(t *testing.T) {
+	h, _ := setupTestEnv(t)
+
+	t.Run("Options", func(t *testing.T) {
+		rr := tusRequestAs(h, "test-user", http.MethodOptions, "/uploads", nil, nil)
+		if rr.Code != http.StatusNoContent || rr.Header().Get("Tus-Version") != "1.0.0" || !strings.Contains(rr.Header().Get("Tus-Extension"), "creation") || rr.Header().Get("Tus-Max-Size") == "" {
+			t.Fatalf("Expected the supported protocol, got %d %v", rr.Code, rr.Header())
+		}
+	})
+
+	t.Run("Chunks", func(t *testing.T) {
+		location, data := createResumableUpload(t, h, "exif.jpg")
+
+		// The first chunk arrives and the client asks where to resume
+		if rr := patchUpload(h, location, 0, data[:500]); rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "500" {
+			t.Fatalf("Expected status code 204 at offset 500, got %d %v", rr.Code, rr.Header())
+		}
+		rr := tusRequestAs(h, "test-user", http.MethodHead, location, nil, nil)
+		if rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != "500" || rr.Header().Get("Upload-Length") != strconv.Itoa(len(data)) || rr.Header().Get("Cache-Control") != "no-store" {
+			t.Fatalf("Expected 500 bytes received, got %d %v", rr.Code, rr.Header())
+		}
+		if metadata := rr.Header().Get("Upload-Metadata"); metadata != "filename ZXhpZi5qcGc=, is_confidential" {
+			t.Fatalf("Expected the upload metadata, got %q", metadata)
+		}
+
+		// A chunk at the wrong offset is refused
+		if rr := patchUpload(h, location, 400, data[400:]); rr.Code != http.StatusConflict {
+			t.Fatalf("Expected status code 409, got %d", rr.Code)
+		}
+
+		// The last chunk creates the receipt
+		rr = patchUpload(h, location, 500, data[500:])
+		var result UploadResult
+		json.NewDecoder(rr.Body).Decode(&result)
+		if rr.Code != http.StatusCreated || result.ReceiptID == "" || result.FileName != "exif.jpg" || rr.Header().Get("Upload-Offset") != strconv.Itoa(len(data)) {
+			t.Fatalf("Expected the receipt to be created, got %d %+v", rr.Code, result)
+		}
+		receipt, err := h.Receipts.Get(result.ReceiptID)
+		if err != nil || receipt.CameraMake != "Receiptcam" || receipt.UserID != "test-user" {
+			t.Fatalf("Expected the photo to be stored like an upload, got %+v, %v", receipt, err)
+		}
+
+		// The receipt can be looked up through the upload afterwards
+		rr = tusRequestAs(h, "test-user", http.MethodGet, location, nil, nil)
+		var progress UploadProgress
+		json.NewDecoder(rr.Body).Decode(&progress)
+		if rr.Code != http.StatusOK || progress.ReceiptID != result.ReceiptID || progress.Offset != int64(len(data)) {
+			t.Fatalf("Expected the complete upload, got %d %+v", rr.Code, progress)
+		}
+		if rr := patchUpload(h, location, len(data), nil); rr.Code != http.StatusConflict {
+			t.Fatalf("Expected status code 409 for a complete upload, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Interrupted", func(t *testing.T) {
+		location, data := createResumableUpload(t, h, "exif.jpg")
+
+		// The connection drops after 300 bytes, which are kept for the client to resume after
+		body := io.MultiReader(bytes.NewReader(data[:300]), iotest.ErrReader(io.ErrUnexpectedEOF))
+		req := withUser(httptest.NewRequest(http.MethodPatch, location, body), "test-user")
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		rr := httptest.NewRecorder()
+		h.PatchUpload(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("Expected status code 400, got %d", rr.Code)
+		}
+		if rr := tusRequestAs(h, "test-user", http.MethodHead, location, nil, nil); rr.Header().Get("Upload-Offset") != "300" {
+			t.Fatalf("Expected 300 bytes received, got %v", rr.Header())
+		}
+
+		// The resumed file is complete and whole: it is the photo stored by the upload above
+		rr = patchUpload(h, location, 300, data[300:])
+		var result UploadResult
+		json.NewDecoder(rr.Body).Decode(&result)
+		if rr.Code != http.StatusOK || result.DuplicateOf == "" {
+			t.Fatalf("Expected the complete photo, got %d %+v", rr.Code, result)
+		}
+	})
+
+	t.Run("InvalidFile", func(t *testing.T) {
+		location, data := createResumableUpload(t, h, "test.txt")
+
+		// The file is validated like UploadReceipt, and a rejected upload cannot be resumed
+		rr := patchUpload(h, location, 0, data)
+		var result UploadResult
+		json.NewDecoder(rr.Body).Decode(&result)
+		if rr.Code != http.StatusUnsupportedMediaType || result.Reason != services.ReasonUnknownFormat {
+			t.Fatalf("Expected the text file to be rejected, got %d %+v", rr.Code, result)
+		}
+		if rr := tusRequestAs(h, "test-user", http.MethodHead, location, nil, nil); rr.Code != http.StatusNotFound {
+			t.Fatalf("Expected status code 404, got %d", rr.Code)
+		}
+	})
+
+	t.Run("InvalidRequests", func(t *testing.T) {
+		location, data := createResumableUpload(t, h, "exif.jpg")
+
+		// Clients must speak the supported protocol version
+		req := withUser(httptest.NewRequest(http.MethodHead, location, nil), "test-user")
+		rr := httptest.NewRecorder()
+		h.HeadUpload(rr, req)
+		if rr.Code != http.StatusPreconditionFailed || rr.Header().Get("Tus-Version") != "1.0.0" {
+			t.Fatalf("Expected status code 412, got %d", rr.Code)
+		}
+
+		for _, headers := range []map[string]string{{}, {"Upload-Length": "-1"}, {"Upload-Defer-Length": "1"}, {"Upload-Length": "10", "Upload-Metadata": "filename not-base64!"}, {"Upload-Length": "10", "Upload-Metadata": "duplicates " + base64.StdEncoding.EncodeToString([]byte("never"))}} {
+			if rr := tusRequestAs(h, "test-user", http.MethodPost, "/uploads", nil, headers); rr.Code != http.StatusBadRequest {
+				t.Fatalf("Expected status code 400 for %v, got %d", headers, rr.Code)
+			}
+		}
+		if rr := tusRequestAs(h, "test-user", http.MethodPost, "/uploads", nil, map[string]string{"Upload-Length": strconv.Itoa(defaultMaxFileBytes + 1)}); rr.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("Expected status code 413, got %d", rr.Code)
+		}
+
+		// Chunks must be sent as raw bytes and must not extend past the upload
+		rr = tusRequestAs(h, "test-user", http.MethodPatch, location, data, map[string]string{"Content-Type": "image/jpeg", "Upload-Offset": "0"})
+		if rr.Code != http.StatusUnsupportedMediaType {
+			t.Fatalf("Expected status code 415, got %d", rr.Code)
+		}
+		if rr := patchUpload(h, location, 0, append(data, 0)); rr.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("Expected status code 413, got %d", rr.Code)
+		}
+
+		// Uploads belong to the user who created them
+		if rr := tusRequestAs(h, "other-user", http.MethodHead, location, nil, nil); rr.Code != http.StatusForbidden {
+			t.Fatalf("Expected status code 403, got %d", rr.Code)
+		}
+		if rr := tusRequestAs(h, "test-user", http.MethodHead, "/uploads/unknown", nil, nil); rr.Code != http.StatusNotFound {
+			t.Fatalf("Expected status code 404, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Terminate", func(t *testing.T) {
+		location, data := createResumableUpload(t, h, "exif.jpg")
+		patchUpload(h, location, 0, data[:100])
+
+		if rr := tusRequestAs(h, "test-user", http.MethodDelete, location, nil, nil); rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code 204, got %d", rr.Code)
+		}
+		if rr := tusRequestAs(h, "test-user", http.MethodHead, location, nil, nil); rr.Code != http.StatusNotFound {
+			t.Fatalf("Expected status code 404, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		location, data := createResumableUpload(t, h, "exif.jpg")
+		patchUpload(h, location, 0, data[:100])
+
+		// Abandoned uploads are deleted by the background sweep
+		h.Resumable = services.NewResumableStore(h.Blobs, time.Millisecond)
+		stop := h.StartUploadExpiry(10 * time.Millisecond)
+		defer stop()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if blobs, _ := h.Blobs.List("resumable/" + strings.TrimPrefix(location, "/uploads/")); len(blobs) == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the abandoned upload to be deleted")
+			}
+		}
+	})
+}
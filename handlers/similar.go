@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"receipt-uploader/models"
+	"receipt-uploader/services"
+	"sort"
+	"strings"
+)
+
+// Default largest perceptual hash distance for two receipt images to count as similar
+const defaultSimilarDistance = 10
+
+// SimilarReceipt is a receipt whose image looks like the image of another receipt
+type SimilarReceipt struct {
+	Receipt  models.Receipt `json:"receipt"`
+	Distance int            `json:"distance"` // Hamming distance between the perceptual hashes, 0 for visually identical images
+}
+
+// SimilarReceiptsResponse lists similar receipts, most similar first
+type SimilarReceiptsResponse struct {
+	Receipts []SimilarReceipt `json:"receipts"`
+}
+
+// GetSimilarReceipts lists the user's other receipts whose images are within the similarity distance of a receipt.
+// The optional max_distance query parameter overrides the configured distance.
+func (h *ReceiptHandler) GetSimilarReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Extract the receipt ID from the URL path
+	receiptID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/receipts/"), "/similar")
+	receipt, ok := h.ownedReceipt(w, receiptID, userID, models.StateActive)
+	if !ok {
+		return
+	}
+
+	maxDistance := h.SimilarDistance
+	if r.URL.Query().Get("max_distance") != "" {
+		distance, err := parseQueryParameter(r.URL.Query().Get("max_distance"), "max_distance")
+		if err != nil || distance > services.MaxHashDistance {
+			http.Error(w, "Invalid max_distance parameter: must be between 0 and 64", http.StatusBadRequest)
+			return
+		}
+		maxDistance = distance
+	}
+
+	// Receipts uploaded before perceptual hashing get their hash on first use
+	if receipt.PerceptualHash == "" {
+		hash, err := h.computePerceptualHash(receipt)
+		if err != nil {
+			log.Println("Error computing perceptual hash:", err)
+			http.Error(w, "Could not compare receipt images", http.StatusInternalServerError)
+			return
+		}
+		receipt.PerceptualHash = hash
+	}
+
+	similar, err := h.similarReceipts(userID, receipt.ID, receipt.PerceptualHash, maxDistance)
+	if err != nil {
+		log.Println("Error finding similar receipts:", err)
+		http.Error(w, "Could not find similar receipts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SimilarReceiptsResponse{Receipts: similar})
+}
+
+// similarReceipts returns the user's active receipts, other than excludeID, whose perceptual hash is within
+// maxDistance of hash. Receipts without a perceptual hash are skipped.
+func (h *ReceiptHandler) similarReceipts(userID, excludeID, hash string, maxDistance int) ([]SimilarReceipt, error) {
+	// Hamming distance cannot be indexed, so every receipt of the user is compared
+	page, err := h.Receipts.Query(models.ReceiptQuery{UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+
+	similar := []SimilarReceipt{}
+	for _, candidate := range page.Receipts {
+		if candidate.ID == excludeID || candidate.PerceptualHash == "" {
+			continue
+		}
+		distance, err := services.HashDistance(hash, candidate.PerceptualHash)
+		if err != nil {
+			return nil, err
+		}
+		if distance <= maxDistance {
+			similar = append(similar, SimilarReceipt{Receipt: candidate, Distance: distance})
+		}
+	}
+
+	// Most similar first; receipts at the same distance stay in upload order
+	sort.SliceStable(similar, func(i, j int) bool { return similar[i].Distance < similar[j].Distance })
+	return similar, nil
+}
+
+// computePerceptualHash hashes a receipt's stored original and saves the hash on the receipt
+func (h *ReceiptHandler) computePerceptualHash(receipt models.Receipt) (string, error) {
+	original, _, err := h.Blobs.Get(services.OriginalKey(receipt.FilePath))
+	if err != nil {
+		return "", err
+	}
+	defer original.Close()
+
+	hash, err := services.PerceptualHash(original, h.Decoder)
+	if err != nil {
+		return "", err
+	}
+
+	// Reload the receipt so changes made while hashing are kept
+	unlock := h.receiptLocks.Lock(receipt.ID)
+	defer unlock()
+	if receipt, err = h.Receipts.Get(receipt.ID); err != nil {
+		return "", err
+	}
+	receipt.PerceptualHash = hash
+	if err := h.Receipts.Update(receipt); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"receipt-uploader/models"
+	"testing"
+)
+
+// TestGetSimilarReceipts tests listing receipts with similar images
+func TestGetSimilarReceipts(t *testing.T) {
+	h, repo := setupTestEnv(t)
+	repo.Create(models.Receipt{ID: "1", FilePath: "test.jpg", UserID: "test-user", PerceptualHash: "00000000000000ff"})
+	repo.Create(models.Receipt{ID: "2", FilePath: "test.jpg", UserID: "test-user", PerceptualHash: "00000000000000fe"}) // Distance 1
+	repo.Create(models.Receipt{ID: "3", FilePath: "test.jpg", UserID: "test-user", PerceptualHash: "000000000000ffff"}) // Distance 8
+	repo.Create(models.Receipt{ID: "4", FilePath: "test.jpg", UserID: "test-user", PerceptualHash: "ffffffffffffff00"}) // Distance 64
+	repo.Create(models.Receipt{ID: "5", FilePath: "test.jpg", UserID: "another-user", PerceptualHash: "00000000000000ff"})
+
+	get := func(t *testing.T, target string) (*httptest.ResponseRecorder, SimilarReceiptsResponse) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req = withUser(req, "test-user")
+		rr := httptest.NewRecorder()
+		h.GetSimilarReceipts(rr, req)
+
+		var response SimilarReceiptsResponse
+		if rr.Code == http.StatusOK {
+			json.NewDecoder(rr.Body).Decode(&response)
+		}
+		return rr, response
+	}
+
+	t.Run("WithinConfiguredDistance", func(t *testing.T) {
+		rr, response := get(t, "/receipts/1/similar")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", rr.Code)
+		}
+		// Other users' receipts are never compared
+		if len(response.Receipts) != 2 || response.Receipts[0].Receipt.ID != "2" || response.Receipts[0].Distance != 1 ||
+			response.Receipts[1].Receipt.ID != "3" || response.Receipts[1].Distance != 8 {
+			t.Fatalf("Expected receipts 2 and 3 ordered by distance, got %+v", response.Receipts)
+		}
+	})
+
+	t.Run("MaxDistanceOverride", func(t *testing.T) {
+		_, response := get(t, "/receipts/1/similar?max_distance=2")
+		if len(response.Receipts) != 1 || response.Receipts[0].Receipt.ID != "2" {
+			t.Fatalf("Expected only receipt 2, got %+v", response.Receipts)
+		}
+		if rr, _ := get(t, "/receipts/1/similar?max_distance=65"); rr.Code != http.StatusBadRequest {
+			t.Fatalf("Expected status code 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("ComputesMissingHash", func(t *testing.T) {
+		repo.Create(models.Receipt{ID: "legacy", FilePath: "test.jpg", UserID: "test-user"})
+		if rr, _ := get(t, "/receipts/legacy/similar"); rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", rr.Code)
+		}
+		if receipt, _ := repo.Get("legacy"); len(receipt.PerceptualHash) != 16 {
+			t.Fatalf("Expected the perceptual hash to be stored, got %q", receipt.PerceptualHash)
+		}
+	})
+
+	t.Run("OtherUsersReceipt", func(t *testing.T) {
+		if rr, _ := get(t, "/receipts/5/similar"); rr.Code != http.StatusForbidden {
+			t.Fatalf("Expected status code 403, got %d", rr.Code)
+		}
+	})
+}
+
+// TestUploadSimilarWarning tests that uploads flag images resembling an existing receipt
+func TestUploadSimilarWarning(t *testing.T) {
+	h, _ := setupTestEnv(t)
+
+	rr := httptest.NewRecorder()
+	h.UploadReceipt(rr, newUploadRequest(t, "test.jpg"))
+	first := decodeUploadResponse(t, rr).Results[0]
+	if first.PossibleDuplicate || len(first.SimilarTo) != 0 {
+		t.Fatalf("Expected no warning for the first upload, got %+v", first)
+	}
+
+	rr = httptest.NewRecorder()
+	h.UploadReceipt(rr, newUploadRequest(t, "test.jpg"))
+	second := decodeUploadResponse(t, rr).Results[0]
+	if !second.PossibleDuplicate || len(second.SimilarTo) != 1 || second.SimilarTo[0] != first.ReceiptID {
+		t.Fatalf("Expected a warning pointing at %s, got %+v", first.ReceiptID, second)
+	}
+}
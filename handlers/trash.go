@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"receipt-uploader/models"
+	"receipt-uploader/services"
+	"strings"
+	"time"
+)
+
+// DeleteReceipt moves a receipt owned by the user to the trash.
+// With ?purge=true the receipt, its original file and all of its thumbnails are removed permanently instead.
+func (h *ReceiptHandler) DeleteReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Extract the receipt ID from the URL path
+	receiptID := strings.TrimPrefix(r.URL.Path, "/receipts/")
+
+	unlock := h.receiptLocks.Lock(receiptID)
+	defer unlock()
+
+	// Purging also applies to receipts that are already in the trash
+	if r.URL.Query().Get("purge") == "true" {
+		receipt, ok := h.ownedReceipt(w, receiptID, userID, models.StateAny)
+		if !ok {
+			return
+		}
+		h.purgeReceipt(w, receipt)
+		return
+	}
+
+	receipt, ok := h.ownedReceipt(w, receiptID, userID, models.StateActive)
+	if !ok {
+		return
+	}
+
+	// Move the receipt to the trash; its files are kept so it can be restored
+	deletedAt := time.Now().UTC()
+	receipt.DeletedAt = &deletedAt
+	if err := h.Receipts.Update(receipt); err != nil {
+		http.Error(w, "Could not delete receipt", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListTrash lists the receipts the user has moved to the trash
+func (h *ReceiptHandler) ListTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := h.Receipts.Query(models.ReceiptQuery{UserID: userID, State: models.StateTrashed})
+	if err != nil {
+		http.Error(w, "Could not list receipts", http.StatusInternalServerError)
+		return
+	}
+
+	// An empty trash is returned as an empty list
+	receipts := page.Receipts
+	if receipts == nil {
+		receipts = []models.Receipt{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipts)
+}
+
+// RestoreReceipt moves a receipt owned by the user out of the trash
+func (h *ReceiptHandler) RestoreReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Extract the receipt ID from the URL path
+	receiptID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/receipts/"), "/restore")
+	unlock := h.receiptLocks.Lock(receiptID)
+	defer unlock()
+	receipt, ok := h.ownedReceipt(w, receiptID, userID, models.StateTrashed)
+	if !ok {
+		return
+	}
+
+	receipt.DeletedAt = nil
+	if err := h.Receipts.Update(receipt); err != nil {
+		http.Error(w, "Could not restore receipt", http.StatusInternalServerError)
+		return
+	}
+
+	// Return the restored receipt
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// purgeReceipt permanently removes a receipt's files and then its metadata.
+// The files go first so that a failure leaves the receipt in place for another attempt.
+// The caller must hold the receipt's lock, so no other request changes its pages meanwhile.
+// The originals of its pages are kept while other receipts with identical contents still reference them.
+func (h *ReceiptHandler) purgeReceipt(w http.ResponseWriter, receipt models.Receipt) {
+	unlock := h.contentLocks.LockAll(contentHashes(receipt.Files()))
+	defer unlock()
+
+	if err := h.releaseOriginals(receipt); err != nil {
+		log.Println("Error deleting receipt original:", err)
+		http.Error(w, "Could not delete receipt files", http.StatusInternalServerError)
+		return
+	}
+	if err := h.Renditions.Invalidate(receipt.ID); err != nil {
+		log.Println("Error deleting receipt renditions:", err)
+		http.Error(w, "Could not delete receipt files", http.StatusInternalServerError)
+		return
+	}
+	if err := services.DeleteThumbnails(h.Blobs, receipt.ID); err != nil {
+		log.Println("Error deleting receipt thumbnails:", err)
+		http.Error(w, "Could not delete receipt files", http.StatusInternalServerError)
+		return
+	}
+	if err := h.Receipts.Delete(receipt.ID); err != nil {
+		http.Error(w, "Could not delete receipt", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
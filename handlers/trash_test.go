@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"receipt-uploader/models"
+	"receipt-uploader/services"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDeleteAndRestoreReceipt tests moving a receipt to the trash and back
+func TestDeleteAndRestoreReceipt(t *testing.T) {
+	// Setup in-memory store with some sample receipts
+	h, repo := setupTestEnv(t)
+	storeReceipt(repo, "1", "test.jpg", "test-user")
+
+	t.Run("UnauthorizedDelete", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/receipts/1", nil)
+		req = withUser(req, "another-user")
+
+		rr := httptest.NewRecorder()
+		h.DeleteReceipt(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("Expected status code 403, got %d", rr.Code)
+		}
+	})
+
+	t.Run("MoveToTrash", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/receipts/1", nil)
+		req = withUser(req, "test-user")
+
+		rr := httptest.NewRecorder()
+		h.DeleteReceipt(rr, req)
+
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code 204, got %d", rr.Code)
+		}
+
+		// The receipt is no longer served or listed, but its file is kept
+		req = httptest.NewRequest(http.MethodGet, "/receipts/1", nil)
+		req = withUser(req, "test-user")
+		rr = httptest.NewRecorder()
+		h.GetReceipt(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("Expected trashed receipt to return 404, got %d", rr.Code)
+		}
+		if _, err := h.Blobs.Stat("test.jpg"); err != nil {
+			t.Fatalf("Expected original file to be kept in the trash, got %v", err)
+		}
+	})
+
+	t.Run("ListTrash", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/receipts/trash", nil)
+		req = withUser(req, "test-user")
+
+		rr := httptest.NewRecorder()
+		h.ListTrash(rr, req)
+
+		var receipts []models.Receipt
+		json.NewDecoder(rr.Body).Decode(&receipts)
+		if rr.Code != http.StatusOK || len(receipts) != 1 || receipts[0].ID != "1" || !receipts[0].Trashed() {
+			t.Fatalf("Expected receipt 1 in the trash, got %d: %+v", rr.Code, receipts)
+		}
+	})
+
+	t.Run("EmptyTrashForOtherUser", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/receipts/trash", nil)
+		req = withUser(req, "another-user")
+
+		rr := httptest.NewRecorder()
+		h.ListTrash(rr, req)
+
+		if rr.Code != http.StatusOK || rr.Body.String() != "[]\n" {
+			t.Fatalf("Expected empty trash, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/receipts/1/restore", nil)
+		req = withUser(req, "test-user")
+
+		rr := httptest.NewRecorder()
+		h.RestoreReceipt(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", rr.Code)
+		}
+		if receipt, _ := repo.Get("1"); receipt.Trashed() {
+			t.Fatalf("Expected receipt to be restored")
+		}
+	})
+
+	t.Run("RestoreActiveReceipt", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/receipts/1/restore", nil)
+		req = withUser(req, "test-user")
+
+		rr := httptest.NewRecorder()
+		h.RestoreReceipt(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("Expected status code 404 for a receipt that is not in the trash, got %d", rr.Code)
+		}
+	})
+}
+
+// TestPurgeReceipt tests permanently deleting a receipt with its files
+func TestPurgeReceipt(t *testing.T) {
+	h, repo := setupTestEnv(t)
+
+	// Create an original, a thumbnail from before the rendition cache and a cached rendition in the blob store
+	receiptID := services.GenerateReceiptID()
+	original := "originals/" + services.GenerateReceiptID() + ".jpg"
+	thumbnail := services.ThumbnailKey(receiptID, 100, 67)
+	rendition := services.RenditionKey{ReceiptID: receiptID, Version: "v1", Size: "small", Format: "jpg"}.BlobKey()
+	for _, key := range []string{original, thumbnail, rendition} {
+		if err := h.Blobs.Put(key, strings.NewReader("data"), 4, "image/jpeg"); err != nil {
+			t.Fatalf("Failed to create %s: %v", key, err)
+		}
+	}
+	storeReceipt(repo, receiptID, original, "test-user")
+
+	t.Run("UnauthorizedPurge", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/receipts/"+receiptID+"?purge=true", nil)
+		req = withUser(req, "another-user")
+
+		rr := httptest.NewRecorder()
+		h.DeleteReceipt(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("Expected status code 403, got %d", rr.Code)
+		}
+		if _, err := h.Blobs.Stat(original); err != nil {
+			t.Fatalf("Expected original to be kept, got %v", err)
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		// Another request is changing the receipt, so the purge waits for it to finish
+		unlock := h.receiptLocks.Lock(receiptID)
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			req := httptest.NewRequest(http.MethodDelete, "/receipts/"+receiptID+"?purge=true", nil)
+			req = withUser(req, "test-user")
+
+			rr := httptest.NewRecorder()
+			h.DeleteReceipt(rr, req)
+			done <- rr
+		}()
+		select {
+		case <-done:
+			t.Fatalf("Expected the purge to wait for the receipt lock")
+		case <-time.After(50 * time.Millisecond):
+		}
+		if _, err := h.Blobs.Stat(original); err != nil {
+			t.Fatalf("Expected original to be kept while the receipt is locked, got %v", err)
+		}
+		unlock()
+
+		rr := <-done
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code 204, got %d", rr.Code)
+		}
+		for _, key := range []string{original, thumbnail, rendition} {
+			if _, err := h.Blobs.Stat(key); !errors.Is(err, services.ErrBlobNotFound) {
+				t.Fatalf("Expected %s to be deleted, got %v", key, err)
+			}
+		}
+		if _, err := repo.Get(receiptID); !errors.Is(err, models.ErrReceiptNotFound) {
+			t.Fatalf("Expected receipt metadata to be deleted, got %v", err)
+		}
+	})
+}
+
+// TestPurgeSharedOriginal tests that an original shared by several receipts is kept until its last receipt is purged
+func TestPurgeSharedOriginal(t *testing.T) {
+	h, repo := setupTestEnv(t)
+
+	// Two receipts referencing the same content-addressed original
+	original := "originals/" + strings.Repeat("ab", 32) + ".jpg"
+	h.Blobs.Put(original, strings.NewReader("data"), 4, "image/jpeg")
+	for _, id := range []string{"1", "2"} {
+		repo.Create(models.Receipt{ID: id, FilePath: original, ContentHash: strings.Repeat("ab", 32), UserID: "test-user"})
+	}
+
+	purge := func(id string) {
+		req := httptest.NewRequest(http.MethodDelete, "/receipts/"+id+"?purge=true", nil)
+		req = withUser(req, "test-user")
+		rr := httptest.NewRecorder()
+		h.DeleteReceipt(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code 204, got %d", rr.Code)
+		}
+	}
+
+	purge("1")
+	if _, err := h.Blobs.Stat(original); err != nil {
+		t.Fatalf("Expected the shared original to be kept, got %v", err)
+	}
+
+	purge("2")
+	if _, err := h.Blobs.Stat(original); !errors.Is(err, services.ErrBlobNotFound) {
+		t.Fatalf("Expected the original to be deleted with its last receipt, got %v", err)
+	}
+}
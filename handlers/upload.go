@@ -0,0 +1,520 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"receipt-uploader/models"
+	"receipt-uploader/services"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadResult reports the outcome of uploading a single file
+type UploadResult struct {
+	FileName    string `json:"file_name"`              // Name of the file as sent by the client
+	ReceiptID   string `json:"receipt_id,omitempty"`   // ID of the created receipt, empty if the upload failed
+	Size        int64  `json:"size"`                   // Size of the file in bytes
+	ContentType string `json:"content_type,omitempty"` // MIME type detected from the file contents
+	Status      int    `json:"status"`                 // HTTP status code for this file
+	Error       string `json:"error,omitempty"`        // Why the upload failed, empty on success
+	Reason      string `json:"reason,omitempty"`       // Why the file was rejected as one of the services.Reason constants
+	DuplicateOf string `json:"duplicate_of,omitempty"` // ID of the user's existing receipt with identical contents
+	Page        int    `json:"page,omitempty"`         // Page of the receipt the file became, when files are uploaded as pages
+
+	// Measurements of the image, and the quality checks it failed with status 422
+	Quality       *services.ImageQuality  `json:"quality,omitempty"`
+	QualityErrors []services.QualityError `json:"quality_errors,omitempty"`
+
+	// Set when the image looks like one of the user's existing receipts, e.g. the same receipt photographed twice
+	PossibleDuplicate bool     `json:"possible_duplicate,omitempty"`
+	SimilarTo         []string `json:"similar_to,omitempty"` // IDs of the similar receipts, most similar first
+}
+
+// Duplicate policies selected with the duplicates query parameter of UploadReceipt
+const (
+	duplicatesExisting = "existing" // Return the existing receipt instead of creating a new one (the default)
+	duplicatesReject   = "reject"   // Fail the file with 409 Conflict, pointing at the existing receipt
+	duplicatesAllow    = "allow"    // Create another receipt that shares the stored original
+)
+
+// Upload modes selected with the mode query parameter of UploadReceipt
+const (
+	uploadSeparate = "separate" // Every file becomes a receipt of its own (the default)
+	uploadPages    = "pages"    // The files are the pages of a single receipt, in request order
+)
+
+// Default size limits of uploads
+const (
+	defaultMaxFileBytes    = 25 << 20  // Largest file in an upload
+	defaultMaxRequestBytes = 100 << 20 // Largest multipart request body
+)
+
+// Files of one upload request inspected at the same time. Reading the request waits while they are busy,
+// so only these files are decoded at once while the others wait spooled to disk.
+const maxConcurrentUploads = 4
+
+// UploadResponse lists the result of every file in an upload request, in request order
+type UploadResponse struct {
+	Results []UploadResult `json:"results"`
+}
+
+// UploadReceipt handles the uploading of receipt images.
+// Every file is processed independently: the response is 201 if all files were stored,
+// 207 Multi-Status if only some were, and the files' common error status if none were.
+// Files are read from the request one at a time, spooled to disk while they are hashed and processed as they arrive,
+// so neither the form nor a file is ever buffered in memory whole.
+// Files the user has uploaded before are handled according to the duplicates query parameter.
+// With mode=pages the stored files become the pages of one receipt instead, such as a long receipt photographed in parts.
+func (h *ReceiptHandler) UploadReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check if the request's content type is multipart/form-data
+	if r.Header.Get("Content-Type") == "" || !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		http.Error(w, "Content-Type must be multipart/form-data", http.StatusBadRequest)
+		return
+	}
+
+	// Identify the authenticated user
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Decide what happens to files with the same contents as one of the user's receipts
+	duplicates := r.URL.Query().Get("duplicates")
+	switch duplicates {
+	case "":
+		duplicates = duplicatesExisting
+	case duplicatesExisting, duplicatesReject, duplicatesAllow:
+	default:
+		http.Error(w, "Invalid duplicates parameter: must be existing, reject or allow", http.StatusBadRequest)
+		return
+	}
+
+	// Decide whether the files are separate receipts or the pages of one
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = uploadSeparate
+	case uploadSeparate, uploadPages:
+	default:
+		http.Error(w, "Invalid mode parameter: must be separate or pages", http.StatusBadRequest)
+		return
+	}
+	if mode == uploadPages && r.URL.Query().Get("duplicates") != "" {
+		http.Error(w, "The duplicates parameter does not apply to mode=pages", http.StatusBadRequest)
+		return
+	}
+
+	// Combine the files into one receipt
+	if mode == uploadPages {
+		inspected, results, ok := h.inspectPages(w, r)
+		defer closeInspected(inspected)
+		if !ok {
+			return
+		}
+		h.uploadPages(inspected, results, userID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(uploadStatus(results))
+		json.NewEncoder(w).Encode(UploadResponse{Results: results})
+		return
+	}
+
+	// Process each file concurrently as it arrives
+	results, ok := h.processUploads(w, r, func(_ int, part uploadPart) UploadResult {
+		defer part.close()
+		return h.uploadFile(part, userID, duplicates)
+	})
+	if !ok {
+		return
+	}
+
+	// Return the per-file results
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(uploadStatus(results))
+	json.NewEncoder(w).Encode(UploadResponse{Results: results})
+}
+
+// uploadPart is a file read from a multipart upload
+type uploadPart struct {
+	fileName string
+	file     *services.SpooledFile
+	err      error // Why the file could not be read, e.g. because it is too large; file is nil then
+}
+
+// close removes the spooled file of the part
+func (p uploadPart) close() {
+	if p.file != nil {
+		p.file.Close()
+	}
+}
+
+// processUploads reads the files of a multipart request one part at a time and runs process on each file as soon
+// as it is spooled, with the file's index in request order, at most maxConcurrentUploads at the same time. process owns
+// the spooled file and must close it. Files larger than MaxFileBytes are passed with an error and not kept. It returns the results in request order once every file is processed. If the request
+// cannot be read or has no files, or its body exceeds MaxRequestBytes before the first file, the error is written to w
+// and ok is false. Files read before the body broke off are still processed and reported, and a request that broke
+// off between files gets a failed result without a file name for the files after it.
+func (h *ReceiptHandler) processUploads(w http.ResponseWriter, r *http.Request, process func(i int, part uploadPart) UploadResult) (results []UploadResult, ok bool) {
+	// Refuse requests that announce a body over the limit before reading any of it
+	if h.MaxRequestBytes > 0 {
+		if r.ContentLength > h.MaxRequestBytes {
+			http.Error(w, requestTooLarge(h.MaxRequestBytes), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, h.MaxRequestBytes)
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Error parsing multipart form", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var mu sync.Mutex // Guards results, which grows while earlier files are processed
+	var wg sync.WaitGroup
+	var lastErr error // Why the last file could not be read, which then reports a request that broke off
+	slots := make(chan struct{}, maxConcurrentUploads)
+	for {
+		var part *multipart.Part
+		if part, err = reader.NextPart(); err != nil {
+			break
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			continue
+		}
+
+		// Read the file; a part cut off by the request limit is reported like a file over the limit
+		upload := uploadPart{fileName: part.FileName()}
+		upload.file, upload.err = services.SpoolUpload(part, h.MaxFileBytes)
+		lastErr = upload.err
+		mu.Lock()
+		i := len(results)
+		results = append(results, UploadResult{})
+		mu.Unlock()
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := process(i, upload)
+			<-slots
+			mu.Lock()
+			results[i] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == io.EOF:
+	case len(results) > 0:
+		// The files read so far are processed already. Unless the file cut off reports the error,
+		// the request broke off between files, and the files after it are reported as lost.
+		log.Println("Error reading multipart upload:", err)
+		if lastErr == nil {
+			results = append(results, readError(err, h.MaxRequestBytes))
+		}
+	case errors.As(err, &tooLarge):
+		http.Error(w, requestTooLarge(h.MaxRequestBytes), http.StatusRequestEntityTooLarge)
+		return nil, false
+	default:
+		http.Error(w, "Error parsing multipart form", http.StatusBadRequest)
+		return nil, false
+	}
+	if len(results) == 0 {
+		http.Error(w, "No files uploaded", http.StatusBadRequest)
+		return nil, false
+	}
+	return results, true
+}
+
+// readError reports the rest of a multipart request that could not be read after its last file
+func readError(err error, limit int64) UploadResult {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return UploadResult{Status: http.StatusRequestEntityTooLarge, Error: requestTooLarge(limit), Reason: services.ReasonTooLarge}
+	}
+	return UploadResult{Status: http.StatusBadRequest, Error: "could not read the rest of the request"}
+}
+
+// requestTooLarge describes a request body over the limit
+func requestTooLarge(limit int64) string {
+	return fmt.Sprintf("request body too large: at most %d bytes allowed", limit)
+}
+
+// inspectedFile is an uploaded file that passed validation and the quality checks and can be stored
+type inspectedFile struct {
+	upload         *services.SpooledFile // Contents to store, removed with close
+	saved          services.SavedFile
+	perceptualHash string
+	quality        *services.ImageQuality // Nil for PDF documents
+}
+
+// inspectUpload validates, normalizes and measures an uploaded file.
+// It returns nil and the failed result if the file cannot be stored.
+func (h *ReceiptHandler) inspectUpload(part uploadPart) (*inspectedFile, UploadResult) {
+	result := UploadResult{FileName: part.fileName}
+
+	// Files that could not be read completely are not inspected
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(part.err, services.ErrFileTooLarge):
+		result.Status, result.Error, result.Reason = http.StatusRequestEntityTooLarge, part.err.Error(), services.ReasonTooLarge
+		return nil, result
+	case errors.As(part.err, &tooLarge):
+		result.Status, result.Error, result.Reason = http.StatusRequestEntityTooLarge, requestTooLarge(tooLarge.Limit), services.ReasonTooLarge
+		return nil, result
+	case part.err != nil:
+		result.Status, result.Error = http.StatusBadRequest, "could not read file"
+		return nil, result
+	}
+
+	// Validate, decode, normalize and hash the file using the service layer
+	result.Size = part.file.Size()
+	saved, err := services.InspectFile(part.file, h.Formats, h.Metadata, h.Decoder)
+	result.ContentType = saved.ContentType
+	result.Reason = services.RejectionReason(err)
+	if errors.Is(err, services.ErrImageTooLarge) {
+		result.Status = http.StatusRequestEntityTooLarge
+		result.Error = err.Error()
+		return nil, result
+	}
+	if errors.Is(err, services.ErrInvalidImage) {
+		result.Status = http.StatusUnsupportedMediaType
+		result.Error = err.Error()
+		return nil, result
+	}
+	if err != nil {
+		log.Println("Error reading uploaded file:", err)
+		result.Status = http.StatusInternalServerError
+		result.Error = "could not save file"
+		return nil, result
+	}
+	result.Size = saved.Size
+
+	// Hash what the image or first page looks like and measure the quality of photos
+	file := &inspectedFile{upload: part.file, saved: saved, perceptualHash: services.FormatHash(services.DHash(saved.Image))}
+	file.saved.Image = nil // Not needed once measured, so the pixels can be freed while the other files are inspected
+	if saved.Format != services.FormatPDF {
+		quality := services.MeasureQuality(saved.Image)
+		file.quality, result.Quality = &quality, &quality
+
+		// Reject photos that are too small, blurry, dark or bright to read
+		if result.QualityErrors = h.Quality.Check(quality); len(result.QualityErrors) > 0 {
+			result.Status = http.StatusUnprocessableEntity
+			result.Error = services.QualityMessage(result.QualityErrors)
+			result.Reason = services.ReasonLowQuality
+			return nil, result
+		}
+	}
+	return file, result
+}
+
+// closeInspected removes the spooled files of inspected files
+func closeInspected(inspected []*inspectedFile) {
+	for _, file := range inspected {
+		if file != nil {
+			file.upload.Close()
+		}
+	}
+}
+
+// uploadFile saves a single uploaded file and stores its receipt metadata
+func (h *ReceiptHandler) uploadFile(part uploadPart, userID, duplicates string) UploadResult {
+	file, result := h.inspectUpload(part)
+	if file == nil {
+		return result
+	}
+	saved := file.saved
+
+	// Hold the content lock until the receipt exists so a concurrent purge cannot delete the shared original
+	unlock := h.contentLocks.Lock(saved.SHA256)
+	defer unlock()
+
+	// Look for a receipt of this user with identical contents
+	if duplicates != duplicatesAllow {
+		page, err := h.Receipts.Query(models.ReceiptQuery{UserID: userID, ContentHash: saved.SHA256, Limit: 1})
+		if err != nil {
+			log.Println("Error checking for duplicate receipts:", err)
+			result.Status = http.StatusInternalServerError
+			result.Error = "could not check for duplicates"
+			return result
+		}
+		if len(page.Receipts) > 0 {
+			result.DuplicateOf = page.Receipts[0].ID
+			if duplicates == duplicatesReject {
+				result.Status = http.StatusConflict
+				result.Error = "identical file already uploaded as receipt " + result.DuplicateOf
+				return result
+			}
+			result.ReceiptID = result.DuplicateOf
+			result.Status = http.StatusOK
+			return result
+		}
+	}
+
+	// Warn about receipts that look the same even though their bytes differ
+	h.markSimilar(&result, userID, file.perceptualHash)
+
+	// Store the original unless identical contents are already stored
+	if err := services.StoreFile(h.Blobs, saved); err != nil {
+		log.Println("Error saving uploaded file:", err)
+		result.Status = http.StatusInternalServerError
+		result.Error = "could not save file"
+		return result
+	}
+
+	// Generate a unique receipt ID and store the receipt metadata
+	receipt := h.newReceipt(userID, file)
+	receipt.PageCount = saved.Pages
+	if err := h.Receipts.Create(receipt); err != nil {
+		log.Println("Error storing receipt:", err)
+		// Do not leave an orphaned original behind
+		h.releaseOriginals(receipt)
+		result.Status = http.StatusInternalServerError
+		result.Error = "could not store receipt"
+		return result
+	}
+
+	// Generate the thumbnails now so the first view does not have to wait for them
+	if h.processing != nil {
+		h.enqueueProcessing(receipt.ID)
+	}
+
+	result.ReceiptID = receipt.ID
+	result.Status = http.StatusCreated
+	return result
+}
+
+// uploadPages stores the inspected files as the pages of one new receipt, in request order, and records
+// the outcome in results. Files that failed are left out; the receipt is created if at least one page remains.
+func (h *ReceiptHandler) uploadPages(inspected []*inspectedFile, results []UploadResult, userID string) {
+	// Hold the content locks until the receipt exists so a concurrent purge cannot delete a shared original
+	var hashes []string
+	for _, file := range inspected {
+		if file != nil {
+			hashes = append(hashes, file.saved.SHA256)
+		}
+	}
+	unlock := h.contentLocks.LockAll(hashes)
+	defer unlock()
+
+	pages, stored := h.storePages(inspected, results)
+	if len(pages) == 0 {
+		return
+	}
+
+	// The first page describes the receipt and is compared with the user's other receipts
+	first := inspected[stored[0]]
+	h.markSimilar(&results[stored[0]], userID, first.perceptualHash)
+	receipt := h.newReceipt(userID, first)
+	receipt.SetPages(pages)
+	if err := h.Receipts.Create(receipt); err != nil {
+		log.Println("Error storing receipt:", err)
+		// Do not leave orphaned originals behind
+		h.releaseOriginals(receipt)
+		for _, i := range stored {
+			results[i].Status = http.StatusInternalServerError
+			results[i].Error = "could not store receipt"
+		}
+		return
+	}
+
+	// Generate the thumbnails now so the first view does not have to wait for them
+	if h.processing != nil {
+		h.enqueueProcessing(receipt.ID)
+	}
+
+	for page, i := range stored {
+		results[i].ReceiptID = receipt.ID
+		results[i].Page = page + 1
+		results[i].Status = http.StatusCreated
+	}
+}
+
+// markSimilar records the user's receipts whose images look like the uploaded one in its result
+func (h *ReceiptHandler) markSimilar(result *UploadResult, userID, perceptualHash string) {
+	if perceptualHash == "" {
+		return
+	}
+	similar, err := h.similarReceipts(userID, "", perceptualHash, h.SimilarDistance)
+	if err != nil {
+		log.Println("Error finding similar receipts:", err)
+	}
+	for _, receipt := range similar {
+		result.SimilarTo = append(result.SimilarTo, receipt.Receipt.ID)
+	}
+	result.PossibleDuplicate = len(result.SimilarTo) > 0
+}
+
+// newReceipt returns a new receipt of the user described by an uploaded file, with a unique ID
+func (h *ReceiptHandler) newReceipt(userID string, file *inspectedFile) models.Receipt {
+	receipt := models.Receipt{
+		ID:         services.GenerateReceiptID(),
+		UserID:     userID,
+		UploadedAt: time.Now().UTC(),
+	}
+	receipt.SetFile(pageFile(file))
+	if h.processing != nil {
+		receipt.ProcessingStatus = models.ProcessingPending
+	}
+	return receipt
+}
+
+// pageFile describes a stored file as the page of a receipt, with what was read from it on upload
+func pageFile(file *inspectedFile) models.PageFile {
+	page := models.PageFile{
+		FilePath:       file.saved.Path,
+		ContentHash:    file.saved.SHA256,
+		PerceptualHash: file.perceptualHash,
+		CapturedAt:     file.saved.Photo.CapturedAt,
+		CameraMake:     file.saved.Photo.CameraMake,
+		CameraModel:    file.saved.Photo.CameraModel,
+	}
+	if file.quality != nil {
+		page.ImageWidth, page.ImageHeight = file.quality.Width, file.quality.Height
+		page.Sharpness, page.Brightness = file.quality.Sharpness, file.quality.Brightness
+	}
+	return page
+}
+
+// uploadStatus returns the overall status code for a batch of per-file results
+func uploadStatus(results []UploadResult) int {
+	succeeded := 0
+	for _, result := range results {
+		if result.Error == "" {
+			succeeded++
+		}
+	}
+
+	switch {
+	case succeeded == len(results):
+		// 200 if every file turned out to be an existing receipt
+		for _, result := range results {
+			if result.Status == http.StatusCreated {
+				return http.StatusCreated
+			}
+		}
+		return http.StatusOK
+	case succeeded > 0:
+		return http.StatusMultiStatus
+	}
+
+	// Nothing was stored: use the files' status if they all failed the same way
+	for _, result := range results[1:] {
+		if result.Status != results[0].Status {
+			return http.StatusMultiStatus
+		}
+	}
+	return results[0].Status
+}
@@ -0,0 +1,379 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"receipt-uploader/services"
+	"strings"
+	"testing"
+)
+
+// Helper function to create a multipart upload request with the given files from testdata.
+// The sample files are uploaded repeatedly, so duplicates are allowed.
+func newUploadRequest(t *testing.T, fileNames ...string) *http.Request {
+	return newUploadRequestTo(t, "/receipts?duplicates=allow", fileNames...)
+}
+
+// Helper function to create a multipart upload request for the given target URL
+func newUploadRequestTo(t *testing.T, target string, fileNames ...string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, fileName := range fileNames {
+		file, err := os.Open(filepath.Join("../testdata", fileName))
+		if err != nil {
+			t.Fatalf("Failed to open test file: %v", err)
+		}
+		part, _ := writer.CreateFormFile("file", fileName)
+		io.Copy(part, file)
+		file.Close()
+	}
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, target, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req = withUser(req, "test-user")
+	return req
+}
+
+// Helper function to decode an upload response
+func decodeUploadResponse(t *testing.T, rr *httptest.ResponseRecorder) UploadResponse {
+	var response UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Expected JSON upload response, got error: %v", err)
+	}
+	return response
+}
+
+// TestUploadReceipt tests the UploadReceipt handler
+func TestUploadReceipt(t *testing.T) {
+	// Setup the in-memory store for the test
+	h, _ := setupTestEnv(t)
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/receipts", strings.NewReader(""))
+		req.Header.Set("Content-Type", "multipart/form-data")
+
+		rr := httptest.NewRecorder()
+
+		h.UploadReceipt(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status code 401, got %d", rr.Code)
+		}
+	})
+
+	t.Run("AllFilesStored", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequest(t, "test.jpg", "test.jpg"))
+
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d", rr.Code)
+		}
+		response := decodeUploadResponse(t, rr)
+		if len(response.Results) != 2 {
+			t.Fatalf("Expected 2 results, got %d", len(response.Results))
+		}
+		for _, result := range response.Results {
+			if result.ReceiptID == "" || result.FileName != "test.jpg" || result.ContentType != "image/jpeg" || result.Size == 0 {
+				t.Fatalf("Unexpected result: %+v", result)
+			}
+			receipt, err := h.Receipts.Get(result.ReceiptID)
+			if err != nil {
+				t.Fatalf("Expected receipt %s to be stored, got %v", result.ReceiptID, err)
+			}
+			if _, err := h.Blobs.Stat(receipt.FilePath); err != nil {
+				t.Fatalf("Expected the original to be in the blob store, got %v", err)
+			}
+		}
+	})
+
+	t.Run("PartialSuccess", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequest(t, "test.jpg", "test.txt"))
+
+		if rr.Code != http.StatusMultiStatus {
+			t.Fatalf("Expected status code 207, got %d", rr.Code)
+		}
+		response := decodeUploadResponse(t, rr)
+		if ok := response.Results[0]; ok.ReceiptID == "" || ok.Status != http.StatusCreated {
+			t.Fatalf("Expected first file to be stored, got %+v", ok)
+		}
+		if failed := response.Results[1]; failed.ReceiptID != "" || failed.Status != http.StatusUnsupportedMediaType || failed.Error == "" {
+			t.Fatalf("Expected second file to be rejected, got %+v", failed)
+		}
+	})
+
+	t.Run("PhotoMetadata", func(t *testing.T) {
+		// exif.jpg is stored sideways with its orientation, camera, capture time and location in EXIF
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequest(t, "exif.jpg"))
+		response := decodeUploadResponse(t, rr)
+		receipt, err := h.Receipts.Get(response.Results[0].ReceiptID)
+		if err != nil {
+			t.Fatalf("Expected the receipt to be stored, got %v", err)
+		}
+		if receipt.CapturedAt != "2024-04-30T12:31:05+02:00" || receipt.CameraMake != "Receiptcam" || receipt.CameraModel != "RC-1 Pro" {
+			t.Fatalf("Expected the photo metadata to be recorded, got %+v", receipt)
+		}
+
+		// The original is stored upright and, by default, without its location
+		blob, _, _ := h.Blobs.Get(receipt.FilePath)
+		data, _ := io.ReadAll(blob)
+		blob.Close()
+		normalized, photo, _ := services.NormalizeJPEG(data, services.MetadataRetain, h.Decoder)
+		config, _, err := image.DecodeConfig(bytes.NewReader(normalized))
+		if err != nil || config.Width != 80 || config.Height != 120 {
+			t.Fatalf("Expected an upright 80x120 original, got %+v, %v", config, err)
+		}
+		if photo.Orientation != 1 || photo.HasGPS || photo.CameraModel != "RC-1 Pro" {
+			t.Fatalf("Expected the EXIF data without rotation and location, got %+v", photo)
+		}
+	})
+
+	t.Run("QualityChecks", func(t *testing.T) {
+		h.Quality = services.QualityLimits{MinWidth: 100, MinHeight: 100, MinSharpness: 1}
+		defer func() { h.Quality = services.QualityLimits{} }()
+
+		// exif.jpg is only 80 pixels wide
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequest(t, "test.jpg", "exif.jpg"))
+		if rr.Code != http.StatusMultiStatus {
+			t.Fatalf("Expected status code 207, got %d", rr.Code)
+		}
+		response := decodeUploadResponse(t, rr)
+
+		rejected := response.Results[1]
+		if rejected.Status != http.StatusUnprocessableEntity || rejected.ReceiptID != "" || rejected.Error == "" || rejected.Reason != services.ReasonLowQuality {
+			t.Fatalf("Expected the small photo to be rejected, got %+v", rejected)
+		}
+		if len(rejected.QualityErrors) != 1 || rejected.QualityErrors[0].Check != "width" || rejected.QualityErrors[0].Measured != 80 {
+			t.Fatalf("Expected the measured width to be reported, got %+v", rejected.QualityErrors)
+		}
+
+		// The scores of accepted photos are stored on the receipt
+		accepted := response.Results[0]
+		receipt, _ := h.Receipts.Get(accepted.ReceiptID)
+		if accepted.Quality == nil || receipt.ImageWidth != 2560 || receipt.ImageHeight != 1440 || receipt.Sharpness != accepted.Quality.Sharpness || receipt.Brightness == 0 {
+			t.Fatalf("Expected the quality scores to be stored, got %+v", receipt)
+		}
+	})
+
+	t.Run("ImageTooLarge", func(t *testing.T) {
+		decoder := h.Decoder
+		h.Decoder = services.NewImageDecoder(services.DecodeLimits{MaxPixels: 1_000_000}, 1)
+		defer func() { h.Decoder = decoder }()
+
+		// test.jpg has 3.7 million pixels, exif.jpg fewer than 10 thousand
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequest(t, "test.jpg", "exif.jpg"))
+		if rr.Code != http.StatusMultiStatus {
+			t.Fatalf("Expected status code 207, got %d", rr.Code)
+		}
+		response := decodeUploadResponse(t, rr)
+		if rejected := response.Results[0]; rejected.Status != http.StatusRequestEntityTooLarge || rejected.ReceiptID != "" || rejected.Reason != services.ReasonTooLarge || !strings.Contains(rejected.Error, "2560x1440") {
+			t.Fatalf("Expected the large image to be rejected with its dimensions, got %+v", rejected)
+		}
+		if response.Results[1].Status != http.StatusCreated {
+			t.Fatalf("Expected the small image to be stored, got %+v", response.Results[1])
+		}
+	})
+
+	t.Run("InvalidImage", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequest(t, "test.txt"))
+
+		// A rejected image is the client's fault, not a server error
+		if rr.Code != http.StatusUnsupportedMediaType {
+			t.Fatalf("Expected status code 415, got %d", rr.Code)
+		}
+		response := decodeUploadResponse(t, rr)
+		if !strings.HasPrefix(response.Results[0].ContentType, "text/plain") || response.Results[0].Reason != services.ReasonUnknownFormat {
+			t.Fatalf("Expected detected content type and reason to be reported, got %+v", response.Results[0])
+		}
+	})
+
+	t.Run("FileTooLarge", func(t *testing.T) {
+		defer func(limit int64) { h.MaxFileBytes = limit }(h.MaxFileBytes)
+		h.MaxFileBytes = 100_000
+
+		// test.jpg has 564946 bytes, exif.jpg about a thousand
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequest(t, "test.jpg", "exif.jpg"))
+		if rr.Code != http.StatusMultiStatus {
+			t.Fatalf("Expected status code 207, got %d", rr.Code)
+		}
+		response := decodeUploadResponse(t, rr)
+		if rejected := response.Results[0]; rejected.Status != http.StatusRequestEntityTooLarge || rejected.Reason != services.ReasonTooLarge || !strings.Contains(rejected.Error, "564946 bytes, at most 100000") {
+			t.Fatalf("Expected the large file to be rejected with its size, got %+v", rejected)
+		}
+		if response.Results[1].Status != http.StatusCreated {
+			t.Fatalf("Expected the small file to be stored, got %+v", response.Results[1])
+		}
+	})
+
+	t.Run("RequestTooLarge", func(t *testing.T) {
+		defer func(limit int64) { h.MaxRequestBytes = limit }(h.MaxRequestBytes)
+		h.MaxRequestBytes = 100_000
+
+		// A request announcing a larger body is refused before it is read
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequest(t, "exif.jpg", "test.jpg"))
+		if rr.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rr.Body.String(), "at most 100000 bytes") {
+			t.Fatalf("Expected status code 413 with the limit, got %d %s", rr.Code, rr.Body.String())
+		}
+
+		// Without a Content-Length the files before the limit are still stored
+		req := newUploadRequest(t, "exif.jpg", "test.jpg")
+		req.ContentLength = -1
+		rr = httptest.NewRecorder()
+		h.UploadReceipt(rr, req)
+		if rr.Code != http.StatusMultiStatus {
+			t.Fatalf("Expected status code 207, got %d", rr.Code)
+		}
+		response := decodeUploadResponse(t, rr)
+		if response.Results[0].Status != http.StatusCreated {
+			t.Fatalf("Expected the first file to be stored, got %+v", response.Results[0])
+		}
+		if cutOff := response.Results[1]; cutOff.Status != http.StatusRequestEntityTooLarge || cutOff.Reason != services.ReasonTooLarge || !strings.Contains(cutOff.Error, "request body too large") {
+			t.Fatalf("Expected the file over the request limit to be rejected, got %+v", cutOff)
+		}
+	})
+
+	t.Run("RequestBrokenOff", func(t *testing.T) {
+		defer func(limit int64) { h.MaxRequestBytes = limit }(h.MaxRequestBytes)
+
+		// The body limit is hit between two files, so the second one is lost
+		req := newUploadRequest(t, "exif.jpg", "exif.jpg")
+		body, _ := io.ReadAll(req.Body)
+		h.MaxRequestBytes = int64(bytes.LastIndex(body, []byte("Content-Disposition")))
+		req.Body, req.ContentLength = io.NopCloser(bytes.NewReader(body)), -1
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, req)
+		if rr.Code != http.StatusMultiStatus {
+			t.Fatalf("Expected status code 207, got %d", rr.Code)
+		}
+		response := decodeUploadResponse(t, rr)
+		if len(response.Results) != 2 || response.Results[0].Status != http.StatusCreated {
+			t.Fatalf("Expected the first file to be stored, got %+v", response.Results)
+		}
+		if lost := response.Results[1]; lost.Status != http.StatusRequestEntityTooLarge || lost.Reason != services.ReasonTooLarge || lost.FileName != "" {
+			t.Fatalf("Expected the rest of the request to be reported as too large, got %+v", lost)
+		}
+
+		// A malformed part after the first file is reported as well
+		h.MaxRequestBytes = 0
+		req = newUploadRequest(t, "exif.jpg", "exif.jpg")
+		body, _ = io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(body[:bytes.LastIndex(body, []byte("Content-Disposition"))+10]))
+		req.ContentLength = -1
+		rr = httptest.NewRecorder()
+		h.UploadReceipt(rr, req)
+		response = decodeUploadResponse(t, rr)
+		if rr.Code != http.StatusMultiStatus || len(response.Results) != 2 || response.Results[1].Status != http.StatusBadRequest {
+			t.Fatalf("Expected the malformed rest of the request to be reported, got %d %+v", rr.Code, response.Results)
+		}
+	})
+
+	t.Run("FormatNotAllowed", func(t *testing.T) {
+		defer func(formats []string) { h.Formats = formats }(h.Formats)
+		h.Formats = []string{services.FormatPNG}
+
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequest(t, "test.jpg"))
+		result := decodeUploadResponse(t, rr).Results[0]
+		if rr.Code != http.StatusUnsupportedMediaType || result.Reason != services.ReasonFormatNotAllowed || result.ContentType != "image/jpeg" {
+			t.Fatalf("Expected a JPEG to be rejected when only PNG is allowed, got %d %+v", rr.Code, result)
+		}
+	})
+}
+
+// TestUploadDuplicates tests uploading a file the user has already uploaded
+func TestUploadDuplicates(t *testing.T) {
+	h, repo := setupTestEnv(t)
+
+	// First upload creates the receipt
+	rr := httptest.NewRecorder()
+	h.UploadReceipt(rr, newUploadRequestTo(t, "/receipts", "test.jpg"))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d", rr.Code)
+	}
+	original := decodeUploadResponse(t, rr).Results[0].ReceiptID
+
+	t.Run("ReturnExisting", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequestTo(t, "/receipts", "test.jpg"))
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", rr.Code)
+		}
+		result := decodeUploadResponse(t, rr).Results[0]
+		if result.ReceiptID != original || result.DuplicateOf != original {
+			t.Fatalf("Expected the existing receipt %s, got %+v", original, result)
+		}
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequestTo(t, "/receipts?duplicates=reject", "test.jpg"))
+
+		if rr.Code != http.StatusConflict {
+			t.Fatalf("Expected status code 409, got %d", rr.Code)
+		}
+		result := decodeUploadResponse(t, rr).Results[0]
+		if result.ReceiptID != "" || result.DuplicateOf != original || result.Error == "" {
+			t.Fatalf("Expected a conflict pointing at %s, got %+v", original, result)
+		}
+	})
+
+	t.Run("OtherUsersAreNotDuplicates", func(t *testing.T) {
+		req := newUploadRequestTo(t, "/receipts?duplicates=reject", "test.jpg")
+		req = withUser(req, "another-user")
+
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, req)
+
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Allow", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequestTo(t, "/receipts?duplicates=allow", "test.jpg"))
+
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d", rr.Code)
+		}
+		result := decodeUploadResponse(t, rr).Results[0]
+		if result.ReceiptID == "" || result.ReceiptID == original || result.DuplicateOf != "" {
+			t.Fatalf("Expected a new receipt, got %+v", result)
+		}
+
+		// Both receipts share one stored original
+		first, _ := repo.Get(original)
+		second, _ := repo.Get(result.ReceiptID)
+		if first.FilePath != second.FilePath || first.ContentHash == "" {
+			t.Fatalf("Expected a shared content-addressed original, got %s and %s", first.FilePath, second.FilePath)
+		}
+		blobs, _ := h.Blobs.List("originals/")
+		if len(blobs) != 1 {
+			t.Fatalf("Expected one stored original, got %d", len(blobs))
+		}
+	})
+
+	t.Run("InvalidPolicy", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.UploadReceipt(rr, newUploadRequestTo(t, "/receipts?duplicates=sometimes", "test.jpg"))
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("Expected status code 400, got %d", rr.Code)
+		}
+	})
+}
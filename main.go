@@ -1,64 +1,294 @@
 package main
 
 import (
+	"crypto/rand"
+	"flag"
 	"log"
 	"net/http"
-	"os"
+	"os/exec"
+	"receipt-uploader/auth"
+	"receipt-uploader/config"
 	"receipt-uploader/handlers"
 	"receipt-uploader/models"
+	"receipt-uploader/services"
 	"strings"
+	"time"
 )
 
-// Upload directory for receipts
-const uploadDir = "uploads"
-
 func main() {
-	// Ensure the uploads directory exists
-	os.MkdirAll(uploadDir, os.ModePerm)
+	configPath := flag.String("config", "config.json", "path to the JSON configuration file")
+	importJSON := flag.String("import-json", "", "import receipts from a receipts.json file into the configured store and exit")
+	flag.Parse()
 
-	// Load receipts from JSON file into memory
-	err := models.LoadReceiptsFromFile()
+	// Load the configuration, falling back to defaults if the file is missing
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+
+	// Open the configured receipt metadata store
+	repo, err := openReceiptRepository(cfg.Storage)
+	if err != nil {
+		log.Fatalf("Error opening receipt store: %v", err)
+	}
+
+	// One-shot migration of an existing receipts.json into the configured store
+	if *importJSON != "" {
+		imported, err := models.ImportJSONReceipts(repo, *importJSON)
+		if err != nil {
+			log.Fatalf("Error importing receipts: %v", err)
+		}
+		log.Printf("Imported %d receipts from %s", imported, *importJSON)
+		if closer, ok := repo.(interface{ Close() error }); ok {
+			closer.Close()
+		}
+		return
+	}
+
+	// Every request must carry a bearer token or API key
+	authenticator, err := auth.NewAuthenticator(cfg.Auth)
 	if err != nil {
-		log.Fatalf("Error loading receipts from file: %v", err)
+		log.Fatalf("Error loading authentication keys: %v", err)
+	}
+	if authenticator.Empty() {
+		log.Fatalf("No JWT keys or API keys configured in %s, every request would be rejected", *configPath)
 	}
 
+	// Open the configured store for receipt files
+	blobs, err := openBlobStore(cfg.Blobs)
+	if err != nil {
+		log.Fatalf("Error opening blob store: %v", err)
+	}
+
+	h := handlers.NewReceiptHandler(repo, blobs)
+	h.Renditions = services.NewRenditionCache(blobs, cfg.Renditions.MaxVariantBytes)
+	h.Presets = renditionPresets(cfg.Renditions.Presets)
+	h.Formats = cfg.Uploads.AllowedFormats
+	h.MaxFileBytes, h.MaxRequestBytes = cfg.Uploads.MaxFileBytes, cfg.Uploads.MaxRequestBytes
+	resumableExpiry := time.Duration(cfg.Uploads.ResumableExpiryMinutes) * time.Minute
+	h.Resumable = services.NewResumableStore(blobs, resumableExpiry)
+	h.Metadata = services.MetadataPolicy(cfg.Metadata.EXIF)
+	h.Quality = services.QualityLimits{
+		MinWidth:      cfg.Quality.MinWidth,
+		MinHeight:     cfg.Quality.MinHeight,
+		MinSharpness:  cfg.Quality.MinSharpness,
+		MinBrightness: cfg.Quality.MinBrightness,
+		MaxBrightness: cfg.Quality.MaxBrightness,
+	}
+	h.Decoder = services.NewImageDecoder(services.DecodeLimits{
+		MaxPixels:    cfg.Decoding.MaxPixels,
+		MaxDimension: cfg.Decoding.MaxDimension,
+	}, cfg.Decoding.MaxConcurrent)
+	if rasterizer, err := pdfRasterizer(cfg.PDF); err != nil {
+		log.Printf("PDF receipts are disabled: %v", err)
+	} else {
+		h.Decoder.Rasterizer = rasterizer
+	}
+	h.SimilarDistance = cfg.Similarity.MaxDistance
+
+	// Generate thumbnails in the background after each upload, resuming work interrupted by a restart
+	err = h.StartProcessing(services.JobQueueOptions{
+		Workers:     cfg.Processing.Workers,
+		Capacity:    cfg.Processing.QueueSize,
+		MaxAttempts: cfg.Processing.MaxAttempts,
+		Backoff:     time.Duration(cfg.Processing.RetryBackoffMS) * time.Millisecond,
+	})
+	if err != nil {
+		log.Fatalf("Error resuming thumbnail processing: %v", err)
+	}
+
+	// Delete abandoned resumable uploads
+	stopExpiry := h.StartUploadExpiry(min(resumableExpiry, time.Hour))
+	defer stopExpiry()
+
 	// Define routes
-	http.HandleFunc("/receipts", handleReceipts)         // unified route for both POST and GET methods on /receipts
-	http.HandleFunc("/receipts/", handleReceiptRequests) // Unified handler for /receipts/{receipt_id} and /receipts/{receipt_id}/thumbnails
+	http.HandleFunc("/receipts", handleReceipts(h))         // unified route for both POST and GET methods on /receipts
+	http.HandleFunc("/receipts/", handleReceiptRequests(h)) // Unified handler for /receipts/{receipt_id} and its sub-resources
+	http.HandleFunc("/uploads", handleUploads(h))           // Resumable uploads with the tus protocol
+	http.HandleFunc("/uploads/", handleUploadRequests(h))   // A single resumable upload
+
+	// Signed blob URLs carry their own credentials; everything else requires authentication
+	root := http.NewServeMux()
+	root.HandleFunc(services.SignedBlobPath, h.ServeSignedBlob)
+	root.Handle("/", authenticator.Middleware(http.DefaultServeMux))
 
 	// Start server
 	log.Println("Server running on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if err := http.ListenAndServe(":8080", root); err != nil {
 		log.Fatalf("Could not start server: %v", err)
 	}
 }
 
+// openReceiptRepository opens the receipt metadata store selected in the configuration
+func openReceiptRepository(cfg config.StorageConfig) (models.ReceiptRepository, error) {
+	if cfg.Driver == config.DriverSQLite {
+		return models.NewSQLiteReceiptRepository(cfg.SQLitePath)
+	}
+	// Load receipts from JSON file into memory
+	return models.NewJSONReceiptRepository(cfg.JSONFile)
+}
+
+// openBlobStore opens the blob store selected in the configuration
+func openBlobStore(cfg config.BlobConfig) (services.BlobStore, error) {
+	if cfg.Driver == config.BlobDriverS3 {
+		return services.NewS3BlobStore(services.S3Options{
+			Endpoint:        cfg.S3.Endpoint,
+			Region:          cfg.S3.Region,
+			Bucket:          cfg.S3.Bucket,
+			AccessKeyID:     cfg.S3.AccessKeyID,
+			SecretAccessKey: cfg.S3.SecretAccessKey,
+			PathStyle:       cfg.S3.PathStyle,
+		})
+	}
+
+	// Without a configured secret, signed URLs stay valid only until the process restarts
+	signingKey := []byte(cfg.SigningSecret)
+	if len(signingKey) == 0 {
+		signingKey = make([]byte, 32)
+		if _, err := rand.Read(signingKey); err != nil {
+			return nil, err
+		}
+		log.Println("No blob signing secret configured, using a random one")
+	}
+	return services.NewFileSystemBlobStore(cfg.Root, signingKey)
+}
+
+// pdfRasterizer locates the Poppler tools PDF receipts are rasterized with
+func pdfRasterizer(cfg config.PDFConfig) (services.Rasterizer, error) {
+	pdfInfo, err := exec.LookPath(cfg.PDFInfo)
+	if err != nil {
+		return nil, err
+	}
+	pdfToPPM, err := exec.LookPath(cfg.PDFToPPM)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	return services.PopplerRasterizer{PDFInfo: pdfInfo, PDFToPPM: pdfToPPM, PageSize: cfg.PageSize, Timeout: timeout}, nil
+}
+
+// renditionPresets converts the configured thumbnail presets, applying their defaults
+func renditionPresets(configured []config.PresetConfig) []services.RenditionPreset {
+	presets := make([]services.RenditionPreset, 0, len(configured))
+	for _, preset := range configured {
+		converted := services.RenditionPreset{
+			Name:    preset.Name,
+			Width:   preset.Width,
+			Height:  preset.Height,
+			Fit:     preset.Fit,
+			Format:  preset.Format,
+			Quality: preset.Quality,
+			Enhance: preset.Enhance,
+		}
+		if converted.Fit == "" {
+			converted.Fit = services.FitContain
+		}
+		if converted.Format == "" {
+			converted.Format = services.FormatJPEG
+		}
+		presets = append(presets, converted)
+	}
+	return presets
+}
+
 // handleReceipts handles both POST (upload) and GET (list receipts) methods on /receipts
-func handleReceipts(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodPost:
-		handlers.UploadReceipt(w, r)
-	case http.MethodGet:
-		handlers.ListReceipts(w, r)
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+func handleReceipts(h *handlers.ReceiptHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			h.UploadReceipt(w, r)
+		case http.MethodGet:
+			h.ListReceipts(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
 	}
 }
 
-// handleReceiptRequests handles both /receipts/{receipt_id} and /receipts/{receipt_id}/thumbnails
-func handleReceiptRequests(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// handleUploads handles POST (create) and OPTIONS (protocol discovery) on /uploads
+func handleUploads(h *handlers.ReceiptHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			h.CreateUpload(w, r)
+		case http.MethodOptions:
+			h.UploadOptions(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
 	}
+}
 
-	// Check if the URL ends with "/thumbnails"
-	if strings.HasSuffix(r.URL.Path, "/thumbnails") {
-		// Handle the thumbnail request
-		handlers.GetThumbnails(w, r)
-		return
+// handleUploadRequests handles HEAD (offset), GET (progress), PATCH (append), DELETE (abandon) and OPTIONS on /uploads/{upload_id}
+func handleUploadRequests(h *handlers.ReceiptHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			h.HeadUpload(w, r)
+		case http.MethodGet:
+			h.GetUpload(w, r)
+		case http.MethodPatch:
+			h.PatchUpload(w, r)
+		case http.MethodDelete:
+			h.DeleteUpload(w, r)
+		case http.MethodOptions:
+			h.UploadOptions(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
 	}
+}
 
-	// Otherwise, handle the receipt retrieval
-	handlers.GetReceipt(w, r)
+// handleReceiptRequests handles /receipts/{receipt_id} (GET, PATCH and DELETE), /receipts/{receipt_id}/thumbnails,
+// /receipts/{receipt_id}/thumbnails/{size}, /receipts/{receipt_id}/similar, /receipts/{receipt_id}/restore,
+// /receipts/{receipt_id}/pages (POST and PUT), /receipts/{receipt_id}/pages/{page} (DELETE) and /receipts/trash
+func handleReceiptRequests(h *handlers.ReceiptHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/receipts/trash":
+			// List the receipts in the trash
+			h.ListTrash(w, r)
+		case strings.HasSuffix(r.URL.Path, "/restore"):
+			// Move a receipt out of the trash
+			h.RestoreReceipt(w, r)
+		case strings.HasSuffix(r.URL.Path, "/similar"):
+			// List receipts whose images look alike
+			h.GetSimilarReceipts(w, r)
+		case strings.Contains(r.URL.Path, "/pages/"):
+			// Remove a page
+			h.DeletePage(w, r)
+		case strings.HasSuffix(r.URL.Path, "/pages"):
+			// Append pages or reorder them
+			switch r.Method {
+			case http.MethodPost:
+				h.AppendPages(w, r)
+			case http.MethodPut:
+				h.ReorderPages(w, r)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		case strings.Contains(r.URL.Path, "/thumbnails/"):
+			// Serve the image of a single thumbnail size
+			h.GetThumbnail(w, r)
+		case strings.HasSuffix(r.URL.Path, "/thumbnails"):
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			// Handle the thumbnail request
+			h.GetThumbnails(w, r)
+		default:
+			// Otherwise, handle the receipt itself
+			switch r.Method {
+			case http.MethodGet:
+				h.GetReceipt(w, r)
+			case http.MethodPatch:
+				h.PatchReceipt(w, r)
+			case http.MethodDelete:
+				h.DeleteReceipt(w, r)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		}
+	}
 }
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ImportJSONReceipts copies every receipt from a receipts.json file written by JSONReceiptRepository
+// (including entries still in its append log) into the target repository.
+// Receipts whose ID already exists in the target are skipped, so the import can safely be re-run.
+// It returns the number of receipts imported.
+func ImportJSONReceipts(target ReceiptRepository, jsonPath string) (int, error) {
+	receipts, err := readJSONStore(jsonPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", jsonPath, err)
+	}
+
+	imported := 0
+	for id, receipt := range receipts {
+		_, err := target.Get(id)
+		if err == nil {
+			continue // Already imported
+		}
+		if !errors.Is(err, ErrReceiptNotFound) {
+			return imported, err
+		}
+		if err := target.Create(receipt); err != nil {
+			return imported, fmt.Errorf("failed to import receipt %s: %v", id, err)
+		}
+		imported++
+	}
+	return imported, nil
+}
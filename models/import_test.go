@@ -0,0 +1,43 @@
+package models
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestImportJSONReceipts tests migrating a receipts.json file into the SQLite repository
+func TestImportJSONReceipts(t *testing.T) {
+	tmpDir := t.TempDir()
+	jsonPath := filepath.Join(tmpDir, "receipts.json")
+
+	// A receipts.json in the format written by SaveReceiptsToFile
+	data := `{
+  "1": {"ID": "1", "FilePath": "uploads/1.jpg", "UserID": "user1"},
+  "2": {"ID": "2", "FilePath": "uploads/2.jpg", "UserID": "user2"}
+}`
+	if err := os.WriteFile(jsonPath, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write receipts.json: %v", err)
+	}
+
+	target, _ := newTestSQLiteRepository(t)
+
+	imported, err := ImportJSONReceipts(target, jsonPath)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if imported != 2 {
+		t.Fatalf("Expected 2 imported receipts, got %d", imported)
+	}
+
+	receipt, err := target.Get("2")
+	if err != nil || receipt.UserID != "user2" || receipt.FilePath != "uploads/2.jpg" {
+		t.Fatalf("Receipt 2 was not imported correctly: %v", err)
+	}
+
+	// Re-running the import must not duplicate or fail
+	imported, err = ImportJSONReceipts(target, jsonPath)
+	if err != nil || imported != 0 {
+		t.Fatalf("Expected re-import to skip existing receipts, got %d, %v", imported, err)
+	}
+}
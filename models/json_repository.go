@@ -0,0 +1,285 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Number of log entries after which the log is folded into the JSON snapshot
+const compactThreshold = 100
+
+// Operations recorded in the append log
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// logEntry is a single mutation recorded in the append log
+type logEntry struct {
+	Op      string   `json:"op"`
+	ID      string   `json:"id"`
+	Receipt *Receipt `json:"receipt,omitempty"`
+}
+
+// JSONReceiptRepository keeps receipts in memory and persists them to a JSON file.
+// Every mutation is first appended and fsynced to a write-ahead log next to the file,
+// so an acknowledged write survives a crash; the log is periodically compacted into
+// the JSON snapshot, which is always replaced atomically.
+type JSONReceiptRepository struct {
+	*MemoryReceiptRepository
+	mu         sync.Mutex // Serializes writers so the log and memory stay in the same order
+	filePath   string     // File where receipts are stored
+	logFile    *os.File   // Append log of mutations since the last snapshot
+	logEntries int        // Number of entries currently in the append log
+}
+
+// NewJSONReceiptRepository creates a repository backed by the given JSON file and loads any existing receipts from it.
+// Mutations that were logged but not yet compacted before a crash are replayed.
+func NewJSONReceiptRepository(filePath string) (*JSONReceiptRepository, error) {
+	receipts, err := readJSONStore(filePath)
+	if err != nil {
+		return nil, err
+	}
+	repo := &JSONReceiptRepository{
+		MemoryReceiptRepository: newMemoryReceiptRepository(receipts),
+		filePath:                filePath,
+	}
+
+	// Fold the replayed log into a fresh snapshot and start with an empty log
+	if err := repo.compact(); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// Create stores a new receipt and logs it to disk
+func (j *JSONReceiptRepository) Create(receipt Receipt) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// Check before logging, since replaying the log would otherwise overwrite the existing receipt
+	if _, err := j.MemoryReceiptRepository.Get(receipt.ID); err == nil {
+		return ErrReceiptExists
+	}
+	if err := j.appendLog(logEntry{Op: opPut, ID: receipt.ID, Receipt: &receipt}); err != nil {
+		return err
+	}
+	if err := j.MemoryReceiptRepository.Create(receipt); err != nil {
+		return err
+	}
+	j.compactIfFull()
+	return nil
+}
+
+// Update replaces an existing receipt and logs it to disk
+func (j *JSONReceiptRepository) Update(receipt Receipt) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.MemoryReceiptRepository.Get(receipt.ID); err != nil {
+		return err
+	}
+	if err := j.appendLog(logEntry{Op: opPut, ID: receipt.ID, Receipt: &receipt}); err != nil {
+		return err
+	}
+	if err := j.MemoryReceiptRepository.Update(receipt); err != nil {
+		return err
+	}
+	j.compactIfFull()
+	return nil
+}
+
+// Delete removes a receipt and logs the deletion to disk
+func (j *JSONReceiptRepository) Delete(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.MemoryReceiptRepository.Get(id); err != nil {
+		return err
+	}
+	if err := j.appendLog(logEntry{Op: opDelete, ID: id}); err != nil {
+		return err
+	}
+	if err := j.MemoryReceiptRepository.Delete(id); err != nil {
+		return err
+	}
+	j.compactIfFull()
+	return nil
+}
+
+// Close compacts the log into the snapshot and releases the log file
+func (j *JSONReceiptRepository) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.compact(); err != nil {
+		return err
+	}
+	return j.logFile.Close()
+}
+
+// logPath returns the path of the append log for a JSON file
+func logPath(filePath string) string {
+	return filePath + ".log"
+}
+
+// appendLog writes the entry to the append log and fsyncs it before returning.
+// The caller must hold j.mu.
+func (j *JSONReceiptRepository) appendLog(entry logEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := j.logFile.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to append to receipt log: %v", err)
+	}
+	if err := j.logFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync receipt log: %v", err)
+	}
+
+	j.logEntries++
+	return nil
+}
+
+// compactIfFull compacts the log once it holds compactThreshold entries. It runs after the logged
+// mutation was applied in memory, so the snapshot includes it. The caller must hold j.mu.
+func (j *JSONReceiptRepository) compactIfFull() {
+	if j.logEntries < compactThreshold {
+		return
+	}
+	// The entries are already durable in the log, so a failed compaction only delays cleanup
+	if err := j.compact(); err != nil {
+		log.Println("Error compacting receipt log:", err)
+	}
+}
+
+// compact saves the in-memory receipts as the new snapshot and truncates the append log.
+// The caller must hold j.mu (or be the constructor).
+func (j *JSONReceiptRepository) compact() error {
+	if err := j.saveToFile(); err != nil {
+		return err
+	}
+
+	// The snapshot now contains every logged mutation, so the log can start over.
+	// The old log is only closed once the new one is open, so a failure leaves a usable log behind.
+	logFile, err := os.OpenFile(logPath(j.filePath), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if j.logFile != nil {
+		j.logFile.Close()
+	}
+	j.logFile = logFile
+	j.logEntries = 0
+	return nil
+}
+
+// saveToFile atomically replaces the JSON file with the current in-memory receipts
+func (j *JSONReceiptRepository) saveToFile() error {
+	data, err := json.MarshalIndent(j.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.filePath, data, 0644)
+}
+
+// readJSONStore loads the receipts saved in a JSON file and applies the mutations
+// recorded in its append log on top of them
+func readJSONStore(filePath string) (map[string]Receipt, error) {
+	receipts := make(map[string]Receipt)
+	if err := loadFromFile(filePath, receipts); err != nil {
+		return nil, err
+	}
+	if err := replayLog(logPath(filePath), receipts); err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+// loadFromFile loads the receipt data from the JSON file into receipts
+func loadFromFile(filePath string, receipts map[string]Receipt) error {
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return nil // If the file doesn't exist, skip loading
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &receipts)
+}
+
+// replayLog applies the mutations recorded in the append log to receipts
+func replayLog(logFilePath string, receipts map[string]Receipt) error {
+	data, err := os.ReadFile(logFilePath)
+	if os.IsNotExist(err) {
+		return nil // Nothing was logged since the last snapshot
+	}
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		var entry logEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn final line means the process crashed mid-append, before that write was acknowledged
+			log.Println("Skipping incomplete receipt log entry:", err)
+			continue
+		}
+		switch entry.Op {
+		case opPut:
+			if entry.Receipt != nil {
+				receipts[entry.ID] = *entry.Receipt
+			}
+		case opDelete:
+			delete(receipts, entry.ID)
+		}
+	}
+	return scanner.Err()
+}
+
+// writeFileAtomic writes data to a temporary file, fsyncs it and renames it over path,
+// so readers see either the old or the new contents and never a partial write
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // No-op once the rename succeeded
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// Sync the directory so the rename itself is durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,224 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestSaveAndLoadReceipts tests the saving and loading of receipts to/from a file
+func TestSaveAndLoadReceipts(t *testing.T) {
+	receiptFile := filepath.Join(t.TempDir(), "test_receipts.json")
+
+	repo, err := NewJSONReceiptRepository(receiptFile)
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+
+	// Add some receipts to the repository and store to file
+	repo.Create(Receipt{ID: "1", FilePath: "/path/to/receipt1.jpg", UserID: "user1"})
+	repo.Create(Receipt{ID: "2", FilePath: "/path/to/receipt2.jpg", UserID: "user2"})
+
+	// Retrieve the receipt and verify the details
+	receipt, err := repo.Get("1")
+	if err != nil || receipt.UserID != "user1" || receipt.FilePath != "/path/to/receipt1.jpg" {
+		t.Fatalf("Receipt was not stored or retrieved correctly")
+	}
+
+	// Open a fresh repository on the same file to load the receipts back
+	reloaded, err := NewJSONReceiptRepository(receiptFile)
+	if err != nil {
+		t.Fatalf("Failed to load receipts from file: %v", err)
+	}
+
+	// Verify the receipts were loaded correctly
+	receipt1, err := reloaded.Get("1")
+	if err != nil || receipt1.UserID != "user1" || receipt1.FilePath != "/path/to/receipt1.jpg" {
+		t.Fatalf("Receipt 1 was not loaded correctly")
+	}
+
+	receipt2, err := reloaded.Get("2")
+	if err != nil || receipt2.UserID != "user2" || receipt2.FilePath != "/path/to/receipt2.jpg" {
+		t.Fatalf("Receipt 2 was not loaded correctly")
+	}
+}
+
+// TestDeletePersisted tests that deletions are written to the file
+func TestDeletePersisted(t *testing.T) {
+	receiptFile := filepath.Join(t.TempDir(), "test_receipts.json")
+
+	repo, err := NewJSONReceiptRepository(receiptFile)
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	repo.Create(Receipt{ID: "1", FilePath: "/path/to/receipt1.jpg", UserID: "user1"})
+	if err := repo.Delete("1"); err != nil {
+		t.Fatalf("Failed to delete receipt: %v", err)
+	}
+
+	reloaded, err := NewJSONReceiptRepository(receiptFile)
+	if err != nil {
+		t.Fatalf("Failed to load receipts from file: %v", err)
+	}
+	if receipts, _ := reloaded.List("user1"); len(receipts) != 0 {
+		t.Fatalf("Expected deleted receipt to stay deleted, got %v", receipts)
+	}
+}
+
+// TestLoadReceiptsFromFileMissing tests loading receipts from a missing file
+func TestLoadReceiptsFromFileMissing(t *testing.T) {
+	receiptFile := filepath.Join(t.TempDir(), "missing_receipts.json")
+
+	// Ensure the receipt file does not exist
+	os.Remove(receiptFile)
+
+	// Attempt to load receipts from a missing file (should not error)
+	_, err := NewJSONReceiptRepository(receiptFile)
+	if err != nil {
+		t.Fatalf("Expected no error when loading from a missing file, got: %v", err)
+	}
+}
+
+// TestConcurrentCreate tests that concurrent writers do not lose or corrupt receipts
+func TestConcurrentCreate(t *testing.T) {
+	receiptFile := filepath.Join(t.TempDir(), "test_receipts.json")
+
+	repo, err := NewJSONReceiptRepository(receiptFile)
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+
+	// Store receipts from many goroutines at once, enough to trigger compaction
+	var wg sync.WaitGroup
+	for i := 0; i < 2*compactThreshold; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := repo.Create(Receipt{ID: fmt.Sprintf("%03d", i), UserID: "user1"}); err != nil {
+				t.Errorf("Failed to create receipt: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err := repo.Close(); err != nil {
+		t.Fatalf("Failed to close repository: %v", err)
+	}
+
+	reloaded, err := NewJSONReceiptRepository(receiptFile)
+	if err != nil {
+		t.Fatalf("Failed to load receipts from file: %v", err)
+	}
+	if receipts, _ := reloaded.List("user1"); len(receipts) != 2*compactThreshold {
+		t.Fatalf("Expected %d receipts, got %d", 2*compactThreshold, len(receipts))
+	}
+
+	// The atomic writes must not leave temporary files behind
+	matches, _ := filepath.Glob(receiptFile + ".tmp-*")
+	if len(matches) != 0 {
+		t.Fatalf("Expected no temporary files, got %v", matches)
+	}
+}
+
+// TestReplayLogAfterCrash tests that logged receipts survive when the snapshot was never rewritten
+func TestReplayLogAfterCrash(t *testing.T) {
+	receiptFile := filepath.Join(t.TempDir(), "test_receipts.json")
+
+	repo, err := NewJSONReceiptRepository(receiptFile)
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	repo.Create(Receipt{ID: "1", FilePath: "/path/to/receipt1.jpg", UserID: "user1"})
+	repo.Create(Receipt{ID: "2", FilePath: "/path/to/receipt2.jpg", UserID: "user1"})
+	repo.Delete("2")
+
+	// Simulate a crash in the middle of appending the next entry
+	f, err := os.OpenFile(receiptFile+".log", os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open receipt log: %v", err)
+	}
+	f.WriteString(`{"op":"put","id":"3","rece`)
+	f.Close()
+
+	// Reopen without closing the first repository, as a restarted process would
+	reloaded, err := NewJSONReceiptRepository(receiptFile)
+	if err != nil {
+		t.Fatalf("Failed to load receipts after crash: %v", err)
+	}
+
+	receipts, _ := reloaded.List("user1")
+	if len(receipts) != 1 || receipts[0].ID != "1" {
+		t.Fatalf("Expected only receipt 1 to survive, got %v", receipts)
+	}
+}
+
+// TestCompactionKeepsLastWrite tests that the write which triggers a compaction is part of the new snapshot
+func TestCompactionKeepsLastWrite(t *testing.T) {
+	receiptFile := filepath.Join(t.TempDir(), "test_receipts.json")
+
+	repo, err := NewJSONReceiptRepository(receiptFile)
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	for i := 1; i <= compactThreshold; i++ {
+		if err := repo.Create(Receipt{ID: fmt.Sprint(i), UserID: "user1"}); err != nil {
+			t.Fatalf("Failed to create receipt %d: %v", i, err)
+		}
+	}
+
+	// Reopen without closing the first repository, as a restarted process would
+	reloaded, err := NewJSONReceiptRepository(receiptFile)
+	if err != nil {
+		t.Fatalf("Failed to load receipts after crash: %v", err)
+	}
+	if _, err := reloaded.Get(fmt.Sprint(compactThreshold)); err != nil {
+		t.Fatalf("Expected the write that triggered the compaction to survive, got %v", err)
+	}
+	if receipts, _ := reloaded.List("user1"); len(receipts) != compactThreshold {
+		t.Fatalf("Expected %d receipts, got %d", compactThreshold, len(receipts))
+	}
+
+	// The original repository keeps logging after the compaction
+	if err := repo.Create(Receipt{ID: "next", UserID: "user1"}); err != nil {
+		t.Fatalf("Expected writes after the compaction to succeed, got %v", err)
+	}
+}
+
+// TestCreateExistingIsNotLogged tests that a rejected create does not replace the receipt when the log is replayed
+func TestCreateExistingIsNotLogged(t *testing.T) {
+	receiptFile := filepath.Join(t.TempDir(), "test_receipts.json")
+
+	repo, err := NewJSONReceiptRepository(receiptFile)
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	repo.Create(Receipt{ID: "1", FilePath: "/path/to/receipt1.jpg", UserID: "user1"})
+	if err := repo.Create(Receipt{ID: "1", FilePath: "/path/to/other.jpg", UserID: "user2"}); !errors.Is(err, ErrReceiptExists) {
+		t.Fatalf("Expected ErrReceiptExists, got %v", err)
+	}
+
+	// Reopen without closing the first repository, as a restarted process would
+	reloaded, err := NewJSONReceiptRepository(receiptFile)
+	if err != nil {
+		t.Fatalf("Failed to load receipts after crash: %v", err)
+	}
+	receipt, _ := reloaded.Get("1")
+	if receipt.UserID != "user1" || receipt.FilePath != "/path/to/receipt1.jpg" {
+		t.Fatalf("Expected the original receipt after replay, got %v", receipt)
+	}
+}
+
+// TestJSONReceiptRepository tests the basic CRUD operations of the JSON repository
+func TestJSONReceiptRepository(t *testing.T) {
+	repo, err := NewJSONReceiptRepository(filepath.Join(t.TempDir(), "test_receipts.json"))
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	testReceiptRepository(t, repo)
+	testReceiptQuery(t, repo)
+}
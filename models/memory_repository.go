@@ -0,0 +1,187 @@
+package models
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryReceiptRepository keeps receipts in memory only.
+// It is used by tests and as the in-memory index of JSONReceiptRepository.
+// It is safe for concurrent use.
+type MemoryReceiptRepository struct {
+	mu        sync.RWMutex
+	receipts  map[string]Receipt
+	byUser    map[string]map[string]struct{} // Receipt IDs per user, so queries do not scan other users' receipts
+	byContent map[string]map[string]struct{} // Receipt IDs per content hash of any page, so shared originals can be counted
+}
+
+// NewMemoryReceiptRepository creates an empty in-memory repository
+func NewMemoryReceiptRepository() *MemoryReceiptRepository {
+	return newMemoryReceiptRepository(make(map[string]Receipt))
+}
+
+// newMemoryReceiptRepository creates a repository holding the given receipts
+func newMemoryReceiptRepository(receipts map[string]Receipt) *MemoryReceiptRepository {
+	m := &MemoryReceiptRepository{
+		receipts:  receipts,
+		byUser:    make(map[string]map[string]struct{}),
+		byContent: make(map[string]map[string]struct{}),
+	}
+	for _, receipt := range receipts {
+		m.index(receipt)
+	}
+	return m
+}
+
+// Create stores a new receipt
+func (m *MemoryReceiptRepository) Create(receipt Receipt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.receipts[receipt.ID]; exists {
+		return ErrReceiptExists
+	}
+	m.put(receipt)
+	return nil
+}
+
+// Get retrieves a receipt by ID
+func (m *MemoryReceiptRepository) Get(id string) (Receipt, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	receipt, exists := m.receipts[id]
+	if !exists {
+		return Receipt{}, ErrReceiptNotFound
+	}
+	return receipt, nil
+}
+
+// List returns all receipts for a given user
+func (m *MemoryReceiptRepository) List(userID string) ([]Receipt, error) {
+	page, err := m.Query(ReceiptQuery{UserID: userID})
+	return page.Receipts, err
+}
+
+// Update replaces an existing receipt
+func (m *MemoryReceiptRepository) Update(receipt Receipt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.receipts[receipt.ID]; !exists {
+		return ErrReceiptNotFound
+	}
+	m.put(receipt)
+	return nil
+}
+
+// put stores the receipt, replacing any receipt with the same ID. The caller must hold m.mu.
+func (m *MemoryReceiptRepository) put(receipt Receipt) {
+	if existing, exists := m.receipts[receipt.ID]; exists {
+		m.unindex(existing)
+	}
+	m.receipts[receipt.ID] = receipt
+	m.index(receipt)
+}
+
+// Delete removes a receipt by ID
+func (m *MemoryReceiptRepository) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, exists := m.receipts[id]
+	if !exists {
+		return ErrReceiptNotFound
+	}
+	m.unindex(existing)
+	delete(m.receipts, id)
+	return nil
+}
+
+// Query returns one page of receipts matching the query
+func (m *MemoryReceiptRepository) Query(query ReceiptQuery) (ReceiptPage, error) {
+	after, err := query.decodeCursor()
+	if err != nil {
+		return ReceiptPage{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Only look at the user's own receipts, or the receipts sharing an original, when the query is scoped to them
+	var receipts []Receipt
+	collect := func(receipt Receipt) {
+		if query.Matches(receipt) && (after == nil || query.afterCursor(receipt, after)) {
+			receipts = append(receipts, receipt)
+		}
+	}
+	if query.UserID != "" {
+		for id := range m.byUser[query.UserID] {
+			collect(m.receipts[id])
+		}
+	} else if query.ContentHash != "" {
+		for id := range m.byContent[query.ContentHash] {
+			collect(m.receipts[id])
+		}
+	} else {
+		for _, receipt := range m.receipts {
+			collect(receipt)
+		}
+	}
+
+	// Sort so results do not depend on map iteration order
+	sort.Slice(receipts, func(i, j int) bool { return query.less(receipts[i], receipts[j]) })
+
+	page := ReceiptPage{Receipts: receipts}
+	if query.Limit > 0 && len(receipts) > query.Limit {
+		page.Receipts = receipts[:query.Limit]
+		page.NextCursor = query.cursorAfter(page.Receipts[query.Limit-1])
+	}
+	return page, nil
+}
+
+// snapshot returns a copy of all stored receipts keyed by ID
+func (m *MemoryReceiptRepository) snapshot() map[string]Receipt {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	receipts := make(map[string]Receipt, len(m.receipts))
+	for id, receipt := range m.receipts {
+		receipts[id] = receipt
+	}
+	return receipts
+}
+
+// index adds the receipt to the user and content indexes. The caller must hold m.mu.
+func (m *MemoryReceiptRepository) index(receipt Receipt) {
+	addToIndex(m.byUser, receipt.UserID, receipt.ID)
+	for _, file := range receipt.Files() {
+		if file.ContentHash != "" {
+			addToIndex(m.byContent, file.ContentHash, receipt.ID)
+		}
+	}
+}
+
+// unindex removes the receipt from the user and content indexes. The caller must hold m.mu.
+func (m *MemoryReceiptRepository) unindex(receipt Receipt) {
+	removeFromIndex(m.byUser, receipt.UserID, receipt.ID)
+	for _, file := range receipt.Files() {
+		removeFromIndex(m.byContent, file.ContentHash, receipt.ID)
+	}
+}
+
+// addToIndex records id under key
+func addToIndex(index map[string]map[string]struct{}, key, id string) {
+	if index[key] == nil {
+		index[key] = make(map[string]struct{})
+	}
+	index[key][id] = struct{}{}
+}
+
+// removeFromIndex removes id from key, dropping keys that become empty
+func removeFromIndex(index map[string]map[string]struct{}, key, id string) {
+	delete(index[key], id)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
@@ -0,0 +1,9 @@
+package models
+
+import "testing"
+
+// TestMemoryReceiptRepository tests the basic CRUD operations of the in-memory repository
+func TestMemoryReceiptRepository(t *testing.T) {
+	testReceiptRepository(t, NewMemoryReceiptRepository())
+	testReceiptQuery(t, NewMemoryReceiptRepository())
+}
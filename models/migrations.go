@@ -0,0 +1,271 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// migration is a versioned schema change applied to the SQLite database
+type migration struct {
+	version    int
+	name       string
+	statements []string
+	apply      func(tx *sql.Tx) error // Optional data migration run after the statements
+}
+
+// sqliteMigrations lists every schema change in order. Never edit an applied migration; append a new one instead.
+var sqliteMigrations = []migration{
+	{
+		version: 1,
+		name:    "create receipts",
+		statements: []string{
+			`CREATE TABLE receipts (
+				id          TEXT PRIMARY KEY,
+				file_path   TEXT NOT NULL,
+				user_id     TEXT NOT NULL,
+				uploaded_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+			)`,
+			`CREATE INDEX idx_receipts_user_id ON receipts (user_id)`,
+			`CREATE INDEX idx_receipts_uploaded_at ON receipts (uploaded_at)`,
+			`CREATE INDEX idx_receipts_user_id_uploaded_at ON receipts (user_id, uploaded_at)`,
+		},
+	},
+	{
+		version: 2,
+		name:    "add receipt details",
+		statements: []string{
+			`ALTER TABLE receipts ADD COLUMN merchant TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE receipts ADD COLUMN transaction_date TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE receipts ADD COLUMN total TEXT`,
+			`ALTER TABLE receipts ADD COLUMN currency TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE receipts ADD COLUMN tax_lines TEXT NOT NULL DEFAULT '[]'`,
+			`ALTER TABLE receipts ADD COLUMN category TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE receipts ADD COLUMN notes TEXT NOT NULL DEFAULT ''`,
+			// Widen existing millisecond timestamps to the fixed nanosecond width so they keep sorting correctly
+			`UPDATE receipts SET uploaded_at = strftime('%Y-%m-%dT%H:%M:%f', uploaded_at) || '000000Z'`,
+		},
+	},
+	{
+		version: 3,
+		name:    "add receipt trash",
+		statements: []string{
+			`ALTER TABLE receipts ADD COLUMN deleted_at TEXT`,
+		},
+	},
+	{
+		version: 4,
+		name:    "add receipt query indexes",
+		statements: []string{
+			// Fixed-width encoding of total so amounts can be compared and sorted lexically with an index
+			`ALTER TABLE receipts ADD COLUMN total_sort TEXT`,
+			`CREATE INDEX idx_receipts_user_id_total_sort ON receipts (user_id, total_sort)`,
+			`CREATE INDEX idx_receipts_user_id_transaction_date ON receipts (user_id, transaction_date)`,
+		},
+		apply: backfillTotalSort,
+	},
+	{
+		version: 5,
+		name:    "add receipt content hash",
+		statements: []string{
+			`ALTER TABLE receipts ADD COLUMN content_hash TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX idx_receipts_content_hash ON receipts (content_hash)`,
+		},
+	},
+	{
+		version: 6,
+		name:    "add receipt perceptual hash",
+		statements: []string{
+			`ALTER TABLE receipts ADD COLUMN perceptual_hash TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 7,
+		name:    "add receipt processing status",
+		statements: []string{
+			`ALTER TABLE receipts ADD COLUMN processing_status TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE receipts ADD COLUMN processing_error TEXT NOT NULL DEFAULT ''`,
+			// Unfinished receipts are looked up on startup to resume their processing
+			`CREATE INDEX idx_receipts_processing_status ON receipts (processing_status)`,
+		},
+	},
+	{
+		version: 8,
+		name:    "add receipt photo metadata",
+		statements: []string{
+			`ALTER TABLE receipts ADD COLUMN captured_at TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE receipts ADD COLUMN camera_make TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE receipts ADD COLUMN camera_model TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 9,
+		name:    "add receipt image quality",
+		statements: []string{
+			`ALTER TABLE receipts ADD COLUMN image_width INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE receipts ADD COLUMN image_height INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE receipts ADD COLUMN sharpness REAL NOT NULL DEFAULT 0`,
+			`ALTER TABLE receipts ADD COLUMN brightness REAL NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version: 10,
+		name:    "add receipt page count",
+		statements: []string{
+			`ALTER TABLE receipts ADD COLUMN page_count INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version: 11,
+		name:    "add receipt pages",
+		statements: []string{
+			`CREATE TABLE receipt_pages (
+				receipt_id      TEXT NOT NULL,
+				position        INTEGER NOT NULL,
+				file_path       TEXT NOT NULL,
+				content_hash    TEXT NOT NULL DEFAULT '',
+				perceptual_hash TEXT NOT NULL DEFAULT '',
+				PRIMARY KEY (receipt_id, position)
+			)`,
+			// Originals shared with other receipts are looked up by content hash
+			`CREATE INDEX idx_receipt_pages_content_hash ON receipt_pages (content_hash)`,
+		},
+	},
+	{
+		version: 12,
+		name:    "add receipt page metadata",
+		statements: []string{
+			`ALTER TABLE receipt_pages ADD COLUMN captured_at TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE receipt_pages ADD COLUMN camera_make TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE receipt_pages ADD COLUMN camera_model TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE receipt_pages ADD COLUMN image_width INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE receipt_pages ADD COLUMN image_height INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE receipt_pages ADD COLUMN sharpness REAL NOT NULL DEFAULT 0`,
+			`ALTER TABLE receipt_pages ADD COLUMN brightness REAL NOT NULL DEFAULT 0`,
+			// The receipt's own columns describe its first page
+			`UPDATE receipt_pages SET (captured_at, camera_make, camera_model, image_width, image_height, sharpness, brightness) =
+				(SELECT captured_at, camera_make, camera_model, image_width, image_height, sharpness, brightness FROM receipts WHERE receipts.id = receipt_pages.receipt_id)
+				WHERE position = 1`,
+		},
+	},
+	{
+		version: 13,
+		name:    "add case-folded category and merchant",
+		statements: []string{
+			// SQLite only folds ASCII letters, so the folded values are computed in Go
+			`ALTER TABLE receipts ADD COLUMN category_folded TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE receipts ADD COLUMN merchant_folded TEXT NOT NULL DEFAULT ''`,
+		},
+		apply: backfillFoldedColumns,
+	},
+}
+
+// migrate applies all migrations that have not been recorded in schema_migrations yet.
+// Each migration runs in its own transaction together with its bookkeeping row.
+func migrate(db *sql.DB, migrations []migration) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue // Already applied
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs a single migration inside a transaction
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op after a successful commit
+
+	for _, statement := range m.statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	if m.apply != nil {
+		if err := m.apply(tx); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// backfillTotalSort fills total_sort for receipts that already have a total
+func backfillTotalSort(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, total FROM receipts WHERE total IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	totals := make(map[string]decimal.Decimal)
+	for rows.Next() {
+		var id string
+		var total decimal.Decimal
+		if err := rows.Scan(&id, &total); err != nil {
+			rows.Close()
+			return err
+		}
+		totals[id] = total
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, total := range totals {
+		if _, err := tx.Exec(`UPDATE receipts SET total_sort = ? WHERE id = ?`, sortableAmount(total), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillFoldedColumns fills category_folded and merchant_folded for existing receipts
+func backfillFoldedColumns(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, category, merchant FROM receipts WHERE category != '' OR merchant != ''`)
+	if err != nil {
+		return err
+	}
+	folded := make(map[string][2]string)
+	for rows.Next() {
+		var id, category, merchant string
+		if err := rows.Scan(&id, &category, &merchant); err != nil {
+			rows.Close()
+			return err
+		}
+		folded[id] = [2]string{foldCase(category), foldCase(merchant)}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, values := range folded {
+		if _, err := tx.Exec(`UPDATE receipts SET category_folded = ?, merchant_folded = ? WHERE id = ?`, values[0], values[1], id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+// TestMigrateFailureRollsBack tests that a failing migration leaves no partial changes behind
+func TestMigrateFailureRollsBack(t *testing.T) {
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	migrations := []migration{
+		{version: 1, name: "create table", statements: []string{`CREATE TABLE a (id TEXT)`}},
+		{version: 2, name: "broken", statements: []string{`CREATE TABLE b (id TEXT)`, `NOT VALID SQL`}},
+	}
+	if err := migrate(db, migrations); err == nil {
+		t.Fatalf("Expected broken migration to fail")
+	}
+
+	// Version 1 is applied, version 2 is rolled back entirely
+	var version int
+	db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if version != 1 {
+		t.Fatalf("Expected schema version 1, got %d", version)
+	}
+	var tables int
+	db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'b'`).Scan(&tables)
+	if tables != 0 {
+		t.Fatalf("Expected table b to be rolled back")
+	}
+
+	// Fixing the migration lets it apply on the next run
+	migrations[1].statements = []string{`CREATE TABLE b (id TEXT)`}
+	if err := migrate(db, migrations); err != nil {
+		t.Fatalf("Expected fixed migration to apply, got %v", err)
+	}
+}
+
+// TestMigrateBackfillsTotalSort tests that existing totals become sortable when the query indexes are added
+func TestMigrateBackfillsTotalSort(t *testing.T) {
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// Migrate up to the version before total_sort existed and store a receipt with a total
+	if err := migrate(db, sqliteMigrations[:3]); err != nil {
+		t.Fatalf("Failed to apply initial migrations: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO receipts (id, file_path, user_id, total) VALUES ('1', 'a.jpg', 'user1', '12.5')`); err != nil {
+		t.Fatalf("Failed to insert receipt: %v", err)
+	}
+
+	if err := migrate(db, sqliteMigrations); err != nil {
+		t.Fatalf("Failed to apply remaining migrations: %v", err)
+	}
+
+	var totalSort string
+	db.QueryRow(`SELECT total_sort FROM receipts WHERE id = '1'`).Scan(&totalSort)
+	if totalSort != sortableAmount(decimal.RequireFromString("12.5")) {
+		t.Fatalf("Expected total_sort to be backfilled, got %q", totalSort)
+	}
+}
+
+// TestMigrateBackfillsPageMetadata tests that the first page of a receipt inherits the receipt's metadata when pages record their own
+func TestMigrateBackfillsPageMetadata(t *testing.T) {
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// Migrate up to the version before pages had metadata and store a receipt with two pages
+	if err := migrate(db, sqliteMigrations[:11]); err != nil {
+		t.Fatalf("Failed to apply initial migrations: %v", err)
+	}
+	for _, statement := range []string{
+		`INSERT INTO receipts (id, file_path, user_id, camera_make, image_width, brightness) VALUES ('1', 'a.jpg', 'user1', 'Receiptcam', 1200, 230.5)`,
+		`INSERT INTO receipt_pages (receipt_id, position, file_path) VALUES ('1', 1, 'a.jpg'), ('1', 2, 'b.jpg')`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("Failed to insert receipt: %v", err)
+		}
+	}
+
+	if err := migrate(db, sqliteMigrations); err != nil {
+		t.Fatalf("Failed to apply remaining migrations: %v", err)
+	}
+
+	var cameraMake string
+	var width int
+	var brightness float64
+	db.QueryRow(`SELECT camera_make, image_width, brightness FROM receipt_pages WHERE receipt_id = '1' AND position = 1`).Scan(&cameraMake, &width, &brightness)
+	if cameraMake != "Receiptcam" || width != 1200 || brightness != 230.5 {
+		t.Fatalf("Expected the first page to be backfilled, got %q %d %v", cameraMake, width, brightness)
+	}
+	db.QueryRow(`SELECT camera_make, image_width FROM receipt_pages WHERE receipt_id = '1' AND position = 2`).Scan(&cameraMake, &width)
+	if cameraMake != "" || width != 0 {
+		t.Fatalf("Expected later pages to stay unknown, got %q %d", cameraMake, width)
+	}
+}
+
+// TestMigrateBackfillsFoldedColumns tests that existing receipts can be filtered by category and merchant once the folded columns are used
+func TestMigrateBackfillsFoldedColumns(t *testing.T) {
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// Migrate up to the version before the folded columns existed and store a receipt with a non-ASCII category
+	if err := migrate(db, sqliteMigrations[:12]); err != nil {
+		t.Fatalf("Failed to apply initial migrations: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO receipts (id, file_path, user_id, category, merchant) VALUES ('1', 'a.jpg', 'user1', 'CAFÉ', 'Épicerie')`); err != nil {
+		t.Fatalf("Failed to insert receipt: %v", err)
+	}
+
+	if err := migrate(db, sqliteMigrations); err != nil {
+		t.Fatalf("Failed to apply remaining migrations: %v", err)
+	}
+
+	var category, merchant string
+	db.QueryRow(`SELECT category_folded, merchant_folded FROM receipts WHERE id = '1'`).Scan(&category, &merchant)
+	if category != "café" || merchant != "épicerie" {
+		t.Fatalf("Expected the folded columns to be backfilled, got %q %q", category, merchant)
+	}
+}
@@ -0,0 +1,208 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// Custom error for cursors that are malformed or belong to a different sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ReceiptState selects receipts by whether they are in the trash
+type ReceiptState int
+
+const (
+	StateActive  ReceiptState = iota // Receipts that are not in the trash (the default)
+	StateTrashed                     // Receipts that are in the trash
+	StateAny                         // Both active and trashed receipts
+)
+
+// Matches reports whether the receipt is in the given state
+func (s ReceiptState) Matches(receipt Receipt) bool {
+	switch s {
+	case StateActive:
+		return !receipt.Trashed()
+	case StateTrashed:
+		return receipt.Trashed()
+	default:
+		return true
+	}
+}
+
+// SortField selects the order in which Query returns receipts
+type SortField string
+
+const (
+	SortByUploadedAt SortField = "uploaded_at" // Order by upload time (the default)
+	SortByTotal      SortField = "total"       // Order by total amount; receipts without a total come last
+)
+
+// ReceiptQuery describes which receipts should be returned by ReceiptRepository.Query
+type ReceiptQuery struct {
+	UserID      string              // Only return receipts owned by this user
+	State       ReceiptState        // Only return receipts in this trash state
+	FromDate    string              // Only return receipts with a transaction date on or after this YYYY-MM-DD date
+	ToDate      string              // Only return receipts with a transaction date on or before this YYYY-MM-DD date
+	Category    string              // Only return receipts in this category (case-insensitive)
+	Merchant    string              // Only return receipts whose merchant contains this text (case-insensitive)
+	MinTotal    decimal.NullDecimal // Only return receipts with a total of at least this amount
+	MaxTotal    decimal.NullDecimal // Only return receipts with a total of at most this amount
+	ContentHash string              // Only return receipts with an original, of any page, that has this SHA-256 content hash
+	Processing  ProcessingStatus    // Only return receipts with this thumbnail processing status
+
+	SortBy     SortField // Sort order, SortByUploadedAt if empty
+	Descending bool      // Reverse the sort order
+	Limit      int       // Maximum number of receipts to return, 0 for all
+	Cursor     string    // Opaque cursor from a previous ReceiptPage.NextCursor
+}
+
+// ReceiptPage is one page of query results
+type ReceiptPage struct {
+	Receipts   []Receipt
+	NextCursor string // Cursor for the following page, empty if this is the last page
+}
+
+// Matches reports whether the receipt satisfies the query's filters
+func (q ReceiptQuery) Matches(receipt Receipt) bool {
+	if q.UserID != "" && receipt.UserID != q.UserID {
+		return false
+	}
+	if !q.State.Matches(receipt) {
+		return false
+	}
+	if q.FromDate != "" && (receipt.TransactionDate == "" || receipt.TransactionDate < q.FromDate) {
+		return false
+	}
+	if q.ToDate != "" && (receipt.TransactionDate == "" || receipt.TransactionDate > q.ToDate) {
+		return false
+	}
+	if q.Category != "" && foldCase(receipt.Category) != foldCase(q.Category) {
+		return false
+	}
+	if q.Merchant != "" && !strings.Contains(foldCase(receipt.Merchant), foldCase(q.Merchant)) {
+		return false
+	}
+	if q.MinTotal.Valid && (!receipt.Total.Valid || receipt.Total.Decimal.LessThan(q.MinTotal.Decimal)) {
+		return false
+	}
+	if q.MaxTotal.Valid && (!receipt.Total.Valid || receipt.Total.Decimal.GreaterThan(q.MaxTotal.Decimal)) {
+		return false
+	}
+	if q.ContentHash != "" && !receipt.References(q.ContentHash) {
+		return false
+	}
+	if q.Processing != "" && receipt.ProcessingStatus != q.Processing {
+		return false
+	}
+	return true
+}
+
+// foldCase returns the form of s used for case-insensitive matching; the SQLite store keeps the same form in its own columns
+func foldCase(s string) string {
+	return strings.ToLower(s)
+}
+
+// sortField returns the effective sort field of the query
+func (q ReceiptQuery) sortField() SortField {
+	if q.SortBy == "" {
+		return SortByUploadedAt
+	}
+	return q.SortBy
+}
+
+// sortKey returns the value a receipt is ordered by and whether that value is missing.
+// Keys compare lexically, so the memory and SQLite implementations order receipts identically.
+func (q ReceiptQuery) sortKey(receipt Receipt) (value string, null bool) {
+	if q.sortField() == SortByTotal {
+		if !receipt.Total.Valid {
+			return "", true
+		}
+		return sortableAmount(receipt.Total.Decimal), false
+	}
+	return receipt.UploadedAt.UTC().Format(sqliteTimeFormat), false
+}
+
+// less reports whether receipt a comes before receipt b in the query's order.
+// Missing values always sort last and the receipt ID breaks ties so the order is stable.
+func (q ReceiptQuery) less(a, b Receipt) bool {
+	aValue, aNull := q.sortKey(a)
+	bValue, bNull := q.sortKey(b)
+	if aNull != bNull {
+		return bNull
+	}
+	if aValue != bValue {
+		return (aValue < bValue) != q.Descending
+	}
+	return a.ID != b.ID && (a.ID < b.ID) != q.Descending
+}
+
+// cursor is the decoded position of the last receipt on a page
+type cursor struct {
+	Sort  string `json:"s"`           // Sort order the cursor was issued for
+	Value string `json:"v,omitempty"` // Sort key of the last receipt
+	Null  bool   `json:"n,omitempty"` // Whether the sort key of the last receipt was missing
+	ID    string `json:"id"`          // ID of the last receipt
+}
+
+// sortName identifies the sort order so a cursor cannot be reused with a different one
+func (q ReceiptQuery) sortName() string {
+	if q.Descending {
+		return string(q.sortField()) + ":desc"
+	}
+	return string(q.sortField()) + ":asc"
+}
+
+// cursorAfter returns the cursor pointing just past the given receipt
+func (q ReceiptQuery) cursorAfter(receipt Receipt) string {
+	value, null := q.sortKey(receipt)
+	data, _ := json.Marshal(cursor{Sort: q.sortName(), Value: value, Null: null, ID: receipt.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses the query's cursor, returning nil if there is none
+func (q ReceiptQuery) decodeCursor() (*cursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Sort != q.sortName() || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// afterCursor reports whether the receipt comes after the cursor position in the query's order
+func (q ReceiptQuery) afterCursor(receipt Receipt, c *cursor) bool {
+	value, null := q.sortKey(receipt)
+	if null != c.Null {
+		return null // Missing values come after every present value
+	}
+	if value != c.Value {
+		return (value > c.Value) != q.Descending
+	}
+	return receipt.ID != c.ID && (receipt.ID > c.ID) != q.Descending
+}
+
+// sortableAmount encodes a non-negative amount as a fixed-width string that sorts lexically in numeric order
+func sortableAmount(amount decimal.Decimal) string {
+	fixed := amount.StringFixed(amountScale)
+	whole, fraction, _ := strings.Cut(fixed, ".")
+	if len(whole) < amountDigits {
+		whole = strings.Repeat("0", amountDigits-len(whole)) + whole
+	}
+	return whole + "." + fraction
+}
+
+// Digits used by sortableAmount for the whole and fractional part of an amount
+const (
+	amountDigits = 20
+	amountScale  = 10
+)
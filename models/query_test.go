@@ -0,0 +1,236 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// TestReceiptQueryMatches tests filtering receipts with a ReceiptQuery
+func TestReceiptQueryMatches(t *testing.T) {
+	receipt := Receipt{ID: "1", FilePath: "/path/to/receipt1.jpg", UserID: "user1"}
+
+	t.Run("MatchingUser", func(t *testing.T) {
+		if !(ReceiptQuery{UserID: "user1"}).Matches(receipt) {
+			t.Fatalf("Expected receipt to match query for its owner")
+		}
+	})
+
+	t.Run("OtherUser", func(t *testing.T) {
+		if (ReceiptQuery{UserID: "user2"}).Matches(receipt) {
+			t.Fatalf("Expected receipt not to match query for another user")
+		}
+	})
+
+	t.Run("EmptyQuery", func(t *testing.T) {
+		if !(ReceiptQuery{}).Matches(receipt) {
+			t.Fatalf("Expected empty query to match every active receipt")
+		}
+	})
+
+	t.Run("TrashState", func(t *testing.T) {
+		deletedAt := time.Now()
+		trashed := receipt
+		trashed.DeletedAt = &deletedAt
+
+		if (ReceiptQuery{}).Matches(trashed) {
+			t.Fatalf("Expected default query to exclude trashed receipts")
+		}
+		if !(ReceiptQuery{State: StateTrashed}).Matches(trashed) || (ReceiptQuery{State: StateTrashed}).Matches(receipt) {
+			t.Fatalf("Expected trashed query to match only trashed receipts")
+		}
+		if !(ReceiptQuery{State: StateAny}).Matches(trashed) || !(ReceiptQuery{State: StateAny}).Matches(receipt) {
+			t.Fatalf("Expected any-state query to match both receipts")
+		}
+	})
+}
+
+// TestSortableAmount tests that encoded amounts sort in numeric order
+func TestSortableAmount(t *testing.T) {
+	amounts := []string{"0", "0.5", "2", "9.99", "10", "10.01", "100", "999999999999.9999999999"}
+	for i := 1; i < len(amounts); i++ {
+		prev := sortableAmount(decimal.RequireFromString(amounts[i-1]))
+		next := sortableAmount(decimal.RequireFromString(amounts[i]))
+		if prev >= next {
+			t.Fatalf("Expected %s (%s) to sort before %s (%s)", amounts[i-1], prev, amounts[i], next)
+		}
+	}
+}
+
+// testReceiptQuery runs the filtering, sorting and pagination checks shared by every ReceiptRepository implementation
+func testReceiptQuery(t *testing.T, repo ReceiptRepository) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	amount := func(s string) decimal.NullDecimal {
+		if s == "" {
+			return decimal.NullDecimal{}
+		}
+		return decimal.NewNullDecimal(decimal.RequireFromString(s))
+	}
+
+	// Ten receipts for user1 uploaded one hour apart, plus one for user2
+	fixtures := []struct {
+		total, date, category, merchant string
+	}{
+		{"12.50", "2024-01-05", "food", "Corner Shop"},
+		{"3", "2024-01-06", "food", "Bakery"},
+		{"", "2024-01-07", "travel", "Taxi Co"},
+		{"100", "", "travel", "Airline"},
+		{"12.5", "2024-02-01", "Food", "corner shop express"},
+		{"7.25", "2024-02-02", "office", "Paper 100%"},
+		{"", "", "", ""},
+		{"45", "2024-03-01", "food", "Bakery"},
+		{"0", "2024-03-02", "office", "Stationer"},
+		{"9.99", "2024-03-03", "food", "Corner_Shop"},
+	}
+	for i, f := range fixtures {
+		repo.Create(Receipt{
+			ID:              fmt.Sprintf("q%02d", i),
+			UserID:          "query-user",
+			Total:           amount(f.total),
+			TransactionDate: f.date,
+			Category:        f.category,
+			Merchant:        f.merchant,
+			UploadedAt:      base.Add(time.Duration(i) * time.Hour),
+		})
+	}
+	repo.Create(Receipt{ID: "q99", UserID: "other-user", Total: amount("1"), UploadedAt: base})
+
+	// Helper to collect every page of a query
+	collect := func(t *testing.T, query ReceiptQuery) []string {
+		var ids []string
+		for pages := 0; ; pages++ {
+			if pages > len(fixtures) {
+				t.Fatalf("Pagination did not terminate")
+			}
+			page, err := repo.Query(query)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if query.Limit > 0 && len(page.Receipts) > query.Limit {
+				t.Fatalf("Expected at most %d receipts per page, got %d", query.Limit, len(page.Receipts))
+			}
+			for _, receipt := range page.Receipts {
+				ids = append(ids, receipt.ID)
+			}
+			if page.NextCursor == "" {
+				return ids
+			}
+			query.Cursor = page.NextCursor
+		}
+	}
+	expect := func(t *testing.T, got []string, want ...string) {
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+	}
+
+	t.Run("SortByUploadTime", func(t *testing.T) {
+		expect(t, collect(t, ReceiptQuery{UserID: "query-user", Limit: 3}),
+			"q00", "q01", "q02", "q03", "q04", "q05", "q06", "q07", "q08", "q09")
+		expect(t, collect(t, ReceiptQuery{UserID: "query-user", Limit: 4, Descending: true}),
+			"q09", "q08", "q07", "q06", "q05", "q04", "q03", "q02", "q01", "q00")
+	})
+
+	t.Run("SortByTotal", func(t *testing.T) {
+		// Equal totals are ordered by ID and missing totals come last in both directions
+		expect(t, collect(t, ReceiptQuery{UserID: "query-user", SortBy: SortByTotal, Limit: 2}),
+			"q08", "q01", "q05", "q09", "q00", "q04", "q07", "q03", "q02", "q06")
+		expect(t, collect(t, ReceiptQuery{UserID: "query-user", SortBy: SortByTotal, Descending: true, Limit: 3}),
+			"q03", "q07", "q04", "q00", "q09", "q05", "q01", "q08", "q06", "q02")
+	})
+
+	t.Run("FilterByDateRange", func(t *testing.T) {
+		expect(t, collect(t, ReceiptQuery{UserID: "query-user", FromDate: "2024-01-06", ToDate: "2024-02-01"}),
+			"q01", "q02", "q04")
+	})
+
+	t.Run("FilterByCategory", func(t *testing.T) {
+		expect(t, collect(t, ReceiptQuery{UserID: "query-user", Category: "FOOD", Limit: 2}),
+			"q00", "q01", "q04", "q07", "q09")
+	})
+
+	t.Run("FilterByMerchant", func(t *testing.T) {
+		expect(t, collect(t, ReceiptQuery{UserID: "query-user", Merchant: "corner shop"}), "q00", "q04")
+		// Wildcard characters are matched literally
+		expect(t, collect(t, ReceiptQuery{UserID: "query-user", Merchant: "_"}), "q09")
+		expect(t, collect(t, ReceiptQuery{UserID: "query-user", Merchant: "0%"}), "q05")
+	})
+
+	t.Run("FilterByNonASCII", func(t *testing.T) {
+		// Case is folded beyond ASCII the same way in every store
+		repo.Create(Receipt{ID: "u1", UserID: "unicode-user", Category: "café", Merchant: "Épicerie Müller", UploadedAt: base})
+		repo.Create(Receipt{ID: "u2", UserID: "unicode-user", Category: "CAFÉ", Merchant: "Bäckerei", UploadedAt: base.Add(time.Hour)})
+
+		expect(t, collect(t, ReceiptQuery{UserID: "unicode-user", Category: "Café"}), "u1", "u2")
+		expect(t, collect(t, ReceiptQuery{UserID: "unicode-user", Merchant: "ÉPICERIE MÜLLER"}), "u1")
+		expect(t, collect(t, ReceiptQuery{UserID: "unicode-user", Merchant: "BÄCK"}), "u2")
+	})
+
+	t.Run("FilterByAmountRange", func(t *testing.T) {
+		expect(t, collect(t, ReceiptQuery{UserID: "query-user", MinTotal: amount("7.25"), MaxTotal: amount("12.5"), SortBy: SortByTotal}),
+			"q05", "q09", "q00", "q04")
+	})
+
+	t.Run("FilterByContentHash", func(t *testing.T) {
+		deletedAt := base
+		repo.Create(Receipt{ID: "h1", UserID: "hash-user1", ContentHash: "aaaa", UploadedAt: base})
+		repo.Create(Receipt{ID: "h2", UserID: "hash-user2", ContentHash: "aaaa", UploadedAt: base, DeletedAt: &deletedAt})
+		repo.Create(Receipt{ID: "h3", UserID: "hash-user1", ContentHash: "bbbb", UploadedAt: base})
+
+		// Without a user the query counts every reference to a shared original, trashed or not
+		expect(t, collect(t, ReceiptQuery{ContentHash: "aaaa", State: StateAny}), "h1", "h2")
+		expect(t, collect(t, ReceiptQuery{UserID: "hash-user1", ContentHash: "aaaa"}), "h1")
+
+		// Changing and removing hashes keeps the results in sync
+		repo.Update(Receipt{ID: "h3", UserID: "hash-user1", ContentHash: "aaaa", UploadedAt: base})
+		repo.Delete("h1")
+		expect(t, collect(t, ReceiptQuery{ContentHash: "aaaa", State: StateAny}), "h2", "h3")
+		expect(t, collect(t, ReceiptQuery{ContentHash: "bbbb", State: StateAny}))
+	})
+
+	t.Run("FilterByPageContentHash", func(t *testing.T) {
+		// Every page of a receipt references its original, not just the first
+		pages := Receipt{ID: "m1", UserID: "pages-user", UploadedAt: base}
+		pages.SetPages([]PageFile{{FilePath: "originals/cccc.jpg", ContentHash: "cccc"}, {FilePath: "originals/dddd.jpg", ContentHash: "dddd"}})
+		repo.Create(pages)
+		expect(t, collect(t, ReceiptQuery{ContentHash: "dddd", State: StateAny}), "m1")
+
+		// Removing the page removes the reference
+		pages.SetPages(pages.Pages[:1])
+		repo.Update(pages)
+		expect(t, collect(t, ReceiptQuery{ContentHash: "dddd", State: StateAny}))
+		expect(t, collect(t, ReceiptQuery{ContentHash: "cccc", State: StateAny}), "m1")
+	})
+
+	t.Run("FilterByProcessingStatus", func(t *testing.T) {
+		repo.Create(Receipt{ID: "p1", UserID: "processing-user", ProcessingStatus: ProcessingPending, UploadedAt: base})
+		repo.Create(Receipt{ID: "p2", UserID: "processing-user", ProcessingStatus: ProcessingDone, UploadedAt: base})
+		repo.Create(Receipt{ID: "p3", UserID: "processing-user", UploadedAt: base})
+
+		expect(t, collect(t, ReceiptQuery{UserID: "processing-user", Processing: ProcessingPending}), "p1")
+		expect(t, collect(t, ReceiptQuery{UserID: "processing-user", Processing: ProcessingDone}), "p2")
+	})
+
+	t.Run("EmptyResult", func(t *testing.T) {
+		page, err := repo.Query(ReceiptQuery{UserID: "nobody", Limit: 10})
+		if err != nil || len(page.Receipts) != 0 || page.NextCursor != "" {
+			t.Fatalf("Expected an empty last page, got %+v, %v", page, err)
+		}
+	})
+
+	t.Run("InvalidCursor", func(t *testing.T) {
+		if _, err := repo.Query(ReceiptQuery{UserID: "query-user", Cursor: "not-a-cursor"}); !errors.Is(err, ErrInvalidCursor) {
+			t.Fatalf("Expected ErrInvalidCursor, got %v", err)
+		}
+
+		// A cursor issued for one sort order cannot be used with another
+		page, _ := repo.Query(ReceiptQuery{UserID: "query-user", Limit: 1})
+		_, err := repo.Query(ReceiptQuery{UserID: "query-user", SortBy: SortByTotal, Cursor: page.NextCursor})
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Fatalf("Expected ErrInvalidCursor, got %v", err)
+		}
+	})
+}
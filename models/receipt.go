@@ -1,71 +1,154 @@
 package models
 
 import (
-	"encoding/json"
-	"log"
-	"os"
+	"errors"
+	"time"
+
+	"github.com/shopspring/decimal"
 )
 
 // Receipt represents the metadata of a receipt
 type Receipt struct {
-	ID       string
-	FilePath string
-	UserID   string
+	ID              string
+	FilePath        string // Blob key of the original file
+	ContentHash     string // Hex encoded SHA-256 of the original file, empty for receipts uploaded before it was recorded
+	PerceptualHash  string // Hex encoded 64-bit difference hash of the image, empty if it has not been computed
+	UserID          string
+	Merchant        string              // Name of the merchant that issued the receipt
+	TransactionDate string              // Date of the purchase in YYYY-MM-DD format
+	Total           decimal.NullDecimal // Total amount including tax, null if unknown
+	Currency        string              // ISO 4217 currency code of Total and TaxLines
+	TaxLines        []TaxLine           // Individual tax amounts printed on the receipt
+	Category        string              // Free-form expense category
+	Notes           string              // Free-form user notes
+	UploadedAt      time.Time           // When the receipt was uploaded
+	DeletedAt       *time.Time          // When the receipt was moved to the trash, nil if it is active
+
+	ProcessingStatus ProcessingStatus // Progress of the background thumbnail generation
+	ProcessingError  string           // Why the last attempt at generating thumbnails failed
+
+	// Read from the photo's EXIF data on upload, empty if the camera did not record them
+	CapturedAt  string // When the photo was taken, RFC 3339 without a zone if the camera did not record one
+	CameraMake  string
+	CameraModel string
+
+	// Image quality measured on upload, zero for receipts uploaded before it was measured
+	ImageWidth  int
+	ImageHeight int
+	Sharpness   float64 // Variance of the Laplacian; blurry photos score low
+	Brightness  float64 // Mean brightness from 0 (black) to 255 (white)
+
+	PageCount int // Pages of a PDF document or of Pages, 1 for images and 0 for receipts uploaded before it was recorded
+
+	// Original images of a receipt photographed in several parts, in page order; empty for receipts stored as a
+	// single file. The fields read from the file and its image always describe the first page.
+	Pages []PageFile
 }
 
-// In-memory receipt store
-var ReceiptStore = make(map[string]Receipt)
+// PageFile is the original image of one page of a receipt and what was read from it on upload
+type PageFile struct {
+	FilePath       string // Blob key of the original file
+	ContentHash    string // Hex encoded SHA-256 of the original file, empty for files stored before it was recorded
+	PerceptualHash string // Hex encoded 64-bit difference hash of the image, empty if it has not been computed
 
-// File where receipts are stored
-var ReceiptFile = "receipts.json"
+	// Read from the photo's EXIF data on upload, empty if the camera did not record them
+	CapturedAt  string
+	CameraMake  string
+	CameraModel string
 
-// SaveReceiptsToFile saves the current in-memory receiptStore to a JSON file
-func SaveReceiptsToFile() error {
-	data, err := json.MarshalIndent(ReceiptStore, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(ReceiptFile, data, 0644)
+	// Image quality measured on upload, zero for pages stored before it was recorded per page
+	ImageWidth  int
+	ImageHeight int
+	Sharpness   float64
+	Brightness  float64
 }
 
-// LoadReceiptsFromFile loads the receipt data from a JSON file into memory (receiptStore)
-func LoadReceiptsFromFile() error {
-	if _, err := os.Stat(ReceiptFile); os.IsNotExist(err) {
-		return nil // If the file doesn't exist, skip loading
-	}
-	data, err := os.ReadFile(ReceiptFile)
-	if err != nil {
-		return err
+// Files returns the original files of the receipt in page order
+func (r Receipt) Files() []PageFile {
+	if len(r.Pages) > 0 {
+		return r.Pages
 	}
-	return json.Unmarshal(data, &ReceiptStore)
+	return []PageFile{{
+		FilePath: r.FilePath, ContentHash: r.ContentHash, PerceptualHash: r.PerceptualHash,
+		CapturedAt: r.CapturedAt, CameraMake: r.CameraMake, CameraModel: r.CameraModel,
+		ImageWidth: r.ImageWidth, ImageHeight: r.ImageHeight, Sharpness: r.Sharpness, Brightness: r.Brightness,
+	}}
 }
 
-// StoreReceipt saves the receipt metadata
-func StoreReceipt(id, filePath, userID string) {
-	ReceiptStore[id] = Receipt{
-		ID:       id,
-		FilePath: filePath,
-		UserID:   userID,
-	}
-	err := SaveReceiptsToFile()
-	if err != nil {
-		log.Println("Error saving receipts to file:", err)
+// SetFile sets the fields describing the receipt's original file, or the first page of a receipt with several
+func (r *Receipt) SetFile(file PageFile) {
+	r.FilePath, r.ContentHash, r.PerceptualHash = file.FilePath, file.ContentHash, file.PerceptualHash
+	r.CapturedAt, r.CameraMake, r.CameraModel = file.CapturedAt, file.CameraMake, file.CameraModel
+	r.ImageWidth, r.ImageHeight, r.Sharpness, r.Brightness = file.ImageWidth, file.ImageHeight, file.Sharpness, file.Brightness
+}
+
+// FileOfPage returns the original file holding a page, numbered from 1, and the page's number within that file
+func (r Receipt) FileOfPage(page int) (PageFile, int) {
+	if page >= 1 && page <= len(r.Pages) {
+		return r.Pages[page-1], 1
 	}
+	return r.Files()[0], page
 }
 
-// GetReceipt retrieves a receipt by ID
-func GetReceipt(id string) (Receipt, bool) {
-	receipt, exists := ReceiptStore[id]
-	return receipt, exists
+// SetPages replaces the receipt's pages and updates the fields describing the first page and the page count
+func (r *Receipt) SetPages(pages []PageFile) {
+	r.Pages = append([]PageFile(nil), pages...)
+	r.SetFile(pages[0])
+	r.PageCount = len(pages)
 }
 
-// ListUserReceipts returns all receipts for a given user
-func ListUserReceipts(userID string) []Receipt {
-	var receipts []Receipt
-	for _, receipt := range ReceiptStore {
-		if receipt.UserID == userID {
-			receipts = append(receipts, receipt)
+// References reports whether any of the receipt's original files has the given content hash
+func (r Receipt) References(contentHash string) bool {
+	for _, file := range r.Files() {
+		if file.ContentHash == contentHash {
+			return true
 		}
 	}
-	return receipts
+	return false
+}
+
+// Trashed reports whether the receipt has been moved to the trash
+func (r Receipt) Trashed() bool {
+	return r.DeletedAt != nil
+}
+
+// ProcessingStatus tracks the background generation of a receipt's thumbnails.
+// It is empty for receipts uploaded before thumbnails were generated in the background.
+type ProcessingStatus string
+
+const (
+	ProcessingPending ProcessingStatus = "pending"    // Waiting for a worker, possibly to retry
+	ProcessingRunning ProcessingStatus = "processing" // A worker is generating the thumbnails
+	ProcessingDone    ProcessingStatus = "done"       // All thumbnails are cached
+	ProcessingFailed  ProcessingStatus = "failed"     // Every attempt failed; thumbnails are generated on request instead
+)
+
+// TaxLine is a single tax entry on a receipt, such as "VAT 24%"
+type TaxLine struct {
+	Name   string
+	Rate   decimal.NullDecimal // Tax rate in percent, null if not printed
+	Amount decimal.Decimal
+}
+
+// Custom error for receipts that do not exist in the repository
+var ErrReceiptNotFound = errors.New("receipt not found")
+
+// Custom error for creating a receipt with an ID that is already taken
+var ErrReceiptExists = errors.New("receipt already exists")
+
+// ReceiptRepository stores receipt metadata.
+// Handlers only depend on this interface so the storage backend can be swapped.
+type ReceiptRepository interface {
+	// Create stores a new receipt, returning ErrReceiptExists if its ID is already taken
+	Create(receipt Receipt) error
+	// Get retrieves a receipt by ID, returning ErrReceiptNotFound if it does not exist
+	Get(id string) (Receipt, error)
+	// List returns all active (not trashed) receipts for a given user
+	List(userID string) ([]Receipt, error)
+	// Update replaces an existing receipt, returning ErrReceiptNotFound if it does not exist
+	Update(receipt Receipt) error
+	// Delete removes a receipt by ID, returning ErrReceiptNotFound if it does not exist
+	Delete(id string) error
+	// Query returns one page of receipts matching the query, in the query's sort order
+	Query(query ReceiptQuery) (ReceiptPage, error)
 }
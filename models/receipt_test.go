@@ -1,105 +1,201 @@
 package models
 
 import (
-	"os"
-	"path/filepath"
+	"errors"
 	"testing"
-)
-
-// Setup function to create a temporary environment for the test
-func setupTestEnv() (string, error) {
-	tmpDir := filepath.Join(os.TempDir(), "receipt_tests")
-	err := os.MkdirAll(tmpDir, os.ModePerm)
-	if err != nil {
-		return "", err
-	}
-	ReceiptFile = filepath.Join(tmpDir, "../test_receipts.json") // Use a test file for receipts
-	return tmpDir, nil
-}
-
-// Cleanup function to remove the temporary test environment
-func cleanupTestEnv(tmpDir string) {
-	os.RemoveAll(tmpDir)
-}
+	"time"
 
-// TestSaveAndLoadReceipts tests the saving and loading of receipts to/from a file
-func TestSaveAndLoadReceipts(t *testing.T) {
-	// Setup the test environment
-	tmpDir, err := setupTestEnv()
-	if err != nil {
-		t.Fatalf("Failed to setup test environment: %v", err)
-	}
-	defer cleanupTestEnv(tmpDir)
-
-	// Add some receipts to the in-memory store and store to file
-	StoreReceipt("1", "/path/to/receipt1.jpg", "user1")
-	StoreReceipt("2", "/path/to/receipt2.jpg", "user2")
-
-	// Retrieve the receipt and verify the details
-	receipt, exists := GetReceipt("1")
-	if !exists || receipt.UserID != "user1" || receipt.FilePath != "/path/to/receipt1.jpg" {
-		t.Fatalf("Receipt was not stored or retrieved correctly")
-	}
-
-	// Clear the in-memory store and load receipts from file
-	ReceiptStore = make(map[string]Receipt)
-	if err := LoadReceiptsFromFile(); err != nil {
-		t.Fatalf("Failed to load receipts from file: %v", err)
-	}
-
-	// Verify the receipts were loaded correctly
-	receipt1, exists := GetReceipt("1")
-	if !exists || receipt1.UserID != "user1" || receipt1.FilePath != "/path/to/receipt1.jpg" {
-		t.Fatalf("Receipt 1 was not loaded correctly")
-	}
-
-	receipt2, exists := GetReceipt("2")
-	if !exists || receipt2.UserID != "user2" || receipt2.FilePath != "/path/to/receipt2.jpg" {
-		t.Fatalf("Receipt 2 was not loaded correctly")
-	}
-}
+	"github.com/shopspring/decimal"
+)
 
-// TestListUserReceipts tests listing receipts for a specific user
-func TestListUserReceipts(t *testing.T) {
-	// Setup the test environment
-	tmpDir, err := setupTestEnv()
-	if err != nil {
-		t.Fatalf("Failed to setup test environment: %v", err)
-	}
-	defer cleanupTestEnv(tmpDir)
+// testReceiptRepository runs the basic CRUD operations shared by every ReceiptRepository implementation
+func testReceiptRepository(t *testing.T, repo ReceiptRepository) {
 
 	// Add some receipts
-	StoreReceipt("1", "/path/to/receipt1.jpg", "user1")
-	StoreReceipt("2", "/path/to/receipt2.jpg", "user1")
-	StoreReceipt("3", "/path/to/receipt3.jpg", "user2")
-
-	// List receipts for user1
-	userReceipts := ListUserReceipts("user1")
-	if len(userReceipts) != 2 {
-		t.Fatalf("Expected 2 receipts for user1, got %d", len(userReceipts))
-	}
-
-	// Verify the details of the receipts
-	if userReceipts[0].ID != "1" && userReceipts[1].ID != "2" {
-		t.Fatalf("Incorrect receipts returned for user1")
-	}
-}
-
-// TestLoadReceiptsFromFileMissing tests loading receipts from a missing file
-func TestLoadReceiptsFromFileMissing(t *testing.T) {
-	// Setup the test environment
-	tmpDir, err := setupTestEnv()
-	if err != nil {
-		t.Fatalf("Failed to setup test environment: %v", err)
-	}
-	defer cleanupTestEnv(tmpDir)
-
-	// Ensure the receipt file does not exist
-	os.Remove(ReceiptFile)
-
-	// Attempt to load receipts from a missing file (should not error)
-	err = LoadReceiptsFromFile()
-	if err != nil {
-		t.Fatalf("Expected no error when loading from a missing file, got: %v", err)
-	}
+	repo.Create(Receipt{ID: "1", FilePath: "/path/to/receipt1.jpg", UserID: "user1"})
+	repo.Create(Receipt{ID: "2", FilePath: "/path/to/receipt2.jpg", UserID: "user1"})
+	repo.Create(Receipt{ID: "3", FilePath: "/path/to/receipt3.jpg", UserID: "user2"})
+
+	t.Run("Get", func(t *testing.T) {
+		receipt, err := repo.Get("1")
+		if err != nil || receipt.UserID != "user1" || receipt.FilePath != "/path/to/receipt1.jpg" {
+			t.Fatalf("Receipt was not stored or retrieved correctly: %v", err)
+		}
+	})
+
+	t.Run("GetMissing", func(t *testing.T) {
+		_, err := repo.Get("999")
+		if !errors.Is(err, ErrReceiptNotFound) {
+			t.Fatalf("Expected ErrReceiptNotFound, got %v", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		receipts, err := repo.List("user1")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(receipts) != 2 || receipts[0].ID != "1" || receipts[1].ID != "2" {
+			t.Fatalf("Incorrect receipts returned for user1: %v", receipts)
+		}
+	})
+
+	t.Run("CreateExisting", func(t *testing.T) {
+		err := repo.Create(Receipt{ID: "1", FilePath: "/path/to/other.jpg", UserID: "user2"})
+		if !errors.Is(err, ErrReceiptExists) {
+			t.Fatalf("Expected ErrReceiptExists, got %v", err)
+		}
+		receipt, _ := repo.Get("1")
+		if receipt.UserID != "user1" || receipt.FilePath != "/path/to/receipt1.jpg" {
+			t.Fatalf("Existing receipt was replaced, got %v", receipt)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		err := repo.Update(Receipt{ID: "2", FilePath: "/path/to/updated.jpg", UserID: "user1"})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		receipt, _ := repo.Get("2")
+		if receipt.FilePath != "/path/to/updated.jpg" {
+			t.Fatalf("Receipt was not updated, got %v", receipt)
+		}
+
+		// Updating a missing receipt must not create it
+		if err := repo.Update(Receipt{ID: "999"}); !errors.Is(err, ErrReceiptNotFound) {
+			t.Fatalf("Expected ErrReceiptNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := repo.Delete("3"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if _, err := repo.Get("3"); !errors.Is(err, ErrReceiptNotFound) {
+			t.Fatalf("Expected receipt to be deleted, got %v", err)
+		}
+		if err := repo.Delete("3"); !errors.Is(err, ErrReceiptNotFound) {
+			t.Fatalf("Expected ErrReceiptNotFound, got %v", err)
+		}
+	})
+
+	t.Run("RichMetadata", func(t *testing.T) {
+		uploadedAt := time.Date(2024, 5, 1, 12, 30, 0, 123, time.UTC)
+		receipt := Receipt{
+			ID:              "4",
+			FilePath:        "/path/to/receipt4.jpg",
+			UserID:          "user1",
+			Merchant:        "Corner Shop",
+			TransactionDate: "2024-04-30",
+			Total:           decimal.NewNullDecimal(decimal.RequireFromString("12.40")),
+			Currency:        "EUR",
+			TaxLines:        []TaxLine{{Name: "VAT", Rate: decimal.NewNullDecimal(decimal.NewFromInt(24)), Amount: decimal.RequireFromString("2.40")}},
+			Category:        "groceries",
+			Notes:           "team lunch",
+			PerceptualHash:  "f0e1d2c3b4a59687",
+			UploadedAt:      uploadedAt,
+
+			ProcessingStatus: ProcessingFailed,
+			ProcessingError:  "decode failed",
+
+			CapturedAt:  "2024-04-30T12:31:05+02:00",
+			CameraMake:  "Receiptcam",
+			CameraModel: "RC-1 Pro",
+
+			ImageWidth:  1440,
+			ImageHeight: 2560,
+			Sharpness:   193.5,
+			Brightness:  143.25,
+
+			PageCount: 3,
+		}
+		if err := repo.Create(receipt); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		stored, err := repo.Get("4")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if stored.Merchant != "Corner Shop" || stored.TransactionDate != "2024-04-30" || stored.Currency != "EUR" ||
+			stored.Category != "groceries" || stored.Notes != "team lunch" || stored.PerceptualHash != "f0e1d2c3b4a59687" ||
+			stored.ProcessingStatus != ProcessingFailed || stored.ProcessingError != "decode failed" ||
+			stored.CapturedAt != "2024-04-30T12:31:05+02:00" || stored.CameraMake != "Receiptcam" || stored.CameraModel != "RC-1 Pro" ||
+			stored.ImageWidth != 1440 || stored.ImageHeight != 2560 || stored.Sharpness != 193.5 || stored.Brightness != 143.25 {
+			t.Fatalf("Text metadata was not stored correctly: %+v", stored)
+		}
+		if !stored.Total.Valid || !stored.Total.Decimal.Equal(decimal.RequireFromString("12.4")) {
+			t.Fatalf("Expected total 12.40, got %v", stored.Total)
+		}
+		if len(stored.TaxLines) != 1 || !stored.TaxLines[0].Amount.Equal(decimal.RequireFromString("2.4")) || !stored.TaxLines[0].Rate.Valid {
+			t.Fatalf("Tax lines were not stored correctly: %+v", stored.TaxLines)
+		}
+		if !stored.UploadedAt.Equal(uploadedAt) {
+			t.Fatalf("Expected upload time %v, got %v", uploadedAt, stored.UploadedAt)
+		}
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		receipt := Receipt{ID: "5", UserID: "user1", UploadedAt: time.Date(2024, 5, 3, 9, 0, 0, 0, time.UTC)}
+		receipt.SetPages([]PageFile{
+			{FilePath: "originals/top.jpg", ContentHash: "top", PerceptualHash: "0f0f0f0f0f0f0f0f", CameraMake: "Receiptcam", ImageWidth: 1200, ImageHeight: 900, Sharpness: 140},
+			{FilePath: "originals/middle.jpg", ContentHash: "middle"},
+			{FilePath: "originals/bottom.jpg", ContentHash: "bottom", CapturedAt: "2024-05-03T08:30:00", ImageWidth: 800, ImageHeight: 1000, Brightness: 220.5},
+		})
+		if err := repo.Create(receipt); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		stored, _ := repo.Get("5")
+		if len(stored.Pages) != 3 || stored.Pages[1].FilePath != "originals/middle.jpg" || stored.FilePath != "originals/top.jpg" ||
+			stored.PerceptualHash != "0f0f0f0f0f0f0f0f" || stored.PageCount != 3 || stored.CameraMake != "Receiptcam" || stored.ImageWidth != 1200 {
+			t.Fatalf("Pages were not stored correctly: %+v", stored)
+		}
+
+		// Moving the last page to the front makes it describe the receipt
+		stored.SetPages([]PageFile{stored.Pages[2], stored.Pages[0], stored.Pages[1]})
+		if err := repo.Update(stored); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		reordered, _ := repo.Get("5")
+		if len(reordered.Pages) != 3 || reordered.Pages[0].ContentHash != "bottom" || reordered.Pages[2].ContentHash != "middle" ||
+			reordered.ContentHash != "bottom" || reordered.PerceptualHash != "" {
+			t.Fatalf("Pages were not reordered correctly: %+v", reordered)
+		}
+		if reordered.CapturedAt != "2024-05-03T08:30:00" || reordered.CameraMake != "" || reordered.ImageWidth != 800 || reordered.ImageHeight != 1000 ||
+			reordered.Sharpness != 0 || reordered.Brightness != 220.5 || reordered.Pages[1].Sharpness != 140 {
+			t.Fatalf("Expected the metadata of the new first page, got %+v", reordered)
+		}
+		if err := repo.Delete("5"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	})
+
+	t.Run("Trash", func(t *testing.T) {
+		receipt, _ := repo.Get("1")
+		deletedAt := time.Date(2024, 5, 2, 8, 0, 0, 0, time.UTC)
+		receipt.DeletedAt = &deletedAt
+		if err := repo.Update(receipt); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		// Trashed receipts are hidden from List but still retrievable by ID and trash queries
+		receipts, _ := repo.List("user1")
+		for _, r := range receipts {
+			if r.ID == "1" {
+				t.Fatalf("Expected trashed receipt to be excluded from List")
+			}
+		}
+		page, _ := repo.Query(ReceiptQuery{UserID: "user1", State: StateTrashed})
+		trashed := page.Receipts
+		if len(trashed) != 1 || trashed[0].ID != "1" || !trashed[0].DeletedAt.Equal(deletedAt) {
+			t.Fatalf("Expected receipt 1 in the trash, got %+v", trashed)
+		}
+
+		// Restoring brings it back
+		receipt.DeletedAt = nil
+		repo.Update(receipt)
+		if restored, _ := repo.Get("1"); restored.Trashed() {
+			t.Fatalf("Expected receipt 1 to be restored")
+		}
+	})
 }
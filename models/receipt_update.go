@@ -0,0 +1,173 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Limits for free-form receipt fields
+const (
+	maxMerchantLength = 200
+	maxCategoryLength = 64
+	maxNotesLength    = 2000
+	maxTaxLines       = 20
+)
+
+// Upper bound for amounts, well within the range sortableAmount can encode
+var maxAmount = decimal.New(1, 15)
+
+// ReceiptUpdate holds the editable receipt metadata sent to PATCH /receipts/{id}.
+// Fields that are nil are left unchanged; an empty string clears a text field and null clears Total.
+type ReceiptUpdate struct {
+	Merchant        *string
+	TransactionDate *string
+	Total           OptionalDecimal
+	Currency        *string
+	TaxLines        *[]TaxLine
+	Category        *string
+	Notes           *string
+}
+
+// OptionalDecimal is an amount of an update that tells a field left out, which leaves the amount unchanged,
+// from an explicit null, which clears it. A nil pointer cannot, since JSON null also decodes to nil.
+type OptionalDecimal struct {
+	Set   bool                // Whether the field was present
+	Value decimal.NullDecimal // The amount, invalid if the field was null
+}
+
+// SetDecimal returns an OptionalDecimal that sets the amount to d
+func SetDecimal(d decimal.Decimal) OptionalDecimal {
+	return OptionalDecimal{Set: true, Value: decimal.NewNullDecimal(d)}
+}
+
+// UnmarshalJSON records that the field was present. It is called for null as well, since OptionalDecimal is not a pointer.
+func (o *OptionalDecimal) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	return o.Value.UnmarshalJSON(data)
+}
+
+// ValidationError describes an invalid field value
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+// Error implements the error interface
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationErrors collects every invalid field of an update
+type ValidationErrors []ValidationError
+
+// Error implements the error interface
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Validate checks every provided field and returns ValidationErrors if any is invalid
+func (u ReceiptUpdate) Validate() error {
+	var errs ValidationErrors
+	invalid := func(field, format string, args ...any) {
+		errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if u.Merchant != nil && len(*u.Merchant) > maxMerchantLength {
+		invalid("Merchant", "must be at most %d characters", maxMerchantLength)
+	}
+	if u.TransactionDate != nil && *u.TransactionDate != "" {
+		date, err := time.Parse(time.DateOnly, *u.TransactionDate)
+		if err != nil {
+			invalid("TransactionDate", "must be a date in YYYY-MM-DD format")
+		} else if date.After(time.Now()) {
+			invalid("TransactionDate", "must not be in the future")
+		}
+	}
+	if total := u.Total.Value; total.Valid && total.Decimal.IsNegative() {
+		invalid("Total", "must not be negative")
+	} else if total.Valid && !total.Decimal.LessThan(maxAmount) {
+		invalid("Total", "must be less than %s", maxAmount)
+	}
+	if u.Currency != nil && *u.Currency != "" && !isCurrencyCode(*u.Currency) {
+		invalid("Currency", "must be a three-letter ISO 4217 code")
+	}
+	if u.TaxLines != nil {
+		if len(*u.TaxLines) > maxTaxLines {
+			invalid("TaxLines", "must contain at most %d entries", maxTaxLines)
+		}
+		for i, line := range *u.TaxLines {
+			if strings.TrimSpace(line.Name) == "" {
+				invalid(fmt.Sprintf("TaxLines[%d].Name", i), "is required")
+			}
+			if line.Amount.IsNegative() {
+				invalid(fmt.Sprintf("TaxLines[%d].Amount", i), "must not be negative")
+			} else if !line.Amount.LessThan(maxAmount) {
+				invalid(fmt.Sprintf("TaxLines[%d].Amount", i), "must be less than %s", maxAmount)
+			}
+			if line.Rate.Valid && (line.Rate.Decimal.IsNegative() || line.Rate.Decimal.GreaterThan(decimal.NewFromInt(100))) {
+				invalid(fmt.Sprintf("TaxLines[%d].Rate", i), "must be between 0 and 100")
+			}
+		}
+	}
+	if u.Category != nil && len(*u.Category) > maxCategoryLength {
+		invalid("Category", "must be at most %d characters", maxCategoryLength)
+	}
+	if u.Notes != nil && len(*u.Notes) > maxNotesLength {
+		invalid("Notes", "must be at most %d characters", maxNotesLength)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Apply validates the update and copies the provided fields onto the receipt
+func (u ReceiptUpdate) Apply(receipt *Receipt) error {
+	if err := u.Validate(); err != nil {
+		return err
+	}
+
+	if u.Merchant != nil {
+		receipt.Merchant = strings.TrimSpace(*u.Merchant)
+	}
+	if u.TransactionDate != nil {
+		receipt.TransactionDate = *u.TransactionDate
+	}
+	if u.Total.Set {
+		receipt.Total = u.Total.Value
+	}
+	if u.Currency != nil {
+		receipt.Currency = strings.ToUpper(*u.Currency)
+	}
+	if u.TaxLines != nil {
+		receipt.TaxLines = *u.TaxLines
+	}
+	if u.Category != nil {
+		receipt.Category = strings.TrimSpace(*u.Category)
+	}
+	if u.Notes != nil {
+		receipt.Notes = *u.Notes
+	}
+	return nil
+}
+
+// isCurrencyCode reports whether code looks like an ISO 4217 alphabetic code
+func isCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range strings.ToUpper(code) {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
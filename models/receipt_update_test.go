@@ -0,0 +1,111 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+// Helper function to take the address of a value in test tables
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// TestReceiptUpdateApply tests applying a valid update to a receipt
+func TestReceiptUpdateApply(t *testing.T) {
+	receipt := Receipt{ID: "1", UserID: "user1", Merchant: "Old Name", Notes: "keep me"}
+
+	update := ReceiptUpdate{
+		Merchant:        ptr("  Corner Shop "),
+		TransactionDate: ptr("2024-04-30"),
+		Total:           SetDecimal(decimal.RequireFromString("12.40")),
+		Currency:        ptr("eur"),
+		TaxLines:        ptr([]TaxLine{{Name: "VAT", Amount: decimal.RequireFromString("2.40")}}),
+	}
+	if err := update.Apply(&receipt); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if receipt.Merchant != "Corner Shop" {
+		t.Fatalf("Expected trimmed merchant, got %q", receipt.Merchant)
+	}
+	if receipt.Currency != "EUR" {
+		t.Fatalf("Expected upper-case currency, got %q", receipt.Currency)
+	}
+	if !receipt.Total.Valid || receipt.Total.Decimal.String() != "12.4" {
+		t.Fatalf("Expected total 12.4, got %v", receipt.Total)
+	}
+	if receipt.Notes != "keep me" {
+		t.Fatalf("Expected omitted fields to be unchanged, got notes %q", receipt.Notes)
+	}
+}
+
+// TestReceiptUpdateTotal tests telling a Total left out from a Total cleared with null
+func TestReceiptUpdateTotal(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		total string
+	}{
+		{"Omitted", `{"Notes": "lunch"}`, "9.99"},
+		{"Set", `{"Total": "12.40"}`, "12.4"},
+		{"Null", `{"Total": null}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := Receipt{ID: "1", Total: decimal.NewNullDecimal(decimal.RequireFromString("9.99"))}
+			var update ReceiptUpdate
+			if err := json.Unmarshal([]byte(tt.body), &update); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if err := update.Apply(&receipt); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			total := ""
+			if receipt.Total.Valid {
+				total = receipt.Total.Decimal.String()
+			}
+			if total != tt.total {
+				t.Fatalf("Expected total %q, got %q", tt.total, total)
+			}
+		})
+	}
+}
+
+// TestReceiptUpdateValidate tests rejecting invalid field values
+func TestReceiptUpdateValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		update ReceiptUpdate
+		field  string
+	}{
+		{"BadDate", ReceiptUpdate{TransactionDate: ptr("30/04/2024")}, "TransactionDate"},
+		{"FutureDate", ReceiptUpdate{TransactionDate: ptr("2999-01-01")}, "TransactionDate"},
+		{"NegativeTotal", ReceiptUpdate{Total: SetDecimal(decimal.NewFromInt(-1))}, "Total"},
+		{"BadCurrency", ReceiptUpdate{Currency: ptr("EURO")}, "Currency"},
+		{"LongMerchant", ReceiptUpdate{Merchant: ptr(strings.Repeat("a", maxMerchantLength+1))}, "Merchant"},
+		{"UnnamedTaxLine", ReceiptUpdate{TaxLines: ptr([]TaxLine{{Amount: decimal.NewFromInt(1)}})}, "TaxLines[0].Name"},
+		{"TaxRateAbove100", ReceiptUpdate{TaxLines: ptr([]TaxLine{{Name: "VAT", Rate: decimal.NewNullDecimal(decimal.NewFromInt(101))}})}, "TaxLines[0].Rate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := Receipt{ID: "1"}
+			err := tt.update.Apply(&receipt)
+
+			var validationErrs ValidationErrors
+			if !errors.As(err, &validationErrs) || validationErrs[0].Field != tt.field {
+				t.Fatalf("Expected validation error for %s, got %v", tt.field, err)
+			}
+			if !reflect.DeepEqual(receipt, Receipt{ID: "1"}) {
+				t.Fatalf("Expected receipt to be unchanged after a failed update, got %+v", receipt)
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // Pure-Go SQLite driver, registered as "sqlite"
+)
+
+// Columns stored for a receipt in the receipts table
+const receiptColumns = `id, file_path, user_id, merchant, transaction_date, total, currency, tax_lines, category, notes, uploaded_at, deleted_at, content_hash, perceptual_hash, processing_status, processing_error, captured_at, camera_make, camera_model,
+	image_width, image_height, sharpness, brightness, page_count`
+
+// Columns selected for a receipt, in the order scanReceipt expects them: the stored columns plus the receipt's pages as a JSON array
+const receiptSelectColumns = receiptColumns + `,
+	(SELECT json_group_array(json_object('position', position, 'file_path', file_path, 'content_hash', content_hash, 'perceptual_hash', perceptual_hash,
+		'captured_at', captured_at, 'camera_make', camera_make, 'camera_model', camera_model,
+		'image_width', image_width, 'image_height', image_height, 'sharpness', sharpness, 'brightness', brightness))
+		FROM receipt_pages WHERE receipt_id = receipts.id)`
+
+// Columns written for a receipt: the stored columns plus derived columns used for querying
+const receiptWriteColumns = receiptColumns + `, total_sort, category_folded, merchant_folded`
+
+// Fixed-width UTC timestamp format so that stored times sort lexically
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// SQLiteReceiptRepository stores receipt metadata in an embedded SQLite database.
+// Receipts are read on demand instead of being loaded into memory at startup.
+type SQLiteReceiptRepository struct {
+	db *sql.DB
+}
+
+// NewSQLiteReceiptRepository opens (or creates) the database at the given path and applies pending migrations
+func NewSQLiteReceiptRepository(path string) (*SQLiteReceiptRepository, error) {
+	// WAL lets readers proceed while a write is in progress; busy_timeout makes concurrent writers wait instead of failing
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(FULL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteReceiptRepository{db: db}, nil
+}
+
+// Create stores a new receipt and its pages
+func (s *SQLiteReceiptRepository) Create(receipt Receipt) error {
+	values, err := receiptValues(receipt)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op after a successful commit
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM receipts WHERE id = ?)`, receipt.ID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrReceiptExists
+	}
+	if _, err := tx.Exec(`INSERT INTO receipts (`+receiptWriteColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, values...); err != nil {
+		return err
+	}
+	if err := insertPages(tx, receipt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get retrieves a receipt by ID
+func (s *SQLiteReceiptRepository) Get(id string) (Receipt, error) {
+	receipt, err := scanReceipt(s.db.QueryRow(`SELECT `+receiptSelectColumns+` FROM receipts WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Receipt{}, ErrReceiptNotFound
+	}
+	return receipt, err
+}
+
+// List returns all receipts for a given user
+func (s *SQLiteReceiptRepository) List(userID string) ([]Receipt, error) {
+	page, err := s.Query(ReceiptQuery{UserID: userID})
+	return page.Receipts, err
+}
+
+// Update replaces an existing receipt and its pages
+func (s *SQLiteReceiptRepository) Update(receipt Receipt) error {
+	values, err := receiptValues(receipt)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op after a successful commit
+
+	result, err := tx.Exec(`UPDATE receipts SET
+		file_path = ?2, user_id = ?3, merchant = ?4, transaction_date = ?5, total = ?6,
+		currency = ?7, tax_lines = ?8, category = ?9, notes = ?10, uploaded_at = ?11, deleted_at = ?12,
+		content_hash = ?13, perceptual_hash = ?14, processing_status = ?15, processing_error = ?16,
+		captured_at = ?17, camera_make = ?18, camera_model = ?19,
+		image_width = ?20, image_height = ?21, sharpness = ?22, brightness = ?23, page_count = ?24, total_sort = ?25,
+		category_folded = ?26, merchant_folded = ?27
+		WHERE id = ?1`, values...)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err != nil {
+		return err
+	}
+
+	// The pages are replaced as a whole since they may have been added, moved or removed
+	if _, err := tx.Exec(`DELETE FROM receipt_pages WHERE receipt_id = ?`, receipt.ID); err != nil {
+		return err
+	}
+	if err := insertPages(tx, receipt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete removes a receipt and its pages by ID
+func (s *SQLiteReceiptRepository) Delete(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op after a successful commit
+
+	if _, err := tx.Exec(`DELETE FROM receipt_pages WHERE receipt_id = ?`, id); err != nil {
+		return err
+	}
+	result, err := tx.Exec(`DELETE FROM receipts WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Query returns one page of receipts matching the query.
+// Filters, ordering and the cursor position are evaluated by SQLite using the user indexes.
+func (s *SQLiteReceiptRepository) Query(query ReceiptQuery) (ReceiptPage, error) {
+	after, err := query.decodeCursor()
+	if err != nil {
+		return ReceiptPage{}, err
+	}
+
+	var conditions []string
+	var args []any
+	where := func(condition string, values ...any) {
+		conditions = append(conditions, condition)
+		args = append(args, values...)
+	}
+
+	if query.UserID != "" {
+		where("user_id = ?", query.UserID)
+	}
+	switch query.State {
+	case StateActive:
+		where("deleted_at IS NULL")
+	case StateTrashed:
+		where("deleted_at IS NOT NULL")
+	}
+	if query.FromDate != "" {
+		where("transaction_date != '' AND transaction_date >= ?", query.FromDate)
+	}
+	if query.ToDate != "" {
+		where("transaction_date != '' AND transaction_date <= ?", query.ToDate)
+	}
+	if query.Category != "" {
+		where("category_folded = ?", foldCase(query.Category))
+	}
+	if query.Merchant != "" {
+		where(`merchant_folded LIKE ? ESCAPE '\'`, "%"+escapeLike(foldCase(query.Merchant))+"%")
+	}
+	if query.MinTotal.Valid {
+		where("total_sort >= ?", sortableAmount(query.MinTotal.Decimal))
+	}
+	if query.MaxTotal.Valid {
+		where("total_sort <= ?", sortableAmount(query.MaxTotal.Decimal))
+	}
+	if query.ContentHash != "" {
+		where("(content_hash = ? OR id IN (SELECT receipt_id FROM receipt_pages WHERE content_hash = ?))", query.ContentHash, query.ContentHash)
+	}
+	if query.Processing != "" {
+		where("processing_status = ?", string(query.Processing))
+	}
+
+	// Keyset pagination: continue strictly after the last receipt of the previous page
+	column, direction, comparison := "uploaded_at", "ASC", ">"
+	if query.sortField() == SortByTotal {
+		column = "total_sort"
+	}
+	if query.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if after != nil {
+		if after.Null {
+			where(fmt.Sprintf("(%[1]s IS NULL AND id %[2]s ?)", column, comparison), after.ID)
+		} else {
+			where(fmt.Sprintf("(%[1]s IS NULL OR %[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", column, comparison),
+				after.Value, after.Value, after.ID)
+		}
+	}
+
+	statement := `SELECT ` + receiptSelectColumns + ` FROM receipts`
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	// Missing values sort last in both directions; the ID makes the order stable
+	statement += fmt.Sprintf(" ORDER BY %[1]s IS NULL, %[1]s %[2]s, id %[2]s", column, direction)
+	if query.Limit > 0 {
+		// Fetch one extra row to find out whether there is another page
+		statement += " LIMIT ?"
+		args = append(args, query.Limit+1)
+	}
+
+	rows, err := s.db.Query(statement, args...)
+	if err != nil {
+		return ReceiptPage{}, err
+	}
+	defer rows.Close()
+
+	var receipts []Receipt
+	for rows.Next() {
+		receipt, err := scanReceipt(rows)
+		if err != nil {
+			return ReceiptPage{}, err
+		}
+		receipts = append(receipts, receipt)
+	}
+	if err := rows.Err(); err != nil {
+		return ReceiptPage{}, err
+	}
+
+	page := ReceiptPage{Receipts: receipts}
+	if query.Limit > 0 && len(receipts) > query.Limit {
+		page.Receipts = receipts[:query.Limit]
+		page.NextCursor = query.cursorAfter(page.Receipts[query.Limit-1])
+	}
+	return page, nil
+}
+
+// Close closes the underlying database
+func (s *SQLiteReceiptRepository) Close() error {
+	return s.db.Close()
+}
+
+// receiptValues returns the column values for a receipt, in the order of receiptWriteColumns
+func receiptValues(receipt Receipt) ([]any, error) {
+	taxLines := receipt.TaxLines
+	if taxLines == nil {
+		taxLines = []TaxLine{}
+	}
+	taxLinesJSON, err := json.Marshal(taxLines)
+	if err != nil {
+		return nil, err
+	}
+	total, err := receipt.Total.Value()
+	if err != nil {
+		return nil, err
+	}
+	var deletedAt, totalSort any
+	if receipt.DeletedAt != nil {
+		deletedAt = receipt.DeletedAt.UTC().Format(sqliteTimeFormat)
+	}
+	if receipt.Total.Valid {
+		totalSort = sortableAmount(receipt.Total.Decimal)
+	}
+	return []any{
+		receipt.ID, receipt.FilePath, receipt.UserID, receipt.Merchant, receipt.TransactionDate, total,
+		receipt.Currency, string(taxLinesJSON), receipt.Category, receipt.Notes,
+		receipt.UploadedAt.UTC().Format(sqliteTimeFormat), deletedAt, receipt.ContentHash, receipt.PerceptualHash,
+		string(receipt.ProcessingStatus), receipt.ProcessingError, receipt.CapturedAt, receipt.CameraMake, receipt.CameraModel,
+		receipt.ImageWidth, receipt.ImageHeight, receipt.Sharpness, receipt.Brightness, receipt.PageCount, totalSort,
+		foldCase(receipt.Category), foldCase(receipt.Merchant),
+	}, nil
+}
+
+// pageRow is a row of the receipt_pages table as selected by receiptSelectColumns
+type pageRow struct {
+	Position       int     `json:"position"`
+	FilePath       string  `json:"file_path"`
+	ContentHash    string  `json:"content_hash"`
+	PerceptualHash string  `json:"perceptual_hash"`
+	CapturedAt     string  `json:"captured_at"`
+	CameraMake     string  `json:"camera_make"`
+	CameraModel    string  `json:"camera_model"`
+	ImageWidth     int     `json:"image_width"`
+	ImageHeight    int     `json:"image_height"`
+	Sharpness      float64 `json:"sharpness"`
+	Brightness     float64 `json:"brightness"`
+}
+
+// insertPages stores the pages of a receipt in page order
+func insertPages(tx *sql.Tx, receipt Receipt) error {
+	for i, page := range receipt.Pages {
+		_, err := tx.Exec(`INSERT INTO receipt_pages (receipt_id, position, file_path, content_hash, perceptual_hash,
+			captured_at, camera_make, camera_model, image_width, image_height, sharpness, brightness) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			receipt.ID, i+1, page.FilePath, page.ContentHash, page.PerceptualHash,
+			page.CapturedAt, page.CameraMake, page.CameraModel, page.ImageWidth, page.ImageHeight, page.Sharpness, page.Brightness)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanReceipt reads a row selected with receiptSelectColumns into a Receipt
+func scanReceipt(row interface{ Scan(dest ...any) error }) (Receipt, error) {
+	var receipt Receipt
+	var taxLines, uploadedAt, pages string
+	var deletedAt sql.NullString
+	err := row.Scan(&receipt.ID, &receipt.FilePath, &receipt.UserID, &receipt.Merchant, &receipt.TransactionDate,
+		&receipt.Total, &receipt.Currency, &taxLines, &receipt.Category, &receipt.Notes, &uploadedAt, &deletedAt, &receipt.ContentHash, &receipt.PerceptualHash,
+		&receipt.ProcessingStatus, &receipt.ProcessingError, &receipt.CapturedAt, &receipt.CameraMake, &receipt.CameraModel,
+		&receipt.ImageWidth, &receipt.ImageHeight, &receipt.Sharpness, &receipt.Brightness, &receipt.PageCount, &pages)
+	if err != nil {
+		return Receipt{}, err
+	}
+	if err := json.Unmarshal([]byte(taxLines), &receipt.TaxLines); err != nil {
+		return Receipt{}, fmt.Errorf("invalid tax lines for receipt %s: %v", receipt.ID, err)
+	}
+	if len(receipt.TaxLines) == 0 {
+		receipt.TaxLines = nil
+	}
+
+	// json_group_array does not guarantee an order, so the pages are sorted by their position
+	var rows []pageRow
+	if err := json.Unmarshal([]byte(pages), &rows); err != nil {
+		return Receipt{}, fmt.Errorf("invalid pages for receipt %s: %v", receipt.ID, err)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Position < rows[j].Position })
+	for _, row := range rows {
+		receipt.Pages = append(receipt.Pages, PageFile{
+			FilePath: row.FilePath, ContentHash: row.ContentHash, PerceptualHash: row.PerceptualHash,
+			CapturedAt: row.CapturedAt, CameraMake: row.CameraMake, CameraModel: row.CameraModel,
+			ImageWidth: row.ImageWidth, ImageHeight: row.ImageHeight, Sharpness: row.Sharpness, Brightness: row.Brightness,
+		})
+	}
+	if receipt.UploadedAt, err = time.Parse(time.RFC3339Nano, uploadedAt); err != nil {
+		return Receipt{}, fmt.Errorf("invalid upload time for receipt %s: %v", receipt.ID, err)
+	}
+	if deletedAt.Valid {
+		t, err := time.Parse(time.RFC3339Nano, deletedAt.String)
+		if err != nil {
+			return Receipt{}, fmt.Errorf("invalid deletion time for receipt %s: %v", receipt.ID, err)
+		}
+		receipt.DeletedAt = &t
+	}
+	return receipt, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so it is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// requireAffected returns ErrReceiptNotFound when a statement did not touch any row
+func requireAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrReceiptNotFound
+	}
+	return nil
+}
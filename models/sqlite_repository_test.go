@@ -0,0 +1,83 @@
+package models
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Helper function to open a SQLite repository in a temporary directory
+func newTestSQLiteRepository(t *testing.T) (*SQLiteReceiptRepository, string) {
+	path := filepath.Join(t.TempDir(), "receipts.db")
+	repo, err := NewSQLiteReceiptRepository(path)
+	if err != nil {
+		t.Fatalf("Failed to open SQLite repository: %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo, path
+}
+
+// TestSQLiteReceiptRepository tests the basic CRUD operations of the SQLite repository
+func TestSQLiteReceiptRepository(t *testing.T) {
+	repo, _ := newTestSQLiteRepository(t)
+	testReceiptRepository(t, repo)
+	testReceiptQuery(t, repo)
+}
+
+// TestSQLiteReceiptRepositoryReopen tests that receipts persist across restarts and migrations are not re-applied
+func TestSQLiteReceiptRepositoryReopen(t *testing.T) {
+	repo, path := newTestSQLiteRepository(t)
+	repo.Create(Receipt{ID: "1", FilePath: "/path/to/receipt1.jpg", UserID: "user1"})
+	repo.Close()
+
+	reopened, err := NewSQLiteReceiptRepository(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen SQLite repository: %v", err)
+	}
+	defer reopened.Close()
+
+	receipt, err := reopened.Get("1")
+	if err != nil || receipt.FilePath != "/path/to/receipt1.jpg" {
+		t.Fatalf("Receipt was not persisted: %v", err)
+	}
+
+	var applied int
+	reopened.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied)
+	if applied != len(sqliteMigrations) {
+		t.Fatalf("Expected %d applied migrations, got %d", len(sqliteMigrations), applied)
+	}
+}
+
+// TestSQLiteReceiptRepositoryIndexes tests that listing by user uses an index rather than a table scan
+func TestSQLiteReceiptRepositoryIndexes(t *testing.T) {
+	repo, _ := newTestSQLiteRepository(t)
+
+	rows, err := repo.db.Query(`EXPLAIN QUERY PLAN SELECT id FROM receipts WHERE user_id = ? ORDER BY uploaded_at`, "user1")
+	if err != nil {
+		t.Fatalf("Failed to explain query: %v", err)
+	}
+	defer rows.Close()
+
+	usesIndex := false
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		rows.Scan(&id, &parent, &notUsed, &detail)
+		if containsAll(detail, "USING", "INDEX") {
+			usesIndex = true
+		}
+	}
+	if !usesIndex {
+		t.Fatalf("Expected query on user_id to use an index")
+	}
+}
+
+// containsAll reports whether s contains every substring
+func containsAll(s string, substrings ...string) bool {
+	for _, sub := range substrings {
+		if !strings.Contains(s, sub) {
+			return false
+		}
+	}
+	return true
+}
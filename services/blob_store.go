@@ -0,0 +1,72 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Custom error for blobs that do not exist in the store
+var ErrBlobNotFound = errors.New("blob not found")
+
+// Custom error for keys that are empty or try to escape the store
+var ErrInvalidBlobKey = errors.New("invalid blob key")
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Key         string
+	Size        int64     // Size of the blob in bytes
+	ContentType string    // MIME type recorded when the blob was stored
+	ModTime     time.Time // When the blob was last written
+}
+
+// BlobStore stores receipt originals and generated images by key.
+// Keys are slash separated relative paths such as "originals/<uuid>.jpg".
+type BlobStore interface {
+	// Put stores the contents of r under key, replacing any existing blob.
+	// size is the number of bytes in r, or -1 if it is not known in advance.
+	Put(key string, r io.Reader, size int64, contentType string) error
+	// Get opens the blob stored under key. The caller must close the reader.
+	Get(key string) (io.ReadCloser, BlobInfo, error)
+	// Stat returns the blob's metadata without reading its contents
+	Stat(key string) (BlobInfo, error)
+	// Delete removes the blob stored under key. Deleting a missing blob is not an error.
+	Delete(key string) error
+	// List returns every blob whose key starts with prefix, sorted by key
+	List(prefix string) ([]BlobInfo, error)
+	// SignedURL returns a URL that allows anyone holding it to download the blob until it expires
+	SignedURL(key string, expires time.Duration) (string, error)
+}
+
+// Key prefixes used for the different kinds of blobs
+const (
+	originalsPrefix  = "originals/"
+	thumbnailsPrefix = "thumbnails/" // Thumbnails generated before the rendition cache
+	renditionsPrefix = "renditions/"
+	resumablePrefix  = "resumable/" // Resumable uploads and their received chunks
+)
+
+// legacyUploadPrefix is prepended to the paths of receipts uploaded before blob storage existed
+const legacyUploadPrefix = "uploads/"
+
+// OriginalKey returns the key of a receipt's original file given its stored FilePath.
+// Receipts uploaded before blob storage recorded the path below the uploads directory,
+// which is the root of the default filesystem store.
+func OriginalKey(filePath string) string {
+	return strings.TrimPrefix(filePath, legacyUploadPrefix)
+}
+
+// validateBlobKey rejects keys that are empty, absolute or contain relative path elements
+func validateBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("%w: %q", ErrInvalidBlobKey, key)
+	}
+	for _, element := range strings.Split(key, "/") {
+		if element == "" || element == "." || element == ".." {
+			return fmt.Errorf("%w: %q", ErrInvalidBlobKey, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// ErrImageTooLarge is returned for images whose header declares more pixels than the decode limits allow
+var ErrImageTooLarge = errors.New("image dimensions too large")
+
+// DecodeLimits bounds the images that are decoded. Zero values disable a limit.
+type DecodeLimits struct {
+	MaxPixels    int64 // Largest width times height
+	MaxDimension int   // Largest width or height
+}
+
+// DefaultDecodeLimits returns limits that admit photos of current phone cameras but not decompression bombs
+func DefaultDecodeLimits() DecodeLimits {
+	return DecodeLimits{MaxPixels: 50_000_000, MaxDimension: 20_000}
+}
+
+// Check returns an error wrapping ErrImageTooLarge if an image header exceeds the limits
+func (l DecodeLimits) Check(config image.Config) error {
+	if l.MaxDimension > 0 && (config.Width > l.MaxDimension || config.Height > l.MaxDimension) {
+		return fmt.Errorf("%w: %dx%d pixels, at most %d pixels per side allowed", ErrImageTooLarge, config.Width, config.Height, l.MaxDimension)
+	}
+	if l.MaxPixels > 0 && int64(config.Width)*int64(config.Height) > l.MaxPixels {
+		return fmt.Errorf("%w: %dx%d pixels, at most %d pixels allowed", ErrImageTooLarge, config.Width, config.Height, l.MaxPixels)
+	}
+	return nil
+}
+
+// ImageDecoder decodes images within DecodeLimits, and only a fixed number at the same time,
+// so large uploads and parallel thumbnail requests cannot exhaust memory
+type ImageDecoder struct {
+	Limits     DecodeLimits
+	Rasterizer Rasterizer    // Renders the pages of PDF documents, nil if PDFs are not supported
+	slots      chan struct{} // Holds a token for every decode in progress
+}
+
+// NewImageDecoder creates an ImageDecoder that runs at most concurrency decodes at the same time
+func NewImageDecoder(limits DecodeLimits, concurrency int) *ImageDecoder {
+	return &ImageDecoder{Limits: limits, slots: make(chan struct{}, max(concurrency, 1))}
+}
+
+// DecodeConfig reads only the header of an image and checks its dimensions against the limits
+func (d *ImageDecoder) DecodeConfig(r io.Reader) (image.Config, string, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return config, format, err
+	}
+	return config, format, d.Limits.Check(config)
+}
+
+// Decode decodes an image, turning photos upright according to their EXIF orientation.
+// The header is checked against the limits first, so oversized images are rejected before any pixels are allocated.
+// It waits while the maximum number of decodes are running.
+func (d *ImageDecoder) Decode(r io.Reader) (image.Image, error) {
+	// Keep the header bytes DecodeConfig consumes so the full decode can read them again
+	var header bytes.Buffer
+	if _, _, err := d.DecodeConfig(io.TeeReader(r, &header)); err != nil {
+		return nil, err
+	}
+
+	d.slots <- struct{}{}
+	defer func() { <-d.slots }()
+	return imaging.Decode(io.MultiReader(&header, r), imaging.AutoOrientation(true))
+}
+
+// DecodePage decodes an image or rasterizes a page of a PDF document, numbered from 1.
+// Images only have a first page.
+func (d *ImageDecoder) DecodePage(r io.Reader, page int) (image.Image, error) {
+	images, err := d.DecodePages(r, []int{page})
+	if err != nil {
+		return nil, err
+	}
+	return images[0], nil
+}
+
+// DecodePages decodes several pages, numbered from 1, of an image or a PDF document. A PDF document is written
+// to a temporary file and counted once for all of its pages; an image is decoded once for each of its first pages.
+func (d *ImageDecoder) DecodePages(r io.Reader, pages []int) ([]image.Image, error) {
+	images := make([]image.Image, len(pages))
+
+	// Look at the signature without consuming it
+	buffered := bufio.NewReader(r)
+	if signature, _ := buffered.Peek(len(pdfSignature)); !IsPDF(signature) {
+		for _, page := range pages {
+			if page != 1 {
+				return nil, fmt.Errorf("%w: images only have page 1", ErrPageNotFound)
+			}
+		}
+		img, err := d.Decode(buffered)
+		if err != nil {
+			return nil, err
+		}
+		for i := range images {
+			images[i] = img
+		}
+		return images, nil
+	}
+
+	if d.Rasterizer == nil {
+		return nil, ErrPDFUnsupported
+	}
+	document, err := SpoolUpload(buffered, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer document.Close()
+	count, err := d.PageCount(document.Path())
+	if err != nil {
+		return nil, err
+	}
+	for i, page := range pages {
+		if images[i], err = d.DecodePDFPage(document.Path(), page, count); err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// DecodePDFPage rasterizes a page, numbered from 1, of the PDF document at path, which has count pages
+func (d *ImageDecoder) DecodePDFPage(path string, page, count int) (image.Image, error) {
+	if d.Rasterizer == nil {
+		return nil, ErrPDFUnsupported
+	}
+	if page < 1 || page > count {
+		return nil, fmt.Errorf("%w: page %d of %d", ErrPageNotFound, page, count)
+	}
+
+	d.slots <- struct{}{}
+	defer func() { <-d.slots }()
+	img, err := d.Rasterizer.RasterizePage(path, page)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rasterizers render pages at a bounded size, but one that does not must not bypass the limits
+	bounds := img.Bounds()
+	if err := d.Limits.Check(image.Config{Width: bounds.Dx(), Height: bounds.Dy()}); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// PageCount returns the number of pages of the PDF document at path
+func (d *ImageDecoder) PageCount(path string) (int, error) {
+	if d.Rasterizer == nil {
+		return 0, ErrPDFUnsupported
+	}
+	return d.Rasterizer.PageCount(path)
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"os"
+	"testing"
+	"time"
+)
+
+// testDecoder decodes test images with the default limits
+var testDecoder = NewImageDecoder(DefaultDecodeLimits(), 2)
+
+// bombPNG returns a tiny PNG whose header declares the given dimensions
+func bombPNG(t *testing.T, width, height uint32) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	data := buf.Bytes()
+
+	// The IHDR chunk follows the 8 byte signature, its length and type; its CRC covers type and data
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+// TestDecodeLimits tests checking declared image dimensions against the limits
+func TestDecodeLimits(t *testing.T) {
+	limits := DecodeLimits{MaxPixels: 1_000_000, MaxDimension: 2000}
+	tests := []struct {
+		width, height int
+		allowed       bool
+	}{
+		{1000, 1000, true},
+		{2000, 400, true},
+		{2001, 10, false},
+		{10, 2001, false},
+		{1001, 1000, false},
+	}
+	for _, test := range tests {
+		err := limits.Check(image.Config{Width: test.width, Height: test.height})
+		if test.allowed && err != nil {
+			t.Fatalf("Expected %dx%d to be allowed, got %v", test.width, test.height, err)
+		}
+		if !test.allowed && !errors.Is(err, ErrImageTooLarge) {
+			t.Fatalf("Expected %dx%d to be too large, got %v", test.width, test.height, err)
+		}
+	}
+
+	if err := (DecodeLimits{}).Check(image.Config{Width: 100_000, Height: 100_000}); err != nil {
+		t.Fatalf("Expected zero limits to allow any size, got %v", err)
+	}
+}
+
+// TestImageDecoder tests decoding within the limits and the number of simultaneous decodes
+func TestImageDecoder(t *testing.T) {
+	data, err := os.ReadFile("../testdata/test.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+
+	t.Run("Decode", func(t *testing.T) {
+		img, err := testDecoder.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if img.Bounds().Dx() != 2560 || img.Bounds().Dy() != 1440 {
+			t.Fatalf("Expected 2560x1440, got %v", img.Bounds())
+		}
+	})
+
+	t.Run("DecompressionBomb", func(t *testing.T) {
+		bomb := bombPNG(t, 50000, 50000)
+		if config, err := png.DecodeConfig(bytes.NewReader(bomb)); err != nil || config.Width != 50000 {
+			t.Fatalf("Expected a valid PNG header declaring 50000x50000, got %+v, %v", config, err)
+		}
+		if _, err := testDecoder.Decode(bytes.NewReader(bomb)); !errors.Is(err, ErrImageTooLarge) {
+			t.Fatalf("Expected ErrImageTooLarge, got %v", err)
+		}
+	})
+
+	t.Run("MaxDimension", func(t *testing.T) {
+		decoder := NewImageDecoder(DecodeLimits{MaxDimension: 2000}, 1)
+		if _, _, err := decoder.DecodeConfig(bytes.NewReader(data)); !errors.Is(err, ErrImageTooLarge) {
+			t.Fatalf("Expected ErrImageTooLarge from the header, got %v", err)
+		}
+		if _, err := decoder.Decode(bytes.NewReader(data)); !errors.Is(err, ErrImageTooLarge) {
+			t.Fatalf("Expected ErrImageTooLarge, got %v", err)
+		}
+	})
+
+	t.Run("Concurrency", func(t *testing.T) {
+		decoder := NewImageDecoder(DefaultDecodeLimits(), 1)
+
+		// Occupy the only slot, as a running decode would
+		decoder.slots <- struct{}{}
+		done := make(chan error)
+		go func() {
+			_, err := decoder.Decode(bytes.NewReader(data))
+			done <- err
+		}()
+
+		select {
+		case <-done:
+			t.Fatalf("Expected the decode to wait for a free slot")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		<-decoder.slots
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the decode to finish once the slot was free")
+		}
+	})
+}
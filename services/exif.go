@@ -0,0 +1,453 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"strings"
+	"time"
+)
+
+// MetadataPolicy selects which EXIF metadata is kept in stored originals and JPEG renditions
+type MetadataPolicy string
+
+const (
+	MetadataRetain   MetadataPolicy = "retain"    // Keep all EXIF metadata
+	MetadataStripGPS MetadataPolicy = "strip_gps" // Keep EXIF metadata but remove the location
+	MetadataStrip    MetadataPolicy = "strip"     // Remove all EXIF metadata
+)
+
+// Quality of originals re-encoded to apply their EXIF orientation
+const orientedJPEGQuality = 95
+
+// Custom error for EXIF data that cannot be parsed
+var ErrInvalidEXIF = errors.New("invalid EXIF data")
+
+// PhotoMetadata is the metadata a camera recorded in a photo's EXIF data
+type PhotoMetadata struct {
+	Orientation int    // EXIF orientation 1-8, 1 if the pixels are stored upright
+	CapturedAt  string // When the photo was taken, RFC 3339 without a zone if the camera did not record one
+	CameraMake  string
+	CameraModel string
+	HasGPS      bool // Whether the photo records where it was taken
+}
+
+// EXIF tags read from the photo
+const (
+	tagMake                = 0x010F
+	tagModel               = 0x0110
+	tagOrientation         = 0x0112
+	tagExifIFD             = 0x8769
+	tagGPSIFD              = 0x8825
+	tagDateTimeOriginal    = 0x9003
+	tagDateTimeDigitized   = 0x9004
+	tagOffsetTimeOriginal  = 0x9011
+	tagOffsetTimeDigitized = 0x9012
+)
+
+// JPEG markers of the segments the metadata is read from
+const (
+	markerSOI  = 0xD8
+	markerEOI  = 0xD9
+	markerSOS  = 0xDA
+	markerAPP1 = 0xE1
+	markerAPP2 = 0xE2
+)
+
+// Identifiers at the start of APP1 and APP2 segments
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+)
+
+// jpegSegment is a marker segment before the image data of a JPEG file
+type jpegSegment struct {
+	marker  byte
+	payload []byte // Contents after the length field
+}
+
+// splitJPEG returns the marker segments of a JPEG file and the data from the start of scan onwards
+func splitJPEG(data []byte) ([]jpegSegment, []byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil, nil, errors.New("not a JPEG file")
+	}
+
+	var segments []jpegSegment
+	pos := 2
+	for {
+		// Markers may be preceded by any number of fill bytes
+		for pos < len(data) && data[pos] == 0xFF && pos+1 < len(data) && data[pos+1] == 0xFF {
+			pos++
+		}
+		if pos+4 > len(data) || data[pos] != 0xFF {
+			return nil, nil, errors.New("truncated JPEG file")
+		}
+		marker := data[pos+1]
+		if marker == markerSOS || marker == markerEOI {
+			return segments, data[pos:], nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, nil, errors.New("truncated JPEG segment")
+		}
+		segments = append(segments, jpegSegment{marker: marker, payload: data[pos+4 : pos+2+length]})
+		pos += 2 + length
+	}
+}
+
+// joinJPEG assembles a JPEG file from its marker segments and image data
+func joinJPEG(segments []jpegSegment, scan []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xFF, markerSOI})
+	for _, segment := range segments {
+		buf.Write([]byte{0xFF, segment.marker})
+		binary.Write(&buf, binary.BigEndian, uint16(len(segment.payload)+2))
+		buf.Write(segment.payload)
+	}
+	buf.Write(scan)
+	return buf.Bytes()
+}
+
+// isEXIF reports whether a segment holds EXIF data
+func (s jpegSegment) isEXIF() bool {
+	return s.marker == markerAPP1 && bytes.HasPrefix(s.payload, exifHeader)
+}
+
+// isXMP reports whether a segment holds an XMP packet, which can repeat the EXIF location
+func (s jpegSegment) isXMP() bool {
+	return s.marker == markerAPP1 && bytes.HasPrefix(s.payload, xmpHeader)
+}
+
+// isICC reports whether a segment holds part of an ICC color profile
+func (s jpegSegment) isICC() bool {
+	return s.marker == markerAPP2 && bytes.HasPrefix(s.payload, iccHeader)
+}
+
+// NormalizeJPEG applies a photo's EXIF orientation to its pixels and the metadata policy to its EXIF data.
+// Photos that are already upright are rewritten without re-encoding their image data; other files are
+// returned unchanged. The metadata is read before the policy is applied.
+func NormalizeJPEG(data []byte, policy MetadataPolicy, decoder *ImageDecoder) ([]byte, PhotoMetadata, error) {
+	photo := PhotoMetadata{Orientation: 1}
+	segments, scan, err := splitJPEG(data)
+	if err != nil {
+		return data, photo, nil
+	}
+
+	var exif *exifData
+	for _, segment := range segments {
+		if segment.isEXIF() {
+			// Unreadable EXIF data is dropped unless everything is retained, since its location cannot be removed
+			if exif, err = parseEXIF(segment.payload[len(exifHeader):]); err == nil {
+				photo = exif.metadata()
+			}
+			break
+		}
+	}
+
+	// Rotating the pixels requires decoding and re-encoding the image
+	if photo.Orientation != 1 {
+		img, err := decoder.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, photo, err
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: orientedJPEGQuality}); err != nil {
+			return nil, photo, err
+		}
+		encoded, encodedScan, err := splitJPEG(buf.Bytes())
+		if err != nil {
+			return nil, photo, err
+		}
+
+		// Carry over the metadata and color profile the encoder does not write
+		var kept []jpegSegment
+		if segment, ok := exif.segment(policy); ok {
+			kept = append(kept, segment)
+		}
+		for _, segment := range segments {
+			if segment.isICC() || (segment.isXMP() && policy == MetadataRetain) {
+				kept = append(kept, segment)
+			}
+		}
+		return joinJPEG(append(kept, encoded...), encodedScan), photo, nil
+	}
+
+	// Upright photos are rewritten without re-encoding, dropping the metadata the policy removes
+	if policy == MetadataRetain {
+		return data, photo, nil
+	}
+	var rewritten []jpegSegment
+	changed, exifKept := false, false
+	for _, segment := range segments {
+		switch {
+		case segment.isEXIF():
+			// Only the first EXIF segment is the photo's metadata; an XMP segment may come before it
+			if kept, ok := exif.segment(policy); ok && !exifKept {
+				rewritten = append(rewritten, kept)
+				exifKept = true
+			}
+			changed = true
+		case segment.isXMP():
+			changed = true
+		default:
+			rewritten = append(rewritten, segment)
+		}
+	}
+	if !changed {
+		return data, photo, nil
+	}
+	return joinJPEG(rewritten, scan), photo, nil
+}
+
+// uprightSize returns the size of an image once turned upright according to the EXIF orientation of the JPEG file data.
+// Orientations 5 to 8 rotate the image by a quarter turn.
+func uprightSize(config image.Config, data []byte) image.Rectangle {
+	segments, _, err := splitJPEG(data)
+	if err != nil {
+		return image.Rect(0, 0, config.Width, config.Height)
+	}
+	for _, segment := range segments {
+		if !segment.isEXIF() {
+			continue
+		}
+		if exif, err := parseEXIF(segment.payload[len(exifHeader):]); err == nil && exif.metadata().Orientation >= 5 {
+			return image.Rect(0, 0, config.Height, config.Width)
+		}
+		break
+	}
+	return image.Rect(0, 0, config.Width, config.Height)
+}
+
+// EmbedPhotoMetadata copies the EXIF data of a JPEG original into a JPEG rendition, applying the metadata policy.
+// Renditions are always upright, so the copy records no rotation.
+func EmbedPhotoMetadata(rendition, original []byte, policy MetadataPolicy) ([]byte, error) {
+	if policy == MetadataStrip {
+		return rendition, nil
+	}
+	segments, _, err := splitJPEG(original)
+	if err != nil {
+		return rendition, nil
+	}
+	for _, segment := range segments {
+		if !segment.isEXIF() {
+			continue
+		}
+		exif, err := parseEXIF(segment.payload[len(exifHeader):])
+		if err != nil {
+			return rendition, nil // Dropped, as for originals
+		}
+		kept, ok := exif.segment(policy)
+		if !ok {
+			return rendition, nil
+		}
+		encoded, scan, err := splitJPEG(rendition)
+		if err != nil {
+			return nil, err
+		}
+		return joinJPEG(append([]jpegSegment{kept}, encoded...), scan), nil
+	}
+	return rendition, nil
+}
+
+// exifData is a parsed TIFF structure from an EXIF segment
+type exifData struct {
+	tiff  []byte
+	order binary.ByteOrder
+	tags  map[uint16]exifEntry // Tags of IFD0, the EXIF IFD and the GPS IFD, which do not overlap
+	gps   int                  // Number of entries in the GPS IFD
+}
+
+// exifEntry is a single IFD entry
+type exifEntry struct {
+	offset    int // Position of the 12 byte entry in the TIFF data
+	valueType uint16
+	count     uint32
+}
+
+// Sizes of the EXIF value types in bytes, by type number
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// parseEXIF parses the TIFF structure of an EXIF segment, following the EXIF and GPS IFD pointers of IFD0
+func parseEXIF(tiff []byte) (*exifData, error) {
+	if len(tiff) < 8 {
+		return nil, ErrInvalidEXIF
+	}
+	exif := &exifData{tiff: tiff, tags: make(map[uint16]exifEntry)}
+	switch string(tiff[:2]) {
+	case "II":
+		exif.order = binary.LittleEndian
+	case "MM":
+		exif.order = binary.BigEndian
+	default:
+		return nil, ErrInvalidEXIF
+	}
+	if exif.order.Uint16(tiff[2:]) != 42 {
+		return nil, ErrInvalidEXIF
+	}
+
+	if _, err := exif.readIFD(int(exif.order.Uint32(tiff[4:]))); err != nil {
+		return nil, err
+	}
+	if entry, ok := exif.tags[tagExifIFD]; ok {
+		offset, ok := exif.uint(entry)
+		if !ok {
+			return nil, ErrInvalidEXIF
+		}
+		if _, err := exif.readIFD(offset); err != nil {
+			return nil, err
+		}
+	}
+	if entry, ok := exif.tags[tagGPSIFD]; ok {
+		offset, ok := exif.uint(entry)
+		if !ok {
+			return nil, ErrInvalidEXIF
+		}
+		count, err := exif.readIFD(offset)
+		if err != nil {
+			return nil, err
+		}
+		exif.gps = count
+	}
+	return exif, nil
+}
+
+// readIFD records the entries of the IFD at offset and returns their number
+func (e *exifData) readIFD(offset int) (int, error) {
+	if offset < 8 || offset+2 > len(e.tiff) {
+		return 0, ErrInvalidEXIF
+	}
+	count := int(e.order.Uint16(e.tiff[offset:]))
+	if offset+2+count*12 > len(e.tiff) {
+		return 0, ErrInvalidEXIF
+	}
+	for i := 0; i < count; i++ {
+		pos := offset + 2 + i*12
+		tag := e.order.Uint16(e.tiff[pos:])
+		if _, seen := e.tags[tag]; seen {
+			continue
+		}
+		e.tags[tag] = exifEntry{offset: pos, valueType: e.order.Uint16(e.tiff[pos+2:]), count: e.order.Uint32(e.tiff[pos+4:])}
+	}
+	return count, nil
+}
+
+// value returns the bytes of an entry's value, which are stored in the entry itself if they fit
+func (e *exifData) value(entry exifEntry) ([]byte, bool) {
+	size, ok := exifTypeSizes[entry.valueType]
+	if !ok || entry.count > uint32(len(e.tiff)) {
+		return nil, false
+	}
+	length := size * int(entry.count)
+	if length <= 4 {
+		return e.tiff[entry.offset+8 : entry.offset+8+length], true
+	}
+	start := int(e.order.Uint32(e.tiff[entry.offset+8:]))
+	if start < 0 || start+length > len(e.tiff) {
+		return nil, false
+	}
+	return e.tiff[start : start+length], true
+}
+
+// uint returns the first value of a SHORT or LONG entry
+func (e *exifData) uint(entry exifEntry) (int, bool) {
+	value, ok := e.value(entry)
+	switch {
+	case !ok || entry.count == 0:
+		return 0, false
+	case entry.valueType == 3:
+		return int(e.order.Uint16(value)), true
+	case entry.valueType == 4:
+		return int(e.order.Uint32(value)), true
+	}
+	return 0, false
+}
+
+// string returns the value of an ASCII entry without its terminator and padding
+func (e *exifData) string(tag uint16) string {
+	entry, ok := e.tags[tag]
+	if !ok || entry.valueType != 2 {
+		return ""
+	}
+	value, ok := e.value(entry)
+	if !ok {
+		return ""
+	}
+	if end := bytes.IndexByte(value, 0); end >= 0 {
+		value = value[:end]
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// metadata extracts the photo metadata recorded in the EXIF data
+func (e *exifData) metadata() PhotoMetadata {
+	photo := PhotoMetadata{Orientation: 1, CameraMake: e.string(tagMake), CameraModel: e.string(tagModel)}
+	if entry, ok := e.tags[tagOrientation]; ok {
+		if orientation, ok := e.uint(entry); ok && orientation >= 1 && orientation <= 8 {
+			photo.Orientation = orientation
+		}
+	}
+	photo.HasGPS = e.gps > 0
+
+	// Prefer the time the photo was taken over the time it was digitized
+	for _, tags := range [][2]uint16{{tagDateTimeOriginal, tagOffsetTimeOriginal}, {tagDateTimeDigitized, tagOffsetTimeDigitized}} {
+		if capturedAt := exifTime(e.string(tags[0]), e.string(tags[1])); capturedAt != "" {
+			photo.CapturedAt = capturedAt
+			break
+		}
+	}
+	return photo
+}
+
+// exifTime converts an EXIF date and time such as "2024:04:30 12:31:05" and its optional
+// UTC offset such as "+02:00" to RFC 3339. Unset or invalid times return "".
+func exifTime(value, offset string) string {
+	t, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil {
+		return ""
+	}
+	if zoned, err := time.Parse("2006:01:02 15:04:05-07:00", value+offset); err == nil {
+		return zoned.Format(time.RFC3339)
+	}
+	return t.Format("2006-01-02T15:04:05")
+}
+
+// segment returns a copy of the EXIF data as an APP1 segment with the policy applied and the orientation
+// reset, since the pixels it is stored with are upright. It returns false if nothing is to be kept.
+func (e *exifData) segment(policy MetadataPolicy) (jpegSegment, bool) {
+	if e == nil || policy == MetadataStrip {
+		return jpegSegment{}, false
+	}
+	scrubbed := &exifData{tiff: bytes.Clone(e.tiff), order: e.order, tags: e.tags}
+	if entry, ok := e.tags[tagOrientation]; ok && entry.valueType == 3 && entry.count == 1 {
+		scrubbed.order.PutUint16(scrubbed.tiff[entry.offset+8:], 1)
+	}
+	if policy == MetadataStripGPS {
+		scrubbed.removeGPS()
+	}
+	return jpegSegment{marker: markerAPP1, payload: append(bytes.Clone(exifHeader), scrubbed.tiff...)}, true
+}
+
+// removeGPS overwrites the GPS IFD and its values with zeros, leaving an empty IFD so other offsets stay valid
+func (e *exifData) removeGPS() {
+	pointer, ok := e.tags[tagGPSIFD]
+	if !ok {
+		return
+	}
+	offset, ok := e.uint(pointer)
+	if !ok || offset+2 > len(e.tiff) {
+		return
+	}
+	count := int(e.order.Uint16(e.tiff[offset:]))
+	for i := 0; i < count && offset+2+(i+1)*12 <= len(e.tiff); i++ {
+		pos := offset + 2 + i*12
+		entry := exifEntry{offset: pos, valueType: e.order.Uint16(e.tiff[pos+2:]), count: e.order.Uint32(e.tiff[pos+4:])}
+		if value, ok := e.value(entry); ok {
+			clear(value)
+		}
+		clear(e.tiff[pos : pos+12])
+	}
+	e.order.PutUint16(e.tiff[offset:], 0)
+}
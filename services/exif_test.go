@@ -0,0 +1,117 @@
+package services
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"testing"
+)
+
+// TestNormalizeJPEG tests applying the EXIF orientation and the metadata policies to uploaded photos
+func TestNormalizeJPEG(t *testing.T) {
+	// exif.jpg is a 120x80 photo stored sideways (orientation 6): red on the left, blue on the right
+	original, err := os.ReadFile("../testdata/exif.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+	latitude := []byte{0, 0, 0, 60, 0, 0, 0, 1, 0, 0, 0, 10, 0, 0, 0, 1}
+
+	normalize := func(t *testing.T, data []byte, policy MetadataPolicy) ([]byte, PhotoMetadata) {
+		normalized, photo, err := NormalizeJPEG(data, policy, testDecoder)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return normalized, photo
+	}
+
+	t.Run("Metadata", func(t *testing.T) {
+		_, photo := normalize(t, original, MetadataStrip)
+		expected := PhotoMetadata{Orientation: 6, CapturedAt: "2024-04-30T12:31:05+02:00", CameraMake: "Receiptcam", CameraModel: "RC-1 Pro", HasGPS: true}
+		if photo != expected {
+			t.Fatalf("Expected %+v, got %+v", expected, photo)
+		}
+	})
+
+	t.Run("Orientation", func(t *testing.T) {
+		normalized, _ := normalize(t, original, MetadataRetain)
+		img, _, err := image.Decode(bytes.NewReader(normalized))
+		if err != nil {
+			t.Fatalf("Expected a decodable image, got %v", err)
+		}
+		if img.Bounds().Dx() != 80 || img.Bounds().Dy() != 120 {
+			t.Fatalf("Expected an upright 80x120 image, got %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+		}
+		if r, _, b, _ := img.At(40, 10).RGBA(); r < b {
+			t.Fatalf("Expected the red half at the top")
+		}
+
+		// The retained metadata no longer asks viewers to rotate the image
+		_, photo := normalize(t, normalized, MetadataRetain)
+		if photo.Orientation != 1 || photo.CameraMake != "Receiptcam" || !photo.HasGPS {
+			t.Fatalf("Expected the metadata to be retained upright, got %+v", photo)
+		}
+	})
+
+	t.Run("StripGPS", func(t *testing.T) {
+		normalized, _ := normalize(t, original, MetadataStripGPS)
+		_, photo := normalize(t, normalized, MetadataRetain)
+		if photo.HasGPS || photo.CapturedAt == "" || photo.CameraModel != "RC-1 Pro" {
+			t.Fatalf("Expected only the location to be removed, got %+v", photo)
+		}
+		if bytes.Contains(normalized, latitude) {
+			t.Fatalf("Expected the GPS coordinates to be erased")
+		}
+	})
+
+	t.Run("StripGPSAfterXMP", func(t *testing.T) {
+		// An XMP segment may come before the EXIF segment of an upright photo
+		rotated, _ := normalize(t, original, MetadataRetain)
+		segments, scan, _ := splitJPEG(rotated)
+		xmp := jpegSegment{marker: markerAPP1, payload: append(append([]byte(nil), xmpHeader...), "<x:xmpmeta/>"...)}
+		withXMP := joinJPEG(append([]jpegSegment{xmp}, segments...), scan)
+
+		normalized, _ := normalize(t, withXMP, MetadataStripGPS)
+		_, photo := normalize(t, normalized, MetadataRetain)
+		if photo.HasGPS || photo.CapturedAt == "" || photo.CameraModel != "RC-1 Pro" {
+			t.Fatalf("Expected only the location to be removed, got %+v", photo)
+		}
+		if bytes.Contains(normalized, xmpHeader) {
+			t.Fatalf("Expected the XMP packet to be removed")
+		}
+	})
+
+	t.Run("Strip", func(t *testing.T) {
+		normalized, _ := normalize(t, original, MetadataStrip)
+		if bytes.Contains(normalized, exifHeader) {
+			t.Fatalf("Expected the EXIF metadata to be removed")
+		}
+		if _, photo := normalize(t, normalized, MetadataRetain); photo != (PhotoMetadata{Orientation: 1}) {
+			t.Fatalf("Expected no metadata, got %+v", photo)
+		}
+	})
+
+	t.Run("UprightUnchanged", func(t *testing.T) {
+		// Photos without metadata are stored byte for byte
+		data, _ := os.ReadFile("../testdata/test.jpg")
+		if normalized, _ := normalize(t, data, MetadataStrip); !bytes.Equal(normalized, data) {
+			t.Fatalf("Expected a photo without metadata to be unchanged")
+		}
+
+		// Removing the metadata of an upright photo does not re-encode it
+		rotated, _ := normalize(t, original, MetadataRetain)
+		stripped, _ := normalize(t, rotated, MetadataStrip)
+		_, scan, _ := splitJPEG(rotated)
+		if !bytes.HasSuffix(stripped, scan) {
+			t.Fatalf("Expected the image data to be kept as it is")
+		}
+	})
+
+	t.Run("OtherFormats", func(t *testing.T) {
+		var buf bytes.Buffer
+		png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4)))
+		if normalized, photo := normalize(t, buf.Bytes(), MetadataStrip); !bytes.Equal(normalized, buf.Bytes()) || photo.Orientation != 1 {
+			t.Fatalf("Expected a PNG to be unchanged")
+		}
+	})
+}
@@ -0,0 +1,225 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignedBlobPath is the URL path below which the filesystem store's signed URLs are served
+const SignedBlobPath = "/blobs/"
+
+// Custom error for signed URLs that are malformed, forged or expired
+var ErrInvalidSignature = errors.New("invalid or expired signature")
+
+// FileSystemBlobStore stores blobs as files below a local directory.
+// Its signed URLs point at this service and must be checked with VerifySignature.
+type FileSystemBlobStore struct {
+	root       string
+	signingKey []byte
+}
+
+// NewFileSystemBlobStore creates the root directory if needed and returns a store rooted there.
+// signingKey is the HMAC key used for signed URLs.
+func NewFileSystemBlobStore(root string, signingKey []byte) (*FileSystemBlobStore, error) {
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory %s: %v", root, err)
+	}
+	return &FileSystemBlobStore{root: root, signingKey: signingKey}, nil
+}
+
+// path returns the filesystem path of the blob stored under key
+func (s *FileSystemBlobStore) path(key string) (string, error) {
+	if err := validateBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob to a temporary file and renames it into place so readers never see a partial blob
+func (s *FileSystemBlobStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	target, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Temporary files start with a dot so List never reports them
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after a successful rename
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// Get opens the blob's file. The returned reader is an *os.File and therefore also seekable.
+func (s *FileSystemBlobStore) Get(key string) (io.ReadCloser, BlobInfo, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+
+	f, err := os.Open(target)
+	if os.IsNotExist(err) {
+		return nil, BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, BlobInfo{}, err
+	}
+	return f, fileBlobInfo(key, stat), nil
+}
+
+// Stat returns the metadata of the blob's file
+func (s *FileSystemBlobStore) Stat(key string) (BlobInfo, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	stat, err := os.Stat(target)
+	if os.IsNotExist(err) {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return fileBlobInfo(key, stat), nil
+}
+
+// Delete removes the blob's file, ignoring files that are already gone
+func (s *FileSystemBlobStore) Delete(key string) error {
+	target, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List walks the directory the prefix ends in and returns the blobs whose key starts with prefix,
+// so listing the blobs of one receipt or upload does not visit the whole store
+func (s *FileSystemBlobStore) List(prefix string) ([]BlobInfo, error) {
+	start := s.root
+	if dir := prefix[:strings.LastIndex(prefix, "/")+1]; dir != "" {
+		if err := validateBlobKey(strings.TrimSuffix(dir, "/")); err != nil {
+			return nil, err
+		}
+		start = filepath.Join(s.root, filepath.FromSlash(dir))
+	}
+
+	var blobs []BlobInfo
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if p == start && errors.Is(err, fs.ErrNotExist) {
+			return fs.SkipAll // Nothing is stored below the prefix
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		stat, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil // Deleted while walking
+		}
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, fileBlobInfo(key, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	return blobs, nil
+}
+
+// SignedURL returns a relative URL below SignedBlobPath carrying an expiry time and an HMAC of the key
+func (s *FileSystemBlobStore) SignedURL(key string, expires time.Duration) (string, error) {
+	if err := validateBlobKey(key); err != nil {
+		return "", err
+	}
+
+	expiresAt := strconv.FormatInt(time.Now().Add(expires).Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expiresAt)
+	query.Set("signature", s.signature(key, expiresAt))
+
+	u := url.URL{Path: SignedBlobPath + key, RawQuery: query.Encode()}
+	return u.String(), nil
+}
+
+// VerifySignature checks the expiry time and signature of a URL created by SignedURL
+func (s *FileSystemBlobStore) VerifySignature(key, expires, signature string) error {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.signature(key, expires))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// signature returns the hex encoded HMAC-SHA256 of the key and expiry time
+func (s *FileSystemBlobStore) signature(key, expires string) string {
+	mac := hmac.New(sha256.New, s.signingKey)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// fileBlobInfo converts file metadata to BlobInfo, deriving the content type from the extension
+func fileBlobInfo(key string, stat fs.FileInfo) BlobInfo {
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return BlobInfo{Key: key, Size: stat.Size(), ContentType: contentType, ModTime: stat.ModTime()}
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBlobStore runs the operations shared by every BlobStore implementation
+func testBlobStore(t *testing.T, store BlobStore) {
+	t.Run("PutGet", func(t *testing.T) {
+		if err := store.Put("originals/a.jpg", strings.NewReader("jpeg data"), 9, "image/jpeg"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		r, info, err := store.Get("originals/a.jpg")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		defer r.Close()
+		data, _ := io.ReadAll(r)
+		if string(data) != "jpeg data" || info.Size != 9 || info.ContentType != "image/jpeg" {
+			t.Fatalf("Expected 9 bytes of image/jpeg, got %q and %+v", data, info)
+		}
+	})
+
+	t.Run("PutUnknownSize", func(t *testing.T) {
+		if err := store.Put("thumbnails/a_100x100.jpg", strings.NewReader("thumb"), -1, "image/jpeg"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		info, err := store.Stat("thumbnails/a_100x100.jpg")
+		if err != nil || info.Size != 5 {
+			t.Fatalf("Expected a 5 byte blob, got %+v and %v", info, err)
+		}
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		store.Put("originals/b.jpg", strings.NewReader("old"), 3, "image/jpeg")
+		store.Put("originals/b.jpg", strings.NewReader("newer"), 5, "image/jpeg")
+		info, err := store.Stat("originals/b.jpg")
+		if err != nil || info.Size != 5 {
+			t.Fatalf("Expected the blob to be replaced, got %+v and %v", info, err)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		if _, _, err := store.Get("originals/missing.jpg"); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("Expected ErrBlobNotFound, got %v", err)
+		}
+		if _, err := store.Stat("originals/missing.jpg"); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("Expected ErrBlobNotFound, got %v", err)
+		}
+		if err := store.Delete("originals/missing.jpg"); err != nil {
+			t.Fatalf("Expected deleting a missing blob to succeed, got %v", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		blobs, err := store.List("originals/")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(blobs) != 2 || blobs[0].Key != "originals/a.jpg" || blobs[1].Key != "originals/b.jpg" {
+			t.Fatalf("Expected originals a and b, got %+v", blobs)
+		}
+
+		// Prefixes may end inside a file name, or in a directory that does not exist
+		if blobs, err := store.List("thumbnails/a_"); err != nil || len(blobs) != 1 || blobs[0].Key != "thumbnails/a_100x100.jpg" {
+			t.Fatalf("Expected the thumbnail of a, got %+v, %v", blobs, err)
+		}
+		if blobs, err := store.List("renditions/missing/"); err != nil || len(blobs) != 0 {
+			t.Fatalf("Expected no blobs, got %+v, %v", blobs, err)
+		}
+		if blobs, err := store.List(""); err != nil || len(blobs) != 3 {
+			t.Fatalf("Expected every blob, got %+v, %v", blobs, err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := store.Delete("originals/a.jpg"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if _, err := store.Stat("originals/a.jpg"); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("Expected blob to be deleted, got %v", err)
+		}
+	})
+
+	t.Run("InvalidKey", func(t *testing.T) {
+		for _, key := range []string{"", "/etc/passwd", "../secret", "a//b", "a/./b"} {
+			if err := store.Put(key, strings.NewReader("x"), 1, ""); !errors.Is(err, ErrInvalidBlobKey) {
+				t.Fatalf("Expected ErrInvalidBlobKey for %q, got %v", key, err)
+			}
+		}
+	})
+}
+
+// TestFileSystemBlobStore tests the filesystem implementation of BlobStore
+func TestFileSystemBlobStore(t *testing.T) {
+	store := newTestBlobStore(t)
+	testBlobStore(t, store)
+
+	t.Run("SignedURL", func(t *testing.T) {
+		signed, err := store.SignedURL("originals/b.jpg", time.Minute)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		u, _ := url.Parse(signed)
+		if u.Path != SignedBlobPath+"originals/b.jpg" {
+			t.Fatalf("Expected URL below %s, got %s", SignedBlobPath, signed)
+		}
+
+		expires, signature := u.Query().Get("expires"), u.Query().Get("signature")
+		if err := store.VerifySignature("originals/b.jpg", expires, signature); err != nil {
+			t.Fatalf("Expected valid signature, got %v", err)
+		}
+		// The signature is bound to the key and expiry time
+		if err := store.VerifySignature("originals/a.jpg", expires, signature); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("Expected ErrInvalidSignature for another key, got %v", err)
+		}
+		if err := store.VerifySignature("originals/b.jpg", expires+"0", signature); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("Expected ErrInvalidSignature for another expiry, got %v", err)
+		}
+	})
+
+	t.Run("ExpiredSignedURL", func(t *testing.T) {
+		signed, _ := store.SignedURL("originals/b.jpg", -time.Minute)
+		u, _ := url.Parse(signed)
+		err := store.VerifySignature("originals/b.jpg", u.Query().Get("expires"), u.Query().Get("signature"))
+		if !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("Expected ErrInvalidSignature for an expired URL, got %v", err)
+		}
+	})
+}
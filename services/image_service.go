@@ -2,9 +2,6 @@ package services
 
 import (
 	"image"
-	"os"
-
-	"github.com/disintegration/imaging"
 )
 
 // result struct holds the processed image or an error
@@ -13,28 +10,22 @@ type Result struct {
 	Err error
 }
 
-// ProcessImage processes the image and returns the result through a channel.
-// It opens, decodes, and resizes the image based on the provided width and height.
-func ProcessImage(filePath string, width, height int) (image.Image, error) {
-	// Open the image file
-	file, err := os.Open(filePath)
+// ProcessImage reads the image stored under key, decodes it upright and resizes it the way a variant rendition of
+// the given width and height is resized, see VariantPreset. Either dimension may be 0 to keep the aspect ratio.
+func ProcessImage(store BlobStore, key string, width, height int, decoder *ImageDecoder) (image.Image, error) {
+	file, _, err := store.Get(key)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	// Decode the image
-	img, err := imaging.Decode(file)
+	img, err := decoder.Decode(file)
 	if err != nil {
 		return nil, err
 	}
-
-	// If both width and height are provided, use Fit to resize proportionally
-	if width > 0 && height > 0 {
-		img = imaging.Fit(img, width, height, imaging.Lanczos)
+	preset := VariantPreset(width, height)
+	if err := checkPresetSize(img.Bounds(), preset, decoder.Limits); err != nil {
+		return nil, err
 	}
-	// Use Resize to maintain aspect ratio with one of the dimensions as 0
-	img = imaging.Resize(img, width, height, imaging.Lanczos)
-
-	return img, nil
+	return applyPreset(img, preset), nil
 }
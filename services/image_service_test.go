@@ -1,72 +1,59 @@
 package services
 
 import (
-	"os"
-	"path/filepath"
+	"errors"
 	"testing"
 )
 
-// Setup function to create the test environment for images
-func setupImageTestEnvironment() error {
-	return os.MkdirAll(uploadDir, os.ModePerm)
-}
-
 // TestProcessImage tests the ProcessImage function
 func TestProcessImage(t *testing.T) {
 	// Setup test environment
-	if err := setupImageTestEnvironment(); err != nil {
+	store, err := setupImageTestEnvironment()
+	if err != nil {
 		t.Fatalf("Failed to set up test environment: %v", err)
 	}
 
 	t.Run("SuccessfulImageResize", func(t *testing.T) {
-		// Get the test image path
-		imagePath := filepath.Join("../testdata", "test.jpg")
-
-		// Process the image (resize to 100x100)
-		img, err := ProcessImage(imagePath, 100, 100)
-
-		// Check for errors
+		// test.jpg is 2560x1440, so it fits a 100x100 box at 100x56
+		img, err := ProcessImage(store, "test.jpg", 100, 100, testDecoder)
 		if err != nil {
 			t.Fatalf("Expected no error, got: %v", err)
 		}
-
-		// Check that the image was resized correctly
-		if img.Bounds().Dx() != 100 || img.Bounds().Dy() != 100 {
-			t.Fatalf("Expected image dimensions to be 100x100, got: %vx%v", img.Bounds().Dx(), img.Bounds().Dy())
+		if img.Bounds().Dx() != 100 || img.Bounds().Dy() != 56 {
+			t.Fatalf("Expected image dimensions to be 100x56, got: %vx%v", img.Bounds().Dx(), img.Bounds().Dy())
 		}
 	})
 
 	t.Run("ResizeWithOneDimension", func(t *testing.T) {
-		// Get the test image path
-		imagePath := filepath.Join("../testdata", "test.jpg")
-
-		// Process the image (resize width to 100, height to 0 to preserve aspect ratio)
-		img, err := ProcessImage(imagePath, 100, 0)
-
-		// Check for errors
+		// Resize width to 100, height to 0 to preserve aspect ratio
+		img, err := ProcessImage(store, "test.jpg", 100, 0, testDecoder)
 		if err != nil {
 			t.Fatalf("Expected no error, got: %v", err)
 		}
-
-		// Check that the width is resized to 100 and the height was adjusted proportionally
-		if img.Bounds().Dx() != 100 {
-			t.Fatalf("Expected image width to be 100, got: %v", img.Bounds().Dx())
-		}
-		if img.Bounds().Dy() == 0 {
-			t.Fatalf("Expected image height is not 0, got: %v", img.Bounds().Dx())
+		if img.Bounds().Dx() != 100 || img.Bounds().Dy() != 56 {
+			t.Fatalf("Expected image dimensions to be 100x56, got: %vx%v", img.Bounds().Dx(), img.Bounds().Dy())
 		}
 	})
 
 	t.Run("InvalidImagePath", func(t *testing.T) {
-		// Use an invalid image path
-		imagePath := "invalid/path.jpg"
+		if _, err := ProcessImage(store, "invalid/path.jpg", 100, 100, testDecoder); err == nil {
+			t.Fatalf("Expected error for invalid image path, got nil")
+		}
+	})
 
-		// Process the image with an invalid path
-		_, err := ProcessImage(imagePath, 100, 100)
+	t.Run("ImageTooLarge", func(t *testing.T) {
+		// test.jpg is 2560x1440, above this decoder's limit
+		decoder := NewImageDecoder(DecodeLimits{MaxDimension: 2000}, 1)
+		if _, err := ProcessImage(store, "test.jpg", 100, 100, decoder); !errors.Is(err, ErrImageTooLarge) {
+			t.Fatalf("Expected ErrImageTooLarge, got %v", err)
+		}
+	})
 
-		// Check for error
-		if err == nil {
-			t.Fatalf("Expected error for invalid image path, got nil")
+	t.Run("EnlargeTooFar", func(t *testing.T) {
+		// Enlarging is bounded by the same limits as decoding
+		decoder := NewImageDecoder(DecodeLimits{MaxDimension: 3000}, 1)
+		if _, err := ProcessImage(store, "test.jpg", 4000, 0, decoder); !errors.Is(err, ErrImageTooLarge) {
+			t.Fatalf("Expected ErrImageTooLarge, got %v", err)
 		}
 	})
 }
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Custom errors for jobs that cannot be queued
+var (
+	ErrQueueFull    = errors.New("job queue is full")
+	ErrQueueStopped = errors.New("job queue is stopped")
+)
+
+// JobQueueOptions configures a JobQueue
+type JobQueueOptions struct {
+	Workers     int           // Number of jobs processed at the same time
+	Capacity    int           // Number of jobs that can wait for a worker
+	MaxAttempts int           // Attempts per job before it is given up
+	Backoff     time.Duration // Delay before the first retry, doubled for every further retry
+}
+
+// JobFunc processes the job with the given ID. attempt starts at 1.
+type JobFunc func(id string, attempt int) error
+
+// queuedJob is a job waiting for a worker
+type queuedJob struct {
+	id      string
+	attempt int
+}
+
+// JobQueue runs jobs, identified by a string, on a bounded pool of worker goroutines.
+// Failed jobs are retried with exponential backoff. The queue only lives in memory,
+// so callers record pending work elsewhere and enqueue it again after a restart.
+type JobQueue struct {
+	opts    JobQueueOptions
+	process JobFunc
+	failed  func(id string, err error) // Called once a job has used up its attempts
+
+	jobs    chan queuedJob
+	stop    chan struct{}
+	stopped sync.Once
+	workers sync.WaitGroup
+}
+
+// NewJobQueue starts the workers of a queue that processes jobs with process
+// and reports jobs that failed on every attempt to failed
+func NewJobQueue(opts JobQueueOptions, process JobFunc, failed func(id string, err error)) *JobQueue {
+	q := &JobQueue{
+		opts:    opts,
+		process: process,
+		failed:  failed,
+		jobs:    make(chan queuedJob, opts.Capacity),
+		stop:    make(chan struct{}),
+	}
+	for i := 0; i < opts.Workers; i++ {
+		q.workers.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// Enqueue queues a job without waiting. It returns ErrQueueFull if every slot is taken.
+func (q *JobQueue) Enqueue(id string) error {
+	select {
+	case <-q.stop:
+		return ErrQueueStopped
+	default:
+	}
+
+	select {
+	case q.jobs <- queuedJob{id: id, attempt: 1}:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// EnqueueWait queues a job, waiting for a free slot if the queue is full
+func (q *JobQueue) EnqueueWait(id string) error {
+	select {
+	case q.jobs <- queuedJob{id: id, attempt: 1}:
+		return nil
+	case <-q.stop:
+		return ErrQueueStopped
+	}
+}
+
+// Stop stops the workers after their current job and waits for them.
+// Queued jobs and scheduled retries are dropped.
+func (q *JobQueue) Stop() {
+	q.stopped.Do(func() { close(q.stop) })
+	q.workers.Wait()
+}
+
+// work processes jobs until the queue is stopped
+func (q *JobQueue) work() {
+	defer q.workers.Done()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case job := <-q.jobs:
+			q.run(job)
+		}
+	}
+}
+
+// run processes a job and schedules a retry if it failed
+func (q *JobQueue) run(job queuedJob) {
+	err := q.process(job.id, job.attempt)
+	if err == nil {
+		return
+	}
+	if job.attempt >= q.opts.MaxAttempts {
+		q.failed(job.id, err)
+		return
+	}
+
+	// Wait Backoff, 2*Backoff, 4*Backoff, ... before the following attempts
+	delay := q.opts.Backoff << (job.attempt - 1)
+	retry := queuedJob{id: job.id, attempt: job.attempt + 1}
+	time.AfterFunc(delay, func() {
+		// Retries wait for a free slot rather than being dropped
+		select {
+		case q.jobs <- retry:
+		case <-q.stop:
+		}
+	})
+}
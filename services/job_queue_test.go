@@ -0,0 +1,127 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestJobQueue tests processing, retrying and giving up on jobs
+func TestJobQueue(t *testing.T) {
+	t.Run("RetryWithBackoff", func(t *testing.T) {
+		var mu sync.Mutex
+		var attempts []time.Time
+		done := make(chan struct{})
+		queue := NewJobQueue(JobQueueOptions{Workers: 1, Capacity: 1, MaxAttempts: 3, Backoff: 20 * time.Millisecond},
+			func(id string, attempt int) error {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts = append(attempts, time.Now())
+				if attempt < 3 {
+					return errors.New("temporary failure")
+				}
+				close(done)
+				return nil
+			}, func(id string, err error) { t.Errorf("Expected the job to succeed, got %v", err) })
+		defer queue.Stop()
+
+		if err := queue.Enqueue("job"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the job to succeed on the third attempt")
+		}
+
+		// The second retry waits twice as long as the first
+		mu.Lock()
+		defer mu.Unlock()
+		if first, second := attempts[1].Sub(attempts[0]), attempts[2].Sub(attempts[1]); first < 20*time.Millisecond || second < 40*time.Millisecond {
+			t.Fatalf("Expected backoff of at least 20ms and 40ms, got %v and %v", first, second)
+		}
+	})
+
+	t.Run("GiveUp", func(t *testing.T) {
+		var calls atomic.Int32
+		failed := make(chan error, 1)
+		queue := NewJobQueue(JobQueueOptions{Workers: 1, Capacity: 1, MaxAttempts: 2, Backoff: time.Millisecond},
+			func(id string, attempt int) error {
+				calls.Add(1)
+				return errors.New("permanent failure")
+			}, func(id string, err error) { failed <- err })
+		defer queue.Stop()
+
+		queue.Enqueue("job")
+		select {
+		case err := <-failed:
+			if err.Error() != "permanent failure" || calls.Load() != 2 {
+				t.Fatalf("Expected the last error after 2 attempts, got %v after %d", err, calls.Load())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the job to be given up")
+		}
+	})
+
+	t.Run("BoundedWorkersAndCapacity", func(t *testing.T) {
+		var running, maxRunning atomic.Int32
+		release := make(chan struct{})
+		var wg sync.WaitGroup
+		queue := NewJobQueue(JobQueueOptions{Workers: 2, Capacity: 2, MaxAttempts: 1},
+			func(id string, attempt int) error {
+				defer wg.Done()
+				now := running.Add(1)
+				for {
+					previous := maxRunning.Load()
+					if now <= previous || maxRunning.CompareAndSwap(previous, now) {
+						break
+					}
+				}
+				<-release
+				running.Add(-1)
+				return nil
+			}, func(id string, err error) {})
+
+		// Two jobs run, two wait and the fifth does not fit
+		wg.Add(4)
+		for _, id := range []string{"1", "2"} {
+			queue.Enqueue(id)
+		}
+		for running.Load() < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		for _, id := range []string{"3", "4"} {
+			if err := queue.Enqueue(id); err != nil {
+				t.Fatalf("Expected job %s to be queued, got %v", id, err)
+			}
+		}
+		if err := queue.Enqueue("5"); !errors.Is(err, ErrQueueFull) {
+			t.Fatalf("Expected ErrQueueFull, got %v", err)
+		}
+
+		// EnqueueWait waits for a slot instead
+		wg.Add(1)
+		queued := make(chan error)
+		go func() { queued <- queue.EnqueueWait("5") }()
+		select {
+		case <-queued:
+			t.Fatalf("Expected EnqueueWait to wait while the queue is full")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(release)
+		if err := <-queued; err != nil {
+			t.Fatalf("Expected the waiting job to be queued, got %v", err)
+		}
+		wg.Wait()
+		queue.Stop()
+		if maxRunning.Load() != 2 {
+			t.Fatalf("Expected at most 2 jobs at a time, got %d", maxRunning.Load())
+		}
+		if err := queue.Enqueue("6"); !errors.Is(err, ErrQueueStopped) {
+			t.Fatalf("Expected ErrQueueStopped, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Custom error for pages beyond the end of a document
+var ErrPageNotFound = errors.New("page not found")
+
+// Custom error for PDF documents uploaded while no rasterizer is configured
+var ErrPDFUnsupported = errors.New("PDF receipts are not supported")
+
+// pdfSignature starts every PDF document
+var pdfSignature = []byte("%PDF-")
+
+// IsPDF reports whether data starts like a PDF document
+func IsPDF(data []byte) bool {
+	return bytes.HasPrefix(data, pdfSignature)
+}
+
+// Rasterizer renders the pages of PDF documents as images. Documents are passed as the path of a file,
+// so a document whose pages are rendered one after another is written to disk only once.
+type Rasterizer interface {
+	// PageCount returns the number of pages of the document at path
+	PageCount(path string) (int, error)
+	// RasterizePage renders a page, numbered from 1, of the document at path. Callers check the page
+	// against the page count, so it is not counted again for every page.
+	RasterizePage(path string, page int) (image.Image, error)
+}
+
+// ErrRasterizerTimeout is returned when a Poppler tool runs longer than its timeout, e.g. on a crafted document
+var ErrRasterizerTimeout = errors.New("PDF rasterizer timed out")
+
+// PopplerRasterizer renders PDF pages with the pdfinfo and pdftoppm tools of Poppler
+type PopplerRasterizer struct {
+	PDFInfo  string        // Path of the pdfinfo executable
+	PDFToPPM string        // Path of the pdftoppm executable
+	PageSize int           // Longest side of rendered pages in pixels
+	Timeout  time.Duration // Longest a tool may run before it is killed, 0 for no limit
+}
+
+// PageCount returns the number of pages reported by pdfinfo
+func (p PopplerRasterizer) PageCount(path string) (int, error) {
+	output, err := p.run(p.PDFInfo, path)
+	if err != nil {
+		return 0, err
+	}
+	return parsePageCount(output)
+}
+
+// RasterizePage renders a page as PNG with pdftoppm and decodes it
+func (p PopplerRasterizer) RasterizePage(path string, page int) (image.Image, error) {
+	// Without an output root pdftoppm writes the image to stdout
+	number := strconv.Itoa(page)
+	output, err := p.run(p.PDFToPPM, "-f", number, "-l", number, "-scale-to", strconv.Itoa(p.PageSize), "-png", path)
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(output))
+}
+
+// run runs a Poppler tool within the timeout and returns its output
+func (p PopplerRasterizer) run(command string, args ...string) ([]byte, error) {
+	ctx := context.Background()
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second // Do not wait for children of a killed tool that hold its output open
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%w: %s ran longer than %v", ErrRasterizerTimeout, command, p.Timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// parsePageCount reads the "Pages:" line of pdfinfo's output
+func parsePageCount(output []byte) (int, error) {
+	for _, line := range strings.Split(string(output), "\n") {
+		if value, ok := strings.CutPrefix(line, "Pages:"); ok {
+			return strconv.Atoi(strings.TrimSpace(value))
+		}
+	}
+	return 0, fmt.Errorf("pdfinfo reported no page count")
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// stubRasterizer renders page n of any PDF document as a white page 100*n pixels wide with a line of text
+type stubRasterizer struct {
+	pages int
+}
+
+func (s stubRasterizer) PageCount(path string) (int, error) {
+	if data, err := os.ReadFile(path); err != nil || !IsPDF(data) {
+		return 0, fmt.Errorf("not a PDF document")
+	}
+	return s.pages, nil
+}
+
+func (s stubRasterizer) RasterizePage(path string, page int) (image.Image, error) {
+	img := imaging.New(100*page, 300, color.White)
+	return imaging.Paste(img, imaging.New(50*page, 8, color.Black), image.Pt(10, 20)), nil
+}
+
+// newPDFDecoder returns a decoder that rasterizes PDF documents with the stub
+func newPDFDecoder(pages int) *ImageDecoder {
+	decoder := NewImageDecoder(DefaultDecodeLimits(), 2)
+	decoder.Rasterizer = stubRasterizer{pages: pages}
+	return decoder
+}
+
+// TestParsePageCount tests reading the page count from pdfinfo's output
+func TestParsePageCount(t *testing.T) {
+	output := []byte("Producer:        receipt-uploader\nTagged:          no\nPages:           2\nEncrypted:       no\nPage size:       226 x 425 pts\n")
+	if pages, err := parsePageCount(output); err != nil || pages != 2 {
+		t.Fatalf("Expected 2 pages, got %d, %v", pages, err)
+	}
+	if _, err := parsePageCount([]byte("Syntax Error: Couldn't find trailer dictionary\n")); err == nil {
+		t.Fatalf("Expected an error without a page count")
+	}
+}
+
+// TestPopplerRasterizer tests rendering pages with the Poppler tools, if they are installed
+func TestPopplerRasterizer(t *testing.T) {
+	pdfInfo, err := exec.LookPath("pdfinfo")
+	if err != nil {
+		t.Skip("pdfinfo is not installed")
+	}
+	pdfToPPM, err := exec.LookPath("pdftoppm")
+	if err != nil {
+		t.Skip("pdftoppm is not installed")
+	}
+	rasterizer := PopplerRasterizer{PDFInfo: pdfInfo, PDFToPPM: pdfToPPM, PageSize: 400, Timeout: time.Minute}
+	path := "../testdata/receipt.pdf"
+
+	if pages, err := rasterizer.PageCount(path); err != nil || pages != 2 {
+		t.Fatalf("Expected 2 pages, got %d, %v", pages, err)
+	}
+	img, err := rasterizer.RasterizePage(path, 2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if img.Bounds().Dy() != 400 {
+		t.Fatalf("Expected the page's longest side to be 400 pixels, got %v", img.Bounds())
+	}
+}
+
+// TestRasterizerTimeout tests that a tool running longer than the timeout is killed
+func TestRasterizerTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	hanging := filepath.Join(t.TempDir(), "pdfinfo")
+	if err := os.WriteFile(hanging, []byte("#!/bin/sh\nsleep 10\n"), 0755); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	started := time.Now()
+	rasterizer := PopplerRasterizer{PDFInfo: hanging, Timeout: 100 * time.Millisecond}
+	if _, err := rasterizer.PageCount("../testdata/receipt.pdf"); !errors.Is(err, ErrRasterizerTimeout) {
+		t.Fatalf("Expected ErrRasterizerTimeout, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("Expected the tool to be killed, took %v", elapsed)
+	}
+}
+
+// countingRasterizer counts how often documents are counted and pages rendered
+type countingRasterizer struct {
+	stubRasterizer
+	counted, rendered *atomic.Int32
+}
+
+func (c countingRasterizer) PageCount(path string) (int, error) {
+	c.counted.Add(1)
+	return c.stubRasterizer.PageCount(path)
+}
+
+func (c countingRasterizer) RasterizePage(path string, page int) (image.Image, error) {
+	c.rendered.Add(1)
+	return c.stubRasterizer.RasterizePage(path, page)
+}
+
+// TestDecodePages tests that the pages of a PDF document are rendered after counting the document once
+func TestDecodePages(t *testing.T) {
+	pdf, err := os.ReadFile("../testdata/receipt.pdf")
+	if err != nil {
+		t.Fatalf("Failed to read test document: %v", err)
+	}
+	rasterizer := countingRasterizer{stubRasterizer: stubRasterizer{pages: 2}, counted: new(atomic.Int32), rendered: new(atomic.Int32)}
+	decoder := NewImageDecoder(DefaultDecodeLimits(), 2)
+	decoder.Rasterizer = rasterizer
+
+	images, err := decoder.DecodePages(bytes.NewReader(pdf), []int{2, 1})
+	if err != nil || len(images) != 2 || images[0].Bounds().Dx() != 200 || images[1].Bounds().Dx() != 100 {
+		t.Fatalf("Expected pages 2 and 1, got %v", err)
+	}
+	if rasterizer.counted.Load() != 1 || rasterizer.rendered.Load() != 2 {
+		t.Fatalf("Expected one count and two renders, got %d and %d", rasterizer.counted.Load(), rasterizer.rendered.Load())
+	}
+
+	// Pages beyond the end are refused without rendering
+	if _, err := decoder.DecodePages(bytes.NewReader(pdf), []int{3}); !errors.Is(err, ErrPageNotFound) || rasterizer.rendered.Load() != 2 {
+		t.Fatalf("Expected ErrPageNotFound, got %v", err)
+	}
+}
+
+// TestDecodePage tests decoding pages of PDF documents and images
+func TestDecodePage(t *testing.T) {
+	pdf, err := os.ReadFile("../testdata/receipt.pdf")
+	if err != nil {
+		t.Fatalf("Failed to read test document: %v", err)
+	}
+	photo, err := os.ReadFile("../testdata/test.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+	decoder := newPDFDecoder(2)
+
+	t.Run("PDFPages", func(t *testing.T) {
+		for page := 1; page <= 2; page++ {
+			img, err := decoder.DecodePage(bytes.NewReader(pdf), page)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if img.Bounds().Dx() != 100*page {
+				t.Fatalf("Expected page %d to be rendered, got %v", page, img.Bounds())
+			}
+		}
+		if _, err := decoder.DecodePage(bytes.NewReader(pdf), 3); !errors.Is(err, ErrPageNotFound) {
+			t.Fatalf("Expected ErrPageNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Images", func(t *testing.T) {
+		if img, err := decoder.DecodePage(bytes.NewReader(photo), 1); err != nil || img.Bounds().Dx() != 2560 {
+			t.Fatalf("Expected the decoded image, got %v", err)
+		}
+		if _, err := decoder.DecodePage(bytes.NewReader(photo), 2); !errors.Is(err, ErrPageNotFound) {
+			t.Fatalf("Expected ErrPageNotFound, got %v", err)
+		}
+	})
+
+	t.Run("RasterLimits", func(t *testing.T) {
+		limited := newPDFDecoder(2)
+		limited.Limits = DecodeLimits{MaxDimension: 150}
+		if _, err := limited.DecodePage(bytes.NewReader(pdf), 1); !errors.Is(err, ErrImageTooLarge) {
+			t.Fatalf("Expected ErrImageTooLarge for a 300 pixel high page, got %v", err)
+		}
+	})
+
+	t.Run("NoRasterizer", func(t *testing.T) {
+		if _, err := testDecoder.DecodePage(bytes.NewReader(pdf), 1); !errors.Is(err, ErrPDFUnsupported) {
+			t.Fatalf("Expected ErrPDFUnsupported, got %v", err)
+		}
+		if _, err := testDecoder.PageCount("../testdata/receipt.pdf"); !errors.Is(err, ErrPDFUnsupported) {
+			t.Fatalf("Expected ErrPDFUnsupported, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// MaxHashDistance is the largest possible Hamming distance between two 64-bit perceptual hashes
+const MaxHashDistance = 64
+
+// DHash computes the 64-bit difference hash of an image.
+// The image is reduced to a 9x8 grayscale thumbnail and each bit records whether a pixel
+// is brighter than its right neighbour, so small changes in angle, scale or exposure
+// only flip a few bits.
+func DHash(img image.Image) uint64 {
+	small := imaging.Resize(imaging.Grayscale(img), 9, 8, imaging.Box)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := small.Pix[small.PixOffset(x, y)]
+			right := small.Pix[small.PixOffset(x+1, y)]
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// PerceptualHash decodes an image, or the first page of a PDF document, and returns its difference hash, hex encoded
+func PerceptualHash(r io.Reader, decoder *ImageDecoder) (string, error) {
+	img, err := decoder.DecodePage(r, 1)
+	if err != nil {
+		return "", err
+	}
+	return FormatHash(DHash(img)), nil
+}
+
+// FormatHash hex encodes a perceptual hash as 16 digits
+func FormatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// HashDistance returns the Hamming distance between two hex encoded perceptual hashes
+func HashDistance(a, b string) (int, error) {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid perceptual hash %q", a)
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid perceptual hash %q", b)
+	}
+	return bits.OnesCount64(x ^ y), nil
+}
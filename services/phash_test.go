@@ -0,0 +1,93 @@
+package services
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"os"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// gradientImage draws a horizontal gradient, reversed if flip is set
+func gradientImage(width, height int, flip bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := uint8(x * 255 / width)
+			if flip {
+				value = 255 - value
+			}
+			img.SetGray(x, y, color.Gray{Y: value})
+		}
+	}
+	return img
+}
+
+// TestDHash tests that similar images hash close together and different images far apart
+func TestDHash(t *testing.T) {
+	t.Run("ScaledCopy", func(t *testing.T) {
+		a := DHash(gradientImage(400, 300, false))
+		b := DHash(gradientImage(123, 97, false))
+		distance, _ := HashDistance(FormatHash(a), FormatHash(b))
+		if distance > 4 {
+			t.Fatalf("Expected a scaled copy to be within distance 4, got %d", distance)
+		}
+	})
+
+	t.Run("DifferentImage", func(t *testing.T) {
+		a := DHash(gradientImage(400, 300, false))
+		b := DHash(gradientImage(400, 300, true))
+		distance, _ := HashDistance(FormatHash(a), FormatHash(b))
+		if distance < 32 {
+			t.Fatalf("Expected opposite gradients to be far apart, got %d", distance)
+		}
+	})
+}
+
+// TestPerceptualHash tests hashing an encoded image and a resized, re-encoded copy of it
+func TestPerceptualHash(t *testing.T) {
+	file, err := os.Open("../testdata/test.jpg")
+	if err != nil {
+		t.Fatalf("Failed to open test image: %v", err)
+	}
+	defer file.Close()
+
+	original, err := PerceptualHash(file, testDecoder)
+	if err != nil || len(original) != 16 {
+		t.Fatalf("Expected a 16 digit hash, got %q and %v", original, err)
+	}
+
+	// A smaller, brighter copy with different bytes still looks the same
+	file.Seek(0, 0)
+	img, _ := imaging.Decode(file)
+	var buf bytes.Buffer
+	imaging.Encode(&buf, imaging.AdjustBrightness(imaging.Resize(img, 300, 0, imaging.Lanczos), 5), imaging.JPEG, imaging.JPEGQuality(60))
+	copied, err := PerceptualHash(&buf, testDecoder)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	distance, _ := HashDistance(original, copied)
+	if distance > 10 {
+		t.Fatalf("Expected the copy within distance 10, got %d", distance)
+	}
+
+	if _, err := PerceptualHash(bytes.NewReader([]byte("not an image")), testDecoder); err == nil {
+		t.Fatalf("Expected an error for data that is not an image")
+	}
+}
+
+// TestHashDistance tests the Hamming distance between hex encoded hashes
+func TestHashDistance(t *testing.T) {
+	distance, err := HashDistance("0000000000000000", "000000000000000f")
+	if err != nil || distance != 4 {
+		t.Fatalf("Expected distance 4, got %d and %v", distance, err)
+	}
+	if distance, _ := HashDistance("ffffffffffffffff", "0000000000000000"); distance != MaxHashDistance {
+		t.Fatalf("Expected distance %d, got %d", MaxHashDistance, distance)
+	}
+	if _, err := HashDistance("not-hex", "0000000000000000"); err == nil {
+		t.Fatalf("Expected an error for an invalid hash")
+	}
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Longest side of the copy sharpness is measured on, so scores do not depend on the photo's resolution
+const qualityMeasureSize = 1024
+
+// ImageQuality holds the measurements quality checks are based on
+type ImageQuality struct {
+	Width      int     `json:"width"`      // Width of the upright image in pixels
+	Height     int     `json:"height"`     // Height of the upright image in pixels
+	Sharpness  float64 `json:"sharpness"`  // Variance of the Laplacian; blurry photos score low
+	Brightness float64 `json:"brightness"` // Mean brightness from 0 (black) to 255 (white)
+}
+
+// QualityLimits are the bounds an uploaded image must stay within. Zero values disable a check.
+type QualityLimits struct {
+	MinWidth      int
+	MinHeight     int
+	MinSharpness  float64
+	MinBrightness float64
+	MaxBrightness float64
+}
+
+// QualityError describes a failed quality check with the measured value and the limit it violated
+type QualityError struct {
+	Check    string  `json:"check"` // "width", "height", "sharpness" or "brightness"
+	Measured float64 `json:"measured"`
+	Limit    float64 `json:"limit"`
+	Message  string  `json:"message"`
+}
+
+// Error returns the message of a failed check
+func (e QualityError) Error() string {
+	return e.Message
+}
+
+// MeasureQuality measures the resolution, sharpness and brightness of an image
+func MeasureQuality(img image.Image) ImageQuality {
+	bounds := img.Bounds()
+	quality := ImageQuality{Width: bounds.Dx(), Height: bounds.Dy()}
+
+	// Only downscale, so small images are not sharpened or blurred by resampling
+	if quality.Width > qualityMeasureSize || quality.Height > qualityMeasureSize {
+		img = imaging.Fit(img, qualityMeasureSize, qualityMeasureSize, imaging.Box)
+	}
+	gray := toGray(img)
+	width, height := gray.Rect.Dx(), gray.Rect.Dy()
+
+	var sum float64
+	for _, v := range gray.Pix {
+		sum += float64(v)
+	}
+	if len(gray.Pix) > 0 {
+		quality.Brightness = sum / float64(len(gray.Pix))
+	}
+
+	// Edges make the Laplacian swing widely; blur flattens it
+	var count, mean, squares float64
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			p := y*gray.Stride + x
+			laplacian := float64(gray.Pix[p-1]) + float64(gray.Pix[p+1]) + float64(gray.Pix[p-gray.Stride]) + float64(gray.Pix[p+gray.Stride]) - 4*float64(gray.Pix[p])
+			count++
+			mean += laplacian
+			squares += laplacian * laplacian
+		}
+	}
+	if count > 0 {
+		mean /= count
+		quality.Sharpness = squares/count - mean*mean
+	}
+	return quality
+}
+
+// Check returns every limit the measurements violate, in the order width, height, sharpness, brightness
+func (l QualityLimits) Check(quality ImageQuality) []QualityError {
+	var failed []QualityError
+	if l.MinWidth > 0 && quality.Width < l.MinWidth {
+		failed = append(failed, QualityError{Check: "width", Measured: float64(quality.Width), Limit: float64(l.MinWidth),
+			Message: fmt.Sprintf("image is %d pixels wide, at least %d required", quality.Width, l.MinWidth)})
+	}
+	if l.MinHeight > 0 && quality.Height < l.MinHeight {
+		failed = append(failed, QualityError{Check: "height", Measured: float64(quality.Height), Limit: float64(l.MinHeight),
+			Message: fmt.Sprintf("image is %d pixels high, at least %d required", quality.Height, l.MinHeight)})
+	}
+	if l.MinSharpness > 0 && quality.Sharpness < l.MinSharpness {
+		failed = append(failed, QualityError{Check: "sharpness", Measured: quality.Sharpness, Limit: l.MinSharpness,
+			Message: fmt.Sprintf("image is too blurry: sharpness %.1f, at least %.1f required", quality.Sharpness, l.MinSharpness)})
+	}
+	if l.MinBrightness > 0 && quality.Brightness < l.MinBrightness {
+		failed = append(failed, QualityError{Check: "brightness", Measured: quality.Brightness, Limit: l.MinBrightness,
+			Message: fmt.Sprintf("image is too dark: brightness %.1f, at least %.1f required", quality.Brightness, l.MinBrightness)})
+	}
+	if l.MaxBrightness > 0 && quality.Brightness > l.MaxBrightness {
+		failed = append(failed, QualityError{Check: "brightness", Measured: quality.Brightness, Limit: l.MaxBrightness,
+			Message: fmt.Sprintf("image is overexposed: brightness %.1f, at most %.1f allowed", quality.Brightness, l.MaxBrightness)})
+	}
+	return failed
+}
+
+// QualityMessage joins the messages of failed quality checks into one error message
+func QualityMessage(failed []QualityError) string {
+	messages := make([]string, len(failed))
+	for i, err := range failed {
+		messages[i] = err.Message
+	}
+	return "image quality too low: " + strings.Join(messages, "; ")
+}
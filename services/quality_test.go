@@ -0,0 +1,88 @@
+package services
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// TestMeasureQuality tests the sharpness and brightness measurements
+func TestMeasureQuality(t *testing.T) {
+	// Black text-like bars on white paper
+	sharp := imaging.New(300, 200, color.White)
+	for y := 20; y < 200; y += 30 {
+		sharp = imaging.Paste(sharp, imaging.New(260, 6, color.Black), image.Pt(20, y))
+	}
+
+	quality := MeasureQuality(sharp)
+	if quality.Width != 300 || quality.Height != 200 {
+		t.Fatalf("Expected 300x200, got %dx%d", quality.Width, quality.Height)
+	}
+	blurred := MeasureQuality(imaging.Blur(sharp, 4))
+	if blurred.Sharpness >= quality.Sharpness/10 {
+		t.Fatalf("Expected blurring to lower the sharpness, got %.1f and %.1f", quality.Sharpness, blurred.Sharpness)
+	}
+
+	gray := MeasureQuality(imaging.New(50, 50, color.Gray{Y: 100}))
+	if math.Abs(gray.Brightness-100) > 0.5 || gray.Sharpness != 0 {
+		t.Fatalf("Expected a flat image of brightness 100, got %+v", gray)
+	}
+}
+
+// TestQualityLimits tests reporting every violated limit with the measured value
+func TestQualityLimits(t *testing.T) {
+	limits := QualityLimits{MinWidth: 300, MinHeight: 300, MinSharpness: 20, MinBrightness: 40, MaxBrightness: 245}
+
+	if failed := limits.Check(ImageQuality{Width: 1200, Height: 1600, Sharpness: 150, Brightness: 140}); len(failed) != 0 {
+		t.Fatalf("Expected a good photo to pass, got %v", failed)
+	}
+
+	failed := limits.Check(ImageQuality{Width: 10, Height: 10, Sharpness: 2.5, Brightness: 12})
+	if len(failed) != 4 {
+		t.Fatalf("Expected width, height, sharpness and brightness to fail, got %v", failed)
+	}
+	expected := []QualityError{
+		{Check: "width", Measured: 10, Limit: 300},
+		{Check: "height", Measured: 10, Limit: 300},
+		{Check: "sharpness", Measured: 2.5, Limit: 20},
+		{Check: "brightness", Measured: 12, Limit: 40},
+	}
+	for i, err := range failed {
+		if err.Check != expected[i].Check || err.Measured != expected[i].Measured || err.Limit != expected[i].Limit || err.Message == "" {
+			t.Fatalf("Expected %+v, got %+v", expected[i], err)
+		}
+	}
+
+	if failed := limits.Check(ImageQuality{Width: 1200, Height: 1600, Sharpness: 150, Brightness: 252}); len(failed) != 1 || failed[0].Limit != 245 {
+		t.Fatalf("Expected an overexposed photo to fail, got %v", failed)
+	}
+
+	// Without limits everything passes
+	if failed := (QualityLimits{}).Check(ImageQuality{Width: 1, Height: 1}); len(failed) != 0 {
+		t.Fatalf("Expected no checks without limits, got %v", failed)
+	}
+}
+
+// TestWhiteScanBrightness tests that a clean scan on white paper stays below the default brightness bound
+func TestWhiteScanBrightness(t *testing.T) {
+	scan := imaging.New(1000, 1400, color.White)
+	for y := 100; y < 1300; y += 100 {
+		scan = imaging.Paste(scan, imaging.New(700, 4, color.Black), image.Pt(150, y))
+	}
+
+	quality := MeasureQuality(scan)
+	if quality.Brightness < 245 {
+		t.Fatalf("Expected a mostly white scan, got brightness %.1f", quality.Brightness)
+	}
+	if failed := (QualityLimits{MinBrightness: 40, MaxBrightness: 253}).Check(quality); len(failed) != 0 {
+		t.Fatalf("Expected the scan to pass, got %v", failed)
+	}
+
+	// A blank page is still rejected
+	if failed := (QualityLimits{MaxBrightness: 253}).Check(MeasureQuality(imaging.New(1000, 1400, color.White))); len(failed) != 1 {
+		t.Fatalf("Expected a blank page to fail, got %v", failed)
+	}
+}
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/disintegration/imaging"
+)
+
+// Fit modes of a rendition preset
+const (
+	FitContain = "fit"  // Scale to fit inside the box, keeping the aspect ratio
+	FitCover   = "fill" // Scale and crop from the center to fill the box exactly
+)
+
+// Encoded formats of renditions
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+	FormatWebP = "webp" // Lossless, so Quality does not apply
+)
+
+// renditionFormat describes how renditions of a format are stored and served
+type renditionFormat struct {
+	extension   string
+	contentType string
+}
+
+// renditionFormats lists the supported output formats
+var renditionFormats = map[string]renditionFormat{
+	FormatJPEG: {extension: "jpg", contentType: "image/jpeg"},
+	FormatPNG:  {extension: "png", contentType: "image/png"},
+	FormatGIF:  {extension: "gif", contentType: "image/gif"},
+	FormatWebP: {extension: "webp", contentType: "image/webp"},
+}
+
+// ParseFormat returns the output format with the given name or file extension, such as "jpg"
+func ParseFormat(name string) (string, bool) {
+	name = strings.TrimPrefix(strings.ToLower(name), ".")
+	for format, info := range renditionFormats {
+		if name == format || name == info.extension {
+			return format, true
+		}
+	}
+	return "", false
+}
+
+// FormatForContentType returns the output format with the given MIME type
+func FormatForContentType(contentType string) (string, bool) {
+	for format, info := range renditionFormats {
+		if strings.EqualFold(contentType, info.contentType) {
+			return format, true
+		}
+	}
+	return "", false
+}
+
+// RenditionPreset describes how a rendition is generated from the original image
+type RenditionPreset struct {
+	Name    string // Name the rendition is requested by
+	Width   int    // Width of the box, 0 to derive it from Height and the aspect ratio
+	Height  int    // Height of the box, 0 to derive it from Width and the aspect ratio
+	Fit     string // FitContain or FitCover
+	Format  string // One of the Format constants
+	Quality int    // JPEG quality 1-100, 0 for the encoder default
+	Enhance bool   // Crop and straighten the paper and threshold it to black and white, see CropDocument and AdaptiveThreshold
+	Page    int    // Page of a PDF original to render, numbered from 1; 0 for the first
+	Stitch  bool   // Render all pages of the receipt stacked top to bottom instead of a single page, see RenderStitched
+}
+
+// DefaultRenditionPresets returns the thumbnail sizes used when none are configured
+func DefaultRenditionPresets() []RenditionPreset {
+	return []RenditionPreset{
+		{Name: "small", Width: 100, Height: 100, Fit: FitContain, Format: FormatJPEG},
+		{Name: "medium", Width: 200, Height: 200, Fit: FitContain, Format: FormatJPEG},
+		{Name: "large", Width: 400, Height: 400, Fit: FitContain, Format: FormatJPEG},
+	}
+}
+
+// VariantPreset returns the preset of an image resized to an arbitrary width and height
+func VariantPreset(width, height int) RenditionPreset {
+	return RenditionPreset{Name: VariantSize(width, height), Width: width, Height: height, Fit: FitContain, Format: FormatJPEG}
+}
+
+// Extension returns the file extension of renditions encoded by the preset
+func (p RenditionPreset) Extension() string {
+	if format, ok := renditionFormats[p.Format]; ok {
+		return format.extension
+	}
+	return renditionFormats[FormatJPEG].extension
+}
+
+// ContentType returns the MIME type of renditions encoded by the preset
+func (p RenditionPreset) ContentType() string {
+	if format, ok := renditionFormats[p.Format]; ok {
+		return format.contentType
+	}
+	return renditionFormats[FormatJPEG].contentType
+}
+
+// PresetsFingerprint returns a short hash of the presets' settings and the metadata policy,
+// so renditions generated with different settings can be told apart
+func PresetsFingerprint(presets []RenditionPreset, policy MetadataPolicy) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s;", policy)
+	for _, preset := range presets {
+		fmt.Fprintf(hash, "%s:%d:%d:%s:%s:%d:%t;", preset.Name, preset.Width, preset.Height, preset.Fit, preset.Format, preset.Quality, preset.Enhance)
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:4])
+}
+
+// Render generates an upright rendition of the image stored under key, or of a page of the PDF document
+// stored under key, and returns the encoded bytes. JPEG renditions carry the original's EXIF metadata as far as the policy allows.
+func Render(store BlobStore, key string, preset RenditionPreset, policy MetadataPolicy, decoder *ImageDecoder) ([]byte, error) {
+	file, _, err := store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	original, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	img, err := decoder.DecodePage(bytes.NewReader(original), max(preset.Page, 1))
+	if err != nil {
+		return nil, err
+	}
+
+	// Enlarging is bounded by the same limits as decoding
+	if err := checkPresetSize(img.Bounds(), preset, decoder.Limits); err != nil {
+		return nil, err
+	}
+	data, err := EncodeImage(applyPreset(img, preset), preset.Format, preset.Quality)
+	if err != nil || preset.Format != FormatJPEG {
+		return data, err
+	}
+	return EmbedPhotoMetadata(data, original, policy)
+}
+
+// presetSize returns the size of the image applyPreset makes from an image of the given bounds.
+// Enhanced images are cropped before they are resized, so their size is at most this.
+func presetSize(bounds image.Rectangle, preset RenditionPreset) (int, int) {
+	width, height := bounds.Dx(), bounds.Dy()
+	switch {
+	case preset.Fit == FitCover:
+		return preset.Width, preset.Height
+	case preset.Width > 0 && preset.Height > 0:
+		// imaging.Fit only scales down
+		if width <= preset.Width && height <= preset.Height {
+			return width, height
+		}
+		if float64(width)/float64(height) > float64(preset.Width)/float64(preset.Height) {
+			return preset.Width, max(int(float64(height)*float64(preset.Width)/float64(width)+0.5), 1)
+		}
+		return max(int(float64(width)*float64(preset.Height)/float64(height)+0.5), 1), preset.Height
+	case preset.Width == 0 && preset.Height == 0:
+		return width, height
+	case preset.Height == 0:
+		return preset.Width, scaledHeight(bounds, preset.Width)
+	default:
+		return max(int(float64(width)*float64(preset.Height)/float64(height)+0.5), 1), preset.Height
+	}
+}
+
+// checkPresetSize returns an error wrapping ErrImageTooLarge if the preset would enlarge an image of the given bounds
+// beyond the limits, so a requested size cannot allocate more pixels than decoding may
+func checkPresetSize(bounds image.Rectangle, preset RenditionPreset, limits DecodeLimits) error {
+	width, height := presetSize(bounds, preset)
+	return limits.Check(image.Config{Width: width, Height: height})
+}
+
+// applyPreset enhances and resizes a decoded image as the preset describes
+func applyPreset(img image.Image, preset RenditionPreset) image.Image {
+	// Scans are cropped to the paper before they are resized
+	if preset.Enhance {
+		img = CropDocument(img)
+	}
+
+	switch {
+	case preset.Fit == FitCover:
+		img = imaging.Fill(img, preset.Width, preset.Height, imaging.Center, imaging.Lanczos)
+	case preset.Width > 0 && preset.Height > 0:
+		img = imaging.Fit(img, preset.Width, preset.Height, imaging.Lanczos)
+	case preset.Width == 0 && preset.Height == 0:
+		// Only converted to another format
+	default:
+		// Resize keeps the aspect ratio when one of the dimensions is 0
+		img = imaging.Resize(img, preset.Width, preset.Height, imaging.Lanczos)
+	}
+	if preset.Enhance {
+		img = AdaptiveThreshold(img)
+	}
+	return img
+}
+
+// EncodeImage encodes an image in the given format. quality only applies to JPEG; 0 uses the encoder default.
+// WebP is encoded losslessly in pure Go.
+func EncodeImage(img image.Image, format string, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case FormatPNG:
+		err = imaging.Encode(&buf, img, imaging.PNG)
+	case FormatGIF:
+		err = imaging.Encode(&buf, img, imaging.GIF)
+	case FormatWebP:
+		err = nativewebp.Encode(&buf, img, nil)
+	case FormatJPEG, "":
+		var options []imaging.EncodeOption
+		if quality > 0 {
+			options = append(options, imaging.JPEGQuality(quality))
+		}
+		err = imaging.Encode(&buf, img, imaging.JPEG, options...)
+	default:
+		return nil, fmt.Errorf("unsupported rendition format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RenditionKey identifies a generated rendition of a receipt's original image
+type RenditionKey struct {
+	ReceiptID string
+	Version   string // Identifies the original the rendition was generated from, so a changed original misses the cache
+	Size      string // Preset name such as "small", or WxH for an arbitrary size
+	Format    string // File extension of the encoded image, e.g. "jpg"
+	Variant   bool   // Arbitrary size, format or quality requested by a client rather than a configured preset
+}
+
+// VariantSize returns the Size of a rendition resized to an arbitrary width and height
+func VariantSize(width, height int) string {
+	return fmt.Sprintf("%dx%d", width, height)
+}
+
+// BlobKey returns the key under which the rendition is stored.
+// Variants are kept apart from presets so they can be told apart when the cache is reloaded.
+func (k RenditionKey) BlobKey() string {
+	if k.Variant {
+		return fmt.Sprintf("%s%s/%s/variants/%s.%s", renditionsPrefix, k.ReceiptID, k.Version, k.Size, k.Format)
+	}
+	return fmt.Sprintf("%s%s/%s/%s.%s", renditionsPrefix, k.ReceiptID, k.Version, k.Size, k.Format)
+}
+
+// parseRenditionKey is the inverse of RenditionKey.BlobKey
+func parseRenditionKey(blobKey string) (RenditionKey, bool) {
+	parts := strings.Split(strings.TrimPrefix(blobKey, renditionsPrefix), "/")
+	if !strings.HasPrefix(blobKey, renditionsPrefix) || len(parts) < 3 || len(parts) > 4 || (len(parts) == 4 && parts[2] != "variants") {
+		return RenditionKey{}, false
+	}
+	size, format, ok := strings.Cut(parts[len(parts)-1], ".")
+	if !ok {
+		return RenditionKey{}, false
+	}
+	return RenditionKey{ReceiptID: parts[0], Version: parts[1], Size: size, Format: format, Variant: len(parts) == 4}, true
+}
+
+// renditionEntry is a cached variant tracked for eviction
+type renditionEntry struct {
+	key  string
+	size int64
+}
+
+// RenditionCache stores generated renditions in the blob store so they are only generated once.
+// Preset renditions are kept for as long as their receipt; arbitrary variants share a size budget
+// and the least recently used ones are evicted when it is exceeded.
+// Recency is tracked in memory and seeded from the blobs' modification times on first use.
+type RenditionCache struct {
+	store           BlobStore
+	maxVariantBytes int64
+
+	mu       sync.Mutex
+	loaded   bool
+	variants *list.List // Most recently used at the front
+	entries  map[string]*list.Element
+	size     int64 // Total size of the cached variants
+}
+
+// NewRenditionCache creates a cache in the given blob store whose variants use at most maxVariantBytes
+func NewRenditionCache(store BlobStore, maxVariantBytes int64) *RenditionCache {
+	return &RenditionCache{
+		store:           store,
+		maxVariantBytes: maxVariantBytes,
+		variants:        list.New(),
+		entries:         make(map[string]*list.Element),
+	}
+}
+
+// Get opens a cached rendition. A miss returns ErrBlobNotFound.
+func (c *RenditionCache) Get(key RenditionKey) (io.ReadCloser, BlobInfo, error) {
+	blob, info, err := c.store.Get(key.BlobKey())
+	if err != nil {
+		return nil, info, err
+	}
+
+	if key.Variant {
+		c.mu.Lock()
+		if err := c.load(); err != nil {
+			log.Println("Error loading rendition cache:", err)
+		}
+		if element, ok := c.entries[key.BlobKey()]; ok {
+			c.variants.MoveToFront(element)
+		}
+		c.mu.Unlock()
+	}
+	return blob, info, nil
+}
+
+// Stat returns the metadata of a cached rendition. A miss returns ErrBlobNotFound.
+func (c *RenditionCache) Stat(key RenditionKey) (BlobInfo, error) {
+	return c.store.Stat(key.BlobKey())
+}
+
+// Put caches an encoded rendition. Renditions of earlier versions of the receipt's original are removed,
+// and a variant evicts the least recently used variants until the cache is within its budget again.
+func (c *RenditionCache) Put(key RenditionKey, data []byte, contentType string) error {
+	if err := c.store.Put(key.BlobKey(), bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		return err
+	}
+
+	// Renditions of a replaced original can never be hit again
+	if err := c.remove(renditionsPrefix+key.ReceiptID+"/", renditionsPrefix+key.ReceiptID+"/"+key.Version+"/"); err != nil {
+		log.Println("Error removing stale renditions:", err)
+	}
+	if !key.Variant {
+		return nil
+	}
+
+	c.mu.Lock()
+	if err := c.load(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.track(key.BlobKey(), int64(len(data)))
+	c.variants.MoveToFront(c.entries[key.BlobKey()])
+
+	// Pick the victims under the lock but delete them after releasing it.
+	// The new variant itself is kept even if it alone exceeds the budget.
+	var evicted []string
+	for c.size > c.maxVariantBytes && c.variants.Len() > 1 {
+		entry := c.variants.Back().Value.(renditionEntry)
+		c.untrack(entry.key)
+		evicted = append(evicted, entry.key)
+	}
+	c.mu.Unlock()
+
+	for _, victim := range evicted {
+		if err := c.store.Delete(victim); err != nil {
+			return fmt.Errorf("failed to evict %s: %v", victim, err)
+		}
+	}
+	return nil
+}
+
+// Invalidate removes every cached rendition of a receipt
+func (c *RenditionCache) Invalidate(receiptID string) error {
+	return c.remove(renditionsPrefix+receiptID+"/", "")
+}
+
+// remove deletes the renditions below prefix, except those below keep if it is not empty
+func (c *RenditionCache) remove(prefix, keep string) error {
+	blobs, err := c.store.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if keep != "" && strings.HasPrefix(blob.Key, keep) {
+			continue
+		}
+		if err := c.store.Delete(blob.Key); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", blob.Key, err)
+		}
+		c.mu.Lock()
+		c.untrack(blob.Key)
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// load seeds the eviction order with the variants already in the blob store, oldest last.
+// The caller must hold c.mu.
+func (c *RenditionCache) load() error {
+	if c.loaded {
+		return nil
+	}
+	blobs, err := c.store.List(renditionsPrefix)
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(blobs, func(i, j int) bool { return blobs[i].ModTime.Before(blobs[j].ModTime) })
+	for _, blob := range blobs {
+		if key, ok := parseRenditionKey(blob.Key); ok && key.Variant {
+			c.track(blob.Key, blob.Size)
+			c.variants.MoveToFront(c.entries[blob.Key])
+		}
+	}
+	c.loaded = true
+	return nil
+}
+
+// track adds a variant to the eviction order or updates its size. The caller must hold c.mu.
+func (c *RenditionCache) track(key string, size int64) {
+	if element, ok := c.entries[key]; ok {
+		c.size -= element.Value.(renditionEntry).size
+		element.Value = renditionEntry{key: key, size: size}
+	} else {
+		c.entries[key] = c.variants.PushBack(renditionEntry{key: key, size: size})
+	}
+	c.size += size
+}
+
+// untrack drops a variant from the eviction order. The caller must hold c.mu.
+func (c *RenditionCache) untrack(key string) {
+	if element, ok := c.entries[key]; ok {
+		c.size -= element.Value.(renditionEntry).size
+		c.variants.Remove(element)
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRenditionCache tests storing, hitting and invalidating renditions
+func TestRenditionCache(t *testing.T) {
+	store := newTestBlobStore(t)
+	cache := NewRenditionCache(store, 1<<20)
+	small := RenditionKey{ReceiptID: "receipt1", Version: "v1", Size: "small", Format: "jpg"}
+
+	t.Run("Miss", func(t *testing.T) {
+		if _, _, err := cache.Get(small); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("Expected ErrBlobNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Hit", func(t *testing.T) {
+		if err := cache.Put(small, []byte("small"), "image/jpeg"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		blob, info, err := cache.Get(small)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		defer blob.Close()
+		data, _ := io.ReadAll(blob)
+		if string(data) != "small" || info.Key != "renditions/receipt1/v1/small.jpg" {
+			t.Fatalf("Expected the cached rendition, got %q under %s", data, info.Key)
+		}
+	})
+
+	t.Run("ChangedOriginal", func(t *testing.T) {
+		// Caching a rendition of a new version drops every rendition of the old one
+		changed := small
+		changed.Version = "v2"
+		if err := cache.Put(changed, []byte("changed"), "image/jpeg"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if _, err := cache.Stat(small); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("Expected the stale rendition to be removed, got %v", err)
+		}
+		if _, err := cache.Stat(changed); err != nil {
+			t.Fatalf("Expected the new rendition to be kept, got %v", err)
+		}
+	})
+
+	t.Run("Invalidate", func(t *testing.T) {
+		other := RenditionKey{ReceiptID: "receipt2", Version: "v1", Size: "small", Format: "jpg"}
+		cache.Put(other, []byte("other"), "image/jpeg")
+
+		if err := cache.Invalidate("receipt1"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if blobs, _ := store.List("renditions/receipt1/"); len(blobs) != 0 {
+			t.Fatalf("Expected no renditions of receipt1, got %v", blobs)
+		}
+		if _, err := cache.Stat(other); err != nil {
+			t.Fatalf("Expected renditions of other receipts to be kept, got %v", err)
+		}
+	})
+}
+
+// TestRenditionCacheEviction tests that variants are evicted least recently used first and presets never are
+func TestRenditionCacheEviction(t *testing.T) {
+	store := newTestBlobStore(t)
+	cache := NewRenditionCache(store, 10)
+	variant := func(width int) RenditionKey {
+		return RenditionKey{ReceiptID: "receipt1", Version: "v1", Size: VariantSize(width, 0), Format: "jpg", Variant: true}
+	}
+	preset := RenditionKey{ReceiptID: "receipt1", Version: "v1", Size: "large", Format: "jpg"}
+
+	cache.Put(preset, []byte(strings.Repeat("p", 20)), "image/jpeg")
+	cache.Put(variant(1), []byte("1111"), "image/jpeg")
+	cache.Put(variant(2), []byte("2222"), "image/jpeg")
+
+	// Using variant 1 makes variant 2 the least recently used
+	blob, _, err := cache.Get(variant(1))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	blob.Close()
+
+	cache.Put(variant(3), []byte("3333"), "image/jpeg")
+	if _, err := cache.Stat(variant(2)); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Expected the least recently used variant to be evicted, got %v", err)
+	}
+	for _, key := range []RenditionKey{variant(1), variant(3), preset} {
+		if _, err := cache.Stat(key); err != nil {
+			t.Fatalf("Expected %s to be kept, got %v", key.BlobKey(), err)
+		}
+	}
+
+	t.Run("Reload", func(t *testing.T) {
+		// A new cache over the same store accounts for the variants already stored, oldest first
+		time.Sleep(10 * time.Millisecond)
+		reloaded := NewRenditionCache(store, 10)
+		reloaded.Put(variant(4), []byte("4444"), "image/jpeg")
+
+		remaining := 0
+		for _, key := range []RenditionKey{variant(1), variant(3), variant(4)} {
+			if _, err := reloaded.Stat(key); err == nil {
+				remaining++
+			}
+		}
+		if remaining != 2 {
+			t.Fatalf("Expected one variant to be evicted after reloading, got %d remaining", remaining)
+		}
+		if _, err := reloaded.Stat(variant(4)); err != nil {
+			t.Fatalf("Expected the new variant to be kept, got %v", err)
+		}
+	})
+}
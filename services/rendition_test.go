@@ -0,0 +1,199 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"testing"
+)
+
+// Setup function to create a blob store serving the test images
+func setupImageTestEnvironment() (BlobStore, error) {
+	return NewFileSystemBlobStore("../testdata", nil)
+}
+
+// TestRender tests generating renditions with the different fit modes and formats
+func TestRender(t *testing.T) {
+	store, err := setupImageTestEnvironment()
+	if err != nil {
+		t.Fatalf("Failed to set up test environment: %v", err)
+	}
+
+	render := func(t *testing.T, preset RenditionPreset) (image.Image, string, int) {
+		data, err := Render(store, "test.jpg", preset, MetadataStripGPS, testDecoder)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		img, format, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Expected a decodable image, got %v", err)
+		}
+		return img, format, len(data)
+	}
+
+	t.Run("Contain", func(t *testing.T) {
+		// The rendition fits inside the box without being stretched
+		img, format, _ := render(t, RenditionPreset{Name: "box", Width: 100, Height: 100, Fit: FitContain, Format: FormatJPEG})
+		width, height := img.Bounds().Dx(), img.Bounds().Dy()
+		if format != "jpeg" || width > 100 || height > 100 || (width != 100 && height != 100) {
+			t.Fatalf("Expected a JPEG fitted into 100x100, got %s %dx%d", format, width, height)
+		}
+	})
+
+	t.Run("Cover", func(t *testing.T) {
+		img, _, _ := render(t, RenditionPreset{Name: "square", Width: 80, Height: 80, Fit: FitCover, Format: FormatJPEG})
+		if img.Bounds().Dx() != 80 || img.Bounds().Dy() != 80 {
+			t.Fatalf("Expected exactly 80x80, got %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		// Enlarging is refused before the pixels are allocated, whichever side is given
+		decoder := NewImageDecoder(DecodeLimits{MaxPixels: 4_000_000, MaxDimension: 3000}, 1)
+		for _, preset := range []RenditionPreset{
+			{Name: "wide", Width: 8000, Fit: FitContain, Format: FormatJPEG},
+			{Name: "tall", Height: 2500, Fit: FitContain, Format: FormatJPEG},
+			{Name: "cover", Width: 2500, Height: 2500, Fit: FitCover, Format: FormatJPEG},
+		} {
+			if _, err := Render(store, "test.jpg", preset, MetadataStripGPS, decoder); !errors.Is(err, ErrImageTooLarge) {
+				t.Fatalf("Expected ErrImageTooLarge for %s, got %v", preset.Name, err)
+			}
+		}
+
+		// Fitting into a large box never enlarges
+		if _, err := Render(store, "test.jpg", RenditionPreset{Name: "box", Width: 2500, Height: 2500, Fit: FitContain, Format: FormatJPEG}, MetadataStripGPS, decoder); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	})
+
+	t.Run("PNG", func(t *testing.T) {
+		if _, format, _ := render(t, RenditionPreset{Name: "png", Width: 50, Fit: FitContain, Format: FormatPNG}); format != "png" {
+			t.Fatalf("Expected a PNG, got %s", format)
+		}
+	})
+
+	t.Run("GIF", func(t *testing.T) {
+		if _, format, _ := render(t, RenditionPreset{Name: "gif", Width: 50, Fit: FitContain, Format: FormatGIF}); format != "gif" {
+			t.Fatalf("Expected a GIF, got %s", format)
+		}
+	})
+
+	t.Run("WebP", func(t *testing.T) {
+		data, err := Render(store, "test.jpg", RenditionPreset{Name: "webp", Width: 50, Fit: FitContain, Format: FormatWebP}, MetadataStripGPS, testDecoder)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(data) < 16 || string(data[0:4]) != "RIFF" || string(data[8:16]) != "WEBPVP8L" {
+			t.Fatalf("Expected a lossless WebP file, got % x", data[:min(len(data), 16)])
+		}
+	})
+
+	t.Run("Convert", func(t *testing.T) {
+		// Without a size the rendition keeps the original dimensions
+		file, _, err := store.Get("test.jpg")
+		if err != nil {
+			t.Fatalf("Failed to open test image: %v", err)
+		}
+		defer file.Close()
+		original, _ := testDecoder.Decode(file)
+		img, format, _ := render(t, RenditionPreset{Name: "png", Fit: FitContain, Format: FormatPNG})
+		if format != "png" || img.Bounds().Size() != original.Bounds().Size() {
+			t.Fatalf("Expected a PNG of the original size, got %s %v", format, img.Bounds().Size())
+		}
+	})
+
+	t.Run("Orientation", func(t *testing.T) {
+		// The photo is stored sideways with EXIF orientation 6
+		for _, policy := range []MetadataPolicy{MetadataRetain, MetadataStrip} {
+			data, err := Render(store, "exif.jpg", RenditionPreset{Name: "upright", Width: 40, Height: 60, Fit: FitContain, Format: FormatJPEG}, policy, testDecoder)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			img, _, _ := image.Decode(bytes.NewReader(data))
+			if img.Bounds().Dx() != 40 || img.Bounds().Dy() != 60 {
+				t.Fatalf("Expected an upright 40x60 rendition, got %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+			}
+
+			// Retained metadata is copied without the rotation, which was applied to the pixels
+			_, photo, _ := NormalizeJPEG(data, MetadataRetain, testDecoder)
+			if policy == MetadataRetain && (photo.Orientation != 1 || photo.CameraModel != "RC-1 Pro" || !photo.HasGPS) {
+				t.Fatalf("Expected the EXIF metadata to be retained without the rotation, got %+v", photo)
+			}
+			if policy == MetadataStrip && bytes.Contains(data, exifHeader) {
+				t.Fatalf("Expected the EXIF metadata to be stripped")
+			}
+		}
+	})
+
+	t.Run("Enhance", func(t *testing.T) {
+		img, _, _ := render(t, RenditionPreset{Name: "scan", Width: 300, Height: 300, Fit: FitContain, Format: FormatPNG, Enhance: true})
+		gray, ok := img.(*image.Gray)
+		if !ok {
+			t.Fatalf("Expected a grayscale scan, got %T", img)
+		}
+		if gray.Rect.Dx() > 300 || gray.Rect.Dy() > 300 {
+			t.Fatalf("Expected the scan to fit into 300x300, got %v", gray.Rect.Size())
+		}
+		for _, v := range gray.Pix {
+			if v != 0 && v != 0xFF {
+				t.Fatalf("Expected only black and white pixels, got %d", v)
+			}
+		}
+	})
+
+	t.Run("PDFPage", func(t *testing.T) {
+		// The stub renders page 2 as a 200x300 page
+		data, err := Render(store, "receipt.pdf", RenditionPreset{Name: "page", Width: 100, Height: 100, Fit: FitContain, Format: FormatPNG, Page: 2}, MetadataStripGPS, newPDFDecoder(2))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || config.Width != 66 || config.Height != 100 {
+			t.Fatalf("Expected the second page fitted into 100x100, got %+v, %v", config, err)
+		}
+	})
+
+	t.Run("Quality", func(t *testing.T) {
+		_, _, low := render(t, RenditionPreset{Name: "low", Width: 300, Fit: FitContain, Format: FormatJPEG, Quality: 20})
+		_, _, high := render(t, RenditionPreset{Name: "high", Width: 300, Fit: FitContain, Format: FormatJPEG, Quality: 95})
+		if low >= high {
+			t.Fatalf("Expected a lower quality to produce a smaller file, got %d and %d bytes", low, high)
+		}
+	})
+}
+
+// TestPresetsFingerprint tests that the fingerprint changes with any preset setting and the metadata policy
+func TestPresetsFingerprint(t *testing.T) {
+	presets := DefaultRenditionPresets()
+	before := PresetsFingerprint(presets, MetadataStripGPS)
+	if PresetsFingerprint(DefaultRenditionPresets(), MetadataStripGPS) != before {
+		t.Fatalf("Expected the same presets to have the same fingerprint")
+	}
+	if PresetsFingerprint(presets, MetadataStrip) == before {
+		t.Fatalf("Expected a changed metadata policy to change the fingerprint")
+	}
+	presets[1].Quality = 70
+	if PresetsFingerprint(presets, MetadataStripGPS) == before {
+		t.Fatalf("Expected a changed preset to change the fingerprint")
+	}
+	changed := PresetsFingerprint(presets, MetadataStripGPS)
+	presets[2].Enhance = true
+	if PresetsFingerprint(presets, MetadataStripGPS) == changed {
+		t.Fatalf("Expected enhancing a preset to change the fingerprint")
+	}
+}
+
+// TestParseFormat tests looking up output formats by name, extension and MIME type
+func TestParseFormat(t *testing.T) {
+	for name, expected := range map[string]string{"jpeg": FormatJPEG, "JPG": FormatJPEG, ".png": FormatPNG, "webp": FormatWebP} {
+		if format, ok := ParseFormat(name); !ok || format != expected {
+			t.Fatalf("Expected %s for %q, got %s", expected, name, format)
+		}
+	}
+	if _, ok := ParseFormat("tiff"); ok {
+		t.Fatalf("Expected tiff to be unsupported")
+	}
+	if format, ok := FormatForContentType("image/gif"); !ok || format != FormatGIF {
+		t.Fatalf("Expected gif, got %s", format)
+	}
+}
@@ -0,0 +1,266 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Custom errors for resumable uploads
+var (
+	ErrUploadNotFound = errors.New("upload not found")       // The upload does not exist or has expired
+	ErrOffsetMismatch = errors.New("upload offset mismatch") // A chunk does not start where the upload ends
+)
+
+// ResumableUpload is a file uploaded in chunks over several requests, such as with the tus protocol.
+// It is stored in the blob store, so it survives a restart.
+type ResumableUpload struct {
+	ID        string            `json:"id"`
+	UserID    string            `json:"user_id"`
+	Length    int64             `json:"length"`               // Size of the complete file in bytes
+	Metadata  map[string]string `json:"metadata,omitempty"`   // Supplied by the client when the upload was created
+	CreatedAt time.Time         `json:"created_at"`           // When the upload was created
+	ReceiptID string            `json:"receipt_id,omitempty"` // Receipt created from the complete file, empty until then
+
+	Offset    int64     `json:"-"` // Bytes received so far
+	UpdatedAt time.Time `json:"-"` // When the upload last changed, which its expiry counts from
+}
+
+// Complete reports whether the receipt of the upload has been created
+func (u ResumableUpload) Complete() bool {
+	return u.ReceiptID != ""
+}
+
+// ResumableStore keeps resumable uploads in a blob store until they are complete.
+// Every chunk is stored as a blob of its own, so the received length is the total size of the chunks
+// and an interrupted request never leaves a partly written upload behind.
+// Uploads that have not changed for the expiry duration are treated as abandoned.
+//
+// The blob store cannot check an offset and store a chunk in one step, so appends to an upload must be
+// serialized by the caller. That only holds within one process: while a chunk is being received, the next
+// chunk of the same upload must not be sent to another replica.
+type ResumableStore struct {
+	store  BlobStore
+	expiry time.Duration
+}
+
+// NewResumableStore creates a store for resumable uploads that expire after expiry without changes
+func NewResumableStore(store BlobStore, expiry time.Duration) *ResumableStore {
+	return &ResumableStore{store: store, expiry: expiry}
+}
+
+// infoKey returns the key of the blob describing an upload
+func infoKey(id string) string {
+	return resumablePrefix + id + "/info.json"
+}
+
+// chunkKey returns the key of the chunk starting at offset. Offsets are zero-padded so the chunks list in order.
+func chunkKey(id string, offset int64) string {
+	return fmt.Sprintf("%s%s/chunks/%020d", resumablePrefix, id, offset)
+}
+
+// Create starts an upload of length bytes for the user
+func (s *ResumableStore) Create(userID string, length int64, metadata map[string]string) (ResumableUpload, error) {
+	now := time.Now().UTC()
+	upload := ResumableUpload{ID: uuid.New().String(), UserID: userID, Length: length, Metadata: metadata, CreatedAt: now, UpdatedAt: now}
+	return upload, s.writeInfo(upload)
+}
+
+// Get returns an upload with the number of bytes received so far.
+// Uploads that have expired are reported as ErrUploadNotFound even before they are deleted.
+func (s *ResumableStore) Get(id string) (ResumableUpload, error) {
+	// IDs come from URLs and must not reach into other blobs
+	if _, err := uuid.Parse(id); err != nil {
+		return ResumableUpload{}, ErrUploadNotFound
+	}
+
+	file, info, err := s.store.Get(infoKey(id))
+	if errors.Is(err, ErrBlobNotFound) {
+		return ResumableUpload{}, ErrUploadNotFound
+	}
+	if err != nil {
+		return ResumableUpload{}, err
+	}
+	defer file.Close()
+	var upload ResumableUpload
+	if err := json.NewDecoder(file).Decode(&upload); err != nil {
+		return ResumableUpload{}, fmt.Errorf("invalid upload %s: %v", id, err)
+	}
+	upload.UpdatedAt = info.ModTime
+
+	// The received length is what the chunks add up to; complete uploads no longer have chunks
+	if upload.Complete() {
+		upload.Offset = upload.Length
+	} else {
+		chunks, err := s.store.List(resumablePrefix + id + "/chunks/")
+		if err != nil {
+			return ResumableUpload{}, err
+		}
+		for _, chunk := range chunks {
+			upload.Offset += chunk.Size
+			if chunk.ModTime.After(upload.UpdatedAt) {
+				upload.UpdatedAt = chunk.ModTime
+			}
+		}
+	}
+
+	if time.Now().After(s.Expires(upload)) {
+		return ResumableUpload{}, ErrUploadNotFound
+	}
+	return upload, nil
+}
+
+// Expires returns when an upload is deleted unless it changes before
+func (s *ResumableStore) Expires(upload ResumableUpload) time.Time {
+	return upload.UpdatedAt.Add(s.expiry)
+}
+
+// Append stores the size bytes of r received at offset as the next chunk of the upload. The offset must be
+// where the upload ends, and the chunk must not extend past its length. Callers serialize appends to the same upload.
+func (s *ResumableStore) Append(upload *ResumableUpload, offset int64, r io.Reader, size int64) error {
+	if offset != upload.Offset {
+		return fmt.Errorf("%w: chunk at %d, upload at %d", ErrOffsetMismatch, offset, upload.Offset)
+	}
+	if upload.Offset+size > upload.Length {
+		return fmt.Errorf("%w: chunk ends at %d, upload length is %d", ErrFileTooLarge, upload.Offset+size, upload.Length)
+	}
+	if size == 0 {
+		return nil
+	}
+	if err := s.store.Put(chunkKey(upload.ID, offset), r, size, "application/octet-stream"); err != nil {
+		return err
+	}
+	upload.Offset += size
+	upload.UpdatedAt = time.Now().UTC()
+	return nil
+}
+
+// Open returns a reader of the received chunks of an upload one after another.
+// Each chunk is opened when the reader reaches it, so the file is never held in memory as a whole.
+func (s *ResumableStore) Open(upload ResumableUpload) (io.ReadCloser, error) {
+	chunks, err := s.store.List(resumablePrefix + upload.ID + "/chunks/")
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{store: s.store, chunks: chunks}, nil
+}
+
+// chunkReader reads the chunks of an upload in order, opening each when it is reached
+type chunkReader struct {
+	store   BlobStore
+	chunks  []BlobInfo    // Chunks not opened yet
+	current io.ReadCloser // Chunk being read, nil between chunks
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			file, _, err := c.store.Get(c.chunks[0].Key)
+			if err != nil {
+				return 0, err
+			}
+			c.current, c.chunks = file, c.chunks[1:]
+		}
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close closes the chunk being read
+func (c *chunkReader) Close() error {
+	if c.current == nil {
+		return nil
+	}
+	return c.current.Close()
+}
+
+// Complete records the receipt created from an upload and deletes its chunks. The upload itself
+// is kept until it expires, so a client whose last request was interrupted can still look up the receipt.
+func (s *ResumableStore) Complete(upload *ResumableUpload, receiptID string) error {
+	completed := *upload
+	completed.ReceiptID = receiptID
+	if err := s.writeInfo(completed); err != nil {
+		return err
+	}
+	*upload = completed
+	upload.Offset, upload.UpdatedAt = upload.Length, time.Now().UTC()
+	return s.deletePrefix(resumablePrefix + upload.ID + "/chunks/")
+}
+
+// Delete removes an upload and its chunks. Deleting a missing upload is not an error.
+func (s *ResumableStore) Delete(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil
+	}
+	return s.deletePrefix(resumablePrefix + id + "/")
+}
+
+// DeleteExpired removes the uploads that have not changed for the expiry duration before now
+// and returns how many were removed
+func (s *ResumableStore) DeleteExpired(now time.Time) (int, error) {
+	blobs, err := s.store.List(resumablePrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	// The last change of an upload is the newest of its blobs
+	updated := make(map[string]time.Time)
+	for _, blob := range blobs {
+		id, _, _ := strings.Cut(strings.TrimPrefix(blob.Key, resumablePrefix), "/")
+		if blob.ModTime.After(updated[id]) {
+			updated[id] = blob.ModTime
+		}
+	}
+
+	deleted := 0
+	for id, modTime := range updated {
+		if now.Before(modTime.Add(s.expiry)) {
+			continue
+		}
+		if err := s.deletePrefix(resumablePrefix + id + "/"); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// writeInfo stores the description of an upload
+func (s *ResumableStore) writeInfo(upload ResumableUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(infoKey(upload.ID), bytes.NewReader(data), int64(len(data)), "application/json")
+}
+
+// deletePrefix deletes every blob whose key starts with prefix
+func (s *ResumableStore) deletePrefix(prefix string) error {
+	blobs, err := s.store.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if err := s.store.Delete(blob.Key); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", blob.Key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// Helper function to append a chunk to an upload
+func appendChunk(uploads *ResumableStore, upload *ResumableUpload, offset int64, chunk string) error {
+	return uploads.Append(upload, offset, strings.NewReader(chunk), int64(len(chunk)))
+}
+
+// TestResumableStore tests receiving an upload in chunks
+func TestResumableStore(t *testing.T) {
+	store := newTestBlobStore(t)
+	uploads := NewResumableStore(store, time.Hour)
+
+	upload, err := uploads.Create("user-1", 12, map[string]string{"filename": "receipt.jpg"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	t.Run("Chunks", func(t *testing.T) {
+		if err := appendChunk(uploads, &upload, 0, "receipt "); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		// The received length survives reloading the upload
+		loaded, err := uploads.Get(upload.ID)
+		if err != nil || loaded.Offset != 8 || loaded.Length != 12 || loaded.UserID != "user-1" || loaded.Metadata["filename"] != "receipt.jpg" {
+			t.Fatalf("Expected 8 of 12 bytes received, got %+v, %v", loaded, err)
+		}
+		if !uploads.Expires(loaded).After(time.Now().Add(59 * time.Minute)) {
+			t.Fatalf("Expected the upload to expire in an hour, got %v", uploads.Expires(loaded))
+		}
+	})
+
+	t.Run("InvalidChunks", func(t *testing.T) {
+		if err := appendChunk(uploads, &upload, 4, "data"); !errors.Is(err, ErrOffsetMismatch) {
+			t.Fatalf("Expected ErrOffsetMismatch, got %v", err)
+		}
+		if err := appendChunk(uploads, &upload, 8, "data!"); !errors.Is(err, ErrFileTooLarge) {
+			t.Fatalf("Expected ErrFileTooLarge, got %v", err)
+		}
+	})
+
+	t.Run("Complete", func(t *testing.T) {
+		appendChunk(uploads, &upload, 8, "data")
+		reader, err := uploads.Open(upload)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		contents, err := io.ReadAll(iotest.OneByteReader(reader))
+		reader.Close()
+		if err != nil || string(contents) != "receipt data" {
+			t.Fatalf("Expected the chunks joined in order, got %q, %v", contents, err)
+		}
+
+		if err := uploads.Complete(&upload, "receipt-1"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		loaded, err := uploads.Get(upload.ID)
+		if err != nil || !loaded.Complete() || loaded.ReceiptID != "receipt-1" || loaded.Offset != 12 {
+			t.Fatalf("Expected a complete upload, got %+v, %v", loaded, err)
+		}
+		if chunks, _ := store.List(resumablePrefix + upload.ID + "/chunks/"); len(chunks) != 0 {
+			t.Fatalf("Expected the chunks to be deleted, got %+v", chunks)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := uploads.Delete(upload.ID); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if _, err := uploads.Get(upload.ID); !errors.Is(err, ErrUploadNotFound) {
+			t.Fatalf("Expected ErrUploadNotFound, got %v", err)
+		}
+
+		// IDs that are not upload IDs never reach the blob store
+		if _, err := uploads.Get("../originals"); !errors.Is(err, ErrUploadNotFound) {
+			t.Fatalf("Expected ErrUploadNotFound, got %v", err)
+		}
+	})
+}
+
+// TestDeleteExpiredUploads tests removing uploads that stopped receiving chunks
+func TestDeleteExpiredUploads(t *testing.T) {
+	store := newTestBlobStore(t)
+	uploads := NewResumableStore(store, time.Hour)
+	abandoned, _ := uploads.Create("user-1", 10, nil)
+	appendChunk(uploads, &abandoned, 0, "data")
+
+	// Nothing has expired yet
+	if deleted, err := uploads.DeleteExpired(time.Now()); err != nil || deleted != 0 {
+		t.Fatalf("Expected no upload to be deleted, got %d, %v", deleted, err)
+	}
+
+	deleted, err := uploads.DeleteExpired(time.Now().Add(2 * time.Hour))
+	if err != nil || deleted != 1 {
+		t.Fatalf("Expected the upload to be deleted, got %d, %v", deleted, err)
+	}
+	if blobs, _ := store.List(resumablePrefix); len(blobs) != 0 {
+		t.Fatalf("Expected all blobs of the upload to be deleted, got %+v", blobs)
+	}
+
+	// Uploads past their expiry are gone even before they are deleted
+	expired, _ := NewResumableStore(store, -time.Minute).Create("user-1", 10, nil)
+	if _, err := NewResumableStore(store, -time.Minute).Get(expired.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Fatalf("Expected ErrUploadNotFound, got %v", err)
+	}
+}
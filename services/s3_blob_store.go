@@ -0,0 +1,251 @@
+package services
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3BlobStore stores blobs in a bucket of an S3-compatible object store such as AWS S3 or MinIO.
+// Requests are signed with AWS Signature Version 4.
+type S3BlobStore struct {
+	endpoint  *url.URL
+	bucket    string
+	pathStyle bool // Address the bucket as endpoint/bucket instead of bucket.endpoint
+	creds     s3Credentials
+	client    *http.Client
+	now       func() time.Time // Clock used for signing, replaced in tests
+}
+
+// S3Options configures an S3BlobStore
+type S3Options struct {
+	Endpoint        string // Base URL of the service, e.g. https://s3.eu-west-1.amazonaws.com
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	PathStyle       bool         // Required by most self-hosted S3-compatible services
+	Client          *http.Client // Defaults to a client with a 60 second timeout
+}
+
+// NewS3BlobStore returns a store for the bucket described by opts
+func NewS3BlobStore(opts S3Options) (*S3BlobStore, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", opts.Endpoint)
+	}
+	if opts.Bucket == "" || opts.Region == "" {
+		return nil, fmt.Errorf("S3 bucket and region are required")
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: 60 * time.Second}
+	}
+	return &S3BlobStore{
+		endpoint:  endpoint,
+		bucket:    opts.Bucket,
+		pathStyle: opts.PathStyle,
+		creds:     s3Credentials{AccessKeyID: opts.AccessKeyID, SecretAccessKey: opts.SecretAccessKey, Region: opts.Region},
+		client:    client,
+		now:       time.Now,
+	}, nil
+}
+
+// objectURL returns the URL of the object stored under key, or of the bucket if key is empty
+func (s *S3BlobStore) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	return &u
+}
+
+// do signs and sends a request, turning 404 responses into ErrBlobNotFound and other failures into errors
+func (s *S3BlobStore) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	signV4(req, payloadHash, s.creds, s.now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("S3 %s %s failed with %s: %s", req.Method, req.URL.Path, resp.Status, bytes.TrimSpace(message))
+	}
+	return resp, nil
+}
+
+// Put uploads the blob with a single PUT request. S3 needs the length up front,
+// so readers of unknown size are buffered in memory first.
+func (s *S3BlobStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	if size < 0 {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		r, size = bytes.NewReader(data), int64(len(data))
+	}
+
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key).String(), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	// The body is streamed, so its hash cannot be signed
+	resp, err := s.do(req, unsignedPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get downloads the blob. The returned reader streams the response body.
+func (s *S3BlobStore) Get(key string) (io.ReadCloser, BlobInfo, error) {
+	if err := validateBlobKey(key); err != nil {
+		return nil, BlobInfo{}, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	return resp.Body, responseBlobInfo(key, resp), nil
+}
+
+// Stat issues a HEAD request for the blob
+func (s *S3BlobStore) Stat(key string) (BlobInfo, error) {
+	if err := validateBlobKey(key); err != nil {
+		return BlobInfo{}, err
+	}
+
+	req, err := http.NewRequest(http.MethodHead, s.objectURL(key).String(), nil)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	resp.Body.Close()
+	return responseBlobInfo(key, resp), nil
+}
+
+// Delete removes the blob. S3 reports success for keys that do not exist.
+func (s *S3BlobStore) Delete(key string) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listBucketResult is the subset of the ListObjectsV2 response used by List
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List pages through ListObjectsV2 until every key with the prefix has been returned.
+// The listing does not include content types; they are left empty.
+func (s *S3BlobStore) List(prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := s.objectURL("")
+		u.RawQuery = canonicalQuery(query)
+
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 listing: %v", err)
+		}
+
+		for _, object := range result.Contents {
+			blobs = append(blobs, BlobInfo{Key: object.Key, Size: object.Size, ModTime: object.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// SignedURL returns a presigned GET URL pointing directly at the object store
+func (s *S3BlobStore) SignedURL(key string, expires time.Duration) (string, error) {
+	if err := validateBlobKey(key); err != nil {
+		return "", err
+	}
+	return presignV4(http.MethodGet, s.objectURL(key), s.creds, s.now(), expires).String(), nil
+}
+
+// responseBlobInfo reads the blob metadata from the headers of a GET or HEAD response
+func responseBlobInfo(key string, resp *http.Response) BlobInfo {
+	info := BlobInfo{Key: key, Size: resp.ContentLength, ContentType: resp.Header.Get("Content-Type")}
+	if size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		info.Size = size // HEAD responses have no body, so ContentLength may not be set
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3Object is an object held by fakeS3
+type fakeS3Object struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+// fakeS3 is a minimal path-style S3 stand-in that checks request signatures
+type fakeS3 struct {
+	t       *testing.T
+	bucket  string
+	creds   s3Credentials
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+}
+
+// newFakeS3 starts a fake S3 server and returns a store pointing at it
+func newFakeS3(t *testing.T) (*fakeS3, *S3BlobStore, *httptest.Server) {
+	fake := &fakeS3{
+		t:       t,
+		bucket:  "receipts",
+		creds:   s3Credentials{AccessKeyID: "test-access-key", SecretAccessKey: "test-secret-key", Region: "us-east-1"},
+		objects: make(map[string]fakeS3Object),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	store, err := NewS3BlobStore(S3Options{
+		Endpoint:        server.URL,
+		Region:          fake.creds.Region,
+		Bucket:          fake.bucket,
+		AccessKeyID:     fake.creds.AccessKeyID,
+		SecretAccessKey: fake.creds.SecretAccessKey,
+		PathStyle:       true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create S3 store: %v", err)
+	}
+	return fake, store, server
+}
+
+// ServeHTTP implements the object and ListObjectsV2 operations used by S3BlobStore
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(r) {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	bucketPrefix := "/" + f.bucket + "/"
+	if !strings.HasPrefix(r.URL.Path, bucketPrefix) {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, bucketPrefix)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		if r.ContentLength != int64(len(data)) {
+			http.Error(w, "MissingContentLength", http.StatusLengthRequired)
+			return
+		}
+		f.objects[key] = fakeS3Object{data: data, contentType: r.Header.Get("Content-Type"), modTime: time.Now().UTC()}
+	case http.MethodGet, http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.data)))
+		w.Header().Set("Last-Modified", object.modTime.Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(object.data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// list returns one key per page so the client has to follow continuation tokens
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix, token := r.URL.Query().Get("prefix"), r.URL.Query().Get("continuation-token")
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	if len(keys) > 0 {
+		object := f.objects[keys[0]]
+		result.Contents = []content{{Key: keys[0], Size: len(object.data), LastModified: object.modTime.Format(time.RFC3339)}}
+		result.IsTruncated = len(keys) > 1
+		if result.IsTruncated {
+			result.NextContinuationToken = keys[0]
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// authorized recomputes the request's header or query signature from what was received
+func (f *fakeS3) authorized(r *http.Request) bool {
+	if signature := r.URL.Query().Get("X-Amz-Signature"); signature != "" {
+		signedAt, _ := time.Parse(sigV4TimeFormat, r.URL.Query().Get("X-Amz-Date"))
+		var seconds int
+		fmt.Sscan(r.URL.Query().Get("X-Amz-Expires"), &seconds)
+		if time.Now().After(signedAt.Add(time.Duration(seconds) * time.Second)) {
+			return false
+		}
+
+		u := &url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path}
+		return presignV4(r.Method, u, f.creds, signedAt, time.Duration(seconds)*time.Second).Query().Get("X-Amz-Signature") == signature
+	}
+
+	// Rebuild the request from the headers it claims to have signed and sign it again
+	authorization := r.Header.Get("Authorization")
+	_, signedHeaders, ok := strings.Cut(authorization, "SignedHeaders=")
+	if !ok {
+		return false
+	}
+	signedHeaders, _, _ = strings.Cut(signedHeaders, ",")
+
+	rebuilt, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	for _, name := range strings.Split(signedHeaders, ";") {
+		if name != "host" {
+			rebuilt.Header.Set(name, r.Header.Get(name))
+		}
+	}
+	signedAt, _ := time.Parse(sigV4TimeFormat, r.Header.Get("X-Amz-Date"))
+	signV4(rebuilt, r.Header.Get("X-Amz-Content-Sha256"), f.creds, signedAt)
+	return rebuilt.Header.Get("Authorization") == authorization
+}
+
+// TestS3BlobStore tests the S3 implementation of BlobStore against the fake server
+func TestS3BlobStore(t *testing.T) {
+	_, store, server := newFakeS3(t)
+	testBlobStore(t, store)
+
+	t.Run("SignedURL", func(t *testing.T) {
+		store.Put("originals/signed.jpg", strings.NewReader("signed"), 6, "image/jpeg")
+		signed, err := store.SignedURL("originals/signed.jpg", time.Minute)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !strings.HasPrefix(signed, server.URL+"/receipts/originals/signed.jpg?") {
+			t.Fatalf("Expected a URL pointing at the object, got %s", signed)
+		}
+
+		// The URL works without any credentials
+		resp, err := http.Get(signed)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(data) != "signed" {
+			t.Fatalf("Expected the object through the signed URL, got %d %q", resp.StatusCode, data)
+		}
+	})
+
+	t.Run("WrongCredentials", func(t *testing.T) {
+		forged, _ := NewS3BlobStore(S3Options{
+			Endpoint:        server.URL,
+			Region:          "us-east-1",
+			Bucket:          "receipts",
+			AccessKeyID:     "test-access-key",
+			SecretAccessKey: "wrong-secret",
+			PathStyle:       true,
+		})
+		if err := forged.Put("originals/forged.jpg", strings.NewReader("x"), 1, "image/jpeg"); err == nil {
+			t.Fatalf("Expected requests with a wrong secret to be rejected")
+		}
+	})
+}
+
+// TestS3ObjectURL tests path-style and virtual-hosted bucket addressing
+func TestS3ObjectURL(t *testing.T) {
+	virtual, _ := NewS3BlobStore(S3Options{Endpoint: "https://s3.eu-west-1.amazonaws.com", Region: "eu-west-1", Bucket: "receipts"})
+	if u := virtual.objectURL("originals/a.jpg").String(); u != "https://receipts.s3.eu-west-1.amazonaws.com/originals/a.jpg" {
+		t.Fatalf("Expected a virtual-hosted URL, got %s", u)
+	}
+
+	pathStyle, _ := NewS3BlobStore(S3Options{Endpoint: "http://minio:9000", Region: "us-east-1", Bucket: "receipts", PathStyle: true})
+	if u := pathStyle.objectURL("originals/a.jpg").String(); u != "http://minio:9000/receipts/originals/a.jpg" {
+		t.Fatalf("Expected a path-style URL, got %s", u)
+	}
+
+	if _, err := NewS3BlobStore(S3Options{Endpoint: "not a url", Region: "us-east-1", Bucket: "receipts"}); err == nil {
+		t.Fatalf("Expected an invalid endpoint to be rejected")
+	}
+}
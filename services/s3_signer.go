@@ -0,0 +1,191 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4 constants
+const (
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	sigV4Service     = "s3"
+	sigV4TimeFormat  = "20060102T150405Z"
+	sigV4DateFormat  = "20060102"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Credentials are the access key pair used to sign requests
+type s3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Region          string
+}
+
+// signV4 adds the x-amz-date, x-amz-content-sha256 and Authorization headers to req.
+// Every header already set on req is included in the signature together with Host.
+func signV4(req *http.Request, payloadHash string, creds s3Credentials, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders, canonicalHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := credentialScope(now, creds.Region)
+	signature := sigV4Signature(canonicalRequest, now, scope, creds)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// presignV4 returns a copy of u carrying query string authentication valid for expires.
+// Only the host header is signed so the URL can be used by any client.
+func presignV4(method string, u *url.URL, creds s3Credentials, now time.Time, expires time.Duration) *url.URL {
+	now = now.UTC()
+	scope := credentialScope(now, creds.Region)
+
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", creds.AccessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	query.Set("X-Amz-Expires", fmt.Sprint(int64(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI(u),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+
+	query.Set("X-Amz-Signature", sigV4Signature(canonicalRequest, now, scope, creds))
+	signed := *u
+	signed.RawQuery = canonicalQuery(query)
+	return &signed
+}
+
+// credentialScope returns the date/region/service scope the signing key is derived for
+func credentialScope(now time.Time, region string) string {
+	return now.Format(sigV4DateFormat) + "/" + region + "/" + sigV4Service + "/aws4_request"
+}
+
+// sigV4Signature signs the canonical request with a key derived from the secret, date and region
+func sigV4Signature(canonicalRequest string, now time.Time, scope string, creds s3Credentials) string {
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		now.Format(sigV4TimeFormat),
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), now.Format(sigV4DateFormat))
+	key = hmacSHA256(key, creds.Region)
+	key = hmacSHA256(key, sigV4Service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalHeaders returns the signed header list and the canonical header block of req
+func canonicalHeaders(req *http.Request) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	if req.Host != "" {
+		headers["host"] = req.Host
+	}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "authorization" {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var block strings.Builder
+	for _, name := range names {
+		block.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return strings.Join(names, ";"), block.String()
+}
+
+// canonicalURI returns the URI-encoded path. S3 does not normalize or double-encode paths.
+func canonicalURI(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery returns the query parameters sorted by name with RFC 3986 encoding
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name)+"="+uriEncode(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything except the RFC 3986 unreserved characters
+func uriEncode(s string) string {
+	var encoded strings.Builder
+	for _, b := range []byte(s) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+// hashHex returns the hex encoded SHA-256 of data
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
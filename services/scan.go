@@ -0,0 +1,268 @@
+package services
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// Tuning of the document scan enhancement
+const (
+	scanDetectSize     = 512  // Longest side of the copy the paper is detected on
+	scanMinPaperArea   = 0.1  // Smallest share of the photo the paper must cover to be cropped
+	scanMaxDeskew      = 15.0 // Largest rotation in degrees that is corrected; steeper papers are only cropped
+	scanThresholdTile  = 16   // The thresholding window spans this many times less than the image's longest side
+	scanThresholdDelta = 15   // Percent below the local mean brightness at which a pixel turns black
+)
+
+// CropDocument finds the paper in a photo as the largest bright region, then rotates the photo so
+// the paper is straight and crops it to the paper. Photos without a clear paper are returned unchanged.
+func CropDocument(img image.Image) image.Image {
+	bounds := img.Bounds()
+	small := toGray(imaging.Fit(img, scanDetectSize, scanDetectSize, imaging.Box))
+	paper := largestRegion(small, otsuThreshold(small))
+	if float64(len(paper)) < scanMinPaperArea*float64(len(small.Pix)) {
+		return img
+	}
+
+	// The paper's outline is the smallest rectangle around its convex hull
+	rect := minAreaRect(convexHull(regionOutline(paper, small.Rect.Dx())))
+	scale := float64(bounds.Dx()) / float64(small.Rect.Dx())
+	cx, cy := rect.cx*scale, rect.cy*scale
+	width, height := rect.width*scale, rect.height*scale
+
+	// Steep angles are more likely a misdetection than a skewed receipt
+	if math.Abs(rect.angle) > scanMaxDeskew {
+		minX, minY, maxX, maxY := regionBounds(paper, small.Rect.Dx())
+		crop := image.Rect(int(float64(minX)*scale), int(float64(minY)*scale), int(math.Ceil(float64(maxX+1)*scale)), int(math.Ceil(float64(maxY+1)*scale)))
+		return imaging.Crop(img, crop.Add(bounds.Min))
+	}
+
+	// Rotating counter-clockwise by the paper's angle levels its edges; the paper's center moves with the canvas
+	rotated := imaging.Rotate(img, rect.angle, color.White)
+	sin, cos := math.Sincos(rect.angle * math.Pi / 180)
+	dx, dy := cx-float64(bounds.Dx())/2, cy-float64(bounds.Dy())/2
+	rx := float64(rotated.Rect.Dx())/2 + dx*cos + dy*sin
+	ry := float64(rotated.Rect.Dy())/2 - dx*sin + dy*cos
+	crop := image.Rect(int(math.Round(rx-width/2)), int(math.Round(ry-height/2)), int(math.Round(rx+width/2)), int(math.Round(ry+height/2)))
+	return imaging.Crop(rotated, crop)
+}
+
+// AdaptiveThreshold converts an image to black and white, comparing every pixel with the mean brightness
+// of its neighbourhood instead of one global level, so shadows and uneven lighting do not swallow the text.
+func AdaptiveThreshold(img image.Image) *image.Gray {
+	gray := toGray(img)
+	width, height := gray.Rect.Dx(), gray.Rect.Dy()
+	radius := max(width, height) / scanThresholdTile / 2
+	radius = max(radius, 7)
+
+	// Summed-area table with a zero row and column, so any window sum takes four lookups
+	stride := width + 1
+	sums := make([]uint64, stride*(height+1))
+	for y := 0; y < height; y++ {
+		var row uint64
+		for x := 0; x < width; x++ {
+			row += uint64(gray.Pix[y*gray.Stride+x])
+			sums[(y+1)*stride+x+1] = sums[y*stride+x+1] + row
+		}
+	}
+
+	out := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := max(y-radius, 0), min(y+radius+1, height)
+		for x := 0; x < width; x++ {
+			x0, x1 := max(x-radius, 0), min(x+radius+1, width)
+			count := uint64((x1 - x0) * (y1 - y0))
+			sum := sums[y1*stride+x1] - sums[y0*stride+x1] - sums[y1*stride+x0] + sums[y0*stride+x0]
+			if uint64(gray.Pix[y*gray.Stride+x])*count*100 > sum*(100-scanThresholdDelta) {
+				out.Pix[y*out.Stride+x] = 0xFF
+			}
+		}
+	}
+	return out
+}
+
+// toGray converts an image to 8-bit grayscale with its origin at 0,0
+func toGray(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(gray, gray.Rect, img, bounds.Min, draw.Src)
+	return gray
+}
+
+// otsuThreshold returns the brightness that best separates the image into a dark and a bright class
+func otsuThreshold(gray *image.Gray) uint8 {
+	var histogram [256]int
+	for _, v := range gray.Pix {
+		histogram[v]++
+	}
+	total := len(gray.Pix)
+	var sumAll float64
+	for v, n := range histogram {
+		sumAll += float64(v * n)
+	}
+
+	var best uint8
+	var bestVariance, sumDark float64
+	dark := 0
+	for v, n := range histogram {
+		dark += n
+		if dark == 0 {
+			continue
+		}
+		if dark == total {
+			break
+		}
+		sumDark += float64(v * n)
+		meanDark := sumDark / float64(dark)
+		meanBright := (sumAll - sumDark) / float64(total-dark)
+		variance := float64(dark) * float64(total-dark) * (meanDark - meanBright) * (meanDark - meanBright)
+		if variance > bestVariance {
+			best, bestVariance = uint8(v), variance
+		}
+	}
+	return best
+}
+
+// largestRegion returns the pixel offsets of the largest 4-connected region brighter than threshold
+func largestRegion(gray *image.Gray, threshold uint8) []int {
+	width, height := gray.Rect.Dx(), gray.Rect.Dy()
+	visited := make([]bool, width*height)
+	var largest, stack []int
+	for start := range visited {
+		if visited[start] || gray.Pix[start] <= threshold {
+			continue
+		}
+		var region []int
+		visited[start] = true
+		stack = append(stack[:0], start)
+		for len(stack) > 0 {
+			p := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			region = append(region, p)
+			x, y := p%width, p/width
+			for _, n := range [4][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				if n[0] < 0 || n[0] >= width || n[1] < 0 || n[1] >= height {
+					continue
+				}
+				q := n[1]*width + n[0]
+				if !visited[q] && gray.Pix[q] > threshold {
+					visited[q] = true
+					stack = append(stack, q)
+				}
+			}
+		}
+		if len(region) > len(largest) {
+			largest = region
+		}
+	}
+	return largest
+}
+
+// regionBounds returns the smallest and largest coordinates of a region's pixels
+func regionBounds(region []int, width int) (minX, minY, maxX, maxY int) {
+	minX, minY = math.MaxInt, math.MaxInt
+	for _, p := range region {
+		x, y := p%width, p/width
+		minX, minY, maxX, maxY = min(minX, x), min(minY, y), max(maxX, x), max(maxY, y)
+	}
+	return minX, minY, maxX, maxY
+}
+
+// point is a position in the detection image
+type point struct{ x, y float64 }
+
+// regionOutline returns the corners of the leftmost and rightmost pixel of every row of a region,
+// which is all the convex hull needs
+func regionOutline(region []int, width int) []point {
+	rows := make(map[int][2]int)
+	for _, p := range region {
+		x, y := p%width, p/width
+		if row, ok := rows[y]; !ok {
+			rows[y] = [2]int{x, x}
+		} else {
+			rows[y] = [2]int{min(row[0], x), max(row[1], x)}
+		}
+	}
+	outline := make([]point, 0, len(rows)*4)
+	for y, row := range rows {
+		left, right, top, bottom := float64(row[0]), float64(row[1]+1), float64(y), float64(y+1)
+		outline = append(outline, point{left, top}, point{left, bottom}, point{right, top}, point{right, bottom})
+	}
+	return outline
+}
+
+// convexHull returns the convex hull of the points in counter-clockwise order (Andrew's monotone chain)
+func convexHull(points []point) []point {
+	sorted := append([]point(nil), points...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].x < sorted[j].x || (sorted[i].x == sorted[j].x && sorted[i].y < sorted[j].y)
+	})
+	cross := func(o, a, b point) float64 { return (a.x-o.x)*(b.y-o.y) - (a.y-o.y)*(b.x-o.x) }
+
+	hull := make([]point, 0, 2*len(sorted))
+	for _, p := range sorted {
+		for len(hull) >= 2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	for i, lower := len(sorted)-2, len(hull)+1; i >= 0; i-- {
+		p := sorted[i]
+		for len(hull) >= lower && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	return hull[:len(hull)-1]
+}
+
+// rotatedRect is a rectangle turned clockwise by angle degrees around its center
+type rotatedRect struct {
+	cx, cy        float64
+	width, height float64
+	angle         float64 // Between -45 and 45
+}
+
+// minAreaRect returns the smallest rectangle enclosing a convex hull. One of its sides lies on a hull edge,
+// so only the edge directions need to be tried.
+func minAreaRect(hull []point) rotatedRect {
+	best := rotatedRect{width: math.Inf(1), height: 1}
+	for i := range hull {
+		a, b := hull[i], hull[(i+1)%len(hull)]
+		length := math.Hypot(b.x-a.x, b.y-a.y)
+		if length == 0 {
+			continue
+		}
+		ux, uy := (b.x-a.x)/length, (b.y-a.y)/length
+		minU, maxU, minV, maxV := math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)
+		for _, p := range hull {
+			u, v := p.x*ux+p.y*uy, -p.x*uy+p.y*ux
+			minU, maxU, minV, maxV = math.Min(minU, u), math.Max(maxU, u), math.Min(minV, v), math.Max(maxV, v)
+		}
+		if (maxU-minU)*(maxV-minV) >= best.width*best.height {
+			continue
+		}
+		u, v := (minU+maxU)/2, (minV+maxV)/2
+		best = rotatedRect{
+			cx: u*ux - v*uy, cy: u*uy + v*ux,
+			width: maxU - minU, height: maxV - minV,
+			angle: math.Atan2(uy, ux) * 180 / math.Pi,
+		}
+	}
+
+	// Describe the rectangle by the side closest to horizontal
+	for best.angle > 45 {
+		best.angle -= 90
+		best.width, best.height = best.height, best.width
+	}
+	for best.angle <= -45 {
+		best.angle += 90
+		best.width, best.height = best.height, best.width
+	}
+	return best
+}
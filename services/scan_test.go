@@ -0,0 +1,87 @@
+package services
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// scanTestPhoto returns a 400x300 photo of a white 160x220 receipt with three dark text lines,
+// turned by angle degrees counter-clockwise and lying on a dark table
+func scanTestPhoto(angle float64) image.Image {
+	paper := imaging.New(160, 220, color.White)
+	for _, y := range []int{40, 100, 160} {
+		paper = imaging.Paste(paper, imaging.New(120, 8, color.Gray{Y: 20}), image.Pt(20, y))
+	}
+	rotated := imaging.Rotate(paper, angle, color.Transparent)
+	table := imaging.New(400, 300, color.Gray{Y: 70})
+	return imaging.Overlay(table, rotated, image.Pt(200-rotated.Rect.Dx()/2, 150-rotated.Rect.Dy()/2), 1)
+}
+
+// darkShare returns the share of dark pixels in a row of an image, ignoring the outer fifth on either side
+func darkShare(img *image.Gray, y int) float64 {
+	from, to := img.Rect.Dx()/5, img.Rect.Dx()*4/5
+	dark := 0
+	for x := from; x < to; x++ {
+		if img.GrayAt(x, y).Y < 128 {
+			dark++
+		}
+	}
+	return float64(dark) / float64(to-from)
+}
+
+// TestCropDocument tests finding, straightening and cropping the paper in a photo
+func TestCropDocument(t *testing.T) {
+	for _, angle := range []float64{0, 6, -9} {
+		cropped := toGray(CropDocument(scanTestPhoto(angle)))
+		width, height := cropped.Rect.Dx(), cropped.Rect.Dy()
+		if width < 150 || width > 170 || height < 210 || height > 230 {
+			t.Fatalf("Expected the 160x220 paper for angle %v, got %dx%d", angle, width, height)
+		}
+
+		// Straight text lines run across the whole paper, the paper between them is blank
+		scale := float64(height) / 220
+		if share := darkShare(cropped, int(104*scale)); share < 0.9 {
+			t.Fatalf("Expected a straight text line for angle %v, got %.2f dark", angle, share)
+		}
+		if share := darkShare(cropped, int(75*scale)); share > 0.1 {
+			t.Fatalf("Expected blank paper between the lines for angle %v, got %.2f dark", angle, share)
+		}
+	}
+
+	t.Run("NoPaper", func(t *testing.T) {
+		// A photo without a bright region is left as it is
+		photo := imaging.New(200, 100, color.Gray{Y: 90})
+		if cropped := CropDocument(photo); cropped.Bounds() != photo.Bounds() {
+			t.Fatalf("Expected the photo to be unchanged, got %v", cropped.Bounds())
+		}
+	})
+}
+
+// TestAdaptiveThreshold tests that text stays black and the paper white under uneven lighting
+func TestAdaptiveThreshold(t *testing.T) {
+	// Lighting falls off from left to right; the text line is darker than its surroundings everywhere
+	img := image.NewGray(image.Rect(0, 0, 300, 100))
+	for x := 0; x < 300; x++ {
+		light := uint8(230 - x/2)
+		for y := 0; y < 100; y++ {
+			value := light
+			if y >= 45 && y < 50 {
+				value = light / 2
+			}
+			img.SetGray(x, y, color.Gray{Y: value})
+		}
+	}
+
+	out := AdaptiveThreshold(img)
+	for _, x := range []int{10, 150, 290} {
+		if out.GrayAt(x, 20).Y != 0xFF || out.GrayAt(x, 80).Y != 0xFF {
+			t.Fatalf("Expected the paper to be white at x=%d", x)
+		}
+		if out.GrayAt(x, 47).Y != 0 {
+			t.Fatalf("Expected the text to be black at x=%d", x)
+		}
+	}
+}
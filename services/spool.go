@@ -0,0 +1,131 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SpooledFile is an uploaded file written to a temporary file while it is read and hashed,
+// so uploads are validated and stored without ever being held in memory whole.
+// Close removes the temporary file.
+type SpooledFile struct {
+	file   *os.File
+	size   int64
+	sha256 string
+}
+
+// SpoolUpload copies an uploaded file of at most maxBytes bytes to a temporary file, hashing it on the way.
+// Larger files are read to the end without being kept, so the error wrapping ErrFileTooLarge can report their size.
+// A limit of 0 disables the check.
+func SpoolUpload(r io.Reader, maxBytes int64) (*SpooledFile, error) {
+	limited := r
+	if maxBytes > 0 {
+		limited = io.LimitReader(r, maxBytes+1)
+	}
+	spooled, err := SpoolChunk(limited)
+	if err != nil {
+		if spooled != nil {
+			spooled.Close()
+		}
+		return nil, err
+	}
+	if maxBytes > 0 && spooled.size > maxBytes {
+		spooled.Close()
+		rest, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %d bytes, at most %d bytes allowed", ErrFileTooLarge, spooled.size+rest, maxBytes)
+	}
+	return spooled, nil
+}
+
+// SpoolChunk copies r to a temporary file, hashing it on the way, like SpoolUpload without a limit.
+// If reading r fails, the bytes read before are kept: the file is returned along with the error,
+// e.g. for the chunk of a resumable upload whose connection dropped. The caller closes it either way.
+func SpoolChunk(r io.Reader) (*SpooledFile, error) {
+	file, err := os.CreateTemp("", "receipt-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &SpooledFile{file: file}
+
+	source := &errorRecorder{r: r}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), source)
+	if err != nil && source.err == nil {
+		// Writing the temporary file failed, so nothing can be kept
+		spooled.Close()
+		return nil, err
+	}
+	spooled.size, spooled.sha256 = size, hex.EncodeToString(hash.Sum(nil))
+	return spooled, source.err
+}
+
+// errorRecorder remembers the error of the reader it reads from, to tell it apart from errors writing the data
+type errorRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorRecorder) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
+
+// Size returns the size of the file in bytes
+func (f *SpooledFile) Size() int64 {
+	return f.size
+}
+
+// SHA256 returns the hex encoded SHA-256 of the file contents
+func (f *SpooledFile) SHA256() string {
+	return f.sha256
+}
+
+// Path returns the path of the temporary file, for tools that read the file themselves
+func (f *SpooledFile) Path() string {
+	return f.file.Name()
+}
+
+// Reader returns a reader of the file contents from the start. Readers are independent of each other.
+func (f *SpooledFile) Reader() *io.SectionReader {
+	return io.NewSectionReader(f.file, 0, f.size)
+}
+
+// Header returns up to n bytes from the start of the file
+func (f *SpooledFile) Header(n int) ([]byte, error) {
+	header := make([]byte, min(int64(n), f.size))
+	_, err := io.ReadFull(f.Reader(), header)
+	return header, err
+}
+
+// ReadAll reads the whole file into memory
+func (f *SpooledFile) ReadAll() ([]byte, error) {
+	return io.ReadAll(f.Reader())
+}
+
+// Replace overwrites the file with data and hashes it again, e.g. after a photo was normalized
+func (f *SpooledFile) Replace(data []byte) error {
+	if err := f.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.file.WriteAt(data, 0); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	f.size, f.sha256 = int64(len(data)), hex.EncodeToString(sum[:])
+	return nil
+}
+
+// Close removes the temporary file
+func (f *SpooledFile) Close() error {
+	f.file.Close()
+	return os.Remove(f.file.Name())
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// TestSpoolUpload tests spooling uploaded files within a size limit
+func TestSpoolUpload(t *testing.T) {
+	upload, err := SpoolUpload(strings.NewReader("receipt"), 7)
+	if err != nil {
+		t.Fatalf("Expected a file at the limit to be spooled, got %v", err)
+	}
+	defer upload.Close()
+	sum := sha256.Sum256([]byte("receipt"))
+	if data, _ := upload.ReadAll(); string(data) != "receipt" || upload.Size() != 7 || upload.SHA256() != hex.EncodeToString(sum[:]) {
+		t.Fatalf("Expected the contents with their hash, got %q %d %s", data, upload.Size(), upload.SHA256())
+	}
+
+	// Larger files are read to the end to report their size
+	if _, err := SpoolUpload(strings.NewReader("receipt data"), 7); !errors.Is(err, ErrFileTooLarge) || !strings.Contains(err.Error(), "12 bytes, at most 7") {
+		t.Fatalf("Expected ErrFileTooLarge with the size, got %v", err)
+	}
+
+	unlimited, err := SpoolUpload(strings.NewReader("receipt data"), 0)
+	if err != nil || unlimited.Size() != 12 {
+		t.Fatalf("Expected no limit, got %v", err)
+	}
+	unlimited.Close()
+	if _, err := os.Stat(unlimited.Path()); !os.IsNotExist(err) {
+		t.Fatalf("Expected the temporary file to be removed, got %v", err)
+	}
+}
+
+// TestSpoolChunk tests that the bytes read before an error are kept
+func TestSpoolChunk(t *testing.T) {
+	dropped := errors.New("connection dropped")
+	chunk, err := SpoolChunk(io.MultiReader(strings.NewReader("rece"), iotest.ErrReader(dropped)))
+	if !errors.Is(err, dropped) || chunk == nil {
+		t.Fatalf("Expected the read error with the file, got %v", err)
+	}
+	defer chunk.Close()
+	if data, _ := chunk.ReadAll(); string(data) != "rece" || chunk.Size() != 4 {
+		t.Fatalf("Expected the bytes before the error, got %q", data)
+	}
+}
+
+// TestReplaceSpooledFile tests replacing the contents of a spooled file
+func TestReplaceSpooledFile(t *testing.T) {
+	upload, err := SpoolUpload(strings.NewReader("receipt data"), 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer upload.Close()
+
+	if err := upload.Replace([]byte("receipt")); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	sum := sha256.Sum256([]byte("receipt"))
+	if data, _ := upload.ReadAll(); string(data) != "receipt" || upload.SHA256() != hex.EncodeToString(sum[:]) {
+		t.Fatalf("Expected the shorter contents with their hash, got %q %s", data, upload.SHA256())
+	}
+	if header, err := upload.Header(512); err != nil || string(header) != "receipt" {
+		t.Fatalf("Expected the header to end with the file, got %q, %v", header, err)
+	}
+}
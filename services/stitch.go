@@ -0,0 +1,155 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// PageSource identifies one page a stitched rendition is generated from
+type PageSource struct {
+	Key  string // Blob key of the original
+	Page int    // Page of the original, numbered from 1
+}
+
+// stitchedOriginal is an original a stitched rendition is generated from
+type stitchedOriginal struct {
+	data    []byte
+	indexes []int // Positions of the original's pages in the stitched rendition
+}
+
+// RenderStitched generates a rendition of several pages stacked top to bottom, such as a long receipt
+// photographed in parts, and returns the encoded bytes. The stitched image is checked against the decoder's
+// limits before it is allocated. It carries no EXIF metadata, since the pages may come from different photos.
+func RenderStitched(store BlobStore, pages []PageSource, preset RenditionPreset, decoder *ImageDecoder) ([]byte, error) {
+	// Each original is read once, however many of the pages it holds
+	var keys []string
+	originals := make(map[string]*stitchedOriginal)
+	for i, page := range pages {
+		original, ok := originals[page.Key]
+		if !ok {
+			data, err := readBlob(store, page.Key)
+			if err != nil {
+				return nil, err
+			}
+			original = &stitchedOriginal{data: data}
+			originals[page.Key] = original
+			keys = append(keys, page.Key)
+		}
+		original.indexes = append(original.indexes, i)
+	}
+
+	// The size of an image page is read from its header. The pages of a PDF document only have a size once
+	// they are rendered, which is bounded by the rasterizer's page size, so they are rendered together first.
+	images := make([]image.Image, len(pages))
+	sizes := make([]image.Rectangle, len(pages))
+	for _, key := range keys {
+		original := originals[key]
+		if IsPDF(original.data) {
+			numbers := make([]int, len(original.indexes))
+			for j, i := range original.indexes {
+				numbers[j] = pages[i].Page
+			}
+			decoded, err := decoder.DecodePages(bytes.NewReader(original.data), numbers)
+			if err != nil {
+				return nil, err
+			}
+			for j, i := range original.indexes {
+				images[i], sizes[i] = decoded[j], decoded[j].Bounds()
+			}
+			continue
+		}
+
+		config, _, err := decoder.DecodeConfig(bytes.NewReader(original.data))
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range original.indexes {
+			if pages[i].Page != 1 {
+				return nil, fmt.Errorf("%w: images only have page 1", ErrPageNotFound)
+			}
+			sizes[i] = uprightSize(config, original.data)
+		}
+	}
+
+	width, height := stitchedSize(sizes)
+	if err := decoder.Limits.Check(image.Config{Width: width, Height: height}); err != nil {
+		return nil, err
+	}
+	if err := checkPresetSize(image.Rect(0, 0, width, height), preset, decoder.Limits); err != nil {
+		return nil, err
+	}
+
+	// Only now are the images decoded, once for all of their pages
+	for _, key := range keys {
+		original := originals[key]
+		if IsPDF(original.data) {
+			continue
+		}
+		img, err := decoder.Decode(bytes.NewReader(original.data))
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range original.indexes {
+			images[i] = img
+		}
+	}
+	return EncodeImage(applyPreset(StitchVertical(images), preset), preset.Format, preset.Quality)
+}
+
+// readBlob reads the whole blob stored under key
+func readBlob(store BlobStore, key string) ([]byte, error) {
+	file, _, err := store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// StitchVertical stacks images top to bottom on a white background.
+// Wider images are scaled down to the width of the narrowest one so the pages line up.
+func StitchVertical(images []image.Image) image.Image {
+	sizes := make([]image.Rectangle, len(images))
+	for i, img := range images {
+		sizes[i] = img.Bounds()
+	}
+	width, height := stitchedSize(sizes)
+	stitched := imaging.New(width, height, color.White)
+	y := 0
+	for _, img := range images {
+		if img.Bounds().Dx() != width {
+			img = imaging.Resize(img, width, 0, imaging.Lanczos)
+		}
+		stitched = imaging.Paste(stitched, img, image.Pt(0, y))
+		y += img.Bounds().Dy()
+	}
+	return stitched
+}
+
+// stitchedSize returns the size of the image StitchVertical builds from images of the given sizes
+func stitchedSize(sizes []image.Rectangle) (int, int) {
+	width := 0
+	for _, size := range sizes {
+		if width == 0 || size.Dx() < width {
+			width = size.Dx()
+		}
+	}
+	height := 0
+	for _, size := range sizes {
+		height += scaledHeight(size, width)
+	}
+	return width, height
+}
+
+// scaledHeight returns the height of an image resized to width, rounded the way imaging.Resize rounds it
+func scaledHeight(bounds image.Rectangle, width int) int {
+	if bounds.Dx() == width {
+		return bounds.Dy()
+	}
+	return max(int(float64(bounds.Dy())*float64(width)/float64(bounds.Dx())+0.5), 1)
+}
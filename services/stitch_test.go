@@ -0,0 +1,141 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// TestStitchVertical tests stacking images of different widths
+func TestStitchVertical(t *testing.T) {
+	top := imaging.New(100, 50, color.Black)
+	bottom := imaging.New(200, 60, color.White)
+
+	// The wider image is scaled down to 100x30 and placed below the narrower one
+	stitched := StitchVertical([]image.Image{top, bottom})
+	if stitched.Bounds().Dx() != 100 || stitched.Bounds().Dy() != 80 {
+		t.Fatalf("Expected a 100x80 image, got %v", stitched.Bounds())
+	}
+	if r, _, _, _ := stitched.At(50, 49).RGBA(); r != 0 {
+		t.Fatalf("Expected the first image at the top, got %v", stitched.At(50, 49))
+	}
+	if r, _, _, _ := stitched.At(50, 50).RGBA(); r != 0xFFFF {
+		t.Fatalf("Expected the second image below the first, got %v", stitched.At(50, 50))
+	}
+}
+
+// TestRenderStitched tests rendering the pages of a PDF document stacked into one image
+func TestRenderStitched(t *testing.T) {
+	store, err := setupImageTestEnvironment()
+	if err != nil {
+		t.Fatalf("Failed to set up test environment: %v", err)
+	}
+	pages := []PageSource{{Key: "receipt.pdf", Page: 1}, {Key: "receipt.pdf", Page: 2}}
+	preset := RenditionPreset{Name: "all", Fit: FitContain, Format: FormatPNG}
+
+	t.Run("Pages", func(t *testing.T) {
+		// The stub renders 100x300 and 200x300 pages, so the second one is halved
+		data, err := RenderStitched(store, pages, preset, newPDFDecoder(2))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil || img.Bounds().Dx() != 100 || img.Bounds().Dy() != 450 {
+			t.Fatalf("Expected a 100x450 image, got %v, %v", img.Bounds(), err)
+		}
+
+		// The black bar of the second page is scaled along with it
+		if r, _, _, _ := img.At(20, 312).RGBA(); r > 0x4000 {
+			t.Fatalf("Expected the second page's bar below the first page, got %v", img.At(20, 312))
+		}
+	})
+
+	t.Run("Resized", func(t *testing.T) {
+		data, err := RenderStitched(store, pages, RenditionPreset{Name: "small", Height: 90, Fit: FitContain, Format: FormatJPEG}, newPDFDecoder(2))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || config.Width != 20 || config.Height != 90 {
+			t.Fatalf("Expected a 20x90 JPEG, got %+v, %v", config, err)
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		// Each page is within the limits but the stitched image is not
+		decoder := newPDFDecoder(2)
+		decoder.Limits = DecodeLimits{MaxDimension: 400}
+		if _, err := RenderStitched(store, pages, preset, decoder); !errors.Is(err, ErrImageTooLarge) {
+			t.Fatalf("Expected ErrImageTooLarge, got %v", err)
+		}
+	})
+
+	t.Run("MissingPage", func(t *testing.T) {
+		if _, err := RenderStitched(store, append(pages, PageSource{Key: "receipt.pdf", Page: 3}), preset, newPDFDecoder(2)); !errors.Is(err, ErrPageNotFound) {
+			t.Fatalf("Expected ErrPageNotFound, got %v", err)
+		}
+	})
+}
+
+// TestRenderStitchedImages tests that the size of stitched photos is checked from their headers before they are decoded
+func TestRenderStitchedImages(t *testing.T) {
+	store, err := NewFileSystemBlobStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create blob store: %v", err)
+	}
+	for _, name := range []string{"exif.jpg", "test.jpg"} {
+		data, err := os.ReadFile("../testdata/" + name)
+		if err != nil {
+			t.Fatalf("Failed to read test image: %v", err)
+		}
+		store.Put(name, bytes.NewReader(data), int64(len(data)), "image/jpeg")
+	}
+
+	// Only the header of the page is stored, so decoding it would fail
+	var page bytes.Buffer
+	png.Encode(&page, imaging.New(100, 300, color.White))
+	store.Put("header.png", bytes.NewReader(page.Bytes()[:64]), 64, "image/png")
+	preset := RenditionPreset{Name: "all", Fit: FitContain, Format: FormatPNG}
+
+	t.Run("Upright", func(t *testing.T) {
+		// The photo is stored sideways with EXIF orientation 6, so it is 80 pixels wide once upright
+		pages := []PageSource{{Key: "exif.jpg", Page: 1}, {Key: "exif.jpg", Page: 1}}
+		data, err := RenderStitched(store, pages, preset, NewImageDecoder(DefaultDecodeLimits(), 1))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil || config.Width != 80 || config.Height != 240 {
+			t.Fatalf("Expected an 80x240 image, got %+v, %v", config, err)
+		}
+
+		// The upright size counts against the limits
+		decoder := NewImageDecoder(DecodeLimits{MaxDimension: 239}, 1)
+		if _, err := RenderStitched(store, pages, preset, decoder); !errors.Is(err, ErrImageTooLarge) {
+			t.Fatalf("Expected ErrImageTooLarge, got %v", err)
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		// Two 100x300 pages fit into the limits, so decoding them is attempted; four do not
+		decoder := NewImageDecoder(DecodeLimits{MaxDimension: 1000}, 1)
+		pages := []PageSource{{Key: "header.png", Page: 1}, {Key: "header.png", Page: 1}}
+		if _, err := RenderStitched(store, pages, preset, decoder); errors.Is(err, ErrImageTooLarge) || err == nil {
+			t.Fatalf("Expected the pages to be decoded, got %v", err)
+		}
+		if _, err := RenderStitched(store, append(pages, pages...), preset, decoder); !errors.Is(err, ErrImageTooLarge) {
+			t.Fatalf("Expected ErrImageTooLarge before decoding, got %v", err)
+		}
+	})
+
+	t.Run("MissingPage", func(t *testing.T) {
+		if _, err := RenderStitched(store, []PageSource{{Key: "test.jpg", Page: 1}, {Key: "test.jpg", Page: 2}}, preset, testDecoder); !errors.Is(err, ErrPageNotFound) {
+			t.Fatalf("Expected ErrPageNotFound, got %v", err)
+		}
+	})
+}
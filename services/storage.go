@@ -1,82 +1,157 @@
 package services
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"image"
-	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 
-	"github.com/disintegration/imaging"
 	"github.com/google/uuid"
 )
 
 // Custom error for invalid image uploads
 var ErrInvalidImage = errors.New("not a valid image")
 
-// SaveFile handles saving the uploaded file to the local filesystem
-func SaveFile(fileHeader *multipart.FileHeader) (string, error) {
-	// Open the file
-	file, err := fileHeader.Open()
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
+// SavedFile describes an uploaded file that is stored in the blob store by its content
+type SavedFile struct {
+	Path        string        // Content-addressed blob key of the file
+	Size        int64         // Size of the stored file in bytes
+	Format      string        // Upload format detected from the file contents, e.g. "jpeg"
+	ContentType string        // MIME type of the detected format, or sniffed from a rejected file
+	SHA256      string        // Hex encoded SHA-256 of the stored file contents
+	Photo       PhotoMetadata // EXIF metadata of the uploaded photo
+	Pages       int           // Number of pages of a PDF document, 1 for images
+	Image       image.Image   // The upright image, or the first page of a PDF document, decoded to validate the file
 
-	// Check if the file is an image by detecting its MIME type
-	buffer := make([]byte, 512) // Buffer to store the first 512 bytes
-	file.Read(buffer)           // Read the file into the buffer to detect content type
-	contentType := http.DetectContentType(buffer)
+	upload *SpooledFile // Contents to store: the normalized photo or the file as uploaded
+}
 
-	// Ensure the content type starts with "image/"
-	if !strings.HasPrefix(contentType, "image/") {
-		return "", ErrInvalidImage
+// ErrFileTooLarge is returned for uploads larger than the size limit
+var ErrFileTooLarge = errors.New("file too large")
+
+// InspectFile validates the contents of an uploaded file and hashes them without storing them.
+// The format is detected from the contents, must be one of the allowed formats and decides the extension
+// of the blob key, whatever the client called the file. Images whose header declares more pixels than the decoder's
+// limits are rejected with ErrImageTooLarge, and the others are decoded in full, or their first page rasterized,
+// so files that only look like images are rejected with a ValidationError. JPEG photos are turned upright and their
+// metadata is reduced according to the policy first, replacing the spooled contents, so the hash is that of the stored file.
+// Only JPEG photos are read into memory while they are normalized; other files are decoded from the spooled file.
+// The content type is returned even when the file is rejected.
+func InspectFile(upload *SpooledFile, formats []string, policy MetadataPolicy, decoder *ImageDecoder) (SavedFile, error) {
+	header, err := upload.Header(512)
+	if err != nil {
+		return SavedFile{}, err
 	}
+	saved := SavedFile{Size: upload.Size(), ContentType: http.DetectContentType(header), Photo: PhotoMetadata{Orientation: 1}, Pages: 1}
 
-	// Rewind the file after reading its MIME type
-	file.Seek(0, 0)
+	// Trust the contents rather than the file name
+	if saved.Format, err = checkFormat(upload, formats, saved.ContentType); err != nil {
+		return saved, err
+	}
+	saved.ContentType = uploadFormats[saved.Format].contentType
 
-	// Create the file on the filesystem
-	fileID := GenerateReceiptID()
-	filePath := filepath.Join("uploads", fileID+filepath.Ext(fileHeader.Filename))
-	f, err := os.Create(filePath)
-	if err != nil {
-		log.Println("Error creating file:", err)
-		return "", fmt.Errorf("failed to create file on the server: %v", err)
+	// Check the declared dimensions before anything is decoded
+	if saved.Format != FormatPDF {
+		if _, _, err := decoder.DecodeConfig(upload.Reader()); err != nil {
+			return saved, corruptOr(err, saved.Format)
+		}
 	}
-	defer f.Close()
 
-	// Copy the uploaded file to the filesystem
-	_, err = io.Copy(f, file)
+	switch saved.Format {
+	case FormatJPEG:
+		var data, normalized []byte
+		if data, err = upload.ReadAll(); err != nil {
+			return saved, err
+		}
+		if normalized, saved.Photo, err = NormalizeJPEG(data, policy, decoder); err != nil {
+			return saved, corruptOr(err, saved.Format)
+		}
+		if !bytes.Equal(normalized, data) {
+			if err := upload.Replace(normalized); err != nil {
+				return saved, err
+			}
+		}
+		saved.Image, err = decoder.Decode(bytes.NewReader(normalized))
+	case FormatPDF:
+		// The rasterizer reads the spooled file, which is counted once
+		if saved.Pages, err = decoder.PageCount(upload.Path()); errors.Is(err, ErrPDFUnsupported) {
+			return saved, &ValidationError{Reason: ReasonUnsupported, Format: saved.Format, Message: "PDF documents cannot be read by this server", Err: err}
+		}
+		if err == nil && saved.Pages < 1 {
+			err = errors.New("PDF document has no pages")
+		}
+		if err == nil {
+			saved.Image, err = decoder.DecodePDFPage(upload.Path(), 1, saved.Pages)
+		}
+	default:
+		// Other formats are stored as uploaded
+		saved.Image, err = decoder.Decode(upload.Reader())
+	}
 	if err != nil {
-		log.Println("Error copying file to filesystem:", err)
-		return "", fmt.Errorf("failed to copy file to the server: %v", err)
+		return saved, corruptOr(err, saved.Format)
 	}
 
-	log.Println("File saved successfully:", filePath)
-	return filePath, nil
+	saved.SHA256 = upload.SHA256()
+	saved.Size = upload.Size()
+	saved.upload = upload
+	saved.Path = originalsPrefix + saved.SHA256 + uploadFormats[saved.Format].extension
+	return saved, nil
 }
 
-// SaveImage saves the resized image to the specified file path
-func SaveImage(img image.Image, filePath string) error {
-	// Create the file on the filesystem
-	f, err := os.Create(filePath)
-	if err != nil {
+// corruptOr returns decode errors of a file in a recognized format as a corrupt file,
+// and ErrImageTooLarge unchanged
+func corruptOr(err error, format string) error {
+	if errors.Is(err, ErrImageTooLarge) {
 		return err
 	}
-	defer f.Close()
+	return &ValidationError{Reason: ReasonCorrupt, Format: format, Message: fmt.Sprintf("the %s file cannot be decoded", format), Err: err}
+}
 
-	// Save the image as a JPEG file
-	err = imaging.Save(img, filePath)
-	if err != nil {
+// StoreFile writes an inspected file to the blob store under its content-addressed key.
+// If an identical original is already stored it is reused instead of being written again.
+func StoreFile(store BlobStore, saved SavedFile) error {
+	if info, err := store.Stat(saved.Path); err == nil && info.Size == saved.Size {
+		log.Println("File already stored:", saved.Path)
+		return nil
+	} else if err != nil && !errors.Is(err, ErrBlobNotFound) {
 		return err
 	}
 
+	if err := store.Put(saved.Path, saved.upload.Reader(), saved.Size, saved.ContentType); err != nil {
+		log.Println("Error storing file:", err)
+		return fmt.Errorf("failed to store file on the server: %v", err)
+	}
+
+	log.Println("File saved successfully:", saved.Path)
+	return nil
+}
+
+// ThumbnailKey returns the key under which thumbnails were stored before the rendition cache
+func ThumbnailKey(receiptID string, width, height int) string {
+	return thumbnailsPrefix + fmt.Sprintf("%s_%dx%d.jpg", receiptID, width, height)
+}
+
+// DeleteThumbnails removes every thumbnail generated for a receipt before the rendition cache.
+// Blobs that are already gone are ignored so a failed purge can be retried.
+func DeleteThumbnails(store BlobStore, receiptID string) error {
+	// Thumbnails generated before blob storage were stored next to the originals
+	for _, prefix := range []string{thumbnailsPrefix + receiptID + "_", receiptID + "_"} {
+		thumbnails, err := store.List(prefix)
+		if err != nil {
+			return err
+		}
+		for _, thumbnail := range thumbnails {
+			if strings.Contains(strings.TrimPrefix(thumbnail.Key, prefix), "/") {
+				continue
+			}
+			if err := store.Delete(thumbnail.Key); err != nil {
+				return fmt.Errorf("failed to delete %s: %v", thumbnail.Key, err)
+			}
+		}
+	}
 	return nil
 }
 
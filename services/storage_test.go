@@ -2,110 +2,205 @@ package services
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"image/color"
 	"io"
-	"mime/multipart"
-	"net/http"
-	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
-)
-
-const uploadDir = "uploads"
 
-// Setup function to create the uploads directory before tests
-func setupTestEnvironment() error {
-	return os.MkdirAll(uploadDir, os.ModePerm)
-}
-
-// Helper function to create a multipart request and return a *multipart.FileHeader
-func createMultipartRequest(fileName string) (*multipart.FileHeader, error) {
-	// Open the file from the testdata directory
-	filePath := filepath.Join("../testdata/", fileName)
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	// Create a new multipart form data
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+	"github.com/disintegration/imaging"
+)
 
-	// Create a form file
-	part, err := writer.CreateFormFile("file", fileName)
+// newTestBlobStore returns a filesystem blob store rooted in a temporary directory
+func newTestBlobStore(t *testing.T) *FileSystemBlobStore {
+	store, err := NewFileSystemBlobStore(t.TempDir(), []byte("test-signing-key"))
 	if err != nil {
-		return nil, err
+		t.Fatalf("Failed to create blob store: %v", err)
 	}
+	return store
+}
 
-	// Copy the file contents into the form
-	_, err = io.Copy(part, file)
+// Helper function to read a file from the testdata directory
+func readTestData(t *testing.T, fileName string) []byte {
+	data, err := os.ReadFile(filepath.Join("../testdata/", fileName))
 	if err != nil {
-		return nil, err
+		t.Fatalf("Failed to read test file: %v", err)
 	}
+	return data
+}
 
-	writer.Close()
-
-	// Create the HTTP request with the multipart body
-	req := httptest.NewRequest(http.MethodPost, "/receipts", body)
-	req.Header.Set("Content-Type", writer.FormDataContentType()) // Set Content-Type for multipart form
-
-	// Parse the multipart form to extract the file header
-	err = req.ParseMultipartForm(10 << 20) // Limit to 10MB
+// Helper function to spool file contents like an upload, removing the temporary file after the test
+func spoolTestData(t *testing.T, data []byte) *SpooledFile {
+	upload, err := SpoolUpload(bytes.NewReader(data), 0)
 	if err != nil {
-		return nil, err
-	}
-
-	// Return the first file header from the form
-	fileHeaders := req.MultipartForm.File["file"]
-	if len(fileHeaders) > 0 {
-		return fileHeaders[0], nil
+		t.Fatalf("Failed to spool test data: %v", err)
 	}
-
-	return nil, errors.New("no file found in request")
+	t.Cleanup(func() { upload.Close() })
+	return upload
 }
 
-// TestSaveFile tests the SaveFile function
-func TestSaveFile(t *testing.T) {
+// TestInspectAndStoreFile tests the InspectFile and StoreFile functions
+func TestInspectAndStoreFile(t *testing.T) {
 	// Setup the test environment
-	if err := setupTestEnvironment(); err != nil {
-		t.Fatalf("Failed to create uploads directory: %v", err)
-	}
+	store := newTestBlobStore(t)
 
 	// Valid image test case
 	t.Run("ValidImageUpload", func(t *testing.T) {
-		req, err := createMultipartRequest("test.jpg")
+		// Run the functions
+		saved, err := InspectFile(spoolTestData(t, readTestData(t, "test.jpg")), DefaultUploadFormats(), MetadataStripGPS, testDecoder)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if err := StoreFile(store, saved); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		// Verify the file was saved correctly under its content hash
+		data := readTestData(t, "test.jpg")
+		sum := sha256.Sum256(data)
+		if saved.SHA256 != hex.EncodeToString(sum[:]) || saved.Path != "originals/"+saved.SHA256+".jpg" {
+			t.Fatalf("Expected the content-addressed key of test.jpg, got %s", saved.Path)
+		}
+		info, err := store.Stat(saved.Path)
 		if err != nil {
-			t.Fatalf("Failed to create multipart request: %v", err)
+			t.Fatalf("Expected file to be saved at %s, got %v", saved.Path, err)
+		}
+		if saved.Size != info.Size || saved.ContentType != "image/jpeg" {
+			t.Fatalf("Expected size %d and image/jpeg, got %d and %s", info.Size, saved.Size, saved.ContentType)
 		}
+	})
 
-		// Run the function
-		filePath, err := SaveFile(req)
+	// Identical contents share the same blob
+	t.Run("IdenticalContents", func(t *testing.T) {
+		a, _ := InspectFile(spoolTestData(t, readTestData(t, "test.jpg")), DefaultUploadFormats(), MetadataStripGPS, testDecoder)
+		b, _ := InspectFile(spoolTestData(t, readTestData(t, "test.jpg")), DefaultUploadFormats(), MetadataStripGPS, testDecoder)
+		if a.Path != b.Path {
+			t.Fatalf("Expected identical contents to share a key, got %s and %s", a.Path, b.Path)
+		}
+		if err := StoreFile(store, b); err != nil {
+			t.Fatalf("Expected storing an existing original to succeed, got %v", err)
+		}
+		blobs, _ := store.List("originals/")
+		if len(blobs) != 1 {
+			t.Fatalf("Expected a single stored original, got %+v", blobs)
+		}
+	})
+
+	// Photos are stored upright and with the metadata the policy allows
+	t.Run("NormalizedPhoto", func(t *testing.T) {
+		saved, err := InspectFile(spoolTestData(t, readTestData(t, "exif.jpg")), DefaultUploadFormats(), MetadataStrip, testDecoder)
 		if err != nil {
 			t.Fatalf("Expected no error, got %v", err)
 		}
+		if saved.Photo.Orientation != 6 || saved.Photo.CameraMake != "Receiptcam" {
+			t.Fatalf("Expected the uploaded photo's metadata, got %+v", saved.Photo)
+		}
+		if err := StoreFile(store, saved); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
 
-		// Defer cleanup in case of any errors
-		defer os.Remove(filePath)
+		blob, info, _ := store.Get(saved.Path)
+		defer blob.Close()
+		data, _ := io.ReadAll(blob)
+		sum := sha256.Sum256(data)
+		if info.Size != saved.Size || saved.SHA256 != hex.EncodeToString(sum[:]) || bytes.Contains(data, []byte("Exif")) {
+			t.Fatalf("Expected the stripped photo to be stored under its own hash")
+		}
+	})
 
-		// Verify the file was saved correctly
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
-			t.Fatalf("Expected file to be saved at %s, but it wasn't", filePath)
+	// Images declaring more pixels than the limits allow are rejected from their header
+	t.Run("TooLarge", func(t *testing.T) {
+		decoder := NewImageDecoder(DecodeLimits{MaxPixels: 1_000_000}, 1)
+		saved, err := InspectFile(spoolTestData(t, readTestData(t, "test.jpg")), DefaultUploadFormats(), MetadataStripGPS, decoder)
+		if !errors.Is(err, ErrImageTooLarge) {
+			t.Fatalf("Expected ErrImageTooLarge, got %v", err)
+		}
+		if saved.ContentType != "image/jpeg" {
+			t.Fatalf("Expected detected content type image/jpeg, got %s", saved.ContentType)
 		}
 	})
 
-	// Non-image file test case
-	t.Run("NonImageFileUpload", func(t *testing.T) {
-		req, err := createMultipartRequest("test.txt")
+	// PDF documents are stored as uploaded with their page count
+	t.Run("PDFDocument", func(t *testing.T) {
+		pdf := readTestData(t, "receipt.pdf")
+		saved, err := InspectFile(spoolTestData(t, pdf), DefaultUploadFormats(), MetadataStripGPS, newPDFDecoder(2))
 		if err != nil {
-			t.Fatalf("Failed to create multipart request: %v", err)
+			t.Fatalf("Expected no error, got %v", err)
 		}
+		sum := sha256.Sum256(pdf)
+		if saved.ContentType != "application/pdf" || saved.Pages != 2 || saved.Path != "originals/"+hex.EncodeToString(sum[:])+".pdf" {
+			t.Fatalf("Expected a two page PDF under its content hash, got %+v", saved)
+		}
+
+		// Without a rasterizer PDF documents are rejected
+		if _, err := InspectFile(spoolTestData(t, pdf), DefaultUploadFormats(), MetadataStripGPS, testDecoder); !errors.Is(err, ErrInvalidImage) || RejectionReason(err) != ReasonUnsupported {
+			t.Fatalf("Expected an unsupported ErrInvalidImage, got %v", err)
+		}
+	})
 
+	// Non-image file test case
+	t.Run("NonImageFileUpload", func(t *testing.T) {
 		// Run the function and check for invalid image error
-		_, err = SaveFile(req)
+		saved, err := InspectFile(spoolTestData(t, readTestData(t, "test.txt")), DefaultUploadFormats(), MetadataStripGPS, testDecoder)
 		if err == nil || !errors.Is(err, ErrInvalidImage) {
 			t.Fatalf("Expected error for invalid image, got %v", err)
 		}
+
+		// The detected type is still reported so the client can see why the file was rejected
+		if !strings.HasPrefix(saved.ContentType, "text/plain") {
+			t.Fatalf("Expected detected content type text/plain, got %s", saved.ContentType)
+		}
+	})
+
+	// The contents decide the format, whatever the file is called
+	t.Run("DisguisedSVG", func(t *testing.T) {
+		svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="400" height="400"><script>alert(1)</script></svg>`)
+		saved, err := InspectFile(spoolTestData(t, svg), DefaultUploadFormats(), MetadataStripGPS, testDecoder)
+		if !errors.Is(err, ErrInvalidImage) || RejectionReason(err) != ReasonUnknownFormat {
+			t.Fatalf("Expected an unknown format, got %v", err)
+		}
+		if saved.ContentType == "image/jpeg" || saved.Path != "" {
+			t.Fatalf("Expected the file not to be taken for a JPEG, got %+v", saved)
+		}
+	})
+
+	t.Run("ExtensionFromContents", func(t *testing.T) {
+		var png bytes.Buffer
+		if err := imaging.Encode(&png, imaging.New(400, 400, color.White), imaging.PNG); err != nil {
+			t.Fatalf("Failed to encode PNG: %v", err)
+		}
+		saved, err := InspectFile(spoolTestData(t, png.Bytes()), DefaultUploadFormats(), MetadataStripGPS, testDecoder)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if saved.Format != FormatPNG || saved.ContentType != "image/png" || !strings.HasSuffix(saved.Path, ".png") || saved.Image == nil {
+			t.Fatalf("Expected a decoded PNG stored with a .png key, got %+v", saved)
+		}
+	})
+
+	t.Run("FormatNotAllowed", func(t *testing.T) {
+		_, err := InspectFile(spoolTestData(t, readTestData(t, "test.jpg")), []string{FormatPNG, FormatPDF}, MetadataStripGPS, testDecoder)
+		var validation *ValidationError
+		if !errors.As(err, &validation) || validation.Reason != ReasonFormatNotAllowed || validation.Format != FormatJPEG {
+			t.Fatalf("Expected a JPEG that is not allowed, got %v", err)
+		}
+	})
+
+	// A valid header is not enough: the whole image must decode
+	t.Run("Corrupt", func(t *testing.T) {
+		data := readTestData(t, "test.jpg")
+		if _, err := InspectFile(spoolTestData(t, data[:len(data)/2]), DefaultUploadFormats(), MetadataStripGPS, testDecoder); RejectionReason(err) != ReasonCorrupt {
+			t.Fatalf("Expected a truncated JPEG to be corrupt, got %v", err)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		if _, err := InspectFile(spoolTestData(t, nil), DefaultUploadFormats(), MetadataStripGPS, testDecoder); RejectionReason(err) != ReasonEmpty {
+			t.Fatalf("Expected an empty file to be rejected, got %v", err)
+		}
 	})
 }
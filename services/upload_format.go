@@ -0,0 +1,127 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"slices"
+	"strings"
+
+	_ "golang.org/x/image/webp" // Registers the WebP decoder with the image package
+)
+
+// Input formats uploads can be in besides the output formats, named like the image package names them
+const (
+	FormatBMP  = "bmp"
+	FormatTIFF = "tiff"
+	FormatPDF  = "pdf"
+)
+
+// uploadFormat describes how originals of an upload format are stored
+type uploadFormat struct {
+	extension   string
+	contentType string
+}
+
+// uploadFormats lists the formats uploads are decoded in. The extension of a stored original comes
+// from here, so identical contents get the same key whatever the uploaded file was called.
+var uploadFormats = map[string]uploadFormat{
+	FormatJPEG: {extension: ".jpg", contentType: "image/jpeg"},
+	FormatPNG:  {extension: ".png", contentType: "image/png"},
+	FormatGIF:  {extension: ".gif", contentType: "image/gif"},
+	FormatWebP: {extension: ".webp", contentType: "image/webp"},
+	FormatBMP:  {extension: ".bmp", contentType: "image/bmp"},
+	FormatTIFF: {extension: ".tiff", contentType: "image/tiff"},
+	FormatPDF:  {extension: ".pdf", contentType: "application/pdf"},
+}
+
+// DefaultUploadFormats returns the formats accepted unless configured otherwise.
+// TIFF is left out since phones do not produce it and browsers cannot display it.
+func DefaultUploadFormats() []string {
+	return []string{FormatJPEG, FormatPNG, FormatGIF, FormatWebP, FormatBMP, FormatPDF}
+}
+
+// Reasons an upload is rejected for, reported to clients so they can tell the cases apart
+const (
+	ReasonEmpty            = "empty"              // The file has no contents
+	ReasonUnknownFormat    = "unknown_format"     // No decoder recognizes the contents, e.g. an SVG or text file
+	ReasonFormatNotAllowed = "format_not_allowed" // The contents are in a format that is not accepted
+	ReasonUnsupported      = "unsupported"        // The format is accepted but the server cannot decode it, e.g. PDF without Poppler
+	ReasonCorrupt          = "corrupt"            // The header is recognized but the contents do not decode
+	ReasonTooLarge         = "too_large"          // The image declares more pixels than the decode limits allow
+	ReasonLowQuality       = "low_quality"        // The image failed the quality checks
+)
+
+// ValidationError describes why an upload is not a valid image. It matches ErrInvalidImage with errors.Is.
+type ValidationError struct {
+	Reason  string // One of the Reason constants
+	Format  string // Detected format, empty if it is unknown
+	Message string // What is wrong with the file
+	Err     error  // Error of the decoder, if any
+}
+
+// Error returns the reason the file was rejected with the decoder's error
+func (e *ValidationError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v: %s: %v", ErrInvalidImage, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%v: %s", ErrInvalidImage, e.Message)
+}
+
+// Unwrap returns ErrInvalidImage and the decoder's error
+func (e *ValidationError) Unwrap() []error {
+	if e.Err != nil {
+		return []error{ErrInvalidImage, e.Err}
+	}
+	return []error{ErrInvalidImage}
+}
+
+// RejectionReason returns the Reason constant describing why InspectFile rejected a file,
+// or an empty string if the error is not a rejection
+func RejectionReason(err error) string {
+	var validation *ValidationError
+	switch {
+	case errors.As(err, &validation):
+		return validation.Reason
+	case errors.Is(err, ErrImageTooLarge):
+		return ReasonTooLarge
+	}
+	return ""
+}
+
+// DetectFormat returns the upload format of a file from its contents, or an empty string if no decoder recognizes them.
+// Only the header is parsed, so a recognized file may still fail to decode.
+func DetectFormat(r io.Reader) string {
+	buffered := bufio.NewReader(r)
+	if signature, _ := buffered.Peek(len(pdfSignature)); IsPDF(signature) {
+		return FormatPDF
+	}
+	if _, format, err := image.DecodeConfig(buffered); err == nil {
+		if _, ok := uploadFormats[format]; ok {
+			return format
+		}
+	}
+	return ""
+}
+
+// checkFormat checks that an uploaded file is in one of the allowed formats and returns the detected format.
+// sniffedType describes unrecognized files in the error.
+func checkFormat(upload *SpooledFile, allowed []string, sniffedType string) (string, error) {
+	if upload.Size() == 0 {
+		return "", &ValidationError{Reason: ReasonEmpty, Message: "the file is empty"}
+	}
+	format := DetectFormat(upload.Reader())
+	if format == "" {
+		return "", &ValidationError{Reason: ReasonUnknownFormat, Message: fmt.Sprintf("unrecognized contents of type %s", sniffedType)}
+	}
+	if !slices.Contains(allowed, format) {
+		return format, &ValidationError{
+			Reason:  ReasonFormatNotAllowed,
+			Format:  format,
+			Message: fmt.Sprintf("%s files are not accepted, only %s", format, strings.Join(allowed, ", ")),
+		}
+	}
+	return format, nil
+}
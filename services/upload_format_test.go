@@ -0,0 +1,52 @@
+package services
+
+import (
+	"bytes"
+	"image/color"
+	"os"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// TestDetectFormat tests recognizing upload formats from file contents
+func TestDetectFormat(t *testing.T) {
+	img := imaging.New(20, 10, color.White)
+	pdf, _ := os.ReadFile("../testdata/receipt.pdf")
+	text, _ := os.ReadFile("../testdata/test.txt")
+
+	for _, format := range []string{FormatJPEG, FormatPNG, FormatGIF, FormatWebP} {
+		t.Run(format, func(t *testing.T) {
+			data, err := EncodeImage(img, format, 90)
+			if err != nil {
+				t.Fatalf("Failed to encode %s: %v", format, err)
+			}
+			if detected := DetectFormat(bytes.NewReader(data)); detected != format {
+				t.Fatalf("Expected %s, got %q", format, detected)
+			}
+		})
+	}
+
+	t.Run("PDF", func(t *testing.T) {
+		if detected := DetectFormat(bytes.NewReader(pdf)); detected != FormatPDF {
+			t.Fatalf("Expected pdf, got %q", detected)
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		for _, data := range [][]byte{text, []byte("<svg></svg>"), nil} {
+			if detected := DetectFormat(bytes.NewReader(data)); detected != "" {
+				t.Fatalf("Expected no format for %q, got %q", data, detected)
+			}
+		}
+	})
+}
+
+// TestDefaultUploadFormats tests that the default formats are all known
+func TestDefaultUploadFormats(t *testing.T) {
+	for _, format := range DefaultUploadFormats() {
+		if _, ok := uploadFormats[format]; !ok {
+			t.Fatalf("Expected %s to be an upload format", format)
+		}
+	}
+}